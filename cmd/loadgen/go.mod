@@ -0,0 +1,7 @@
+module otel-goexpert-loadgen
+
+go 1.24.2
+
+require github.com/joaolima7/otel-goexpert/pkg v0.0.0-00010101000000-000000000000
+
+replace github.com/joaolima7/otel-goexpert/pkg => ../../pkg
@@ -0,0 +1,384 @@
+// Command loadgen fires a steady rate of CEP lookups at service A and
+// reports latency percentiles and error rates.
+//
+// Requests mix valid CEPs, malformed ones and well-formed CEPs that don't
+// exist, each expected to get its own status (200, 422 and 404). They all
+// carry the baggage "synthetic=true,loadgen.run=<id>", which the services
+// turn into span attributes so the traffic can be filtered out of
+// dashboards and alerts.
+//
+//	cd cmd/loadgen && go run . -url http://localhost:8080/cep -rps 50 -duration 1m
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// defaultCeps are real CEPs spread over the country, used when -ceps is
+// not given.
+var defaultCeps = []string{
+	"01001000", "20040002", "30130010", "40020000", "50010000",
+	"60060000", "70040010", "80010000", "90010000", "69005040",
+}
+
+// kind is the class of CEP a request sends, which decides the status it
+// expects back.
+type kind string
+
+const (
+	kindValid   kind = "valid"
+	kindInvalid kind = "invalid"
+	kindUnknown kind = "unknown"
+)
+
+var kinds = []kind{kindValid, kindInvalid, kindUnknown}
+
+func (k kind) expectedStatus() int {
+	switch k {
+	case kindInvalid:
+		return weather.CodeInvalidZipcode.Status()
+	case kindUnknown:
+		return weather.CodeZipcodeNotFound.Status()
+	default:
+		return http.StatusOK
+	}
+}
+
+// mix holds the weight of each kind of CEP in the traffic.
+type mix map[kind]int
+
+// parseMix parses "valid=80,invalid=10,unknown=10".
+func parseMix(s string) (mix, error) {
+	m := mix{}
+	total := 0
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mix entry %q, want kind=weight", pair)
+		}
+		k := kind(strings.TrimSpace(name))
+		if !slices.Contains(kinds, k) {
+			return nil, fmt.Errorf("unknown kind %q, want valid, invalid or unknown", name)
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %q for %s", value, k)
+		}
+		m[k] = w
+		total += w
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("mix %q has no weight", s)
+	}
+	return m, nil
+}
+
+func (m mix) pick() kind {
+	total := 0
+	for _, w := range m {
+		total += w
+	}
+	n := mrand.IntN(total)
+	for _, k := range kinds {
+		if n < m[k] {
+			return k
+		}
+		n -= m[k]
+	}
+	return kindValid
+}
+
+// cepFor makes up a CEP of kind k. Unknown CEPs are eight digits in the
+// 00000-000 range ViaCEP has nothing for.
+func cepFor(k kind, valid []string) string {
+	switch k {
+	case kindInvalid:
+		return []string{"123", "abcdefgh", "1234-567", "012345678", ""}[mrand.IntN(5)]
+	case kindUnknown:
+		return fmt.Sprintf("00000%03d", mrand.IntN(1000))
+	default:
+		return valid[mrand.IntN(len(valid))]
+	}
+}
+
+// result is the outcome of one request. Status is 0 when no response came
+// back.
+type result struct {
+	kind    kind
+	status  int
+	latency time.Duration
+}
+
+// stats accumulates results for the interim and final reports.
+type stats struct {
+	mu        sync.Mutex
+	latencies map[kind][]time.Duration
+	statuses  map[int]int
+	failed    map[kind]int
+	dropped   int
+}
+
+func newStats() *stats {
+	return &stats{latencies: map[kind][]time.Duration{}, statuses: map[int]int{}, failed: map[kind]int{}}
+}
+
+func (s *stats) add(r result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies[r.kind] = append(s.latencies[r.kind], r.latency)
+	s.statuses[r.status]++
+	if r.status != r.kind.expectedStatus() {
+		s.failed[r.kind]++
+	}
+}
+
+func (s *stats) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped++
+}
+
+// percentile returns the p-th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+type summary struct {
+	requests, failed int
+	p50, p90, p99    time.Duration
+	max              time.Duration
+}
+
+func summarize(latencies []time.Duration, failed int) summary {
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	s := summary{requests: len(sorted), failed: failed}
+	if len(sorted) > 0 {
+		s.p50, s.p90, s.p99 = percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99)
+		s.max = sorted[len(sorted)-1]
+	}
+	return s
+}
+
+func (s summary) errorRate() float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	return float64(s.failed) / float64(s.requests)
+}
+
+func (s summary) String() string {
+	return fmt.Sprintf("%7d req  %6.2f%% errors  p50 %-9s p90 %-9s p99 %-9s max %s",
+		s.requests, 100*s.errorRate(), round(s.p50), round(s.p90), round(s.p99), round(s.max))
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(100 * time.Microsecond)
+}
+
+// total summarizes every kind together.
+func (s *stats) total() summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []time.Duration
+	failed := 0
+	for _, k := range kinds {
+		all = append(all, s.latencies[k]...)
+		failed += s.failed[k]
+	}
+	return summarize(all, failed)
+}
+
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	total := s.total()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, "\n%d requests in %s (%.1f req/s), %d dropped\n",
+		total.requests, elapsed.Round(time.Millisecond), float64(total.requests)/elapsed.Seconds(), s.dropped)
+	fmt.Fprintf(w, "%-8s %s\n", "all", total)
+	for _, k := range kinds {
+		if len(s.latencies[k]) > 0 {
+			fmt.Fprintf(w, "%-8s %s\n", k, summarize(s.latencies[k], s.failed[k]))
+		}
+	}
+
+	codes := make([]int, 0, len(s.statuses))
+	for code := range s.statuses {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	fmt.Fprint(w, "status  ")
+	for _, code := range codes {
+		label := strconv.Itoa(code)
+		if code == 0 {
+			label = "no response"
+		}
+		fmt.Fprintf(w, " %s: %d", label, s.statuses[code])
+	}
+	fmt.Fprintln(w)
+}
+
+type config struct {
+	url          string
+	rps          float64
+	duration     time.Duration
+	timeout      time.Duration
+	concurrency  int
+	mix          mix
+	ceps         []string
+	apiKey       string
+	interval     time.Duration
+	maxErrorRate float64
+}
+
+func main() {
+	var cfg config
+	var mixFlag, cepsFlag string
+	flag.StringVar(&cfg.url, "url", "http://localhost:8080/cep", "service A CEP endpoint")
+	flag.Float64Var(&cfg.rps, "rps", 10, "requests per second")
+	flag.DurationVar(&cfg.duration, "duration", 30*time.Second, "how long to run; 0 runs until interrupted")
+	flag.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "per-request timeout")
+	flag.IntVar(&cfg.concurrency, "concurrency", 100, "maximum requests in flight; ticks past it are dropped")
+	flag.StringVar(&mixFlag, "mix", "valid=80,invalid=10,unknown=10", "weights of valid, invalid and unknown CEPs")
+	flag.StringVar(&cepsFlag, "ceps", strings.Join(defaultCeps, ","), "comma-separated valid CEPs to pick from")
+	flag.StringVar(&cfg.apiKey, "api-key", os.Getenv("LOADGEN_API_KEY"), "X-API-Key to send, when service A requires one")
+	flag.DurationVar(&cfg.interval, "report-every", 5*time.Second, "interval of the interim reports; 0 disables them")
+	flag.Float64Var(&cfg.maxErrorRate, "max-error-rate", -1, "exit with status 1 when the error rate goes over this fraction")
+	flag.Parse()
+
+	var err error
+	if cfg.mix, err = parseMix(mixFlag); err != nil {
+		log.Fatal(err)
+	}
+	for _, cep := range strings.Split(cepsFlag, ",") {
+		if cep = strings.TrimSpace(cep); cep != "" {
+			cfg.ceps = append(cfg.ceps, cep)
+		}
+	}
+	if len(cfg.ceps) == 0 && cfg.mix[kindValid] > 0 {
+		log.Fatal("-ceps is empty but the mix asks for valid CEPs")
+	}
+	if cfg.rps <= 0 {
+		log.Fatal("-rps must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.duration)
+		defer cancel()
+	}
+
+	total := run(ctx, cfg)
+	if cfg.maxErrorRate >= 0 && total.errorRate() > cfg.maxErrorRate {
+		fmt.Fprintf(os.Stderr, "error rate %.2f%% is over the %.2f%% allowed\n", 100*total.errorRate(), 100*cfg.maxErrorRate)
+		os.Exit(1)
+	}
+}
+
+// run sends requests at cfg.rps until ctx is done, then waits for those in
+// flight and prints the final report. It paces requests on a fixed
+// schedule rather than waiting for responses, so a slow service shows up
+// as latency and drops instead of a lower rate.
+func run(ctx context.Context, cfg config) summary {
+	runID := newRunID()
+	client := &http.Client{Timeout: cfg.timeout}
+	s := newStats()
+	log.Printf("Sending %.1f req/s to %s, run %s", cfg.rps, cfg.url, runID)
+
+	sem := make(chan struct{}, max(cfg.concurrency, 1))
+	var wg sync.WaitGroup
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.rps))
+	defer ticker.Stop()
+
+	var interim <-chan time.Time
+	if cfg.interval > 0 {
+		t := time.NewTicker(cfg.interval)
+		defer t.Stop()
+		interim = t.C
+	}
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-interim:
+			log.Printf("%s", s.total())
+		case <-ticker.C:
+			select {
+			case sem <- struct{}{}:
+			default:
+				s.drop()
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				k := cfg.mix.pick()
+				s.add(send(client, cfg, runID, k, cepFor(k, cfg.ceps)))
+			}()
+		}
+	}
+	wg.Wait()
+
+	s.report(os.Stdout, time.Since(start))
+	return s.total()
+}
+
+// send posts one lookup. Requests are not tied to the run's context, so
+// that those in flight when it ends still complete and get counted.
+func send(client *http.Client, cfg config, runID string, k kind, cep string) result {
+	body, _ := json.Marshal(weather.Location{Cep: cep})
+	req, err := http.NewRequest(http.MethodPost, cfg.url, bytes.NewReader(body))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Baggage", "synthetic=true,loadgen.run="+runID)
+	if cfg.apiKey != "" {
+		req.Header.Set("X-API-Key", cfg.apiKey)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{kind: k, latency: time.Since(start)}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return result{kind: k, status: resp.StatusCode, latency: time.Since(start)}
+}
+
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,125 @@
+// Package accesslog writes the JSON access log of the services.
+package accesslog
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logger writes one JSON line per request. Successful requests on
+// routes listed in sampling are only logged at the configured rate; errors
+// are always logged.
+type Logger struct {
+	logger   *slog.Logger
+	sampling map[string]float64
+}
+
+// New returns an access logger writing to w, sampling successful requests
+// by the "route=rate" pairs of sampling.
+func New(w io.Writer, sampling string) *Logger {
+	return &Logger{
+		logger:   slog.New(slog.NewJSONHandler(w, nil)),
+		sampling: parseRouteSampling(sampling),
+	}
+}
+
+// parseRouteSampling parses "route=rate" pairs such as "/healthz=0.01,/cep=0.5".
+func parseRouteSampling(s string) map[string]float64 {
+	rates := make(map[string]float64)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		route, value, ok := strings.Cut(pair, "=")
+		rate, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil || rate < 0 || rate > 1 {
+			log.Printf("Ignoring invalid access log sampling entry %q", pair)
+			continue
+		}
+		rates[route] = rate
+	}
+	return rates
+}
+
+// accessLogFields collects attributes that handlers further down the chain
+// add to the request's access log line.
+type accessLogFields struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+type accessLogFieldsKey struct{}
+
+// Annotate adds attrs to the access log line of the request
+// carried by ctx.
+func Annotate(ctx context.Context, attrs ...slog.Attr) {
+	if f, ok := ctx.Value(accessLogFieldsKey{}).(*accessLogFields); ok {
+		f.mu.Lock()
+		f.attrs = append(f.attrs, attrs...)
+		f.mu.Unlock()
+	}
+}
+
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		fields := &accessLogFields{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogFieldsKey{}, fields))
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		route := r.URL.Path
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		if status < http.StatusBadRequest {
+			if rate, ok := l.sampling[route]; ok && clock.Random().Float64() >= rate {
+				return
+			}
+		}
+
+		clientIP := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			clientIP = host
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", clientIP),
+			slog.String("user_agent", r.UserAgent()),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+			attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+		}
+		fields.mu.Lock()
+		attrs = append(attrs, fields.attrs...)
+		fields.mu.Unlock()
+		l.logger.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+	})
+}
@@ -0,0 +1,90 @@
+// Package admin holds what the admin APIs of both services share: the
+// bearer-token guard in front of them and the clock endpoints of
+// DETERMINISTIC_MODE.
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// Auth guards the admin API with a static bearer token. Without a token
+// the admin API is disabled altogether. Every call is recorded in
+// auditLog, denied or not, with the CEPs of its path masked by masker.
+func Auth(token string, auditLog *audit.Logger, masker *masking.Masker) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				httpapi.RespondWithError(w, weather.CodeNotFound, "not found", r.Context())
+				return
+			}
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				auditLog.Record(r.Context(), "admin", "admin.auth", "denied", map[string]string{
+					"method": r.Method,
+					"path":   masker.Text(r.URL.Path),
+				})
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				httpapi.RespondWithError(w, weather.CodeUnauthorized, "unauthorized", r.Context())
+				return
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			outcome := "success"
+			if status >= http.StatusBadRequest {
+				outcome = "failure"
+			}
+			auditLog.Record(r.Context(), "admin", "admin.request", outcome, map[string]string{
+				"method": r.Method,
+				"path":   masker.Text(r.URL.Path),
+				"status": strconv.Itoa(status),
+			})
+		})
+	}
+}
+
+type clockResponse struct {
+	Now           time.Time `json:"now"`
+	Deterministic bool      `json:"deterministic"`
+}
+
+// HandleClock answers GET /admin/clock with the time the service goes by.
+func HandleClock(w http.ResponseWriter, r *http.Request) {
+	httpapi.Render(w, http.StatusOK, clockResponse{Now: clock.Now().UTC(), Deterministic: clock.Deterministic()}, r.Context())
+}
+
+// ClockAdvanceHandler answers POST /admin/clock/advance?by=<duration>,
+// which moves the pinned clock of DETERMINISTIC_MODE forward, running the
+// cron tasks and expiring the entries that come due on the way.
+func ClockAdvanceHandler(auditLog *audit.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mc, ok := clock.Current().(*clock.Manual)
+		if !ok {
+			httpapi.RespondWithError(w, weather.CodeBadRequest, "the clock only moves by hand in DETERMINISTIC_MODE", r.Context())
+			return
+		}
+		d, err := time.ParseDuration(r.URL.Query().Get("by"))
+		if err != nil || d < 0 {
+			httpapi.RespondWithError(w, weather.CodeInvalidRequest, "by must be a non-negative duration", r.Context())
+			return
+		}
+		now := mc.Advance(d)
+		auditLog.Record(r.Context(), "admin", "clock.advance", "success", map[string]string{"by": d.String()})
+		httpapi.Render(w, http.StatusOK, clockResponse{Now: now.UTC(), Deterministic: true}, r.Context())
+	}
+}
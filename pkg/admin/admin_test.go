@@ -0,0 +1,83 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+)
+
+func TestAuthAuditsEveryCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.New(path, "service-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	masker, err := masking.New(string(masking.Truncate), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Auth("secret", auditLog, masker)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte("{}"))
+			return
+		}
+		http.Error(w, "cache key not found", http.StatusNotFound)
+	}))
+
+	for _, tc := range []struct {
+		method, token string
+	}{
+		{http.MethodGet, "secret"},
+		{http.MethodDelete, "secret"},
+		{http.MethodGet, "wrong"},
+	} {
+		req := httptest.NewRequest(tc.method, "/cache/cep:01001000", nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []audit.Event
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var e audit.Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("audit line %q: %v", sc.Text(), err)
+		}
+		got = append(got, e)
+	}
+
+	want := []struct {
+		action, outcome, method, status string
+	}{
+		{"admin.request", "success", http.MethodGet, "200"},
+		{"admin.request", "failure", http.MethodDelete, "404"},
+		{"admin.auth", "denied", http.MethodGet, ""},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("recorded %d events, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		e := got[i]
+		if e.Action != w.action || e.Outcome != w.outcome {
+			t.Errorf("event %d: %s %s, want %s %s", i, e.Action, e.Outcome, w.action, w.outcome)
+		}
+		if e.Details["method"] != w.method || e.Details["status"] != w.status {
+			t.Errorf("event %d: details %v, want method %s status %q", i, e.Details, w.method, w.status)
+		}
+		if p := e.Details["path"]; p != "/cache/cep:01001***" {
+			t.Errorf("event %d: path = %q, want the CEP masked", i, p)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Package apperrors holds the sentinel errors both services return, each
+// carrying the API error code, and so the HTTP status, it is answered with.
+// Checking a failure with errors.Is against these sentinels, and mapping it
+// with CodeOf, reads the same in service A and service B.
+package apperrors
+
+import (
+	"context"
+	"errors"
+
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+var (
+	// ErrCepNotFound means no provider knows the CEP.
+	ErrCepNotFound = New(weather.CodeZipcodeNotFound, "cep not found")
+	// ErrInvalidCep means the CEP is malformed, or outside the range of
+	// every UF when that is checked.
+	ErrInvalidCep = New(weather.CodeInvalidZipcode, "invalid cep")
+	// ErrUpstreamTimeout means a service or provider called didn't answer
+	// in time.
+	ErrUpstreamTimeout = New(weather.CodeUpstreamTimeout, "upstream timeout")
+	// ErrUpstreamUnavailable means a service or provider called shed the
+	// request or ran out of quota; the client may retry later.
+	ErrUpstreamUnavailable = New(weather.CodeUpstreamUnavailable, "upstream unavailable")
+	// ErrUpstreamSchema means a provider answered with a body that doesn't
+	// match its schema: the API changed or broke, and none of its fields can
+	// be trusted.
+	ErrUpstreamSchema = New(weather.CodeUpstreamSchemaError, "upstream response does not match its schema")
+)
+
+// Error is an error answered with an API error code.
+type Error struct {
+	Code weather.ErrorCode
+	msg  string
+}
+
+// New returns a sentinel error answered with code.
+func New(code weather.ErrorCode, msg string) *Error {
+	return &Error{Code: code, msg: msg}
+}
+
+func (e *Error) Error() string { return e.msg }
+
+// Status is the HTTP status the error is answered with.
+func (e *Error) Status() int { return e.Code.Status() }
+
+// CodeOf returns the code of the outermost Error in err's chain. A context
+// deadline that ran out is an UPSTREAM_TIMEOUT, and any other error is
+// INTERNAL.
+func CodeOf(err error) weather.ErrorCode {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return weather.CodeUpstreamTimeout
+	}
+	return weather.CodeInternal
+}
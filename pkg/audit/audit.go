@@ -0,0 +1,93 @@
+// Package audit records security-relevant actions, such as admin calls,
+// bans and denied credentials, to an audit log kept apart from the
+// application log.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Event is a single entry in the audit log.
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Service string            `json:"service"`
+	Actor   string            `json:"actor"`
+	Action  string            `json:"action"`
+	Outcome string            `json:"outcome"`
+	TraceID string            `json:"trace_id,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Logger appends audit events as JSON lines to a dedicated sink,
+// kept apart from the application log. A nil *Logger records nothing.
+type Logger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	service string
+}
+
+// New returns a Logger appending the events of service to the file at
+// path. Without a path, events are discarded.
+func New(path, service string) (*Logger, error) {
+	if path == "" {
+		return &Logger{w: io.Discard, service: service}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &Logger{w: f, service: service}, nil
+}
+
+// Record appends the event of actor performing action with outcome.
+func (a *Logger) Record(ctx context.Context, actor, action, outcome string, details map[string]string) {
+	if a == nil {
+		return
+	}
+	event := Event{
+		Time:    clock.Now().UTC(),
+		Service: a.service,
+		Actor:   actor,
+		Action:  action,
+		Outcome: outcome,
+		Details: details,
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		event.TraceID = sc.TraceID().String()
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding audit event: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing audit event: %v", err)
+	}
+}
+
+func (a *Logger) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c, ok := a.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
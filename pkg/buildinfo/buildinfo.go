@@ -0,0 +1,91 @@
+// Package buildinfo tells which build of a service is running.
+package buildinfo
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/google/uuid"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// Set at build time with
+// -ldflags "-X github.com/joaolima7/otel-goexpert/pkg/buildinfo.version=...",
+// and likewise gitCommit and buildDate.
+// Builds without them fall back to what the Go toolchain recorded: the
+// module version, the VCS revision and the commit time.
+var (
+	version   = ""
+	gitCommit = ""
+	buildDate = ""
+)
+
+type Info struct {
+	Version    string `json:"version"`
+	GitCommit  string `json:"git_commit"`
+	BuildDate  string `json:"build_date"`
+	GoVersion  string `json:"go_version"`
+	InstanceID string `json:"instance_id"`
+}
+
+// Current resolves the build information once, preferring the values
+// stamped by the linker.
+var Current = readBuildInfo()
+
+func readBuildInfo() Info {
+	info := Info{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.GitCommit == "":
+				info.GitCommit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if info.GitCommit == "" {
+		info.GitCommit = "unknown"
+	}
+	return info
+}
+
+// InstanceID tells apart the processes running the same version, for
+// example the old and new replicas during a rollout.
+var InstanceID = uuid.NewString()
+
+// NewResource describes this process to the telemetry backends, so traces
+// and metrics can be segmented by deployed version and instance.
+func NewResource(ctx context.Context, serviceName string) (*resource.Resource, error) {
+	return resource.New(ctx,
+		resource.WithAttributes(
+			semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceVersionKey.String(Current.Version),
+			semconv.ServiceInstanceIDKey.String(InstanceID),
+			attribute.String("vcs.revision", Current.GitCommit),
+		),
+	)
+}
+
+// HandleVersion answers GET /version.
+func HandleVersion(w http.ResponseWriter, r *http.Request) {
+	info := Current
+	info.InstanceID = InstanceID
+	httpapi.Render(w, http.StatusOK, info, r.Context())
+}
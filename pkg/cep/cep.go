@@ -0,0 +1,149 @@
+// Package cep parses Brazilian postal codes (CEPs) and tells which state
+// (UF) a CEP belongs to, from the ranges the Correios assign to each one.
+package cep
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrMalformed means a CEP is not made of 8 digits.
+	ErrMalformed = errors.New("cep: not made of 8 digits")
+	// ErrOutOfRange means a well-formed CEP falls outside the ranges of
+	// every UF, so that no address can have it.
+	ErrOutOfRange = errors.New("cep: outside the range of every UF")
+)
+
+// Strictness is how much of a CEP Validate checks.
+type Strictness string
+
+const (
+	// Format only checks that the CEP is made of 8 digits.
+	Format Strictness = "format"
+	// Range also checks that the CEP falls in the range of a UF.
+	Range Strictness = "range"
+)
+
+// ParseStrictness reads a Strictness, case-insensitively.
+func ParseStrictness(s string) (Strictness, error) {
+	switch st := Strictness(strings.ToLower(strings.TrimSpace(s))); st {
+	case Format, Range:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown CEP strictness %q, want format or range", s)
+}
+
+// maxInputLen is the longest input Normalize reads: a CEP, with the spaces
+// a form may leave around it, is far shorter, and longer inputs are
+// refused before they are trimmed.
+const maxInputLen = 64
+
+// Normalize returns s as 8 digits. Surrounding spaces are dropped, as are
+// the hyphen of the usual 00000-000 form and the dot of the older
+// 00.000-000 one; anything else is ErrMalformed. Digits must be ASCII:
+// Arabic-Indic or full-width digits, which unicode.IsDigit accepts, are
+// malformed rather than translated.
+func Normalize(s string) (string, error) {
+	if len(s) > maxInputLen {
+		return "", ErrMalformed
+	}
+	s = strings.TrimSpace(s)
+	if len(s) == 10 && s[2] == '.' {
+		s = s[:2] + s[3:]
+	}
+	if len(s) == 9 && s[5] == '-' {
+		s = s[:5] + s[6:]
+	}
+	if !IsWellFormed(s) {
+		return "", ErrMalformed
+	}
+	return s, nil
+}
+
+// IsWellFormed reports whether s is exactly 8 ASCII digits.
+func IsWellFormed(s string) bool {
+	if len(s) != 8 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks cep, which must already be normalized, with strictness
+// st. An unknown strictness checks the format only.
+func Validate(cep string, st Strictness) error {
+	if !IsWellFormed(cep) {
+		return ErrMalformed
+	}
+	if st == Range {
+		if _, ok := UF(cep); !ok {
+			return ErrOutOfRange
+		}
+	}
+	return nil
+}
+
+// ufRange is a range of CEP prefixes, the first five digits, of a UF.
+type ufRange struct {
+	first, last int
+	uf          string
+}
+
+// ufRanges are the ranges the Correios assign to each UF, sorted. Some UFs
+// have two, around the ranges of a neighbour.
+var ufRanges = []ufRange{
+	{1000, 19999, "SP"},
+	{20000, 28999, "RJ"},
+	{29000, 29999, "ES"},
+	{30000, 39999, "MG"},
+	{40000, 48999, "BA"},
+	{49000, 49999, "SE"},
+	{50000, 56999, "PE"},
+	{57000, 57999, "AL"},
+	{58000, 58999, "PB"},
+	{59000, 59999, "RN"},
+	{60000, 63999, "CE"},
+	{64000, 64999, "PI"},
+	{65000, 65999, "MA"},
+	{66000, 68899, "PA"},
+	{68900, 68999, "AP"},
+	{69000, 69299, "AM"},
+	{69300, 69399, "RR"},
+	{69400, 69899, "AM"},
+	{69900, 69999, "AC"},
+	{70000, 72799, "DF"},
+	{72800, 72999, "GO"},
+	{73000, 73699, "DF"},
+	{73700, 76799, "GO"},
+	{76800, 76999, "RO"},
+	{77000, 77999, "TO"},
+	{78000, 78899, "MT"},
+	{78900, 78999, "RO"},
+	{79000, 79999, "MS"},
+	{80000, 87999, "PR"},
+	{88000, 89999, "SC"},
+	{90000, 99999, "RS"},
+}
+
+// UF returns the state cep, 8 digits, belongs to.
+func UF(cep string) (string, bool) {
+	if !IsWellFormed(cep) {
+		return "", false
+	}
+	prefix := 0
+	for i := 0; i < 5; i++ {
+		prefix = prefix*10 + int(cep[i]-'0')
+	}
+	i := sort.Search(len(ufRanges), func(i int) bool { return ufRanges[i].last >= prefix })
+	if i == len(ufRanges) || prefix < ufRanges[i].first {
+		return "", false
+	}
+	return ufRanges[i].uf, true
+}
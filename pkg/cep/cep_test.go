@@ -0,0 +1,97 @@
+package cep
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func FuzzNormalize(f *testing.F) {
+	for _, s := range []string{
+		"01001000", "01001-000", "01.001-000", " 01001-000\n", " 01001000　",
+		"0100100", "010010000", "01001_000", "01.001000", "0100.1000",
+		"٠١٠٠١٠٠٠", "０１００１０００", "01001-00٠", "\xff\xfe01001000",
+		"00000000", "99999999", "",
+		strings.Repeat(" ", 1<<16) + "01001000",
+		strings.Repeat("0", 1<<16),
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		c, err := Normalize(s)
+		if err != nil {
+			if !errors.Is(err, ErrMalformed) {
+				t.Fatalf("Normalize(%q) = %v, want ErrMalformed", s, err)
+			}
+			return
+		}
+		if !IsWellFormed(c) {
+			t.Fatalf("Normalize(%q) = %q, not 8 ASCII digits", s, c)
+		}
+		if again, err := Normalize(c); err != nil || again != c {
+			t.Fatalf("Normalize(%q) = %q, %v, want it unchanged", c, again, err)
+		}
+		if strings.Map(asciiDigit, s) != c {
+			t.Fatalf("Normalize(%q) = %q, not the digits of the input", s, c)
+		}
+	})
+}
+
+func FuzzValidate(f *testing.F) {
+	for _, s := range []string{"01001000", "00000000", "00999999", "99999999", "0100100", "٠١٠٠١٠٠٠", ""} {
+		f.Add(s, false)
+		f.Add(s, true)
+	}
+	f.Fuzz(func(t *testing.T, s string, ranged bool) {
+		st := Format
+		if ranged {
+			st = Range
+		}
+		err := Validate(s, st)
+		uf, ok := UF(s)
+		switch {
+		case !IsWellFormed(s):
+			if !errors.Is(err, ErrMalformed) || ok {
+				t.Fatalf("Validate(%q, %s) = %v, UF = %q, %v; want ErrMalformed and no UF", s, st, err, uf, ok)
+			}
+		case ok != (uf != ""):
+			t.Fatalf("UF(%q) = %q, %v", s, uf, ok)
+		case st == Range && ok != (err == nil):
+			t.Fatalf("Validate(%q, %s) = %v, but UF = %q, %v", s, st, err, uf, ok)
+		case st == Format && err != nil:
+			t.Fatalf("Validate(%q, %s) = %v, want nil", s, st, err)
+		}
+	})
+}
+
+func TestUF(t *testing.T) {
+	tests := []struct {
+		cep, uf string
+	}{
+		{"01001000", "SP"},
+		{"70040010", "DF"},
+		{"72800000", "GO"},
+		{"69900000", "AC"},
+		// DF wraps around a range of GO, so both of its edges are borders.
+		{"72799999", "DF"},
+		{"72999999", "GO"},
+		{"73000000", "DF"},
+		{"73699999", "DF"},
+		{"73700000", "GO"},
+		{"00999999", ""},
+	}
+	for _, tt := range tests {
+		uf, ok := UF(tt.cep)
+		if uf != tt.uf || ok != (tt.uf != "") {
+			t.Errorf("UF(%q) = %q, %v; want %q", tt.cep, uf, ok, tt.uf)
+		}
+	}
+}
+
+// asciiDigit keeps the ASCII digits of a string mapped through it.
+func asciiDigit(r rune) rune {
+	if r >= '0' && r <= '9' {
+		return r
+	}
+	return -1
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// APIError is an error response of the APIs. Quote RequestID and TraceID
+// when reporting it: they find the request in the services' logs and
+// traces.
+type APIError struct {
+	Status    int               `json:"-"`
+	Code      weather.ErrorCode `json:"code"`
+	Message   string            `json:"message"`
+	RequestID string            `json:"request_id"`
+	TraceID   string            `json:"trace_id"`
+	DocsURL   string            `json:"docs_url"`
+	Support   string            `json:"support"`
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s (status %d): %s", e.Code, e.Status, e.Message)
+	if e.TraceID != "" {
+		msg += " [trace " + e.TraceID + "]"
+	}
+	return msg
+}
+
+// Retryable reports whether repeating the request may succeed.
+func (e *APIError) Retryable() bool {
+	return e.Code.Retryable()
+}
+
+// DecodeResult reads the response to a lookup, POST /cep on service A or
+// POST /weather on service B, and closes its body. Any status but 200
+// comes back as an *APIError.
+func DecodeResult(resp *http.Response) (weather.Result, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return weather.Result{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &APIError{Status: resp.StatusCode}
+		if err := json.Unmarshal(body, apiErr); err != nil || apiErr.Code == "" {
+			apiErr.Code = weather.CodeInternal
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return weather.Result{}, apiErr
+	}
+	var result weather.Result
+	if err := json.Unmarshal(body, &result); err != nil {
+		return weather.Result{}, fmt.Errorf("decoding result: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,201 @@
+// Package clock is the time source of everything that expires, is rate
+// limited, is scheduled or is stamped with the time it was observed:
+// caches, limiters, bans, quotas, cron tasks, events and stored records.
+// Going through Now and NewTimer instead of the time package lets tests
+// and DETERMINISTIC_MODE drive time. Request deadlines and measured
+// latencies stay on the wall clock.
+//
+// It is also the source of non-cryptographic randomness, which
+// deterministic mode seeds along with the time.
+package clock
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes timers that follow it.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of *time.Timer the scheduler and limiters use.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+var (
+	current Clock = systemClock{}
+	rng           = &Rand{r: mrand.New(mrand.NewPCG(mrand.Uint64(), mrand.Uint64()))}
+	// deterministic routes the random IDs through rng as well.
+	deterministic bool
+)
+
+// Now returns the current time of the process clock.
+func Now() time.Time { return current.Now() }
+
+// NewTimer returns a timer that fires once the process clock has moved d
+// forward.
+func NewTimer(d time.Duration) Timer { return current.NewTimer(d) }
+
+// Current returns the process clock, a *Manual in deterministic mode.
+func Current() Clock { return current }
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+func (t systemTimer) Stop() bool          { return t.t.Stop() }
+
+// Manual stands still until Advance moves it, firing the timers that come
+// due on the way, in order.
+type Manual struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+func NewManual(start time.Time) *Manual {
+	return &Manual{now: start}
+}
+
+func (c *Manual) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Manual) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d.
+func (c *Manual) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	slices.SortFunc(c.timers, func(a, b *manualTimer) int { return a.at.Compare(b.at) })
+	for len(c.timers) > 0 && !c.timers[0].at.After(end) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.at
+		t.c <- t.at
+	}
+	c.now = end
+	return end
+}
+
+type manualTimer struct {
+	clock *Manual
+	at    time.Time
+	c     chan time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.c }
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	i := slices.Index(t.clock.timers, t)
+	if i < 0 {
+		return false
+	}
+	t.clock.timers = slices.Delete(t.clock.timers, i, i+1)
+	return true
+}
+
+// Rand is a math/rand generator safe for concurrent use.
+type Rand struct {
+	mu sync.Mutex
+	r  *mrand.Rand
+}
+
+func (l *Rand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *Rand) IntN(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.IntN(n)
+}
+
+func (l *Rand) Int64N(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int64N(n)
+}
+
+func (l *Rand) Read(b []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range b {
+		b[i] = byte(l.r.Uint32())
+	}
+}
+
+// Random returns the source of non-cryptographic randomness: sampling,
+// jitter and weighted picks. Deterministic mode seeds it.
+func Random() *Rand { return rng }
+
+// RandomBytes fills b with random bytes: from crypto/rand normally, from
+// the seeded generator in deterministic mode.
+func RandomBytes(b []byte) {
+	if deterministic {
+		rng.Read(b)
+		return
+	}
+	rand.Read(b)
+}
+
+// DeterministicConfig pins time and randomness so that runs repeat
+// exactly: the clock starts at Start and only moves through Advance, and
+// the random generators start from Seed. IDs and secrets become
+// predictable, so it is for tests only.
+type DeterministicConfig struct {
+	Enabled bool
+	Seed    uint64
+	Start   string
+}
+
+// SetDeterministic pins the process clock and randomness as cfg says. It
+// must be called at startup, before anything reads the clock.
+func SetDeterministic(cfg DeterministicConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	start, err := time.Parse(time.RFC3339, cfg.Start)
+	if err != nil {
+		return fmt.Errorf("invalid DETERMINISTIC_START %q: %w", cfg.Start, err)
+	}
+	current = NewManual(start)
+	rng = &Rand{r: mrand.New(mrand.NewPCG(cfg.Seed, cfg.Seed))}
+	deterministic = true
+	log.Printf("DETERMINISTIC_MODE is on: clock pinned at %s, seed %d; do not use in production", start.Format(time.RFC3339), cfg.Seed)
+	return nil
+}
+
+// Deterministic reports whether the process runs in deterministic mode.
+func Deterministic() bool { return deterministic }
@@ -0,0 +1,357 @@
+// Package compression compresses responses with the content coding the
+// client prefers, gzip, br or zstd, and decompresses request bodies sent
+// in one of them.
+package compression
+
+import (
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Config sets how responses are compressed and how large
+// compressed request bodies may grow.
+type Config struct {
+	// Encodings lists the offered encodings, gzip, br and zstd, in the
+	// order preferred when the client weighs them equally; empty disables
+	// compression.
+	Encodings []string
+	// GzipLevel is 1 (fastest) to 9 (smallest) and BrotliLevel 0 to 11;
+	// ZstdLevel follows the zstd command line, 1 to 22, and is rounded to
+	// the nearest level the encoder implements.
+	GzipLevel   int
+	BrotliLevel int
+	ZstdLevel   int
+	// MinBytes leaves responses shorter than this uncompressed: the
+	// encoding would cost more than it saves.
+	MinBytes int
+	// RequestMaxBytes bounds request bodies sent compressed, once
+	// decompressed.
+	RequestMaxBytes int64
+}
+
+// DefaultBrotliLevel trades ratio for speed as responses are compressed
+// on the fly: the levels past it cost far more CPU for a few percent.
+const DefaultBrotliLevel = 4
+
+// compressionEncoder creates the writers of one content coding; they are
+// pooled, since building a zstd encoder is expensive.
+type compressionEncoder struct {
+	name string
+	pool sync.Pool
+}
+
+type resettableWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+	Flush() error
+}
+
+func newCompressionEncoders(cfg Config) []*compressionEncoder {
+	var encoders []*compressionEncoder
+	for _, name := range cfg.Encodings {
+		e := &compressionEncoder{name: name}
+		switch name {
+		case "gzip":
+			level := cfg.GzipLevel
+			if level < gzip.BestSpeed || level > gzip.BestCompression {
+				log.Printf("Invalid COMPRESSION_GZIP_LEVEL %d, using %d", level, gzip.DefaultCompression)
+				level = gzip.DefaultCompression
+			}
+			e.pool.New = func() any {
+				w, _ := gzip.NewWriterLevel(io.Discard, level)
+				return w
+			}
+		case "br":
+			level := cfg.BrotliLevel
+			if level < brotli.BestSpeed || level > brotli.BestCompression {
+				log.Printf("Invalid COMPRESSION_BROTLI_LEVEL %d, using %d", level, DefaultBrotliLevel)
+				level = DefaultBrotliLevel
+			}
+			e.pool.New = func() any {
+				return brotli.NewWriterLevel(io.Discard, level)
+			}
+		case "zstd":
+			level := zstd.EncoderLevelFromZstd(cfg.ZstdLevel)
+			e.pool.New = func() any {
+				w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+				return w
+			}
+		default:
+			log.Printf("Ignoring unknown compression encoding %q", name)
+			continue
+		}
+		encoders = append(encoders, e)
+	}
+	return encoders
+}
+
+// negotiateEncoding picks the encoder for the Accept-Encoding header,
+// honoring its q-values and, among equals, the order of encoders. It
+// returns nil when the client accepts none of them.
+func negotiateEncoding(header string, encoders []*compressionEncoder) *compressionEncoder {
+	if header == "" {
+		return nil
+	}
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		weights[name] = q
+	}
+	var best *compressionEncoder
+	bestQ := 0.0
+	for _, e := range encoders {
+		q, ok := weights[e.name]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// compressibleTypes are the media types worth compressing; images,
+// archives and event streams, which must reach the client as written, are
+// not among them.
+var compressibleTypes = []string{
+	"application/json",
+	"application/problem+json",
+	"application/x-ndjson",
+	"application/xml",
+	"application/javascript",
+	"text/csv",
+	"text/html",
+	"text/plain",
+	"text/css",
+	"text/javascript",
+	"text/xml",
+}
+
+// Middleware compresses responses with the best encoding the client
+// accepts. Responses are held back until MinBytes are written, or the
+// handler is done or flushes, to tell whether compressing pays off.
+func Middleware(cfg Config) func(http.Handler) http.Handler {
+	encoders := newCompressionEncoders(cfg)
+	return func(next http.Handler) http.Handler {
+		if len(encoders) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			e := negotiateEncoding(r.Header.Get("Accept-Encoding"), encoders)
+			if e == nil || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoder: e, minBytes: cfg.MinBytes, status: http.StatusOK}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// compressWriter buffers the start of a response and then either
+// compresses it or passes it through.
+type compressWriter struct {
+	http.ResponseWriter
+	encoder  *compressionEncoder
+	minBytes int
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	w           resettableWriter
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	// Informational responses go out as is; the real one comes later.
+	if status < http.StatusOK {
+		cw.wroteHeader = false
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	// Ranges are of the uncompressed bytes, and some statuses have no body.
+	switch status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.w != nil {
+			return cw.w.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minBytes {
+		if err := cw.decide(cw.compressible()); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// compressible reports whether the response may be compressed, going by
+// its headers.
+func (cw *compressWriter) compressible() bool {
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return slices.Contains(compressibleTypes, mediaType)
+}
+
+// decide sends the header, compressing the rest of the response or not,
+// and then whatever was buffered.
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	if compress {
+		h := cw.Header()
+		h.Set("Content-Encoding", cw.encoder.name)
+		h.Del("Content-Length")
+		// A strong ETag names the uncompressed bytes.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.w = cw.encoder.pool.Get().(resettableWriter)
+		cw.w.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.w != nil {
+		_, err = cw.w.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// Flush sends what was written so far. A response flushed before MinBytes
+// is a stream, compressed if its type allows it.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			cw.WriteHeader(http.StatusOK)
+		}
+		if cw.decide(cw.compressible()) != nil {
+			return
+		}
+	}
+	if cw.w != nil && cw.w.Flush() != nil {
+		return
+	}
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close ends the response: a short one is sent uncompressed, a compressed
+// one gets its trailer and the writer goes back to the pool.
+func (cw *compressWriter) Close() {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			return
+		}
+		cw.decide(false)
+	}
+	if cw.w != nil {
+		cw.w.Close()
+		cw.w.Reset(io.Discard)
+		cw.encoder.pool.Put(cw.w)
+		cw.w = nil
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// requestEncodings are the Content-Encodings accepted on request bodies.
+const requestEncodings = "gzip, br, zstd"
+
+// DecompressRequests decodes request bodies sent with a Content-Encoding
+// of gzip, br or zstd, so clients on slow links can send large batches
+// compressed. The decoded body is cut at maxBytes, which keeps a small zip
+// bomb from inflating into gigabytes; handlers answer 413 past it (see
+// httpapi.RespondWithDecodeError). Other encodings are refused with 415.
+func DecompressRequests(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			var body io.ReadCloser
+			switch encoding {
+			case "", "identity":
+				next.ServeHTTP(w, r)
+				return
+			case "gzip":
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					httpapi.RespondWithError(w, weather.CodeBadRequest, "invalid gzip body", r.Context())
+					return
+				}
+				defer zr.Close()
+				body = io.NopCloser(zr)
+			case "br":
+				// Corrupt input surfaces as a read error, which handlers
+				// answer as an invalid body.
+				body = io.NopCloser(brotli.NewReader(r.Body))
+			case "zstd":
+				// 8 MiB is the largest window decoders are expected to
+				// support; it also bounds what one frame makes us allocate.
+				zr, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(8<<20))
+				if err != nil {
+					httpapi.RespondWithError(w, weather.CodeBadRequest, "invalid zstd body", r.Context())
+					return
+				}
+				defer zr.Close()
+				body = io.NopCloser(zr)
+			default:
+				w.Header().Set("Accept-Encoding", requestEncodings)
+				httpapi.RespondWithError(w, weather.CodeUnsupportedMediaType, "unsupported content encoding "+encoding, r.Context())
+				return
+			}
+			r.Body = http.MaxBytesReader(w, body, maxBytes)
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
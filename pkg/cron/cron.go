@@ -0,0 +1,273 @@
+// Package cron runs the recurring tasks of a service.
+package cron
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	robfig "github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Task is a recurring task. Spec is its default schedule, in cron
+// syntax or as "@every <duration>"; empty leaves it off unless CRON_SCHEDULE
+// sets one.
+type Task struct {
+	Name string
+	Spec string
+	Run  func(ctx context.Context) error
+	// Singleton tasks run on one replica only, the leader, when the
+	// scheduler has a leader check.
+	Singleton bool
+}
+
+type Status struct {
+	Name           string     `json:"name"`
+	Schedule       string     `json:"schedule"`
+	Enabled        bool       `json:"enabled"`
+	Singleton      bool       `json:"singleton,omitempty"`
+	NextRun        *time.Time `json:"next_run,omitempty"`
+	LastRun        *time.Time `json:"last_run,omitempty"`
+	LastStatus     string     `json:"last_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastDurationMs float64    `json:"last_duration_ms,omitempty"`
+	Runs           int        `json:"runs"`
+	Failures       int        `json:"failures"`
+	// Skipped counts the runs of a singleton task left to the leader.
+	Skipped int `json:"skipped,omitempty"`
+}
+
+// Scheduler runs the cron tasks, each under its own root span, and keeps
+// the outcome of their last run for the admin API. A run still in progress
+// when the next is due is skipped. Runs come due by clock, so a pinned
+// clock only runs them as it is advanced.
+type Scheduler struct {
+	mu      sync.Mutex
+	status  map[string]*Status
+	entries []*entry
+	names   []string
+	// isLeader, when set, tells whether this replica runs the singleton
+	// tasks.
+	isLeader func() bool
+	tracer   trace.Tracer
+
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
+	runs   sync.WaitGroup
+}
+
+type entry struct {
+	task     Task
+	schedule robfig.Schedule
+	running  atomic.Bool
+}
+
+// parseCronSchedule reads CRON_SCHEDULE, written as "task=spec;task=spec".
+// A spec of "off" disables the task.
+func parseCronSchedule(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid CRON_SCHEDULE entry %q, want task=spec", item)
+		}
+		out[strings.TrimSpace(name)] = strings.TrimSpace(spec)
+	}
+	return out, nil
+}
+
+// New schedules tasks, with the overrides of schedule, tracing their runs
+// with tracer.
+func New(schedule string, tasks []Task, tracer trace.Tracer) (*Scheduler, error) {
+	overrides, err := parseCronSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scheduler{status: make(map[string]*Status), tracer: tracer}
+
+	for _, t := range tasks {
+		spec := t.Spec
+		if o, ok := overrides[t.Name]; ok {
+			spec = o
+			delete(overrides, t.Name)
+		}
+		st := &Status{Name: t.Name, Schedule: spec, Singleton: t.Singleton}
+		s.status[t.Name] = st
+		s.names = append(s.names, t.Name)
+		if spec == "" || spec == "off" {
+			continue
+		}
+		schedule, err := robfig.ParseStandard(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q for cron task %s: %w", spec, t.Name, err)
+		}
+		st.Enabled = true
+		s.entries = append(s.entries, &entry{task: t, schedule: schedule})
+	}
+	for name := range overrides {
+		return nil, fmt.Errorf("unknown cron task %q", name)
+	}
+	return s, nil
+}
+
+// loop waits for each run of e to come due and starts it, unless the
+// previous one is still going.
+func (s *Scheduler) loop(ctx context.Context, e *entry) {
+	defer s.loops.Done()
+	for {
+		now := clock.Now()
+		next := e.schedule.Next(now)
+		s.mu.Lock()
+		s.status[e.task.Name].NextRun = &next
+		s.mu.Unlock()
+
+		timer := clock.NewTimer(next.Sub(now))
+		var due time.Time
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case due = <-timer.C():
+		}
+		if e.task.Singleton && s.isLeader != nil && !s.isLeader() {
+			s.mu.Lock()
+			s.status[e.task.Name].Skipped++
+			s.mu.Unlock()
+			continue
+		}
+		if !e.running.CompareAndSwap(false, true) {
+			continue
+		}
+		s.runs.Add(1)
+		go func() {
+			defer s.runs.Done()
+			defer e.running.Store(false)
+			s.run(e.task, due)
+		}()
+	}
+}
+
+// run runs t once, recording due as the time of the run.
+func (s *Scheduler) run(t Task, due time.Time) {
+	ctx, span := s.tracer.Start(context.Background(), "cron "+t.Name,
+		trace.WithNewRoot(), trace.WithAttributes(attribute.String("cron.task", t.Name)))
+	defer span.End()
+
+	start := time.Now()
+	err := t.Run(ctx)
+	elapsed := time.Since(start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status[t.Name]
+	st.LastRun = &due
+	st.LastDurationMs = float64(elapsed.Microseconds()) / 1000
+	st.Runs++
+	st.LastStatus, st.LastError = "ok", ""
+	if err != nil {
+		st.Failures++
+		st.LastStatus, st.LastError = "error", err.Error()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		errlog.Printf("Cron task %s failed: %v", t.Name, err)
+	}
+}
+
+// SetLeaderCheck makes the singleton tasks run only while isLeader reports
+// true. It must be called before Start.
+func (s *Scheduler) SetLeaderCheck(isLeader func() bool) {
+	s.isLeader = isLeader
+}
+
+// Describe summarizes the enabled tasks for the startup log.
+func (s *Scheduler) Describe() string {
+	var parts []string
+	for _, name := range s.names {
+		st := s.status[name]
+		switch {
+		case !st.Enabled:
+		case st.Singleton && s.isLeader != nil:
+			parts = append(parts, name+" ("+st.Schedule+", leader only)")
+		default:
+			parts = append(parts, name+" ("+st.Schedule+")")
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Start runs the enabled tasks as they come due.
+func (s *Scheduler) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for _, e := range s.entries {
+		s.loops.Add(1)
+		go s.loop(ctx, e)
+	}
+}
+
+// Stop stops scheduling and waits for the running tasks until ctx is done.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.loops.Wait()
+	done := make(chan struct{})
+	go func() {
+		s.runs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		log.Printf("Cron tasks still running at shutdown")
+		return nil
+	}
+}
+
+// Statuses reports every task, enabled or not, in registration order.
+func (s *Scheduler) Statuses() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Status, 0, len(s.names))
+	for _, name := range s.names {
+		out = append(out, *s.status[name])
+	}
+	return out
+}
+
+// HandleStatus answers GET /admin/cron, or the task named by the
+// optional ?task= parameter.
+func (s *Scheduler) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := s.Statuses()
+	if name := r.URL.Query().Get("task"); name != "" {
+		i := slices.IndexFunc(statuses, func(st Status) bool { return st.Name == name })
+		if i < 0 {
+			httpapi.RespondWithError(w, weather.CodeNotFound, "cron task not found", r.Context())
+			return
+		}
+		httpapi.Render(w, http.StatusOK, statuses[i], r.Context())
+		return
+	}
+	httpapi.Render(w, http.StatusOK, statuses, r.Context())
+}
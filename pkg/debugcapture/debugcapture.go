@@ -0,0 +1,425 @@
+// Package debugcapture records the full exchanges of the requests that ask
+// for it, inbound and with upstreams, redacted, on their spans and in a
+// ring buffer served by the admin API.
+package debugcapture
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/redact"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Debug capture is asked for per request by sending X-Debug-Capture with
+// DEBUG_CAPTURE_SECRET, or enabled by the service for other requests, such
+// as every request of a tenant. Service A passes it on to service B in the
+// BaggageKey baggage member, so one request is captured end to end.
+const (
+	header     = "X-Debug-Capture"
+	BaggageKey = "debug.capture"
+)
+
+// Config sets who may ask for captures and how much of them is kept.
+type Config struct {
+	Secret string `secret:"true"`
+	// MaxBytes caps every captured body; Keep is how many captures the
+	// debug store holds, zero leaving them on the spans only.
+	MaxBytes int
+	Keep     int
+}
+
+// Capture is one exchange of a captured request, inbound or with an
+// upstream, redacted before it is stored or exported.
+type Capture struct {
+	ID              int64     `json:"id"`
+	Time            time.Time `json:"time"`
+	TraceID         string    `json:"trace_id,omitempty"`
+	Direction       string    `json:"direction"`
+	Method          string    `json:"method"`
+	URL             string    `json:"url"`
+	Status          int       `json:"status,omitempty"`
+	DurationMs      float64   `json:"duration_ms"`
+	RequestHeaders  []string  `json:"request_headers,omitempty"`
+	RequestBody     string    `json:"request_body,omitempty"`
+	ResponseHeaders []string  `json:"response_headers,omitempty"`
+	ResponseBody    string    `json:"response_body,omitempty"`
+	Truncated       bool      `json:"truncated,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type captureList struct {
+	Captures []Capture `json:"captures"`
+}
+
+// Capturer decides which requests are captured and keeps the latest
+// captures in a ring buffer, served by GET /admin/debug/captures.
+type Capturer struct {
+	secret     string
+	maxBytes   int
+	enabledFor func(r *http.Request) bool
+	masker     *masking.Masker
+	auditLog   *audit.Logger
+
+	mu   sync.Mutex
+	buf  []Capture
+	next int
+	full bool
+	seq  int64
+}
+
+// New returns a Capturer of the requests that ask for it or for which
+// enabledFor is true, masking the CEPs of the captures with masker and
+// recording their clearing to auditLog.
+func New(cfg Config, enabledFor func(r *http.Request) bool, masker *masking.Masker, auditLog *audit.Logger) *Capturer {
+	d := &Capturer{secret: cfg.Secret, maxBytes: max(cfg.MaxBytes, 0), enabledFor: enabledFor, masker: masker, auditLog: auditLog}
+	if cfg.Keep > 0 {
+		d.buf = make([]Capture, cfg.Keep)
+	}
+	return d
+}
+
+type activeKey struct{}
+
+// Active reports whether ctx belongs to a captured request.
+func Active(ctx context.Context) bool {
+	on, _ := ctx.Value(activeKey{}).(bool)
+	return on
+}
+
+func (d *Capturer) requested(r *http.Request) bool {
+	given := r.Header.Get(header)
+	if d.secret != "" && given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(d.secret)) == 1 {
+		return true
+	}
+	return d.enabledFor(r)
+}
+
+// Middleware captures the requests that ask for it, and the upstream
+// calls made for them through Transport. Anyone else's debug.capture
+// baggage is dropped so it doesn't reach service B.
+func (d *Capturer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		bag := baggage.FromContext(ctx)
+		if !d.requested(r) {
+			if bag.Member(BaggageKey).Key() != "" {
+				ctx = baggage.ContextWithBaggage(ctx, bag.DeleteMember(BaggageKey))
+				r = r.WithContext(ctx)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx = context.WithValue(ctx, activeKey{}, true)
+		if member, err := baggage.NewMember(BaggageKey, "true"); err == nil {
+			if bag, err := bag.SetMember(member); err == nil {
+				ctx = baggage.ContextWithBaggage(ctx, bag)
+			}
+		}
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("debug.capture", true))
+
+		reqBody := &captureBuffer{max: d.maxBytes}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, reqBody), r.Body}
+		respBody := &captureBuffer{max: d.maxBytes}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Tee(respBody)
+
+		start := time.Now()
+		next.ServeHTTP(ww, r.WithContext(ctx))
+		d.record(ctx, Capture{
+			Direction:       "inbound",
+			Method:          r.Method,
+			URL:             r.URL.String(),
+			Status:          cmp.Or(ww.Status(), http.StatusOK),
+			DurationMs:      float64(time.Since(start).Microseconds()) / 1000,
+			RequestHeaders:  redactHeaders(r.Header),
+			ResponseHeaders: redactHeaders(ww.Header()),
+		}, reqBody, respBody)
+	})
+}
+
+// Transport captures the outbound calls made through base on behalf of a
+// captured request. It is meant to wrap the instrumented transport, so the
+// captures land on the span of the caller.
+func (d *Capturer) Transport(base http.RoundTripper) http.RoundTripper {
+	return captureTransport{d: d, base: base}
+}
+
+type captureTransport struct {
+	d    *Capturer
+	base http.RoundTripper
+}
+
+func (t captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if !Active(ctx) {
+		return t.base.RoundTrip(req)
+	}
+	d := t.d
+	c := Capture{
+		Direction:      "upstream",
+		Method:         req.Method,
+		URL:            req.URL.String(),
+		RequestHeaders: redactHeaders(req.Header),
+	}
+	reqBody := &captureBuffer{max: d.maxBytes}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			io.Copy(reqBody, body)
+			body.Close()
+		}
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		c.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		c.Error = err.Error()
+		d.record(ctx, c, reqBody, nil)
+		return nil, err
+	}
+	c.Status = resp.StatusCode
+	c.ResponseHeaders = redactHeaders(resp.Header)
+	respBody := &captureBuffer{max: d.maxBytes}
+	resp.Body = &capturedBody{
+		ReadCloser: resp.Body,
+		tee:        io.TeeReader(resp.Body, respBody),
+		done: func() {
+			c.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+			d.record(ctx, c, reqBody, respBody)
+		},
+	}
+	return resp, nil
+}
+
+// capturedBody records the upstream exchange once the caller is done
+// with the response body.
+type capturedBody struct {
+	io.ReadCloser
+	tee  io.Reader
+	once sync.Once
+	done func()
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) { return b.tee.Read(p) }
+
+func (b *capturedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// captureBuffer keeps the first max bytes written to it and notes whether
+// more came.
+type captureBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	room := b.max - b.buf.Len()
+	if len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+		return len(p), nil
+	}
+	b.buf.Write(p)
+	return len(p), nil
+}
+
+// record redacts c and its bodies, adds it to the span of ctx as a
+// debug.capture event and keeps it in the store.
+func (d *Capturer) record(ctx context.Context, c Capture, reqBody, respBody *captureBuffer) {
+	c.Time = clock.Now().UTC()
+	c.URL = d.redactURL(c.URL)
+	if reqBody != nil {
+		c.RequestBody = d.redactBody(reqBody.buf.Bytes())
+		c.Truncated = reqBody.truncated
+	}
+	if respBody != nil {
+		c.ResponseBody = d.redactBody(respBody.buf.Bytes())
+		c.Truncated = c.Truncated || respBody.truncated
+	}
+	if c.Error != "" {
+		c.Error = d.redactText(c.Error)
+	}
+
+	d.mu.Lock()
+	d.seq++
+	c.ID = d.seq
+	d.mu.Unlock()
+
+	span := trace.SpanFromContext(ctx)
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		c.TraceID = sc.TraceID().String()
+	}
+	span.AddEvent("debug.capture", trace.WithAttributes(
+		attribute.Int64("debug.capture.id", c.ID),
+		attribute.String("debug.direction", c.Direction),
+		attribute.String("http.request.method", c.Method),
+		attribute.String("url.full", c.URL),
+		attribute.Int("http.response.status_code", c.Status),
+		attribute.String("debug.request.body", c.RequestBody),
+		attribute.String("debug.response.body", c.ResponseBody),
+		attribute.Bool("debug.truncated", c.Truncated),
+	))
+
+	if len(d.buf) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.buf[d.next] = c
+	d.next = (d.next + 1) % len(d.buf)
+	if d.next == 0 {
+		d.full = true
+	}
+}
+
+// Recent returns the stored captures, newest first, of traceID when set.
+func (d *Capturer) Recent(traceID string) []Capture {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := d.next
+	if d.full {
+		n = len(d.buf)
+	}
+	out := make([]Capture, 0, n)
+	for i := 1; i <= n; i++ {
+		c := d.buf[(d.next-i+len(d.buf))%len(d.buf)]
+		if traceID == "" || c.TraceID == traceID {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (d *Capturer) Clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clear(d.buf)
+	d.next, d.full = 0, false
+}
+
+// HandleList serves GET /admin/debug/captures, optionally filtered by
+// ?trace_id=.
+func (d *Capturer) HandleList(w http.ResponseWriter, r *http.Request) {
+	httpapi.Render(w, http.StatusOK, captureList{Captures: d.Recent(r.URL.Query().Get("trace_id"))}, r.Context())
+}
+
+// HandleClear serves DELETE /admin/debug/captures.
+func (d *Capturer) HandleClear(w http.ResponseWriter, r *http.Request) {
+	d.Clear()
+	d.auditLog.Record(r.Context(), "admin", "debug.captures.clear", "success", nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var (
+	// sensitiveName matches the names of headers, query parameters and
+	// JSON fields whose values are never captured.
+	sensitiveName = regexp.MustCompile(`(?i)key|token|secret|passw|authorization|cookie|signature|credential|appid|` + header)
+	// sensitivePair matches name=value pairs of form bodies and error
+	// messages, such as the API keys in upstream URLs.
+	sensitivePair = regexp.MustCompile(`(?i)([\w.-]*(?:key|token|secret|passw|signature|appid)[\w.-]*=)[^&\s"]+`)
+	// sensitiveField matches the same names as JSON fields, in bodies cut
+	// short by MaxBytes.
+	sensitiveField = regexp.MustCompile(`(?i)("[\w.-]*(?:key|token|secret|passw|signature|appid)[\w.-]*"\s*:\s*)"[^"]*"`)
+)
+
+func redactHeaders(h http.Header) []string {
+	out := make([]string, 0, len(h))
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		value := strings.Join(h[name], ", ")
+		if sensitiveName.MatchString(name) {
+			value = redact.Placeholder
+		}
+		out = append(out, name+": "+value)
+	}
+	return out
+}
+
+// redactURL masks credentials, sensitive query parameters and CEPs.
+func (d *Capturer) redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return d.redactText(raw)
+	}
+	if u.User != nil {
+		u.User = url.User(redact.Placeholder)
+	}
+	if q := u.Query(); len(q) > 0 {
+		for name := range q {
+			if sensitiveName.MatchString(name) {
+				q.Set(name, redact.Placeholder)
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return d.masker.Text(u.String())
+}
+
+// redactBody masks the sensitive fields of JSON bodies, anything that
+// looks like a secret in other bodies, and CEPs everywhere.
+func (d *Capturer) redactBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return d.redactText(string(body))
+	}
+	out, err := json.Marshal(redactJSON(v))
+	if err != nil {
+		return d.redactText(string(body))
+	}
+	return d.masker.Text(string(out))
+}
+
+func redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if sensitiveName.MatchString(k) {
+				v[k] = redact.Placeholder
+				continue
+			}
+			v[k] = redactJSON(child)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = redactJSON(child)
+		}
+	}
+	return v
+}
+
+func (d *Capturer) redactText(s string) string {
+	s = sensitiveField.ReplaceAllString(s, `${1}"`+redact.Placeholder+`"`)
+	return d.masker.Text(sensitivePair.ReplaceAllString(s, "${1}"+redact.Placeholder))
+}
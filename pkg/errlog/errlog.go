@@ -0,0 +1,103 @@
+// Package errlog logs errors that tend to repeat, such as those of a
+// failing upstream, without flooding the log: lines sharing a format
+// string are collapsed into periodic summaries.
+package errlog
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// std is the limiter of Printf: the first five occurrences of a format in
+// each minute are logged.
+var std = New(time.Minute, 5)
+
+// Printf logs through the process-wide Limiter.
+func Printf(format string, args ...any) {
+	std.Printf(format, args...)
+}
+
+// Stop flushes the process-wide Limiter and stops it.
+func Stop() {
+	std.Stop()
+}
+
+// Limiter collapses repeated log lines that share a format string. The
+// first burst occurrences in each window are logged as usual; the rest are
+// counted and reported as a single summary line when the window closes.
+type Limiter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	burst   int
+	entries map[string]*entry
+	stop    chan struct{}
+}
+
+type entry struct {
+	count      int
+	suppressed int
+	last       string
+}
+
+func New(window time.Duration, burst int) *Limiter {
+	l := &Limiter{
+		window:  window,
+		burst:   burst,
+		entries: make(map[string]*entry),
+		stop:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *Limiter) Printf(format string, args ...any) {
+	l.mu.Lock()
+	e, ok := l.entries[format]
+	if !ok {
+		e = &entry{}
+		l.entries[format] = e
+	}
+	e.count++
+	if e.count > l.burst {
+		e.suppressed++
+		e.last = fmt.Sprintf(format, args...)
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+
+	log.Printf(format, args...)
+}
+
+func (l *Limiter) run() {
+	ticker := time.NewTicker(l.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-l.stop:
+			l.flush()
+			return
+		}
+	}
+}
+
+func (l *Limiter) flush() {
+	l.mu.Lock()
+	entries := l.entries
+	l.entries = make(map[string]*entry)
+	l.mu.Unlock()
+
+	for _, e := range entries {
+		if e.suppressed > 0 {
+			log.Printf("Suppressed %d similar messages in the last %s, last: %s", e.suppressed, l.window, e.last)
+		}
+	}
+}
+
+func (l *Limiter) Stop() {
+	close(l.stop)
+}
@@ -0,0 +1,160 @@
+// Package health checks the dependencies of a service at startup and gates
+// its readiness on them.
+package health
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// ReadinessCheck verifies one dependency during startup.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Readiness gates /readyz on the startup checks. Once the grace period runs
+// out the service reports ready anyway, flagged as degraded, so a missing
+// optional dependency does not keep it out of rotation forever.
+type Readiness struct {
+	mu       sync.RWMutex
+	ready    bool
+	degraded bool
+	checks   map[string]string
+}
+
+type readinessResponse struct {
+	Status   string            `json:"status"`
+	Degraded bool              `json:"degraded"`
+	Checks   map[string]string `json:"checks,omitempty"`
+}
+
+func NewReadiness() *Readiness {
+	return &Readiness{checks: make(map[string]string)}
+}
+
+// Run retries the pending checks until all pass or grace elapses. Checks
+// run concurrently and never outlive the grace period.
+func (rd *Readiness) Run(parent context.Context, grace time.Duration, checks []ReadinessCheck) {
+	ctx, cancel := context.WithTimeout(parent, grace)
+	defer cancel()
+	pending := checks
+
+	for {
+		failed := make([]bool, len(pending))
+		var wg sync.WaitGroup
+		for i, c := range pending {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				defer cancel()
+
+				status := "ok"
+				if err := c.Check(checkCtx); err != nil {
+					status = err.Error()
+					failed[i] = true
+				}
+				rd.mu.Lock()
+				rd.checks[c.Name] = status
+				rd.mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		var still []ReadinessCheck
+		for i, c := range pending {
+			if failed[i] {
+				still = append(still, c)
+			}
+		}
+		pending = still
+
+		if len(pending) == 0 || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	// Stopped before the grace period ran out: the process is shutting down.
+	if parent.Err() != nil {
+		return
+	}
+
+	rd.mu.Lock()
+	rd.ready = true
+	rd.degraded = len(pending) > 0
+	rd.mu.Unlock()
+
+	if len(pending) > 0 {
+		for _, c := range pending {
+			log.Printf("Readiness check %s still failing after %s, starting in degraded mode", c.Name, grace)
+		}
+		return
+	}
+	log.Printf("All readiness checks passed")
+}
+
+func (rd *Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rd.mu.RLock()
+	resp := readinessResponse{Status: "starting", Degraded: rd.degraded, Checks: make(map[string]string, len(rd.checks))}
+	for name, status := range rd.checks {
+		resp.Checks[name] = status
+	}
+	ready := rd.ready
+	rd.mu.RUnlock()
+
+	statusCode := http.StatusServiceUnavailable
+	if ready {
+		resp.Status = "ready"
+		statusCode = http.StatusOK
+	}
+
+	httpapi.Render(w, statusCode, resp, r.Context())
+}
+
+// GRPCConnCheck waits until conn reaches the Ready state.
+func GRPCConnCheck(conn *grpc.ClientConn) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		conn.Connect()
+		for {
+			state := conn.GetState()
+			if state == connectivity.Ready {
+				return nil
+			}
+			if !conn.WaitForStateChange(ctx, state) {
+				return fmt.Errorf("collector connection is %s", state)
+			}
+		}
+	}
+}
+
+// HTTPReachableCheck succeeds when url answers client with anything below 500.
+func HTTPReachableCheck(client *http.Client, url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,60 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StartupCheck verifies one dependency once at boot. Hard checks guard
+// dependencies the service cannot work without; Hint tells the operator
+// what to look at when the check fails.
+type StartupCheck struct {
+	Name  string
+	Hint  string
+	Hard  bool
+	Check func(ctx context.Context) error
+}
+
+// VerifyStartup runs the checks concurrently, each bounded by timeout, and
+// logs one line per dependency. With strict set, a failed hard check is
+// returned as an error so the service refuses to start.
+func VerifyStartup(ctx context.Context, timeout time.Duration, strict bool, checks []StartupCheck) error {
+	errs := make([]error, len(checks))
+	took := make([]time.Duration, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			errs[i] = c.Check(checkCtx)
+			took[i] = time.Since(start)
+		}()
+	}
+	wg.Wait()
+
+	var hardFailures []string
+	for i, c := range checks {
+		if errs[i] == nil {
+			log.Printf("Startup check %-12s ok (%s)", c.Name, took[i].Round(time.Millisecond))
+			continue
+		}
+		severity := "warning"
+		if c.Hard {
+			severity = "error"
+			hardFailures = append(hardFailures, c.Name)
+		}
+		log.Printf("Startup check %-12s FAILED [%s]: %v; %s", c.Name, severity, errs[i], c.Hint)
+	}
+
+	if len(hardFailures) > 0 && strict {
+		return fmt.Errorf("startup checks failed: %s", strings.Join(hardFailures, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Code    weather.ErrorCode `json:"code"`
+	Message string            `json:"message"`
+	// Details lists the offending fields of a rejected request body.
+	Details []FieldError `json:"details,omitempty"`
+	// RequestID and TraceID find the request in the logs and traces, and
+	// DocsURL documents the code, so that a bug report quoting the
+	// response is actionable as it is. Support is SUPPORT_CONTACT.
+	RequestID string `json:"request_id,omitempty"`
+	TraceID   string `json:"trace_id,omitempty"`
+	DocsURL   string `json:"docs_url"`
+	Support   string `json:"support,omitempty"`
+}
+
+// RespondWithError answers with the status of code and an ErrorResponse,
+// recording the code on the span of the request.
+func RespondWithError(w http.ResponseWriter, code weather.ErrorCode, message string, ctx context.Context) {
+	RespondWithErrorDetails(w, code, message, nil, ctx)
+}
+
+func RespondWithErrorDetails(w http.ResponseWriter, code weather.ErrorCode, message string, details []FieldError, ctx context.Context) {
+	statusCode := code.Status()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("error.code", string(code)))
+	span.AddEvent("error_response", trace.WithAttributes(
+		semconv.HTTPStatusCodeKey.Int(statusCode),
+		attribute.String("error.code", string(code)),
+	))
+
+	resp := ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: middleware.GetReqID(ctx),
+		DocsURL:   errorDocsLink(code, ctx),
+		Support:   optionsFrom(ctx).SupportContact,
+	}
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		resp.TraceID = sc.TraceID().String()
+	}
+	Render(w, statusCode, resp, ctx)
+}
+
+func errorDocsLink(code weather.ErrorCode, ctx context.Context) string {
+	docsURL := optionsFrom(ctx).ErrorDocsURL
+	if docsURL == "" {
+		docsURL = DefaultErrorDocsURL
+	}
+	return strings.ReplaceAll(docsURL, "{code}", string(code))
+}
+
+// HandleErrorCatalog serves the catalog of error codes.
+func HandleErrorCatalog(w http.ResponseWriter, r *http.Request) {
+	Render(w, http.StatusOK, weather.ErrorCatalog, r.Context())
+}
+
+// HandleErrorDefinition serves GET /errors/{code}, the definition of one
+// error code.
+func HandleErrorDefinition(w http.ResponseWriter, r *http.Request) {
+	def, ok := weather.ErrorCode(strings.ToUpper(chi.URLParam(r, "code"))).Definition()
+	if !ok {
+		RespondWithError(w, weather.CodeNotFound, "unknown error code", r.Context())
+		return
+	}
+	Render(w, http.StatusOK, def, r.Context())
+}
@@ -0,0 +1,64 @@
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// supportedLocales are the locales the human-facing formats (HTML and CSV)
+// format numbers for. The first one is used when the request names none
+// of them.
+var supportedLocales = []language.Tag{
+	language.BrazilianPortuguese,
+	language.English,
+	language.Spanish,
+}
+
+var localeMatcher = language.NewMatcher(supportedLocales)
+
+// requestLocale picks the locale for r: ?locale= wins, then the
+// Accept-Language header.
+func requestLocale(r *http.Request) language.Tag {
+	var tags []language.Tag
+	if v := r.URL.Query().Get("locale"); v != "" {
+		if tag, err := language.Parse(v); err == nil {
+			tags = append(tags, tag)
+		}
+	}
+	if accepted, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language")); err == nil {
+		tags = append(tags, accepted...)
+	}
+	_, i, _ := localeMatcher.Match(tags...)
+	return supportedLocales[i]
+}
+
+// localeFormatter formats numbers the way readers in one locale write
+// them, e.g. 28,5 and 1.234 in pt-BR.
+type localeFormatter struct {
+	tag     language.Tag
+	printer *message.Printer
+}
+
+func newLocaleFormatter(tag language.Tag) localeFormatter {
+	return localeFormatter{tag: tag, printer: message.NewPrinter(tag)}
+}
+
+// Decimal formats v with exactly digits fraction digits.
+func (f localeFormatter) Decimal(v float64, digits int) string {
+	return f.printer.Sprint(number.Decimal(v, number.Scale(digits)))
+}
+
+// Number formats v with as many fraction digits as it needs.
+func (f localeFormatter) Number(v float64) string {
+	return f.printer.Sprint(number.Decimal(v))
+}
+
+// CommaDecimal reports whether the locale writes decimals with a comma,
+// in which case CSV fields are separated with semicolons.
+func (f localeFormatter) CommaDecimal() bool {
+	return strings.Contains(f.Number(1.5), ",")
+}
@@ -0,0 +1,44 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+)
+
+// DefaultErrorDocsURL is the ErrorDocsURL of Options that leave it empty:
+// GET /errors/{code} of the service itself.
+const DefaultErrorDocsURL = "/errors/{code}"
+
+// Options are the settings of a service that change how this package
+// decodes requests and answers errors. Middleware applies them to the
+// requests under it; requests outside it get the zero Options.
+type Options struct {
+	// StrictJSON is STRICT_JSON: request bodies are decoded strictly and
+	// every problem with them is reported field by field.
+	StrictJSON bool
+	// ErrorDocsURL is where the docs_url of error responses points, with
+	// {code} replaced by the code; empty means DefaultErrorDocsURL.
+	ErrorDocsURL string
+	// SupportContact, when set, is added to every error response.
+	SupportContact string
+}
+
+type optionsKey struct{}
+
+// WithOptions returns a context under which this package follows o.
+func WithOptions(ctx context.Context, o Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, o)
+}
+
+// Middleware applies o to every request, so handlers and error paths deep
+// in the stack follow the same settings.
+func (o Options) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithOptions(r.Context(), o)))
+	})
+}
+
+func optionsFrom(ctx context.Context) Options {
+	o, _ := ctx.Value(optionsKey{}).(Options)
+	return o
+}
@@ -0,0 +1,476 @@
+// Package httpapi is the HTTP plumbing both services answer through:
+// content negotiation and rendering, error responses, request body
+// decoding, streaming, routing fallbacks and Retry-After.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/text/language"
+)
+
+// templateFiles holds the shared HTML views: the layout, default.html for
+// the response types without a view of their own and the view of
+// ErrorResponse.
+//
+//go:embed templates
+var templateFiles embed.FS
+
+// htmlTemplates is never executed itself: each response runs a clone with
+// the locale functions bound to the reader's locale.
+var htmlTemplates = template.Must(template.New("").Funcs(templateFuncs(newLocaleFormatter(supportedLocales[0]))).ParseFS(templateFiles, "templates/*.html"))
+
+// ParseTemplates adds the HTML views of a service, one per response type,
+// named after the Go type, such as Result.html. They may use the "head"
+// and "foot" templates of the layout. It is meant to be called from init.
+func ParseTemplates(fsys fs.FS, patterns ...string) {
+	template.Must(htmlTemplates.ParseFS(fsys, patterns...))
+}
+
+func templateFuncs(f localeFormatter) template.FuncMap {
+	return template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.MarshalIndent(v, "", "  ")
+			return string(b), err
+		},
+		"lang":    f.tag.String,
+		"decimal": f.Decimal,
+	}
+}
+
+// renderer encodes response bodies in one format.
+type renderer interface {
+	ContentType() string
+	Render(w io.Writer, v any) error
+}
+
+// JSONContentType is the Content-Type of JSON responses.
+const JSONContentType = "application/json; charset=utf-8"
+
+type jsonRenderer struct{}
+
+func (jsonRenderer) ContentType() string { return JSONContentType }
+
+func (jsonRenderer) Render(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// xmlRenderer translates the JSON form of the body into XML under a
+// <response> root, so both formats carry the same names: objects become
+// child elements, list items <item> elements and keys that aren't valid
+// element names <entry key="..."> elements.
+type xmlRenderer struct{}
+
+func (xmlRenderer) ContentType() string { return "application/xml; charset=utf-8" }
+
+func (xmlRenderer) Render(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	if err := jsonToXML(dec, enc, "response"); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// jsonToXML copies the next JSON value of dec to enc as an element.
+func jsonToXML(dec *json.Decoder, enc *xml.Encoder, name string) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !isXMLName(name) {
+		start = xml.StartElement{Name: xml.Name{Local: "entry"}, Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}}}
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		if tok == nil {
+			return enc.EncodeElement("", start)
+		}
+		return enc.EncodeElement(fmt.Sprint(tok), start)
+	}
+
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for dec.More() {
+		child := "item"
+		if delim == '{' {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			child = key.(string)
+		}
+		if err := jsonToXML(dec, enc, child); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	return enc.EncodeToken(start.End())
+}
+
+func isXMLName(s string) bool {
+	for i, c := range s {
+		switch {
+		case c == '_' || unicode.IsLetter(c):
+		case i > 0 && (c == '-' || c == '.' || unicode.IsDigit(c)):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// msgpackRenderer uses the json field names, so both formats carry the
+// same keys.
+type msgpackRenderer struct{}
+
+func (msgpackRenderer) ContentType() string { return "application/msgpack" }
+
+func (msgpackRenderer) Render(w io.Writer, v any) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	return enc.Encode(v)
+}
+
+// localizedRenderer is implemented by the human-facing formats, which
+// write numbers the way the reader's locale does. JSON, XML and
+// msgpack stay machine-formatted.
+type localizedRenderer interface {
+	renderer
+	WithLocale(tag language.Tag) renderer
+}
+
+// htmlRenderer renders the template named after the type of the body, or
+// default.html, which shows it as indented JSON.
+type htmlRenderer struct {
+	locale localeFormatter
+}
+
+func (htmlRenderer) ContentType() string { return "text/html; charset=utf-8" }
+
+func (h htmlRenderer) WithLocale(tag language.Tag) renderer {
+	return htmlRenderer{locale: newLocaleFormatter(tag)}
+}
+
+func (h htmlRenderer) Render(w io.Writer, v any) error {
+	if h.locale.printer == nil {
+		h.locale = newLocaleFormatter(supportedLocales[0])
+	}
+	set, err := htmlTemplates.Clone()
+	if err != nil {
+		return err
+	}
+	set.Funcs(templateFuncs(h.locale))
+	t := set.Lookup(reflect.Indirect(reflect.ValueOf(v)).Type().Name() + ".html")
+	if t == nil {
+		t = set.Lookup("default.html")
+	}
+	return t.Execute(w, v)
+}
+
+// csvRenderer writes a header and one row per object for bodies that are a
+// flat object or a list of flat objects, with the json field names as
+// columns. Other bodies can't be tabulated and fall back to JSON.
+type csvRenderer struct {
+	locale localeFormatter
+}
+
+func (csvRenderer) ContentType() string { return "text/csv; charset=utf-8" }
+
+func (c csvRenderer) WithLocale(tag language.Tag) renderer {
+	return csvRenderer{locale: newLocaleFormatter(tag)}
+}
+
+func (c csvRenderer) Render(w io.Writer, v any) error {
+	if c.locale.printer == nil {
+		c.locale = newLocaleFormatter(supportedLocales[0])
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var header []string
+	var rows [][]string
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		header, rows, err = c.appendRow(dec, header, rows)
+	case json.Delim('['):
+		for dec.More() && err == nil {
+			if tok, err = dec.Token(); err == nil && tok != json.Delim('{') {
+				err = fmt.Errorf("csv: list items must be objects")
+			}
+			if err == nil {
+				header, rows, err = c.appendRow(dec, header, rows)
+			}
+		}
+	default:
+		err = fmt.Errorf("csv: body must be an object or a list of objects")
+	}
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	if c.locale.CommaDecimal() {
+		cw.Comma = ';'
+	}
+	cw.Write(header)
+	for _, row := range rows {
+		// Objects of a list may omit fields; pad them to the header.
+		cw.Write(append(row, make([]string, len(header)-len(row))...))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// appendRow reads the rest of a flat object from dec as a row, adding the
+// columns the header doesn't have yet.
+func (c csvRenderer) appendRow(dec *json.Decoder, header []string, rows [][]string) ([]string, [][]string, error) {
+	row := make([]string, len(header))
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		var field string
+		switch tok := tok.(type) {
+		case json.Delim:
+			return nil, nil, fmt.Errorf("csv: field %q is not a scalar", key)
+		case json.Number:
+			f, err := tok.Float64()
+			if err != nil {
+				return nil, nil, err
+			}
+			field = c.locale.Number(f)
+		case nil:
+		default:
+			field = fmt.Sprint(tok)
+		}
+		col := slices.Index(header, key.(string))
+		if col < 0 {
+			header = append(header, key.(string))
+			row = append(row, "")
+			col = len(header) - 1
+		}
+		row[col] = field
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, nil, err
+	}
+	return header, append(rows, row), nil
+}
+
+// renderFormats maps the ?format= values, and mediaRenderers the Accept
+// media types, to renderers.
+var (
+	renderFormats = map[string]renderer{
+		"json":    jsonRenderer{},
+		"xml":     xmlRenderer{},
+		"msgpack": msgpackRenderer{},
+		"html":    htmlRenderer{},
+		"csv":     csvRenderer{},
+	}
+	mediaRenderers = map[string]renderer{
+		"application/json":      jsonRenderer{},
+		"application/xml":       xmlRenderer{},
+		"text/xml":              xmlRenderer{},
+		"application/msgpack":   msgpackRenderer{},
+		"application/x-msgpack": msgpackRenderer{},
+		"text/html":             htmlRenderer{},
+		"text/csv":              csvRenderer{},
+	}
+)
+
+// negotiateRenderer picks the renderer for r: ?format= wins, then the
+// most preferred supported type in Accept, then JSON.
+func negotiateRenderer(r *http.Request) renderer {
+	if f, ok := renderFormats[r.URL.Query().Get("format")]; ok {
+		return f
+	}
+
+	type accepted struct {
+		media string
+		q     float64
+	}
+	var prefs []accepted
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		media, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		prefs = append(prefs, accepted{media, q})
+	}
+	slices.SortStableFunc(prefs, func(a, b accepted) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		}
+		return 0
+	})
+	for _, p := range prefs {
+		if p.q <= 0 {
+			continue
+		}
+		if rd, ok := mediaRenderers[p.media]; ok {
+			return rd
+		}
+		if p.media == "*/*" || p.media == "application/*" {
+			break
+		}
+	}
+	return jsonRenderer{}
+}
+
+type rendererKey struct{}
+
+// RenderMiddleware negotiates the response format once per request, so
+// handlers and error paths deep in the stack answer in the same one. The
+// human-facing formats also get the locale of the request.
+func RenderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		rd := negotiateRenderer(r)
+		if lr, ok := rd.(localizedRenderer); ok {
+			w.Header().Add("Vary", "Accept-Language")
+			rd = lr.WithLocale(requestLocale(r))
+		}
+		ctx := context.WithValue(r.Context(), rendererKey{}, rd)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func rendererFrom(ctx context.Context) renderer {
+	if rd, ok := ctx.Value(rendererKey{}).(renderer); ok {
+		return rd
+	}
+	return jsonRenderer{}
+}
+
+type renderObserverKey struct{}
+
+// WithRenderObserver returns a context under which Render also hands every
+// body it writes to observe, before encoding, so middleware can inspect
+// responses whatever their format.
+func WithRenderObserver(ctx context.Context, observe func(statusCode int, v any)) context.Context {
+	return context.WithValue(ctx, renderObserverKey{}, observe)
+}
+
+// Render writes v with the status code in the format negotiated for the
+// request. Should a format fail to encode the body, it is sent as JSON.
+func Render(w http.ResponseWriter, statusCode int, v any, ctx context.Context) {
+	rd, body, ok := encodeResponse(w, statusCode, v, ctx)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", rd.ContentType())
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// RenderCacheable writes v with status 200, as Render does, for caches to
+// keep as cacheControl says; an empty cacheControl sends no Cache-Control.
+// The ETag hashes the encoded body, so a GET or HEAD whose If-None-Match
+// names it is answered 304, without the body.
+func RenderCacheable(w http.ResponseWriter, r *http.Request, v any, cacheControl string, ctx context.Context) {
+	rd, body, ok := encodeResponse(w, http.StatusOK, v, ctx)
+	if !ok {
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"%x"`, sum[:12])
+	h := w.Header()
+	h.Set("ETag", etag)
+	if cacheControl != "" {
+		h.Set("Cache-Control", cacheControl)
+	}
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", rd.ContentType())
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// etagMatches reports whether an If-None-Match header names etag. The
+// comparison is weak: the compression middleware sends the ETag of a
+// compressed body as W/"...".
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeResponse encodes v in the format negotiated for the request, or
+// in JSON should that format fail. When JSON fails too, it answers 500
+// itself and returns false.
+func encodeResponse(w http.ResponseWriter, statusCode int, v any, ctx context.Context) (renderer, []byte, bool) {
+	if observe, ok := ctx.Value(renderObserverKey{}).(func(int, any)); ok {
+		observe(statusCode, v)
+	}
+	rd := rendererFrom(ctx)
+	var buf bytes.Buffer
+	if err := rd.Render(&buf, v); err != nil {
+		rd = jsonRenderer{}
+		buf.Reset()
+		if err := rd.Render(&buf, v); err != nil {
+			errlog.Printf("Error encoding response: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return nil, nil, false
+		}
+	}
+	return rd, buf.Bytes(), true
+}
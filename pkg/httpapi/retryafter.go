@@ -0,0 +1,54 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryAfterError tells how long to wait before an operation that failed
+// with err is worth trying again.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// WithRetryAfter attaches a retry delay to err.
+func WithRetryAfter(err error, after time.Duration) error {
+	return &retryAfterError{err: err, after: after}
+}
+
+// RetryAfterOf returns the retry delay attached to err, or zero.
+func RetryAfterOf(err error) time.Duration {
+	var e *retryAfterError
+	if errors.As(err, &e) {
+		return e.after
+	}
+	return 0
+}
+
+// SetRetryAfter sets the Retry-After header to d rounded up to whole
+// seconds, never below one.
+func SetRetryAfter(w http.ResponseWriter, d time.Duration) {
+	secs := max(1, int64((d+time.Second-1)/time.Second))
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+}
+
+// ParseRetryAfter reads a Retry-After header in either of its forms,
+// delay-seconds or an HTTP date. It returns zero when absent or invalid.
+func ParseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return max(0, time.Duration(secs)*time.Second)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(0, time.Until(t))
+	}
+	return 0
+}
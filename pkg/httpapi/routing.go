@@ -0,0 +1,78 @@
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// routableMethods are the methods probed when working out what a path
+// accepts.
+var routableMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// allowedMethods lists the methods routes serves for path. HEAD is implied
+// by GET and OPTIONS by any route at all.
+func allowedMethods(routes chi.Routes, path string) []string {
+	var allowed []string
+	for _, m := range routableMethods {
+		if !routes.Match(chi.NewRouteContext(), m, path) {
+			continue
+		}
+		allowed = append(allowed, m)
+		if m == http.MethodGet {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	if len(allowed) > 0 {
+		allowed = append(allowed, http.MethodOptions)
+	}
+	return allowed
+}
+
+func routingPath(r *http.Request) string {
+	if r.URL.RawPath != "" {
+		return r.URL.RawPath
+	}
+	return r.URL.Path
+}
+
+func HandleNotFound(w http.ResponseWriter, r *http.Request) {
+	RespondWithError(w, weather.CodeNotFound, "not found", r.Context())
+}
+
+// MethodNotAllowedHandler answers 405 with the Allow header chi's default
+// handler would have set.
+func MethodNotAllowedHandler(routes chi.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(routes, routingPath(r)), ", "))
+		RespondWithError(w, weather.CodeMethodNotAllowed, "method not allowed", r.Context())
+	}
+}
+
+// OptionsMiddleware answers OPTIONS requests with the methods routes
+// accepts for the path.
+func OptionsMiddleware(routes chi.Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			allowed := allowedMethods(routes, routingPath(r))
+			if len(allowed) == 0 {
+				HandleNotFound(w, r)
+				return
+			}
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// streamFlushBytes and streamFlushInterval bound how much of a streamed
+	// response waits in the buffers of the server before it is flushed to
+	// the client: whichever is reached first.
+	streamFlushBytes    = 32 << 10
+	streamFlushInterval = 250 * time.Millisecond
+)
+
+// ResponseStream writes a large response item by item as the items are
+// produced, rather than encoding it whole into memory first, and flushes
+// it periodically so the client sees progress. Once started, the status
+// is sent: an error past that point can only cut the response short.
+type ResponseStream struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	pending int
+	flushed time.Time
+	err     error
+}
+
+// NewResponseStream sends the header of a response of contentType.
+func NewResponseStream(w http.ResponseWriter, status int, contentType string) *ResponseStream {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	return &ResponseStream{w: w, rc: http.NewResponseController(w), flushed: time.Now()}
+}
+
+// StreamsJSON reports whether the format negotiated for the response is
+// JSON, which large responses are streamed in. The other formats are
+// rendered whole.
+func StreamsJSON(ctx context.Context) bool {
+	_, ok := rendererFrom(ctx).(jsonRenderer)
+	return ok
+}
+
+// Raw writes literal JSON, such as the brackets around streamed items.
+func (s *ResponseStream) Raw(b []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	n, err := s.w.Write(b)
+	s.pending += n
+	if err != nil {
+		s.err = err
+		return err
+	}
+	if s.pending >= streamFlushBytes || time.Since(s.flushed) >= streamFlushInterval {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Encode writes v as one line of NDJSON.
+func (s *ResponseStream) Encode(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Raw(append(b, '\n'))
+}
+
+// EncodeWithArray writes v, a JSON object, with the n items returned by
+// item streamed into its array under key, which must be empty in v. Only
+// one item is encoded in memory at a time.
+func (s *ResponseStream) EncodeWithArray(v any, key string, n int, item func(i int) any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// Quotes inside strings are escaped, so the marker can only be the key.
+	marker := []byte(`"` + key + `":[`)
+	head, tail, ok := bytes.Cut(b, append(marker, ']'))
+	if !ok {
+		return fmt.Errorf("no empty %q array to stream into", key)
+	}
+	if err := s.Raw(append(head, marker...)); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		ib, err := json.Marshal(item(i))
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			ib = append([]byte{','}, ib...)
+		}
+		if err := s.Raw(ib); err != nil {
+			return err
+		}
+	}
+	return s.Raw(append(append([]byte{']'}, tail...), '\n'))
+}
+
+// Flush sends what has been written so far. Writers that can't flush
+// leave it to the server, which sends the rest as its buffers fill.
+func (s *ResponseStream) Flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	s.pending, s.flushed = 0, time.Now()
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.err = err
+	}
+	return s.err
+}
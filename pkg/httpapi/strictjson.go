@@ -0,0 +1,237 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// FieldError is one problem with a request body. Field is empty when the
+// problem is with the body as a whole.
+type FieldError struct {
+	Field  string `json:"field,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// requestBodyError lists everything wrong with a body decoded strictly.
+type requestBodyError struct {
+	fields []FieldError
+}
+
+func (e *requestBodyError) Error() string {
+	parts := make([]string, len(e.fields))
+	for i, f := range e.fields {
+		parts[i] = f.Reason
+		if f.Field != "" {
+			parts[i] = f.Field + " " + f.Reason
+		}
+	}
+	return "invalid request body: " + strings.Join(parts, "; ")
+}
+
+// ErrNotJSON is returned by DecodeRequest for bodies not sent as JSON.
+var ErrNotJSON = errors.New("Content-Type must be application/json")
+
+const (
+	// MaxRequestBodyBytes bounds the bodies DecodeRequest reads, past which
+	// it fails with an *http.MaxBytesError. A job of JOB_MAX_CEPS CEPs, the
+	// largest body a client has a reason to send, is well under it.
+	MaxRequestBodyBytes = 1 << 20
+	// MaxRequestBodyDepth bounds how deeply a body may nest arrays and
+	// objects. Request bodies are flat; encoding/json alone would follow
+	// 10000 levels.
+	MaxRequestBodyDepth = 32
+)
+
+// ErrBodyTooDeep is returned by DecodeRequest for bodies nested deeper than
+// MaxRequestBodyDepth.
+var ErrBodyTooDeep = fmt.Errorf("request body is nested deeper than %d levels", MaxRequestBodyDepth)
+
+// DecodeRequest decodes the JSON body of r into v, a pointer to a struct.
+// The body must be sent as application/json, or ErrNotJSON is returned.
+// By default it is as lenient as encoding/json. When the Options of r ask
+// for StrictJSON the body must be a single object whose fields all exist
+// in v, under their exact names, with values of the right JSON type and no
+// nulls; otherwise it returns a *requestBodyError listing every offending
+// field. Either way the body is refused past MaxRequestBodyBytes or
+// MaxRequestBodyDepth.
+func DecodeRequest(r *http.Request, v any) error {
+	if !isJSONContentType(r.Header.Get("Content-Type")) {
+		return ErrNotJSON
+	}
+	body, err := readRequestBody(r.Body)
+	if err != nil {
+		return err
+	}
+	if !optionsFrom(r.Context()).StrictJSON {
+		return json.NewDecoder(bytes.NewReader(body)).Decode(v)
+	}
+	return decodeStrict(body, v)
+}
+
+// readRequestBody reads body whole, up to MaxRequestBodyBytes, and checks
+// its nesting before anything decodes it.
+func readRequestBody(body io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(body, MaxRequestBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxRequestBodyBytes {
+		return nil, &http.MaxBytesError{Limit: MaxRequestBodyBytes}
+	}
+	if jsonDepthExceeds(b, MaxRequestBodyDepth) {
+		return nil, ErrBodyTooDeep
+	}
+	return b, nil
+}
+
+// jsonDepthExceeds reports whether the arrays and objects of b, which
+// needn't be valid JSON, nest deeper than limit. Brackets within strings
+// don't count.
+func jsonDepthExceeds(b []byte, limit int) bool {
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range b {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > limit {
+				return true
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return false
+}
+
+// isJSONContentType reports whether header names JSON in UTF-8:
+// application/json or a +json type such as application/merge-patch+json,
+// in any case, with no charset or a UTF-8 one.
+func isJSONContentType(header string) bool {
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	if mediaType != "application/json" && !(strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")) {
+		return false
+	}
+	charset, ok := params["charset"]
+	return !ok || strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "utf8")
+}
+
+func decodeStrict(body []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var raw map[string]json.RawMessage
+	if err := dec.Decode(&raw); err != nil || raw == nil {
+		return &requestBodyError{fields: []FieldError{{Reason: "must be a JSON object"}}}
+	}
+
+	var fields []FieldError
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		fields = append(fields, FieldError{Reason: "must hold a single JSON object"})
+	}
+	target := reflect.ValueOf(v).Elem()
+	known := jsonFieldIndexes(target.Type())
+	for _, name := range slices.Sorted(maps.Keys(raw)) {
+		i, ok := known[name]
+		switch {
+		case !ok:
+			fields = append(fields, FieldError{Field: name, Reason: "is not a known field"})
+		case bytes.Equal(bytes.TrimSpace(raw[name]), []byte("null")):
+			fields = append(fields, FieldError{Field: name, Reason: "must not be null"})
+		default:
+			f := target.Field(i)
+			if err := json.Unmarshal(raw[name], f.Addr().Interface()); err != nil {
+				fields = append(fields, FieldError{Field: name, Reason: "must be " + jsonTypeName(f.Type())})
+			}
+		}
+	}
+	if len(fields) > 0 {
+		return &requestBodyError{fields: fields}
+	}
+	return nil
+}
+
+// jsonFieldIndexes maps the JSON names of the exported fields of struct
+// type t to their index.
+func jsonFieldIndexes(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+// jsonTypeName describes the JSON values t decodes from.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		elem := jsonTypeName(t.Elem())
+		_, noun, _ := strings.Cut(elem, " ")
+		return "an array of " + noun + "s"
+	default:
+		return "an object"
+	}
+}
+
+// RespondWithDecodeError answers a body DecodeRequest rejected: with 415
+// when it isn't JSON, with 413 when it is past the size limit, with every
+// offending field under STRICT_JSON, else with code and message.
+func RespondWithDecodeError(w http.ResponseWriter, err error, code weather.ErrorCode, message string, ctx context.Context) {
+	if errors.Is(err, ErrNotJSON) {
+		RespondWithError(w, weather.CodeUnsupportedMediaType, err.Error(), ctx)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		RespondWithError(w, weather.CodePayloadTooLarge, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit), ctx)
+		return
+	}
+	var bodyErr *requestBodyError
+	if errors.As(err, &bodyErr) {
+		RespondWithErrorDetails(w, weather.CodeInvalidRequest, "invalid request body", bodyErr.fields, ctx)
+		return
+	}
+	RespondWithError(w, code, message, ctx)
+}
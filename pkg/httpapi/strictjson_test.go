@@ -0,0 +1,90 @@
+package httpapi
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+func FuzzDecodeRequest(f *testing.F) {
+	for _, body := range []string{
+		`{"cep": "01001000"}`,
+		`{"city": "São Paulo"}`,
+		`{"cep": "01001000", "extra": [1, {"a": null}]}`,
+		`{"cep": null}`,
+		`{"cep": 1001000}`,
+		`{"cep": "٠١٠٠١٠٠٠"}`,
+		`{"cep": "0\ud800"}`,
+		`{"ceps": ["01001000", "20040020"]}`,
+		`{"cep": "01001000"} {"cep": "20040020"}`,
+		`{"cep": "[[[[{{{{"}`,
+		`[]`, `null`, `"01001000"`, `{`, "\xff\xfe{}", ``,
+		strings.Repeat("[", 100000),
+		strings.Repeat(`{"a":`, MaxRequestBodyDepth) + `1` + strings.Repeat(`}`, MaxRequestBodyDepth),
+		`{"cep": "` + strings.Repeat("0", MaxRequestBodyBytes) + `"}`,
+	} {
+		f.Add([]byte(body), false)
+		f.Add([]byte(body), true)
+	}
+	f.Fuzz(func(t *testing.T, body []byte, strict bool) {
+		opts := Options{StrictJSON: strict}
+
+		var loc weather.Location
+		err := DecodeRequest(withOptions(jsonRequest(body), opts), &loc)
+		checkDecodeLimits(t, body, err)
+		var list struct {
+			Ceps []string `json:"ceps"`
+		}
+		err = DecodeRequest(withOptions(jsonRequest(body), opts), &list)
+		checkDecodeLimits(t, body, err)
+	})
+}
+
+func TestDecodeRequestLimits(t *testing.T) {
+	var tooLarge *http.MaxBytesError
+	var loc weather.Location
+	body := []byte(`{"cep": "` + strings.Repeat("0", MaxRequestBodyBytes) + `"}`)
+	if err := DecodeRequest(jsonRequest(body), &loc); !errors.As(err, &tooLarge) {
+		t.Errorf("DecodeRequest of %d bytes = %v, want *http.MaxBytesError", len(body), err)
+	}
+
+	deep := strings.Repeat(`{"a":`, MaxRequestBodyDepth+1) + `1` + strings.Repeat(`}`, MaxRequestBodyDepth+1)
+	if err := DecodeRequest(jsonRequest([]byte(deep)), &loc); !errors.Is(err, ErrBodyTooDeep) {
+		t.Errorf("DecodeRequest nested %d levels = %v, want ErrBodyTooDeep", MaxRequestBodyDepth+1, err)
+	}
+
+	brackets := []byte(`{"city": "` + strings.Repeat("[", 1000) + `"}`)
+	if err := DecodeRequest(jsonRequest(brackets), &loc); err != nil {
+		t.Errorf("DecodeRequest with brackets in a string = %v, want nil", err)
+	}
+}
+
+func jsonRequest(body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func withOptions(r *http.Request, o Options) *http.Request {
+	return r.WithContext(WithOptions(r.Context(), o))
+}
+
+// checkDecodeLimits fails t when DecodeRequest accepted a body past its
+// limits.
+func checkDecodeLimits(t *testing.T, body []byte, err error) {
+	t.Helper()
+	if err != nil {
+		return
+	}
+	if len(body) > MaxRequestBodyBytes {
+		t.Fatalf("DecodeRequest accepted a body of %d bytes", len(body))
+	}
+	if jsonDepthExceeds(body, MaxRequestBodyDepth) {
+		t.Fatalf("DecodeRequest accepted a body nested deeper than %d levels", MaxRequestBodyDepth)
+	}
+}
@@ -0,0 +1,266 @@
+// Package idempotency replays the response of a request to its retries:
+// those carrying the same Idempotency-Key and, for deduplication, the
+// identical requests of the same caller.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentResponse is the stored outcome of the first request made with
+// a key. done is closed once it is filled in.
+type idempotentResponse struct {
+	done        chan struct{}
+	fingerprint [32]byte
+	expiresAt   time.Time
+
+	status int
+	header http.Header
+	body   []byte
+	stored bool
+}
+
+// Store replays the response of the first request for every
+// later request carrying the same Idempotency-Key within ttl, so a client
+// retrying after a network blip doesn't trigger another upstream call.
+// Reusing a key with a different request, as told by its fingerprint, is
+// rejected with 422, and 5xx and 304 responses are not kept; see complete.
+type Store struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+	ttl     time.Duration
+	maxKeys int
+	caller  func(r *http.Request) string
+}
+
+// New returns a Store keeping up to maxKeys responses for ttl. Keys are
+// chosen by clients, so two clients may well pick the same one: caller
+// names who sent a request, such as its tenant or client address, and
+// keeps the keys of different callers apart.
+func New(ttl time.Duration, maxKeys int, caller func(r *http.Request) string) *Store {
+	return &Store{entries: make(map[string]*idempotentResponse), ttl: ttl, maxKeys: maxKeys, caller: caller}
+}
+
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || s.ttl <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		s.serve(w, r, next, s.caller(r)+" "+r.Method+" "+r.URL.Path+" "+key, fingerprint(r, body), "idempotency.replayed")
+	})
+}
+
+// DedupMiddleware applies the same replay to identical requests from the
+// same caller that carry no Idempotency-Key, keyed by the caller, route and
+// fingerprint of the request. Concurrent duplicates share the in-flight
+// result and later ones get it until the window closes. Conditional
+// requests are left alone: their answer depends on what the client
+// already holds, not only on the request.
+func (s *Store) DedupMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.ttl <= 0 || r.Header.Get(idempotencyKeyHeader) != "" || conditional(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		fp := fingerprint(r, body)
+		s.serve(w, r, next, fmt.Sprintf("%s %s %s %x", s.caller(r), r.Method, r.URL.Path, fp), fp, "dedup.replayed")
+	})
+}
+
+// representationHeaders choose the representation of a response, so
+// requests that differ in them are not the same request.
+var representationHeaders = []string{"Accept", "Accept-Language"}
+
+// fingerprint identifies a request by its query, the headers that choose
+// the representation of its response and its body.
+func fingerprint(r *http.Request, body []byte) [32]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", r.URL.RawQuery)
+	for _, name := range representationHeaders {
+		fmt.Fprintf(h, "%q\n", r.Header.Values(name))
+	}
+	h.Write(body)
+	return [32]byte(h.Sum(nil))
+}
+
+// conditional reports whether r asks to be answered 304 when the client's
+// copy is current.
+func conditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// readBody buffers the request body so it can be fingerprinted and still
+// be read by the handler. It stops at the size limit of
+// httpapi.DecodeRequest, so that a replayable request can't make the server
+// buffer more than any other; larger bodies are answered 413.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, httpapi.MaxRequestBodyBytes))
+	if err != nil {
+		httpapi.RespondWithDecodeError(w, err, weather.CodeBadRequest, "error reading request body", r.Context())
+		return nil, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// serve runs next for the first request under key and replays its
+// response to the others with the same fingerprint, marking them with
+// replayedAttr on the span.
+func (s *Store) serve(w http.ResponseWriter, r *http.Request, next http.Handler, key string, fp [32]byte, replayedAttr string) {
+	var entry *idempotentResponse
+	for {
+		var first bool
+		entry, first = s.claim(key, fp)
+		if first {
+			break
+		}
+		if entry.fingerprint != fp {
+			httpapi.RespondWithError(w, weather.CodeIdempotencyKeyReused, "idempotency key reused with a different request", r.Context())
+			return
+		}
+		select {
+		case <-entry.done:
+		case <-r.Context().Done():
+			httpapi.RespondWithError(w, weather.CodeUpstreamTimeout, "request timeout", r.Context())
+			return
+		}
+		if entry.stored {
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.Bool(replayedAttr, true))
+			for k, v := range entry.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+		// The earlier attempt failed and was not kept; try to run this one.
+	}
+
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		// A handler that panics leaves nothing to replay: the requests
+		// waiting on it run again, and the panic goes on to the recoverer.
+		if p := recover(); p != nil {
+			s.drop(key, entry)
+			panic(p)
+		}
+	}()
+	next.ServeHTTP(rec, r)
+	s.complete(key, entry, rec)
+}
+
+// claim returns the entry for key and whether the caller created it and
+// must therefore complete it.
+func (s *Store) claim(key string, fp [32]byte) (*idempotentResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expiresAt) {
+		return entry, false
+	}
+	if len(s.entries) >= s.maxKeys {
+		for k, entry := range s.entries {
+			if now.After(entry.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+	}
+
+	entry := &idempotentResponse{done: make(chan struct{}), fingerprint: fp, expiresAt: now.Add(s.ttl)}
+	if len(s.entries) < s.maxKeys {
+		s.entries[key] = entry
+	}
+	return entry, true
+}
+
+// complete stores the response of entry, but for 5xx responses, so that a
+// retry can still succeed, and 304 responses, which only mean something to
+// the client holding the validators.
+func (s *Store) complete(key string, entry *idempotentResponse, rec *responseRecorder) {
+	if rec.status >= http.StatusInternalServerError || rec.status == http.StatusNotModified {
+		s.drop(key, entry)
+		return
+	}
+	s.mu.Lock()
+	entry.status = rec.status
+	entry.header = rec.header
+	if entry.header == nil {
+		entry.header = rec.Header().Clone()
+	}
+	entry.body = rec.body.Bytes()
+	entry.stored = true
+	s.mu.Unlock()
+	close(entry.done)
+}
+
+// drop forgets entry, unless key has been claimed again since, and lets
+// the requests waiting on it run themselves.
+func (s *Store) drop(key string, entry *idempotentResponse) {
+	s.mu.Lock()
+	if s.entries[key] == entry {
+		delete(s.entries, key)
+	}
+	s.mu.Unlock()
+	close(entry.done)
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+// as the handler wrote it. The header is taken when the handler sends it,
+// before the middleware further out, such as compression, rewrite it for
+// the body they encode: the copy is the plain body, and a replay goes back
+// through them to be encoded for the client asking.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	header      http.Header
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader && status >= http.StatusOK {
+		r.wroteHeader = true
+		r.status = status
+		r.header = r.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets streamed responses flush through the recorder.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,256 @@
+package idempotency
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/compression"
+)
+
+func TestReplayThroughCompression(t *testing.T) {
+	const want = `{"city":"São Paulo","temp_C":21.5,"temp_F":70.7,"temp_K":294.5}`
+	calls := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(want))
+	})
+	store := New(time.Minute, 10, func(*http.Request) string { return "client 192.0.2.1" })
+	h := compression.Middleware(compression.Config{Encodings: []string{"gzip"}, GzipLevel: 6})(store.Middleware(handler))
+
+	for i, acceptEncoding := range []string{"gzip", "gzip", ""} {
+		req := httptest.NewRequest(http.MethodPost, "/cep", strings.NewReader(`{"cep":"01001000"}`))
+		req.Header.Set("Idempotency-Key", "k1")
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, http.StatusOK)
+		}
+		if got := rec.Header().Get("Idempotent-Replayed"); (got == "true") != (i > 0) {
+			t.Errorf("request %d: Idempotent-Replayed = %q", i, got)
+		}
+		var body io.Reader = rec.Body
+		wantETag := `"v1"`
+		if acceptEncoding == "gzip" {
+			if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("request %d: Content-Encoding = %q, want gzip", i, got)
+			}
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("request %d: body is not gzip: %v", i, err)
+			}
+			body = zr
+			wantETag = `W/"v1"`
+		} else if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("request %d: Content-Encoding = %q on a request that accepts none", i, got)
+		}
+		if got := rec.Header().Get("ETag"); got != wantETag {
+			t.Errorf("request %d: ETag = %q, want %q", i, got, wantETag)
+		}
+		got, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("request %d: reading body: %v", i, err)
+		}
+		if string(got) != want {
+			t.Errorf("request %d: body = %q, want %q", i, got, want)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestPanicReleasesKey(t *testing.T) {
+	calls := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		w.Write([]byte("ok"))
+	})
+	h := New(time.Minute, 10, func(*http.Request) string { return "client 192.0.2.1" }).Middleware(handler)
+	request := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/cep", strings.NewReader(`{"cep":"01001000"}`))
+		req.Header.Set("Idempotency-Key", "k1")
+		return req
+	}
+
+	func() {
+		defer func() {
+			if p := recover(); p != "handler failed" {
+				t.Errorf("recovered %v, want the handler's panic", p)
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), request())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, request().WithContext(ctx))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("retry after a panic: status = %d, body = %q; want 200 ok", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Idempotent-Replayed"); got != "" {
+		t.Errorf("Idempotent-Replayed = %q on a request that ran", got)
+	}
+}
+
+// countingHandler answers with the query and representation headers of
+// each request, counting the calls.
+func countingHandler(calls *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(r.URL.RawQuery + " " + r.Header.Get("Accept") + " " + r.Header.Get("Accept-Language")))
+	})
+}
+
+func TestDedupKeepsRepresentationsApart(t *testing.T) {
+	tests := []struct {
+		name       string
+		change     func(r *http.Request)
+		wantCalls  int
+		wantReplay bool
+	}{
+		{"identical", func(*http.Request) {}, 1, true},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "format=xml" }, 2, false},
+		{"accept", func(r *http.Request) { r.Header.Set("Accept", "text/html") }, 2, false},
+		{"accept-language", func(r *http.Request) { r.Header.Set("Accept-Language", "en") }, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			h := New(time.Minute, 10, func(*http.Request) string { return "client 192.0.2.1" }).DedupMiddleware(countingHandler(&calls))
+			request := func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/cep/01001000?format=json", nil)
+				req.Header.Set("Accept", "application/json")
+				req.Header.Set("Accept-Language", "pt-BR")
+				return req
+			}
+
+			first := httptest.NewRecorder()
+			h.ServeHTTP(first, request())
+			req := request()
+			tt.change(req)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if calls != tt.wantCalls {
+				t.Errorf("handler called %d times, want %d", calls, tt.wantCalls)
+			}
+			if got := rec.Header().Get("Idempotent-Replayed") == "true"; got != tt.wantReplay {
+				t.Errorf("replayed = %v, want %v", got, tt.wantReplay)
+			}
+			if want := req.URL.RawQuery + " " + req.Header.Get("Accept") + " " + req.Header.Get("Accept-Language"); rec.Body.String() != want {
+				t.Errorf("body = %q, want %q", rec.Body, want)
+			}
+		})
+	}
+}
+
+func TestDedupSkipsConditionalRequests(t *testing.T) {
+	for _, header := range []string{"If-None-Match", "If-Modified-Since"} {
+		t.Run(header, func(t *testing.T) {
+			calls := 0
+			h := New(time.Minute, 10, func(*http.Request) string { return "client 192.0.2.1" }).DedupMiddleware(countingHandler(&calls))
+
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cep/01001000", nil))
+			req := httptest.NewRequest(http.MethodGet, "/cep/01001000", nil)
+			req.Header.Set(header, `"v0"`)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if calls != 2 {
+				t.Errorf("handler called %d times, want 2", calls)
+			}
+			if got := rec.Header().Get("Idempotent-Replayed"); got != "" {
+				t.Errorf("Idempotent-Replayed = %q on a conditional request", got)
+			}
+		})
+	}
+}
+
+func TestNotModifiedIsNotStored(t *testing.T) {
+	calls := 0
+	h := New(time.Minute, 10, func(*http.Request) string { return "client 192.0.2.1" }).Middleware(countingHandler(&calls))
+	request := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/cep", strings.NewReader(`{"cep":"01001000"}`))
+		req.Header.Set("Idempotency-Key", "k1")
+		return req
+	}
+
+	conditional := request()
+	conditional.Header.Set("If-None-Match", `"v1"`)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, conditional)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("conditional request: status = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, request())
+	if rec.Code != http.StatusOK {
+		t.Errorf("retry: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Idempotent-Replayed"); got != "" {
+		t.Errorf("Idempotent-Replayed = %q after a 304", got)
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want 2", calls)
+	}
+}
+
+func TestKeyReusedForAnotherRepresentation(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(r *http.Request)
+	}{
+		{"query", func(r *http.Request) { r.URL.RawQuery = "format=xml" }},
+		{"accept", func(r *http.Request) { r.Header.Set("Accept", "text/html") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			h := New(time.Minute, 10, func(*http.Request) string { return "client 192.0.2.1" }).Middleware(countingHandler(&calls))
+			request := func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/cep?format=json", strings.NewReader(`{"cep":"01001000"}`))
+				req.Header.Set("Idempotency-Key", "k1")
+				req.Header.Set("Accept", "application/json")
+				return req
+			}
+
+			h.ServeHTTP(httptest.NewRecorder(), request())
+			retry := request()
+			tt.change(retry)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, retry)
+
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+			}
+			if got := rec.Header().Get("Idempotent-Replayed"); got != "" {
+				t.Errorf("Idempotent-Replayed = %q for another representation", got)
+			}
+			if calls != 1 {
+				t.Errorf("handler called %d times, want 1", calls)
+			}
+		})
+	}
+}
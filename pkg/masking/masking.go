@@ -0,0 +1,97 @@
+// Package masking masks CEPs before they leave the process: in logs, span
+// attributes and events, and stored records. The exact value is only ever
+// used in memory for the lookup itself.
+package masking
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Mode is how CEPs are masked, set by CEP_MASKING.
+type Mode string
+
+const (
+	// None leaves CEPs as they are.
+	None Mode = "none"
+	// Truncate keeps the first five digits, the region, and masks the rest.
+	Truncate Mode = "truncate"
+	// Hash replaces a CEP with a keyed hash of it.
+	Hash Mode = "hash"
+)
+
+// MinHashSaltLen is the shortest CEP_HASH_SALT hash mode accepts. There
+// are only 10^8 CEPs: whoever knows the key can hash them all and reverse
+// any masked CEP, so the key must be long enough not to be guessed.
+const MinHashSaltLen = 16
+
+// Masker masks CEPs in one mode. A nil *Masker leaves them as they are.
+type Masker struct {
+	mode Mode
+	salt string
+}
+
+// New returns the Masker of mode. An unknown mode, or hash mode without a
+// salt of at least MinHashSaltLen bytes, is an error: masking that
+// silently does something else is no masking.
+func New(mode, salt string) (*Masker, error) {
+	switch Mode(mode) {
+	case None, Truncate:
+	case Hash:
+		if len(salt) < MinHashSaltLen {
+			return nil, fmt.Errorf("CEP_MASKING=hash needs a CEP_HASH_SALT of at least %d bytes", MinHashSaltLen)
+		}
+	default:
+		return nil, fmt.Errorf("unknown CEP_MASKING mode %q: want %s, %s or %s", mode, None, Truncate, Hash)
+	}
+	return &Masker{mode: Mode(mode), salt: salt}, nil
+}
+
+// Mode returns the mode of m.
+func (m *Masker) Mode() Mode {
+	if m == nil {
+		return None
+	}
+	return m.mode
+}
+
+// Lossy reports whether different CEPs may mask to the same value, as
+// they do when truncated, or can't be told apart from the masked value
+// without the key, as when hashed.
+func (m *Masker) Lossy() bool {
+	return m.Mode() != None
+}
+
+// Cep returns the representation of cep that may leave the process.
+func (m *Masker) Cep(cep string) string {
+	switch m.Mode() {
+	case Truncate:
+		if len(cep) <= 5 {
+			return "*****"
+		}
+		return cep[:5] + "***"
+	case Hash:
+		// An HMAC keyed by the salt: without the key, the hashes can't be
+		// reversed by hashing every CEP.
+		mac := hmac.New(sha256.New, []byte(m.salt))
+		mac.Write([]byte(cep))
+		return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:6])
+	default:
+		return cep
+	}
+}
+
+// cepPattern matches CEPs, with or without the dash.
+var cepPattern = regexp.MustCompile(`\b\d{5}-?\d{3}\b`)
+
+// Text masks every CEP found in s, such as those of URLs, bodies and error
+// messages.
+func (m *Masker) Text(s string) string {
+	return cepPattern.ReplaceAllStringFunc(s, func(cep string) string {
+		return m.Cep(strings.ReplaceAll(cep, "-", ""))
+	})
+}
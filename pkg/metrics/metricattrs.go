@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// metricAttributes are the attribute keys metrics may be broken down by.
+// Each has a small, bounded set of values; an attribute with unbounded
+// ones, such as a CEP, a city or a full URL, would make every value a
+// time series of its own and overwhelm the metrics backend. Add a key here
+// only once its values are known to be bounded.
+var metricAttributes = []string{
+	// otelhttp
+	"http.request.method",
+	"http.response.status_code",
+	"http.route",
+	"url.scheme",
+	"server.address",
+	"server.port",
+	"network.protocol.name",
+	"network.protocol.version",
+	"error.type",
+
+	// this repo
+	"check",
+	"dead_letter.kind",
+	"gateway",
+	"outbox.topic",
+	"outcome",
+	"priority",
+	"provider",
+	"reason",
+	"region",
+	"reused",
+	"state",
+	"store",
+	"task.kind",
+	"tenant.id",
+}
+
+// serverMetricDenied are dropped from the http.server.* metrics unless
+// allowed explicitly: there they come from the Host header, which any
+// client sets.
+var serverMetricDenied = []string{"server.address", "server.port"}
+
+// attributeView returns the view that drops from every metric the
+// attributes not in metricAttributes or allow, METRICS_ATTRIBUTE_ALLOW.
+// An allow of "*" turns the guard off. Each key dropped is logged once,
+// naming the metric it was first seen on.
+func attributeView(allow []string) sdkmetric.View {
+	if slices.Contains(allow, "*") {
+		log.Printf("Metric attribute filter disabled: metrics record every attribute")
+		return func(sdkmetric.Instrument) (sdkmetric.Stream, bool) {
+			return sdkmetric.Stream{}, false
+		}
+	}
+
+	allowed := make(map[attribute.Key]bool, len(metricAttributes)+len(allow))
+	for _, k := range metricAttributes {
+		allowed[attribute.Key(k)] = true
+	}
+	serverAllowed := make(map[attribute.Key]bool, len(allowed))
+	for k := range allowed {
+		serverAllowed[k] = !slices.Contains(serverMetricDenied, string(k))
+	}
+	for _, k := range allow {
+		allowed[attribute.Key(k)] = true
+		serverAllowed[attribute.Key(k)] = true
+	}
+	var logged sync.Map
+	return func(i sdkmetric.Instrument) (sdkmetric.Stream, bool) {
+		keys := allowed
+		if strings.HasPrefix(i.Name, "http.server.") {
+			keys = serverAllowed
+		}
+		filter := func(kv attribute.KeyValue) bool {
+			if keys[kv.Key] {
+				return true
+			}
+			if _, seen := logged.LoadOrStore(kv.Key, true); !seen {
+				log.Printf("Dropping attribute %q from metric %s; add it to METRICS_ATTRIBUTE_ALLOW if its values are bounded", kv.Key, i.Name)
+			}
+			return false
+		}
+		return sdkmetric.Stream{
+			Name:            i.Name,
+			Description:     i.Description,
+			Unit:            i.Unit,
+			AttributeFilter: filter,
+		}, true
+	}
+}
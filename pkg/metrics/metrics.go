@@ -0,0 +1,103 @@
+// Package metrics builds the meter provider of the services and guards the
+// cardinality of what it records.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/buildinfo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// Config tunes what the meter provider exports.
+type Config struct {
+	// AttributeAllow adds attribute keys to metricAttributes; "*" allows
+	// every attribute.
+	AttributeAllow []string
+	// Temporality is cumulative, delta or lowmemory; see
+	// temporalitySelector.
+	Temporality string
+	// Interval is how often metrics are exported.
+	Interval time.Duration
+	// Prometheus also serves the metrics on GET /metrics; see
+	// PrometheusEndpoint.
+	Prometheus bool
+}
+
+const (
+	TemporalityCumulative = "cumulative"
+	TemporalityDelta      = "delta"
+	TemporalityLowMemory  = "lowmemory"
+)
+
+// temporalitySelector returns the temporality of each instrument kind for
+// preference, as OTEL_EXPORTER_OTLP_METRICS_TEMPORALITY_PREFERENCE defines
+// it. Prometheus needs cumulative; backends such as Dynatrace or statsd
+// bridges need delta. Up-down counters stay cumulative under delta, since
+// their sum is what matters; lowmemory also keeps observable counters
+// cumulative, so the SDK doesn't hold their last value.
+func temporalitySelector(preference string) sdkmetric.TemporalitySelector {
+	switch preference {
+	case TemporalityCumulative:
+		return sdkmetric.DefaultTemporalitySelector
+	case TemporalityDelta:
+		return func(k sdkmetric.InstrumentKind) metricdata.Temporality {
+			switch k {
+			case sdkmetric.InstrumentKindUpDownCounter, sdkmetric.InstrumentKindObservableUpDownCounter:
+				return metricdata.CumulativeTemporality
+			}
+			return metricdata.DeltaTemporality
+		}
+	case TemporalityLowMemory:
+		return func(k sdkmetric.InstrumentKind) metricdata.Temporality {
+			switch k {
+			case sdkmetric.InstrumentKindCounter, sdkmetric.InstrumentKindHistogram:
+				return metricdata.DeltaTemporality
+			}
+			return metricdata.CumulativeTemporality
+		}
+	default:
+		log.Printf("Unknown METRICS_TEMPORALITY %q, falling back to %q", preference, TemporalityCumulative)
+		return sdkmetric.DefaultTemporalitySelector
+	}
+}
+
+// NewMeterProvider exports the metrics of service to the collector and,
+// when prom isn't nil, to the Prometheus endpoint too. It installs itself
+// as the global provider.
+func NewMeterProvider(service, collectorURL string, cfg Config, prom *PrometheusEndpoint) (*sdkmetric.MeterProvider, error) {
+	ctx := context.Background()
+
+	exporter, err := otlpmetricgrpc.New(ctx,
+		otlpmetricgrpc.WithEndpoint(collectorURL),
+		otlpmetricgrpc.WithInsecure(),
+		otlpmetricgrpc.WithTemporalitySelector(temporalitySelector(cfg.Temporality)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric exporter: %w", err)
+	}
+
+	res, err := buildinfo.NewResource(ctx, service)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resource: %w", err)
+	}
+
+	opts := []sdkmetric.Option{
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter, sdkmetric.WithInterval(cfg.Interval))),
+		sdkmetric.WithResource(res),
+		sdkmetric.WithView(attributeView(cfg.AttributeAllow)),
+	}
+	if prom != nil {
+		opts = append(opts, sdkmetric.WithReader(prom.reader))
+	}
+	mp := sdkmetric.NewMeterProvider(opts...)
+	otel.SetMeterProvider(mp)
+
+	return mp, nil
+}
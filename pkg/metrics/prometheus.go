@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// PrometheusEndpoint serves the metrics of the meter provider on GET
+// /metrics, for Prometheus to scrape alongside the OTLP export, while
+// METRICS_PROMETHEUS is set. Scrapers that accept OpenMetrics, as
+// Prometheus does by default, get it: every family with its TYPE, UNIT and
+// HELP, the trace of the exemplars sampled with the measurements, and the
+// _created sample of counters and histograms, so that a restart isn't
+// mistaken for a counter reset. Other scrapers get the classic text
+// format.
+type PrometheusEndpoint struct {
+	registry *prometheus.Registry
+	reader   *otelprom.Exporter
+	// start is when the series started counting. The SDK starts the
+	// cumulative series of an instrument when it is created, which here
+	// is during startup, right after the meter provider.
+	start time.Time
+}
+
+// prometheusUnits are the unit suffixes the exporter gives metric names,
+// after the OTel unit of their instrument.
+var prometheusUnits = []string{
+	"days", "hours", "minutes", "seconds", "milliseconds", "microseconds", "nanoseconds",
+	"bytes", "kibibytes", "mebibytes", "gibibytes", "tibibytes", "kilobytes", "megabytes", "gigabytes", "terabytes",
+	"meters", "volts", "amperes", "joules", "watts", "grams", "celsius", "hertz", "ratio", "percent",
+}
+
+// NewPrometheusEndpoint returns nil when METRICS_PROMETHEUS is off.
+func NewPrometheusEndpoint(cfg Config) (*PrometheusEndpoint, error) {
+	if !cfg.Prometheus {
+		return nil, nil
+	}
+	registry := prometheus.NewRegistry()
+	reader, err := otelprom.New(otelprom.WithRegisterer(registry))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Prometheus exporter: %w", err)
+	}
+	return &PrometheusEndpoint{registry: registry, reader: reader, start: time.Now()}, nil
+}
+
+// Gather gathers the registry and fills in the metadata the exporter
+// leaves out: the unit of each family, read back from its name, and the
+// created timestamp of counters, histograms and summaries.
+func (p *PrometheusEndpoint) Gather() ([]*dto.MetricFamily, error) {
+	families, err := p.registry.Gather()
+	created := timestamppb.New(p.start)
+	for _, f := range families {
+		name := f.GetName()
+		if f.GetType() == dto.MetricType_COUNTER {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		for _, unit := range prometheusUnits {
+			if strings.HasSuffix(name, "_"+unit) {
+				f.Unit = &unit
+				break
+			}
+		}
+		for _, m := range f.Metric {
+			switch {
+			case m.Counter != nil && m.Counter.CreatedTimestamp == nil:
+				m.Counter.CreatedTimestamp = created
+			case m.Histogram != nil && m.Histogram.CreatedTimestamp == nil:
+				m.Histogram.CreatedTimestamp = created
+			case m.Summary != nil && m.Summary.CreatedTimestamp == nil:
+				m.Summary.CreatedTimestamp = created
+			}
+		}
+	}
+	return families, err
+}
+
+// ServeHTTP serves GET /metrics in the format the scraper negotiates. A
+// family that fails to gather is left out rather than failing the scrape.
+func (p *PrometheusEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	families, err := p.Gather()
+	if err != nil {
+		errlog.Printf("Error gathering metrics for Prometheus: %v", err)
+	}
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	enc := expfmt.NewEncoder(w, format, expfmt.WithCreatedLines(), expfmt.WithUnit())
+	for _, f := range families {
+		if err := enc.Encode(f); err != nil {
+			errlog.Printf("Error encoding metrics for Prometheus: %v", err)
+			return
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,130 @@
+// Package netacl admits requests by client address, and works out that
+// address behind trusted proxies.
+package netacl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// parsePrefixes parses CIDRs and bare addresses, the latter as
+// single-host prefixes.
+func parsePrefixes(items []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(items))
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", item, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", item, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL admits requests by client address. The deny list wins over
+// the allow list, and an empty allow list admits everyone not denied.
+type ACL struct {
+	allow    []netip.Prefix
+	deny     []netip.Prefix
+	trusted  []netip.Prefix
+	auditLog *audit.Logger
+}
+
+// New returns the ACL of the allow and deny lists, which recognizes the
+// clients behind trustedProxies and records the requests it denies to
+// auditLog.
+func New(allow, deny, trustedProxies []string, auditLog *audit.Logger) (*ACL, error) {
+	acl := &ACL{auditLog: auditLog}
+	var err error
+	if acl.allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	if acl.trusted, err = parsePrefixes(trustedProxies); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// ClientAddr returns the address of the client behind r. X-Forwarded-For
+// is only believed when the peer is a trusted proxy, and is then walked
+// from the right past the other trusted proxies, so a client can't spoof
+// its address by sending the header itself.
+func (acl *ACL) ClientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	if !containsAddr(acl.trusted, addr) {
+		return addr.Unmap(), true
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop
+		if !containsAddr(acl.trusted, hop) {
+			break
+		}
+	}
+	return addr.Unmap(), true
+}
+
+func (acl *ACL) allowed(addr netip.Addr) bool {
+	if containsAddr(acl.deny, addr) {
+		return false
+	}
+	return len(acl.allow) == 0 || containsAddr(acl.allow, addr)
+}
+
+func (acl *ACL) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(acl.allow) == 0 && len(acl.deny) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		addr, ok := acl.ClientAddr(r)
+		if !ok || !acl.allowed(addr) {
+			acl.auditLog.Record(r.Context(), addr.String(), "network.acl", "denied", map[string]string{
+				"path": r.URL.Path,
+			})
+			httpapi.RespondWithError(w, weather.CodeForbidden, "forbidden", r.Context())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package outbound
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// connReuseTransport records whether each outbound request got a fresh or
+// a pooled connection, which is the main signal when tuning pool sizes.
+type connReuseTransport struct {
+	base     http.RoundTripper
+	acquired metric.Int64Counter
+	total    atomic.Int64
+	reused   atomic.Int64
+}
+
+func newConnReuseTransport(base http.RoundTripper, meter metric.Meter) *connReuseTransport {
+	t := &connReuseTransport{base: base}
+
+	var err error
+	t.acquired, err = meter.Int64Counter("http.client.connection.acquired",
+		metric.WithDescription("Outbound connections handed to requests, by whether they were reused from the pool"),
+		metric.WithUnit("{connection}"),
+	)
+	if err != nil {
+		log.Printf("Error creating connection counter: %v", err)
+	}
+
+	_, err = meter.Float64ObservableGauge("http.client.connection.reuse_ratio",
+		metric.WithDescription("Fraction of outbound requests served by a pooled connection"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			if total := t.total.Load(); total > 0 {
+				o.Observe(float64(t.reused.Load()) / float64(total))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		log.Printf("Error creating connection reuse gauge: %v", err)
+	}
+
+	return t
+}
+
+func (t *connReuseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.total.Add(1)
+			if info.Reused {
+				t.reused.Add(1)
+			}
+			if t.acquired != nil {
+				t.acquired.Add(req.Context(), 1, metric.WithAttributes(
+					attribute.Bool("reused", info.Reused),
+					attribute.String("server.address", req.URL.Hostname()),
+				))
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,100 @@
+// Package outbound builds the HTTP client every upstream call of a service
+// goes through, so that connections are pooled and the calls are traced,
+// measured and captured alike.
+package outbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/debugcapture"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Config controls how the shared outbound transport reaches
+// upstream services.
+type Config struct {
+	CABundlePath       string
+	InsecureSkipVerify bool
+	ForceHTTP1         bool
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	TLSHandshakeTimeout time.Duration
+
+	Telemetry TelemetryConfig
+	// H2C talks HTTP/2 with prior knowledge to plaintext upstreams, so the
+	// hop to service B multiplexes requests over a few connections.
+	H2C bool
+}
+
+// NewTransport builds the transport used for all upstream calls.
+// Proxies are taken from HTTPS_PROXY/HTTP_PROXY/NO_PROXY, and extra CAs are
+// appended to the system pool.
+func NewTransport(cfg Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.MaxIdleConns = cfg.MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = cfg.MaxConnsPerHost
+	transport.IdleConnTimeout = cfg.IdleConnTimeout
+	transport.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CABundlePath != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(cfg.CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CABundlePath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.InsecureSkipVerify {
+		log.Printf("WARNING: TLS certificate verification is DISABLED for outbound calls (OUTBOUND_INSECURE_SKIP_VERIFY=true). Never use this in production.")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport.TLSClientConfig = tlsConfig
+
+	protocols := new(http.Protocols)
+	switch {
+	case cfg.ForceHTTP1:
+		protocols.SetHTTP1(true)
+		transport.ForceAttemptHTTP2 = false
+	case cfg.H2C:
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	}
+	transport.Protocols = protocols
+	return transport, nil
+}
+
+// NewClient returns the client of the upstream calls: over NewTransport,
+// traced, with their connection reuse measured with meter, and captured
+// by capturer.
+func NewClient(cfg Config, meter metric.Meter, capturer *debugcapture.Capturer) (*http.Client, error) {
+	transport, err := NewTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: capturer.Transport(otelhttp.NewTransport(newConnReuseTransport(transport, meter), cfg.Telemetry.clientOptions()...))}, nil
+}
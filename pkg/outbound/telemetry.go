@@ -0,0 +1,85 @@
+package outbound
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// TelemetryConfig tunes how outbound calls are traced, without
+// touching the gateways that make them.
+type TelemetryConfig struct {
+	// ClientExclude lists the calls left untraced, as "host" or
+	// "host/path-prefix" patterns; "*.example.com" matches subdomains.
+	ClientExclude []string
+	// ClientSpanName names the client spans; {method}, {host}, {peer} and
+	// {path} are replaced. Empty keeps otelhttp's "HTTP GET".
+	ClientSpanName string
+	// PeerNames maps hosts to the name {peer} stands for; hosts not
+	// listed stand for themselves.
+	PeerNames map[string]string
+}
+
+// clientOptions returns the otelhttp options of the shared outbound
+// transport.
+func (c TelemetryConfig) clientOptions() []otelhttp.Option {
+	var opts []otelhttp.Option
+	if len(c.ClientExclude) > 0 {
+		opts = append(opts, otelhttp.WithFilter(func(r *http.Request) bool {
+			return !matchesCallPattern(c.ClientExclude, r)
+		}))
+	}
+	if c.ClientSpanName != "" {
+		opts = append(opts, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			host := r.URL.Hostname()
+			peer, ok := c.PeerNames[host]
+			if !ok {
+				peer = host
+			}
+			return strings.NewReplacer(
+				"{method}", r.Method,
+				"{host}", host,
+				"{peer}", peer,
+				"{path}", r.URL.Path,
+			).Replace(c.ClientSpanName)
+		}))
+	}
+	return opts
+}
+
+// matchesCallPattern reports whether r is to a host and path matched by
+// one of patterns.
+func matchesCallPattern(patterns []string, r *http.Request) bool {
+	host := r.URL.Hostname()
+	for _, p := range patterns {
+		pHost, pPath, hasPath := strings.Cut(p, "/")
+		if suffix, ok := strings.CutPrefix(pHost, "*."); ok {
+			if !strings.HasSuffix(host, "."+suffix) {
+				continue
+			}
+		} else if !strings.EqualFold(host, pHost) {
+			continue
+		}
+		if !hasPath || strings.HasPrefix(r.URL.Path, "/"+pPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePeerNames parses "host=name" pairs such as "viacep.com.br=viacep"
+// and "api.weatherapi.com=weatherapi".
+func ParsePeerNames(pairs []string) map[string]string {
+	names := make(map[string]string)
+	for _, pair := range pairs {
+		host, name, ok := strings.Cut(pair, "=")
+		if !ok || host == "" || name == "" {
+			log.Printf("Ignoring invalid peer name entry %q", pair)
+			continue
+		}
+		names[strings.TrimSpace(host)] = strings.TrimSpace(name)
+	}
+	return names
+}
@@ -0,0 +1,171 @@
+// Package profiling uploads continuous profiles to Pyroscope.
+package profiling
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/buildinfo"
+	"github.com/joaolima7/otel-goexpert/pkg/redact"
+)
+
+// Config enables continuous profiling: CPU and heap profiles are
+// taken every Interval and uploaded to the Pyroscope server at URL.
+type Config struct {
+	URL       string
+	AuthToken string `secret:"true"`
+	// TenantID is sent as X-Scope-OrgID, for multi-tenant servers.
+	TenantID string
+	Interval time.Duration
+	// Types lists the profiles taken: cpu, heap or both.
+	Types []string
+}
+
+// Profiler uploads profiles in the pprof format through Pyroscope's
+// /ingest API. Each is named after the service and labeled with its
+// version and instance, so a regression can be tied to the release that
+// brought it.
+type Profiler struct {
+	service string
+	cfg     Config
+	client  *http.Client
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a profiler of service.
+func New(service string, cfg Config) *Profiler {
+	return &Profiler{
+		service: service,
+		cfg:     cfg,
+		// Uploads are not traced: a span per upload would only add noise.
+		client: &http.Client{Timeout: 10 * time.Second},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (p *Profiler) Start() {
+	log.Printf("Uploading %s profiles to %s every %s", strings.Join(p.cfg.Types, ", "), redact.Credentials(p.cfg.URL), p.cfg.Interval)
+	go p.loop()
+}
+
+// Stop ends the profiling, uploading the CPU profile in progress.
+func (p *Profiler) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *Profiler) loop() {
+	defer close(p.done)
+	for {
+		// Profiles are stamped with the real time even under a pinned clock.
+		from := time.Now()
+		var cpu bytes.Buffer
+		cpuOn := false
+		if slices.Contains(p.cfg.Types, "cpu") {
+			if err := pprof.StartCPUProfile(&cpu); err != nil {
+				// Someone else, such as a test run with -cpuprofile, holds
+				// the profiler; try again next round.
+				log.Printf("Error starting CPU profile: %v", err)
+			} else {
+				cpuOn = true
+			}
+		}
+
+		stopped := false
+		select {
+		case <-p.stop:
+			stopped = true
+		case <-time.After(p.cfg.Interval):
+		}
+
+		until := time.Now()
+		if cpuOn {
+			pprof.StopCPUProfile()
+			p.upload("cpu", &cpu, from, until)
+		}
+		if slices.Contains(p.cfg.Types, "heap") {
+			var heap bytes.Buffer
+			if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+				log.Printf("Error writing heap profile: %v", err)
+			} else {
+				p.upload("heap", &heap, from, until)
+			}
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+func (p *Profiler) upload(kind string, profile *bytes.Buffer, from, until time.Time) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("profile", "profile.pprof")
+	if err == nil {
+		_, err = io.Copy(part, profile)
+	}
+	if err == nil {
+		err = form.Close()
+	}
+	if err != nil {
+		log.Printf("Error encoding %s profile: %v", kind, err)
+		return
+	}
+
+	q := url.Values{}
+	q.Set("name", p.appName())
+	q.Set("from", strconv.FormatInt(from.Unix(), 10))
+	q.Set("until", strconv.FormatInt(until.Unix(), 10))
+	q.Set("format", "pprof")
+	q.Set("spyName", "gospy")
+	if kind == "cpu" {
+		q.Set("sampleRate", "100")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(p.cfg.URL, "/")+"/ingest?"+q.Encode(), &body)
+	if err != nil {
+		log.Printf("Error uploading %s profile: %v", kind, err)
+		return
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if p.cfg.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.cfg.AuthToken)
+	}
+	if p.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", p.cfg.TenantID)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("Error uploading %s profile: %v", kind, err)
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		log.Printf("Error uploading %s profile: %s", kind, resp.Status)
+	}
+}
+
+// appName is the Pyroscope application name of the profiles, with the
+// labels they are filtered by. The server tells the profile types apart
+// by the sample types of each upload.
+func (p *Profiler) appName() string {
+	return fmt.Sprintf("%s{service_version=%s,instance=%s,vcs_revision=%s}",
+		p.service, buildinfo.Current.Version, buildinfo.InstanceID, buildinfo.Current.GitCommit)
+}
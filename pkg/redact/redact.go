@@ -0,0 +1,69 @@
+// Package redact masks the secrets of configurations and connection
+// strings before they are shown or logged.
+package redact
+
+import (
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Placeholder replaces every masked value.
+const Placeholder = "********"
+
+// dsnPassword matches the password of key=value connection strings such as
+// "host=db user=app password=secret".
+var dsnPassword = regexp.MustCompile(`(?i)(password=)\S+`)
+
+// Config renders a resolved configuration for display. Fields tagged
+// `secret:"true"` are masked when set, and credentials embedded in URLs or
+// connection strings are masked everywhere.
+func Config(cfg any) any {
+	return value(reflect.ValueOf(cfg))
+}
+
+func value(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Struct:
+		out := make(map[string]any, v.NumField())
+		t := v.Type()
+		for i := range t.NumField() {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			if f.Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+				out[f.Name] = Placeholder
+				continue
+			}
+			out[f.Name] = value(v.Field(i))
+		}
+		return out
+	case reflect.Slice:
+		out := make([]any, v.Len())
+		for i := range v.Len() {
+			out[i] = value(v.Index(i))
+		}
+		return out
+	case reflect.String:
+		return Credentials(v.String())
+	}
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	return v.Interface()
+}
+
+// Credentials masks the password of URLs and connection strings.
+func Credentials(s string) string {
+	if strings.Contains(s, "://") {
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				return u.Redacted()
+			}
+		}
+	}
+	return dsnPassword.ReplaceAllString(s, "${1}"+Placeholder)
+}
@@ -0,0 +1,150 @@
+// Package retry retries failed upstream calls within a budget shared by
+// every gateway of the service.
+package retry
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Budget caps retries across every upstream gateway at a fraction of
+// the calls made over a sliding window, plus a small floor so a quiet
+// instance can still retry. During an outage per-call retries would
+// otherwise multiply the load on the failing dependency.
+type Budget struct {
+	mu         sync.Mutex
+	ratio      float64
+	minRetries int
+	buckets    []retryBucket
+
+	retried   metric.Int64Counter
+	exhausted metric.Int64Counter
+}
+
+// retryBucket counts the calls and retries of one second of the window.
+type retryBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// NewBudget returns a Budget allowing ratio retries per call made over
+// window, plus minRetries, that counts the retries it allows and denies
+// with meter.
+func NewBudget(ratio float64, minRetries int, window time.Duration, meter metric.Meter) *Budget {
+	b := &Budget{
+		ratio:      ratio,
+		minRetries: minRetries,
+		buckets:    make([]retryBucket, max(int(window/time.Second), 1)),
+	}
+
+	var err error
+	b.retried, err = meter.Int64Counter("retry.attempts",
+		metric.WithDescription("Upstream retries allowed by the retry budget, by gateway"),
+		metric.WithUnit("{retry}"),
+	)
+	if err != nil {
+		log.Printf("Error creating retry counter: %v", err)
+	}
+	b.exhausted, err = meter.Int64Counter("retry.budget.exhausted",
+		metric.WithDescription("Upstream retries denied because the retry budget was spent, by gateway"),
+		metric.WithUnit("{retry}"),
+	)
+	if err != nil {
+		log.Printf("Error creating retry budget counter: %v", err)
+	}
+	return b
+}
+
+// bucketLocked returns the bucket of the current second, resetting it if
+// it last held an older second.
+func (b *Budget) bucketLocked(now int64) *retryBucket {
+	bucket := &b.buckets[now%int64(len(b.buckets))]
+	if bucket.second != now {
+		*bucket = retryBucket{second: now}
+	}
+	return bucket
+}
+
+// RecordRequest counts one upstream call towards the budget.
+func (b *Budget) RecordRequest() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucketLocked(clock.Now().Unix()).requests++
+}
+
+// TryRetry spends one retry if the budget allows it.
+func (b *Budget) TryRetry(ctx context.Context, gateway string) bool {
+	now := clock.Now().Unix()
+	oldest := now - int64(len(b.buckets)) + 1
+
+	b.mu.Lock()
+	requests, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if bucket.second >= oldest {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	allowed := float64(retries) < float64(b.minRetries)+b.ratio*float64(requests)
+	if allowed {
+		b.bucketLocked(now).retries++
+	}
+	b.mu.Unlock()
+
+	counter := b.exhausted
+	if allowed {
+		counter = b.retried
+	}
+	if counter != nil {
+		counter.Add(ctx, 1, metric.WithAttributes(attribute.String("gateway", gateway)))
+	}
+	return allowed
+}
+
+// Policy retries failed upstream calls with a linear, jittered backoff
+// while the shared budget allows it.
+type Policy struct {
+	Budget      *Budget
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+// Do runs attempt until it succeeds, reports a non-retryable failure, runs
+// out of attempts or is denied by the budget, and returns the last error.
+func (p Policy) Do(ctx context.Context, gateway string, attempt func(ctx context.Context) (retryable bool, err error)) error {
+	p.Budget.RecordRequest()
+	span := trace.SpanFromContext(ctx)
+
+	for i := 1; ; i++ {
+		retryable, err := attempt(ctx)
+		if err == nil || !retryable || i >= p.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		if !p.Budget.TryRetry(ctx, gateway) {
+			span.AddEvent("retry_budget_exhausted", trace.WithAttributes(attribute.String("gateway", gateway)))
+			return err
+		}
+		span.AddEvent("retry", trace.WithAttributes(
+			attribute.String("gateway", gateway),
+			attribute.Int("attempt", i+1),
+			attribute.String("error", err.Error()),
+		))
+
+		delay := p.Backoff*time.Duration(i) + time.Duration(clock.Random().Int64N(int64(p.Backoff)+1))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
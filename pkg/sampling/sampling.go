@@ -0,0 +1,313 @@
+// Package sampling decides which traces are sampled, at rates that can
+// be changed at runtime through the admin API.
+package sampling
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Override samples the traces started by the requests of Tenant,
+// to Route, or both, at Rate instead of the default rate. A Route ending
+// in "*" is a path prefix.
+type Override struct {
+	ID        string     `json:"id"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Route     string     `json:"route,omitempty"`
+	Rate      float64    `json:"rate"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (o Override) matches(tenant, route string) bool {
+	if o.Tenant != "" && o.Tenant != tenant {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(o.Route, "*"); ok {
+		return strings.HasPrefix(route, prefix)
+	}
+	return o.Route == "" || o.Route == route
+}
+
+// specificity ranks the overrides matching a request: tenant and route
+// first, then tenant, then route, longer routes before shorter ones.
+func (o Override) specificity() int {
+	s := len(o.Route)
+	if o.Tenant != "" {
+		s += 1 << 16
+	}
+	return s
+}
+
+func (o Override) expired(now time.Time) bool {
+	return o.ExpiresAt != nil && !now.Before(*o.ExpiresAt)
+}
+
+// rule names o in the sampling.rule attribute of the spans it samples.
+func (o Override) rule() string {
+	var parts []string
+	if o.Tenant != "" {
+		parts = append(parts, "tenant="+o.Tenant)
+	}
+	if o.Route != "" {
+		parts = append(parts, "route="+o.Route)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Sampler samples the traces started here at a rate that can be
+// changed at runtime, overall or for a tenant or a route, through
+// /admin/sampling. Spans with a parent follow its decision, so a trace is
+// sampled whole, by the service it started in. Sampled root spans carry
+// the rate and the rule that chose it.
+type Sampler struct {
+	mu        sync.RWMutex
+	rate      float64
+	overrides []Override
+	// baggageKey is the baggage member that names the tenant of a request
+	// the hints don't.
+	baggageKey string
+}
+
+// New returns a sampler that samples everything until SetRate says
+// otherwise, taking the tenant of a request from tenantBaggageKey when
+// HintsMiddleware doesn't tell it.
+func New(tenantBaggageKey string) *Sampler {
+	return &Sampler{rate: 1, baggageKey: tenantBaggageKey}
+}
+
+var followParent = sdktrace.ParentBased(sdktrace.AlwaysSample())
+
+func (s *Sampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if trace.SpanContextFromContext(p.ParentContext).IsValid() {
+		return followParent.ShouldSample(p)
+	}
+	tenant, route := s.subject(p.ParentContext)
+	rate, rule := s.match(tenant, route)
+	res := sdktrace.TraceIDRatioBased(rate).ShouldSample(p)
+	if res.Decision == sdktrace.RecordAndSample {
+		res.Attributes = append(res.Attributes,
+			attribute.Float64("sampling.rate", rate),
+			attribute.String("sampling.rule", rule),
+		)
+	}
+	return res
+}
+
+func (s *Sampler) Description() string {
+	return "DynamicSampler"
+}
+
+// match returns the rate of the most specific override for tenant and
+// route, or the default rate.
+func (s *Sampler) match(tenant, route string) (float64, string) {
+	now := clock.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	best := -1
+	for i, o := range s.overrides {
+		if o.expired(now) || !o.matches(tenant, route) {
+			continue
+		}
+		if best < 0 || o.specificity() > s.overrides[best].specificity() {
+			best = i
+		}
+	}
+	if best < 0 {
+		return s.rate, "default"
+	}
+	return s.overrides[best].Rate, s.overrides[best].rule()
+}
+
+func (s *Sampler) SetRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rate = rate
+}
+
+func (s *Sampler) Add(o Override) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides = append(s.overrides, o)
+}
+
+func (s *Sampler) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.overrides)
+	s.overrides = slices.DeleteFunc(s.overrides, func(o Override) bool { return o.ID == id })
+	return len(s.overrides) < n
+}
+
+// Snapshot returns the default rate and the overrides in force, dropping
+// the expired ones.
+func (s *Sampler) Snapshot() State {
+	now := clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides = slices.DeleteFunc(s.overrides, func(o Override) bool { return o.expired(now) })
+	return State{Rate: s.rate, Overrides: slices.Clone(s.overrides)}
+}
+
+type samplingHintsKey struct{}
+
+// samplingHints is what the sampler knows of a request before its server
+// span starts.
+type samplingHints struct {
+	tenant, route string
+}
+
+// HintsMiddleware goes around otelhttp, so that the sampler knows
+// the route and, through tenantOf, the tenant of the request its server
+// span is for. Without tenantOf the tenant is taken from the baggage.
+func HintsMiddleware(tenantOf func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := samplingHints{route: r.URL.Path}
+			if tenantOf != nil {
+				h.tenant = tenantOf(r)
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), samplingHintsKey{}, h)))
+		})
+	}
+}
+
+func (s *Sampler) subject(ctx context.Context) (tenant, route string) {
+	h, _ := ctx.Value(samplingHintsKey{}).(samplingHints)
+	if h.tenant == "" {
+		h.tenant = baggage.FromContext(ctx).Member(s.baggageKey).Value()
+	}
+	return h.tenant, h.route
+}
+
+type State struct {
+	Rate      float64    `json:"rate"`
+	Overrides []Override `json:"overrides"`
+}
+
+// samplingRateRequest is the body of PUT /admin/sampling.
+type samplingRateRequest struct {
+	Rate float64 `json:"rate"`
+}
+
+// samplingOverrideRequest is the body of POST /admin/sampling/overrides.
+// TTL, such as "1h", makes the override expire; without it the override
+// lasts until deleted or the process restarts.
+type samplingOverrideRequest struct {
+	Tenant string  `json:"tenant"`
+	Route  string  `json:"route"`
+	Rate   float64 `json:"rate"`
+	TTL    string  `json:"ttl"`
+	Reason string  `json:"reason"`
+}
+
+// AdminRoutes serves /admin/sampling, recording the changes in auditLog.
+func (s *Sampler) AdminRoutes(auditLog *audit.Logger) http.Handler {
+	h := &adminHandler{sampler: s, auditLog: auditLog}
+	r := chi.NewRouter()
+	r.Get("/", h.handleSampling)
+	r.Put("/", h.handleSamplingRate)
+	r.Post("/overrides", h.handleSamplingOverrideCreate)
+	r.Delete("/overrides/{id}", h.handleSamplingOverrideDelete)
+	return r
+}
+
+type adminHandler struct {
+	sampler  *Sampler
+	auditLog *audit.Logger
+}
+
+// handleSampling serves GET /admin/sampling.
+func (h *adminHandler) handleSampling(w http.ResponseWriter, r *http.Request) {
+	httpapi.Render(w, http.StatusOK, h.sampler.Snapshot(), r.Context())
+}
+
+// handleSamplingRate serves PUT /admin/sampling, which sets the default
+// rate.
+func (h *adminHandler) handleSamplingRate(w http.ResponseWriter, r *http.Request) {
+	var req samplingRateRequest
+	if err := httpapi.DecodeRequest(r, &req); err != nil {
+		httpapi.RespondWithDecodeError(w, err, weather.CodeInvalidRequest, "invalid request body", r.Context())
+		return
+	}
+	if req.Rate < 0 || req.Rate > 1 {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, "rate must be between 0 and 1", r.Context())
+		return
+	}
+	h.sampler.SetRate(req.Rate)
+	h.auditLog.Record(r.Context(), "admin", "sampling.rate", "success", map[string]string{"rate": formatRate(req.Rate)})
+	httpapi.Render(w, http.StatusOK, h.sampler.Snapshot(), r.Context())
+}
+
+// handleSamplingOverrideCreate serves POST /admin/sampling/overrides.
+func (h *adminHandler) handleSamplingOverrideCreate(w http.ResponseWriter, r *http.Request) {
+	var req samplingOverrideRequest
+	if err := httpapi.DecodeRequest(r, &req); err != nil {
+		httpapi.RespondWithDecodeError(w, err, weather.CodeInvalidRequest, "invalid request body", r.Context())
+		return
+	}
+	if req.Tenant == "" && req.Route == "" {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, "tenant or route is required", r.Context())
+		return
+	}
+	if req.Rate < 0 || req.Rate > 1 {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, "rate must be between 0 and 1", r.Context())
+		return
+	}
+	o := Override{
+		ID:        uuid.NewString(),
+		Tenant:    req.Tenant,
+		Route:     req.Route,
+		Rate:      req.Rate,
+		Reason:    req.Reason,
+		CreatedAt: clock.Now().UTC(),
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			httpapi.RespondWithError(w, weather.CodeInvalidRequest, "ttl must be a positive duration", r.Context())
+			return
+		}
+		expires := o.CreatedAt.Add(ttl)
+		o.ExpiresAt = &expires
+	}
+	h.sampler.Add(o)
+	h.auditLog.Record(r.Context(), "admin", "sampling.override.create", "success", map[string]string{
+		"id":   o.ID,
+		"rule": o.rule(),
+		"rate": formatRate(o.Rate),
+	})
+	httpapi.Render(w, http.StatusCreated, o, r.Context())
+}
+
+// handleSamplingOverrideDelete serves DELETE /admin/sampling/overrides/{id}.
+func (h *adminHandler) handleSamplingOverrideDelete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !h.sampler.Remove(id) {
+		httpapi.RespondWithError(w, weather.CodeNotFound, "sampling override not found", r.Context())
+		return
+	}
+	h.auditLog.Record(r.Context(), "admin", "sampling.override.delete", "success", map[string]string{"id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'g', -1, 64)
+}
@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd)
+
+package server
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// upgradeSignals is empty where SIGUSR2 is unavailable; graceful upgrades
+// are not supported there.
+var upgradeSignals []os.Signal
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,185 @@
+// Package server runs the HTTP server of a service, with graceful
+// shutdown and binary upgrades.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenerFDEnv tells a process started by a graceful upgrade which file
+// descriptor holds the listener inherited from its parent.
+const listenerFDEnv = "GRACEFUL_LISTENER_FD"
+
+// Config controls the inbound listener.
+type Config struct {
+	Addr        string
+	TLSCertFile string
+	TLSKeyFile  string
+	// ForceHTTP1 disables HTTP/2 entirely, which is handy when debugging
+	// with tools that only speak HTTP/1.1.
+	ForceHTTP1 bool
+	// H2C accepts HTTP/2 with prior knowledge over plaintext connections.
+	H2C bool
+	// ReusePort sets SO_REUSEPORT so a new process can bind the same port
+	// while the old one is still draining.
+	ReusePort bool
+	// DrainTimeout bounds how long in-flight requests may take to finish
+	// on shutdown.
+	DrainTimeout time.Duration
+	// ShutdownTimeout bounds the whole shutdown, from the signal: draining
+	// requests and streams, then stopping the components, with the
+	// telemetry flushed last.
+	ShutdownTimeout time.Duration
+}
+
+// New returns the server of handler, speaking the protocols cfg allows.
+func New(cfg Config, handler http.Handler) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	if !cfg.ForceHTTP1 {
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(cfg.H2C)
+	}
+
+	return &http.Server{
+		Addr:      cfg.Addr,
+		Handler:   handler,
+		Protocols: protocols,
+	}
+}
+
+// listen returns the listener inherited from a parent process when started
+// by a graceful upgrade, and a fresh one otherwise.
+func listen(cfg Config) (net.Listener, error) {
+	if value := os.Getenv(listenerFDEnv); value != "" {
+		fd, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", listenerFDEnv, err)
+		}
+		f := os.NewFile(uintptr(fd), "inherited-listener")
+		defer f.Close()
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit listener: %w", err)
+		}
+		log.Printf("Inherited listener on %s from parent process", ln.Addr())
+		return ln, nil
+	}
+
+	lc := net.ListenConfig{}
+	if cfg.ReusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", cfg.Addr)
+}
+
+// serve serves over TLS (with HTTP/2 negotiated via ALPN) when a
+// certificate file or a certificate source in srv.TLSConfig is configured,
+// and over plaintext otherwise.
+func serve(srv *http.Server, ln net.Listener, cfg Config) error {
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		return srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	if srv.TLSConfig != nil && srv.TLSConfig.GetCertificate != nil {
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
+
+// Run serves until SIGINT/SIGTERM, then drains in-flight requests.
+// On the upgrade signal (SIGUSR2 where supported) it first starts a new
+// copy of the binary that inherits the listener, so connections keep being
+// accepted while this process drains. beforeShutdown runs before draining
+// and is told whether a successor process has taken over. It returns the
+// deadline the rest of the shutdown must be over by.
+func Run(srv *http.Server, cfg Config, beforeShutdown func(upgrading bool)) (time.Time, error) {
+	ln, err := listen(cfg)
+	if err != nil {
+		return time.Now().Add(cfg.ShutdownTimeout), err
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- serve(srv, ln, cfg) }()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, upgradeSignals...)...)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case err := <-errCh:
+			deadline := time.Now().Add(cfg.ShutdownTimeout)
+			if errors.Is(err, http.ErrServerClosed) {
+				return deadline, nil
+			}
+			return deadline, err
+		case sig := <-sigCh:
+			deadline := time.Now().Add(cfg.ShutdownTimeout)
+			upgrading := slices.Contains(upgradeSignals, sig)
+			if upgrading {
+				pid, err := startSuccessor(ln)
+				if err != nil {
+					log.Printf("Graceful upgrade failed, keeping current process: %v", err)
+					continue
+				}
+				log.Printf("Started successor process %d, draining", pid)
+			}
+
+			if beforeShutdown != nil {
+				beforeShutdown(upgrading)
+			}
+
+			// Long-lived streams are ended by the functions registered with
+			// srv.RegisterOnShutdown, which tell their clients to reconnect,
+			// so they don't hold up the drain.
+			log.Printf("Shutting down: draining in-flight requests")
+			ctx, cancel := context.WithTimeout(context.Background(), min(cfg.DrainTimeout, cfg.ShutdownTimeout))
+			defer cancel()
+			return deadline, srv.Shutdown(ctx)
+		}
+	}
+}
+
+// startSuccessor re-executes the current binary, handing it ln as fd 3.
+func startSuccessor(ln net.Listener) (int, error) {
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return 0, fmt.Errorf("listener %T cannot be inherited", ln)
+	}
+	f, err := filer.File()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get listener file: %w", err)
+	}
+	defer f.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		return strings.HasPrefix(kv, listenerFDEnv+"=")
+	}), listenerFDEnv+"=3")
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start successor: %w", err)
+	}
+	return cmd.Process.Pid, nil
+}
@@ -0,0 +1,118 @@
+// Package shedding turns requests away once too many are in flight,
+// lower priority classes first.
+package shedding
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PriorityHeader carries the request's priority class. It is forwarded
+// from service A to service B so both shed the same traffic first.
+const PriorityHeader = "X-Priority"
+
+const (
+	priorityCritical    = "critical"
+	priorityInteractive = "interactive"
+	priorityBatch       = "batch"
+)
+
+// priorityShare is the fraction of the in-flight limit each class may
+// occupy. Batch traffic is turned away at half capacity, leaving headroom
+// for interactive and critical requests.
+var priorityShare = map[string]float64{
+	priorityCritical:    1.0,
+	priorityInteractive: 0.9,
+	priorityBatch:       0.5,
+}
+
+// RetryAfter is the Retry-After sent with shed requests. Requests in
+// flight usually complete within it, freeing room for the retry.
+const RetryAfter = time.Second
+
+// priorityKey stores the priority class in the request context.
+type priorityKey struct{}
+
+// ValidPriority reports whether p names a priority class.
+func ValidPriority(p string) bool {
+	_, ok := priorityShare[p]
+	return ok
+}
+
+// Priority returns the priority class the Shedder gave the request of
+// ctx.
+func Priority(ctx context.Context) (string, bool) {
+	p, ok := ctx.Value(priorityKey{}).(string)
+	return p, ok
+}
+
+// requestPriority returns the priority class of r, defaulting to
+// interactive for missing or unknown values.
+func requestPriority(r *http.Request) string {
+	p := strings.ToLower(strings.TrimSpace(r.Header.Get(PriorityHeader)))
+	if _, ok := priorityShare[p]; ok {
+		return p
+	}
+	return priorityInteractive
+}
+
+// Shedder rejects requests with 503 once the number in flight reaches the
+// share of maxInFlight allowed for their priority.
+type Shedder struct {
+	maxInFlight int64
+	inFlight    atomic.Int64
+	shed        metric.Int64Counter
+}
+
+// New returns a Shedder admitting up to maxInFlight requests, or any
+// number when it is zero, that counts the requests it sheds with meter.
+func New(maxInFlight int, meter metric.Meter) *Shedder {
+	s := &Shedder{maxInFlight: int64(maxInFlight)}
+
+	var err error
+	s.shed, err = meter.Int64Counter("http.server.request.shed",
+		metric.WithDescription("Requests rejected by the load shedder, by priority class"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		log.Printf("Error creating load shedding counter: %v", err)
+	}
+	return s
+}
+
+func (s *Shedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priority := requestPriority(r)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.priority", priority))
+		r = r.WithContext(context.WithValue(r.Context(), priorityKey{}, priority))
+
+		if s.maxInFlight <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limit := max(1, int64(float64(s.maxInFlight)*priorityShare[priority]))
+		if n := s.inFlight.Add(1); n > limit {
+			s.inFlight.Add(-1)
+			if s.shed != nil {
+				s.shed.Add(r.Context(), 1, metric.WithAttributes(attribute.String("priority", priority)))
+			}
+			httpapi.SetRetryAfter(w, RetryAfter)
+			httpapi.RespondWithError(w, weather.CodeOverloaded, "server overloaded", r.Context())
+			return
+		}
+		defer s.inFlight.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,85 @@
+// Package slowrequest reports the requests that take too long, phase by
+// phase.
+package slowrequest
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type phaseTimingsKey struct{}
+
+// phaseTimings records how long each phase of a request took.
+type phaseTimings struct {
+	mu     sync.Mutex
+	phases []slog.Attr
+}
+
+// StartPhase starts timing a named phase and returns the function that ends
+// it. It is a no-op when the context carries no phaseTimings.
+func StartPhase(ctx context.Context, name string) func() {
+	pt, ok := ctx.Value(phaseTimingsKey{}).(*phaseTimings)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		elapsed := float64(time.Since(start).Microseconds()) / 1000
+		pt.mu.Lock()
+		pt.phases = append(pt.phases, slog.Float64(name+"_ms", elapsed))
+		pt.mu.Unlock()
+	}
+}
+
+// Middleware logs a structured record with per-phase timings for
+// requests slower than threshold and flags their span with slow_request,
+// which the tail sampling policy of the collector keeps whatever its
+// baseline rate. The flag can't rescue a trace TRACE_SAMPLE_RATE dropped:
+// by then its spans aren't recording.
+func Middleware(threshold time.Duration) func(http.Handler) http.Handler {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if threshold <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			pt := &phaseTimings{}
+			start := time.Now()
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), phaseTimingsKey{}, pt)))
+
+			elapsed := time.Since(start)
+			// Event streams stay open for as long as the client watches.
+			if elapsed < threshold || w.Header().Get("Content-Type") == "text/event-stream" {
+				return
+			}
+
+			span := trace.SpanFromContext(r.Context())
+			span.SetAttributes(attribute.Bool("slow_request", true))
+
+			pt.mu.Lock()
+			phases := append([]slog.Attr(nil), pt.phases...)
+			pt.mu.Unlock()
+
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+				slog.Float64("threshold_ms", float64(threshold.Microseconds())/1000),
+				slog.Any("phases", slog.GroupValue(phases...)),
+			}
+			if sc := span.SpanContext(); sc.HasTraceID() {
+				attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+			}
+			logger.LogAttrs(r.Context(), slog.LevelWarn, "slow request", attrs...)
+		})
+	}
+}
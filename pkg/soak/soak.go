@@ -0,0 +1,187 @@
+// Package soak runs the soak tests of the services. They drive traffic at
+// the service for as long as SOAK_DURATION says while sampling goroutines,
+// heap and open file descriptors, and fail when any of them trends upward.
+// They are skipped unless SOAK_DURATION is set:
+//
+//	SOAK_DURATION=2h go test -run TestSoak -timeout 0 -v .
+//
+// SOAK_CONCURRENCY sets the number of concurrent clients (8 by default).
+package soak
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resourceSample is what the process holds at one point of a soak.
+type resourceSample struct {
+	at         time.Duration
+	goroutines int
+	heapBytes  uint64
+	// openFDs is -1 where /proc/self/fd is not available.
+	openFDs int
+}
+
+func sampleResources(at time.Duration) resourceSample {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	fds := -1
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		fds = len(entries)
+	}
+	return resourceSample{at: at, goroutines: runtime.NumGoroutine(), heapBytes: ms.HeapAlloc, openFDs: fds}
+}
+
+// leakChecks are the resources a soak watches, each with the growth over
+// the run it tolerates given where it started.
+var leakChecks = []struct {
+	name    string
+	value   func(resourceSample) float64
+	allowed func(base float64) float64
+}{
+	{"goroutines", func(s resourceSample) float64 { return float64(s.goroutines) },
+		func(base float64) float64 { return max(10, base/10) }},
+	{"heap bytes", func(s resourceSample) float64 { return float64(s.heapBytes) },
+		func(base float64) float64 { return max(8<<20, base/4) }},
+	{"open fds", func(s resourceSample) float64 { return float64(s.openFDs) },
+		func(base float64) float64 { return max(10, base/10) }},
+}
+
+// Duration returns SOAK_DURATION, skipping the test when it is unset.
+func Duration(t *testing.T) time.Duration {
+	t.Helper()
+	v := os.Getenv("SOAK_DURATION")
+	if v == "" {
+		t.Skip("set SOAK_DURATION to run the soak test")
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		t.Fatalf("invalid SOAK_DURATION %q", v)
+	}
+	return d
+}
+
+// Concurrency returns SOAK_CONCURRENCY, the number of concurrent clients.
+func Concurrency() int {
+	if n, err := strconv.Atoi(os.Getenv("SOAK_CONCURRENCY")); err == nil && n > 0 {
+		return n
+	}
+	return 8
+}
+
+// Run calls drive from every client in a loop for duration, samples
+// the resources a hundred times along the way, and checks them once the
+// clients are done. settle runs after every sample and once more at the
+// end, to do what the service's background tasks would, such as pruning
+// history, and to drop idle connections. The first fifth of the run is
+// warm-up and is left out of the trend.
+func Run(t *testing.T, duration time.Duration, drive func(ctx context.Context, client int) error, settle func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		requests int
+		failures int
+		lastErr  error
+	)
+	for i := range Concurrency() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				err := drive(ctx, i)
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				requests++
+				if err != nil {
+					failures++
+					lastErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	interval := max(duration/100, 100*time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start := time.Now()
+	var samples []resourceSample
+sampling:
+	for {
+		select {
+		case <-ctx.Done():
+			break sampling
+		case <-ticker.C:
+			settle()
+			s := sampleResources(time.Since(start))
+			samples = append(samples, s)
+			mu.Lock()
+			t.Logf("%s: %d requests, %d goroutines, %d KiB heap, %d fds",
+				s.at.Round(time.Second), requests, s.goroutines, s.heapBytes>>10, s.openFDs)
+			mu.Unlock()
+		}
+	}
+	wg.Wait()
+	settle()
+
+	if failures > 0 {
+		t.Errorf("%d of %d requests failed, last with: %v", failures, requests, lastErr)
+	}
+	checkLeaks(t, samples[len(samples)/5:])
+}
+
+// checkLeaks fits a line through each resource's samples and fails when
+// the growth it predicts over the run goes past what the check allows.
+func checkLeaks(t *testing.T, samples []resourceSample) {
+	t.Helper()
+	if len(samples) < 5 {
+		t.Fatalf("only %d samples after warm-up; run the soak for longer", len(samples))
+	}
+	span := (samples[len(samples)-1].at - samples[0].at).Seconds()
+	for _, check := range leakChecks {
+		base := check.value(samples[0])
+		if base < 0 {
+			continue
+		}
+		growth := slope(samples, check.value) * span
+		allowed := check.allowed(base)
+		msg := fmt.Sprintf("%s: %.0f at the start of the trend, growing by %.0f over %s (%.0f allowed)",
+			check.name, base, growth, time.Duration(span*float64(time.Second)).Round(time.Second), allowed)
+		if growth > allowed {
+			t.Error(msg)
+		} else {
+			t.Log(msg)
+		}
+	}
+}
+
+// slope is the least-squares slope of value over time, per second.
+func slope(samples []resourceSample, value func(resourceSample) float64) float64 {
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range samples {
+		x, y := s.at.Seconds(), value(s)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(samples))
+	d := n*sumXX - sumX*sumX
+	if d == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / d
+}
@@ -0,0 +1,35 @@
+// Package synthetic tells synthetic traffic apart from real requests.
+package synthetic
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Baggage members that mark a request as synthetic traffic, as sent by
+// cmd/loadgen. They travel from service A to service B with the rest of
+// the baggage.
+const (
+	BaggageKey    = "synthetic"
+	RunBaggageKey = "loadgen.run"
+)
+
+// Middleware tags the server span of requests whose
+// baggage carries synthetic=true with the synthetic attribute, so that
+// load tests can be filtered out of dashboards and alerts.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bag := baggage.FromContext(r.Context())
+		if bag.Member(BaggageKey).Value() == "true" {
+			attrs := []attribute.KeyValue{attribute.Bool("synthetic", true)}
+			if run := bag.Member(RunBaggageKey).Value(); run != "" {
+				attrs = append(attrs, attribute.String("loadgen.run", run))
+			}
+			trace.SpanFromContext(r.Context()).SetAttributes(attrs...)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,190 @@
+// Package watchdog warns about leaks and stalls of the process.
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Config sets what the watchdog considers anomalous. A zero limit
+// disables its check.
+type Config struct {
+	// Interval is how often the process is sampled; zero disables the
+	// watchdog.
+	Interval      time.Duration
+	MaxGoroutines int
+	MaxHeapBytes  uint64
+	// MaxLag bounds how late a timer of the watchdog may fire: when the
+	// scheduler is this far behind, so are the handlers.
+	MaxLag time.Duration
+	// DumpDir receives a goroutine and a heap profile when a check starts
+	// failing, at most once per DumpCooldown; empty disables the dumps.
+	DumpDir      string
+	DumpCooldown time.Duration
+}
+
+// Watchdog samples the goroutine count, the heap and the scheduling lag of
+// the process, and warns when one of them goes past its limit. Leaks and
+// stalls then show up in the log and the metrics before the process is
+// killed, and the dumps it leaves behind tell what it was doing.
+type Watchdog struct {
+	service string
+	cfg     Config
+
+	failing  map[string]bool
+	lastDump time.Time
+	lag      metric.Float64Histogram
+	alerts   metric.Int64Counter
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a watchdog of service, recording its metrics with meter.
+func New(service string, cfg Config, meter metric.Meter) *Watchdog {
+	w := &Watchdog{
+		service: service,
+		cfg:     cfg,
+		failing: make(map[string]bool),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	var err error
+	w.lag, err = meter.Float64Histogram("watchdog.scheduling_lag",
+		metric.WithDescription("How late the watchdog's timer fired, as a proxy for how long runnable goroutines wait"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		log.Printf("Error creating watchdog lag histogram: %v", err)
+	}
+	w.alerts, err = meter.Int64Counter("watchdog.alerts",
+		metric.WithDescription("Times a watchdog check started failing, by check"),
+		metric.WithUnit("{alert}"),
+	)
+	if err != nil {
+		log.Printf("Error creating watchdog alert counter: %v", err)
+	}
+	_, err = meter.Int64ObservableGauge("watchdog.goroutines",
+		metric.WithDescription("Goroutines of the process"),
+		metric.WithUnit("{goroutine}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(runtime.NumGoroutine()))
+			return nil
+		}),
+	)
+	if err != nil {
+		log.Printf("Error creating watchdog goroutine gauge: %v", err)
+	}
+	return w
+}
+
+func (w *Watchdog) Start() {
+	go w.loop()
+}
+
+func (w *Watchdog) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *Watchdog) loop() {
+	defer close(w.done)
+	timer := time.NewTimer(w.cfg.Interval)
+	defer timer.Stop()
+	armed := time.Now()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-timer.C:
+		}
+		// The real clock, not clock.Now: a pinned clock would hide the lag.
+		lag := max(time.Since(armed)-w.cfg.Interval, 0)
+		w.check(lag)
+		timer.Reset(w.cfg.Interval)
+		armed = time.Now()
+	}
+}
+
+func (w *Watchdog) check(lag time.Duration) {
+	if w.lag != nil {
+		w.lag.Record(context.Background(), lag.Seconds())
+	}
+	goroutines := runtime.NumGoroutine()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	w.observe("goroutines", w.cfg.MaxGoroutines > 0 && goroutines > w.cfg.MaxGoroutines,
+		fmt.Sprintf("%d goroutines, limit %d", goroutines, w.cfg.MaxGoroutines))
+	w.observe("heap", w.cfg.MaxHeapBytes > 0 && mem.HeapAlloc > w.cfg.MaxHeapBytes,
+		fmt.Sprintf("heap at %d MiB, limit %d MiB", mem.HeapAlloc>>20, w.cfg.MaxHeapBytes>>20))
+	w.observe("lag", w.cfg.MaxLag > 0 && lag > w.cfg.MaxLag,
+		fmt.Sprintf("scheduling lag of %s, limit %s", lag.Round(time.Millisecond), w.cfg.MaxLag))
+}
+
+// observe logs when check starts and stops failing, rather than on every
+// sample, and dumps the process when it starts.
+func (w *Watchdog) observe(check string, failing bool, detail string) {
+	if failing == w.failing[check] {
+		return
+	}
+	w.failing[check] = failing
+	if !failing {
+		log.Printf("Watchdog: %s back within limits (%s)", check, detail)
+		return
+	}
+	errlog.Printf("Watchdog: %s over the limit: %s", check, detail)
+	if w.alerts != nil {
+		w.alerts.Add(context.Background(), 1, metric.WithAttributes(attribute.String("check", check)))
+	}
+	w.dump(check)
+}
+
+// dump writes the goroutine stacks and a heap profile to DumpDir, named
+// after the service, the time and the check that failed.
+func (w *Watchdog) dump(check string) {
+	if w.cfg.DumpDir == "" || time.Since(w.lastDump) < w.cfg.DumpCooldown {
+		return
+	}
+	w.lastDump = time.Now()
+	if err := os.MkdirAll(w.cfg.DumpDir, 0o755); err != nil {
+		errlog.Printf("Error creating watchdog dump directory: %v", err)
+		return
+	}
+	prefix := filepath.Join(w.cfg.DumpDir, fmt.Sprintf("%s-%s-%s", w.service, w.lastDump.UTC().Format("20060102T150405Z"), check))
+	for _, p := range []struct {
+		profile, file string
+		debug         int
+	}{
+		{"goroutine", prefix + "-stacks.txt", 2},
+		{"heap", prefix + "-heap.pprof", 0},
+	} {
+		if err := writeProfile(p.profile, p.file, p.debug); err != nil {
+			errlog.Printf("Error dumping %s profile: %v", p.profile, err)
+			continue
+		}
+		log.Printf("Watchdog: wrote %s", p.file)
+	}
+}
+
+func writeProfile(name, path string, debug int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.Lookup(name).WriteTo(f, debug); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,21 @@
+package weather
+
+// Condition is the sky over a city, in terms every weather provider can be
+// mapped onto, so that a result reads the same whichever provider
+// answered it.
+type Condition string
+
+const (
+	ConditionClear        Condition = "clear"
+	ConditionPartlyCloudy Condition = "partly_cloudy"
+	ConditionCloudy       Condition = "cloudy"
+	ConditionFog          Condition = "fog"
+	ConditionDrizzle      Condition = "drizzle"
+	ConditionRain         Condition = "rain"
+	// ConditionSleet is ice falling or forming on the ground: sleet, ice
+	// pellets, freezing drizzle and freezing rain.
+	ConditionSleet   Condition = "sleet"
+	ConditionSnow    Condition = "snow"
+	ConditionStorm   Condition = "storm"
+	ConditionUnknown Condition = "unknown"
+)
@@ -0,0 +1,93 @@
+package weather
+
+import "net/http"
+
+// ErrorCode identifies an error response for machines. Codes are stable
+// across releases and shared by both services; messages are for humans and
+// may change.
+type ErrorCode string
+
+const (
+	CodeInvalidZipcode       ErrorCode = "INVALID_ZIPCODE"
+	CodeZipcodeNotFound      ErrorCode = "ZIPCODE_NOT_FOUND"
+	CodeUpstreamTimeout      ErrorCode = "UPSTREAM_TIMEOUT"
+	CodeUpstreamUnavailable  ErrorCode = "UPSTREAM_UNAVAILABLE"
+	CodeUpstreamSchemaError  ErrorCode = "UPSTREAM_SCHEMA_ERROR"
+	CodeQuotaExceeded        ErrorCode = "QUOTA_EXCEEDED"
+	CodeRateLimited          ErrorCode = "RATE_LIMITED"
+	CodeOverloaded           ErrorCode = "OVERLOADED"
+	CodeUnauthorized         ErrorCode = "UNAUTHORIZED"
+	CodeForbidden            ErrorCode = "FORBIDDEN"
+	CodeBanned               ErrorCode = "BANNED"
+	CodeNotFound             ErrorCode = "NOT_FOUND"
+	CodeMethodNotAllowed     ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeBadRequest           ErrorCode = "BAD_REQUEST"
+	CodeInvalidRequest       ErrorCode = "INVALID_REQUEST"
+	CodePayloadTooLarge      ErrorCode = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedMediaType ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	CodeIdempotencyKeyReused ErrorCode = "IDEMPOTENCY_KEY_REUSED"
+	CodeInternal             ErrorCode = "INTERNAL"
+)
+
+// ErrorDefinition documents an error code. The catalog below drives both
+// the responses and GET /errors of the services, so the published catalog
+// cannot drift from what they return.
+type ErrorDefinition struct {
+	Code   ErrorCode `json:"code"`
+	Status int       `json:"status"`
+	// Retryable tells whether repeating the same request may succeed,
+	// after the Retry-After delay when one is sent.
+	Retryable   bool   `json:"retryable"`
+	Description string `json:"description"`
+}
+
+// ErrorCatalog lists every error code.
+var ErrorCatalog = []ErrorDefinition{
+	{CodeInvalidZipcode, http.StatusUnprocessableEntity, false, "The CEP is missing, is not made of 8 digits or, with CEP_VALIDATION=range, is outside the range of every UF."},
+	{CodeZipcodeNotFound, http.StatusNotFound, false, "No location or weather is known for the CEP."},
+	{CodeUpstreamTimeout, http.StatusGatewayTimeout, true, "The request did not complete within its deadline."},
+	{CodeUpstreamUnavailable, http.StatusServiceUnavailable, true, "A downstream service or provider is unavailable or out of quota."},
+	{CodeUpstreamSchemaError, http.StatusBadGateway, true, "A provider answered with a response that does not match its schema."},
+	{CodeQuotaExceeded, http.StatusTooManyRequests, true, "The tenant used up its daily or monthly quota; retry after it resets."},
+	{CodeRateLimited, http.StatusTooManyRequests, true, "The tenant exceeded its request rate."},
+	{CodeOverloaded, http.StatusServiceUnavailable, true, "The service shed the request under load."},
+	{CodeUnauthorized, http.StatusUnauthorized, false, "The API key or admin token is missing or invalid."},
+	{CodeForbidden, http.StatusForbidden, false, "The client address is not allowed by the network ACL, or the API key is not allowed from the Origin or Referer of the request."},
+	{CodeBanned, http.StatusForbidden, true, "The client is temporarily banned after repeated invalid or rate limited requests."},
+	{CodeNotFound, http.StatusNotFound, false, "The route or resource does not exist."},
+	{CodeMethodNotAllowed, http.StatusMethodNotAllowed, false, "The route does not accept the method; see the Allow header."},
+	{CodeBadRequest, http.StatusBadRequest, false, "The request body could not be read."},
+	{CodeInvalidRequest, http.StatusUnprocessableEntity, false, "The request body failed validation."},
+	{CodePayloadTooLarge, http.StatusRequestEntityTooLarge, false, "The request body, once decompressed, is larger than the service accepts."},
+	{CodeUnsupportedMediaType, http.StatusUnsupportedMediaType, false, "The request body is not JSON sent as application/json in UTF-8, or is compressed in an encoding the service does not accept; see the Accept-Encoding header."},
+	{CodeIdempotencyKeyReused, http.StatusUnprocessableEntity, false, "The Idempotency-Key was already used with a different request."},
+	{CodeInternal, http.StatusInternalServerError, true, "An unexpected error occurred."},
+}
+
+var errorDefinitions = make(map[ErrorCode]ErrorDefinition, len(ErrorCatalog))
+
+func init() {
+	for _, def := range ErrorCatalog {
+		errorDefinitions[def.Code] = def
+	}
+}
+
+// Definition returns the definition of c, if c is a known code.
+func (c ErrorCode) Definition() (ErrorDefinition, bool) {
+	def, ok := errorDefinitions[c]
+	return def, ok
+}
+
+// Status returns the HTTP status of c, 500 for unknown codes.
+func (c ErrorCode) Status() int {
+	if def, ok := errorDefinitions[c]; ok {
+		return def.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// Retryable reports whether a request that failed with c may succeed if
+// repeated.
+func (c ErrorCode) Retryable() bool {
+	return errorDefinitions[c].Retryable
+}
@@ -0,0 +1,71 @@
+package weather
+
+import "fmt"
+
+// Unit is a temperature scale, written as its symbol.
+type Unit string
+
+const (
+	Celsius    Unit = "C"
+	Fahrenheit Unit = "F"
+	Kelvin     Unit = "K"
+)
+
+// kelvinOffset is 273 rather than 273.15: the API has answered
+// K = °C + 273 since its first release, as its specification asks, and
+// clients compare against it.
+const kelvinOffset = 273
+
+// Temperature is a value on a scale. The zero Unit is Celsius.
+type Temperature struct {
+	Value float64 `json:"value"`
+	Unit  Unit    `json:"unit"`
+}
+
+// Celsius returns t in degrees Celsius.
+func (t Temperature) Celsius() float64 {
+	switch t.Unit {
+	case Fahrenheit:
+		return (t.Value - 32) / 1.8
+	case Kelvin:
+		return t.Value - kelvinOffset
+	}
+	return t.Value
+}
+
+// Fahrenheit returns t in degrees Fahrenheit.
+func (t Temperature) Fahrenheit() float64 {
+	if t.Unit == Fahrenheit {
+		return t.Value
+	}
+	return t.Celsius()*1.8 + 32
+}
+
+// Kelvin returns t in kelvins.
+func (t Temperature) Kelvin() float64 {
+	if t.Unit == Kelvin {
+		return t.Value
+	}
+	return t.Celsius() + kelvinOffset
+}
+
+// In returns t converted to unit u.
+func (t Temperature) In(u Unit) Temperature {
+	switch u {
+	case Fahrenheit:
+		return Temperature{Value: t.Fahrenheit(), Unit: Fahrenheit}
+	case Kelvin:
+		return Temperature{Value: t.Kelvin(), Unit: Kelvin}
+	}
+	return Temperature{Value: t.Celsius(), Unit: Celsius}
+}
+
+func (t Temperature) String() string {
+	switch t.Unit {
+	case Fahrenheit:
+		return fmt.Sprintf("%.1f°F", t.Value)
+	case Kelvin:
+		return fmt.Sprintf("%.1f K", t.Value)
+	}
+	return fmt.Sprintf("%.1f°C", t.Value)
+}
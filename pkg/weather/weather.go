@@ -0,0 +1,46 @@
+// Package weather holds the domain types of the otel-goexpert APIs: the
+// location a lookup asks for, the temperature and weather it gets back,
+// and the error codes of failed lookups. Both services answer with them,
+// and consumers decode responses into them, so the three agree on the wire
+// format by construction.
+package weather
+
+// Location is what a lookup asks the weather of: a CEP, or a city for
+// callers located some other way. Service A takes the CEP only; service B
+// takes either.
+type Location struct {
+	Cep  string `json:"cep,omitempty"`
+	City string `json:"city,omitempty"`
+}
+
+// Result is the weather of a location, as the services answer it.
+type Result struct {
+	City  string  `json:"city"`
+	TempC float64 `json:"temp_C"`
+	TempF float64 `json:"temp_F"`
+	TempK float64 `json:"temp_K"`
+	// Condition is the normalized sky over the city. ConditionCode and
+	// Provider, the answering provider's own code and the provider, are
+	// only answered in extended mode: the code means nothing without the
+	// provider.
+	Condition     Condition `json:"condition,omitempty"`
+	ConditionCode string    `json:"condition_code,omitempty"`
+	Provider      string    `json:"provider,omitempty"`
+	// Approximate marks the weather of the city the caller was located in
+	// by address, answered to a request without a CEP.
+	Approximate bool `json:"approximate,omitempty"`
+	// DefaultLocation marks the weather of the configured default
+	// location, answered when the location of the request could not be
+	// resolved.
+	DefaultLocation bool `json:"default_location,omitempty"`
+}
+
+// NewResult returns the result for city at temperature t, in every unit.
+func NewResult(city string, t Temperature) Result {
+	return Result{City: city, TempC: t.Celsius(), TempF: t.Fahrenheit(), TempK: t.Kelvin()}
+}
+
+// Temperature returns the temperature of r.
+func (r Result) Temperature() Temperature {
+	return Temperature{Value: r.TempC, Unit: Celsius}
+}
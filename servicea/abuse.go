@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/netacl"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// offenseMemory is how long past bans count towards escalating the next.
+const offenseMemory = 24 * time.Hour
+
+// banStore keeps strikes and bans per client. The Redis implementation
+// shares them between replicas.
+type banStore interface {
+	// Strike records a strike against client and returns how many it
+	// collected within window.
+	Strike(ctx context.Context, client string, window time.Duration) (int, error)
+	// Ban bans client for base doubled once per ban it received in the
+	// last offenseMemory, capped at limit, and returns the duration.
+	Ban(ctx context.Context, client string, base, limit time.Duration) (time.Duration, error)
+	// Banned returns how long client stays banned, zero if it isn't.
+	Banned(ctx context.Context, client string) (time.Duration, error)
+}
+
+// banDuration doubles base for each previous offense, up to limit.
+func banDuration(offenses int, base, limit time.Duration) time.Duration {
+	d := base
+	for i := 1; i < offenses && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// abuseGuard temporarily bans clients that keep sending invalid CEPs or
+// running into rate limits and quotas.
+type abuseGuard struct {
+	store     banStore
+	acl       *netacl.ACL
+	threshold int
+	window    time.Duration
+	banBase   time.Duration
+	banMax    time.Duration
+	auditLog  *audit.Logger
+	strikes   metric.Int64Counter
+	bans      metric.Int64Counter
+	rejected  metric.Int64Counter
+}
+
+func newAbuseGuard(store banStore, acl *netacl.ACL, threshold int, window, banBase, banMax time.Duration, auditLog *audit.Logger, meter metric.Meter) *abuseGuard {
+	g := &abuseGuard{
+		store:     store,
+		acl:       acl,
+		threshold: threshold,
+		window:    window,
+		banBase:   banBase,
+		banMax:    max(banBase, banMax),
+		auditLog:  auditLog,
+	}
+
+	var err error
+	g.strikes, err = meter.Int64Counter("abuse.strikes",
+		metric.WithDescription("Invalid or rate limited requests counted against clients, by reason"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		log.Printf("Error creating abuse strike counter: %v", err)
+	}
+	g.bans, err = meter.Int64Counter("abuse.bans",
+		metric.WithDescription("Temporary client bans issued"),
+		metric.WithUnit("{ban}"),
+	)
+	if err != nil {
+		log.Printf("Error creating abuse ban counter: %v", err)
+	}
+	g.rejected, err = meter.Int64Counter("abuse.rejected",
+		metric.WithDescription("Requests rejected from banned clients"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		log.Printf("Error creating abuse rejection counter: %v", err)
+	}
+	return g
+}
+
+// strikeReason classifies a response status as abusive, or returns "".
+func strikeReason(status int) string {
+	switch status {
+	case http.StatusUnprocessableEntity:
+		return "invalid_cep"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	}
+	return ""
+}
+
+func (g *abuseGuard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g.threshold <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		addr, ok := g.acl.ClientAddr(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := addr.String()
+		ctx := r.Context()
+
+		remaining, err := g.store.Banned(ctx, client)
+		if err != nil {
+			// Fail open: a store outage must not lock everyone out.
+			errlog.Printf("Error checking ban for %s: %v", client, err)
+		}
+		if remaining > 0 {
+			if g.rejected != nil {
+				g.rejected.Add(ctx, 1)
+			}
+			httpapi.SetRetryAfter(w, remaining)
+			httpapi.RespondWithError(w, weather.CodeBanned, "temporarily banned", ctx)
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		reason := strikeReason(ww.Status())
+		if reason == "" {
+			return
+		}
+		// Count the strike even if the client went away meanwhile.
+		ctx = context.WithoutCancel(ctx)
+		if g.strikes != nil {
+			g.strikes.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", reason)))
+		}
+		n, err := g.store.Strike(ctx, client, g.window)
+		if err != nil {
+			errlog.Printf("Error recording strike for %s: %v", client, err)
+			return
+		}
+		if n < g.threshold {
+			return
+		}
+
+		d, err := g.store.Ban(ctx, client, g.banBase, g.banMax)
+		if err != nil {
+			errlog.Printf("Error banning %s: %v", client, err)
+			return
+		}
+		if g.bans != nil {
+			g.bans.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", reason)))
+		}
+		log.Printf("Banned %s for %s after %d strikes (%s)", client, d, n, reason)
+		g.auditLog.Record(ctx, client, "abuse.ban", "success", map[string]string{
+			"reason":   reason,
+			"strikes":  strconv.Itoa(n),
+			"duration": d.String(),
+		})
+	})
+}
+
+// memoryBanStore keeps strikes and bans in process memory.
+type memoryBanStore struct {
+	mu      sync.Mutex
+	clients map[string]*clientRecord
+}
+
+type clientRecord struct {
+	strikes     int
+	windowEnd   time.Time
+	bannedUntil time.Time
+	offenses    int
+	lastBan     time.Time
+}
+
+func newMemoryBanStore() *memoryBanStore {
+	return &memoryBanStore{clients: make(map[string]*clientRecord)}
+}
+
+func (s *memoryBanStore) record(client string) *clientRecord {
+	rec, ok := s.clients[client]
+	if !ok {
+		rec = &clientRecord{}
+		s.clients[client] = rec
+	}
+	return rec
+}
+
+func (s *memoryBanStore) Strike(_ context.Context, client string, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	if len(s.clients) >= 10000 {
+		s.sweep(now)
+	}
+	rec := s.record(client)
+	if now.After(rec.windowEnd) {
+		rec.strikes = 0
+		rec.windowEnd = now.Add(window)
+	}
+	rec.strikes++
+	return rec.strikes, nil
+}
+
+func (s *memoryBanStore) Ban(_ context.Context, client string, base, limit time.Duration) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	rec := s.record(client)
+	if now.Sub(rec.lastBan) > offenseMemory {
+		rec.offenses = 0
+	}
+	rec.offenses++
+	rec.lastBan = now
+	rec.strikes = 0
+	d := banDuration(rec.offenses, base, limit)
+	rec.bannedUntil = now.Add(d)
+	return d, nil
+}
+
+func (s *memoryBanStore) Banned(_ context.Context, client string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.clients[client]
+	if !ok {
+		return 0, nil
+	}
+	return max(0, rec.bannedUntil.Sub(clock.Now())), nil
+}
+
+// sweep forgets clients with nothing left to remember.
+func (s *memoryBanStore) sweep(now time.Time) {
+	for client, rec := range s.clients {
+		if now.After(rec.windowEnd) && now.After(rec.bannedUntil) && now.Sub(rec.lastBan) > offenseMemory {
+			delete(s.clients, client)
+		}
+	}
+}
+
+// redisBanStore keeps strikes and bans in Redis under keyPrefix, so every
+// replica enforces the same bans.
+type redisBanStore struct {
+	client    *redis.Client
+	keyPrefix string
+}
+
+func newRedisBanStore(client *redis.Client, keyPrefix string) *redisBanStore {
+	return &redisBanStore{client: client, keyPrefix: keyPrefix}
+}
+
+func (s *redisBanStore) key(kind, client string) string {
+	return s.keyPrefix + kind + ":" + client
+}
+
+func (s *redisBanStore) Strike(ctx context.Context, client string, window time.Duration) (int, error) {
+	key := s.key("strikes", client)
+	pipe := s.client.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+func (s *redisBanStore) Ban(ctx context.Context, client string, base, limit time.Duration) (time.Duration, error) {
+	key := s.key("offenses", client)
+	pipe := s.client.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, offenseMemory)
+	pipe.Del(ctx, s.key("strikes", client))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	d := banDuration(int(incr.Val()), base, limit)
+	if err := s.client.Set(ctx, s.key("ban", client), 1, d).Err(); err != nil {
+		return 0, err
+	}
+	return d, nil
+}
+
+func (s *redisBanStore) Banned(ctx context.Context, client string) (time.Duration, error) {
+	ttl, err := s.client.PTTL(ctx, s.key("ban", client)).Result()
+	if err != nil {
+		return 0, err
+	}
+	// PTTL reports missing keys with negative durations.
+	return max(0, ttl), nil
+}
+
+// fallbackBanStore keeps strikes and bans in Redis, and in memory while
+// Redis is unavailable.
+type fallbackBanStore struct {
+	shared   banStore
+	local    banStore
+	fallback *stateFallback
+}
+
+func (s *fallbackBanStore) Strike(ctx context.Context, client string, window time.Duration) (n int, err error) {
+	err = s.fallback.run(ctx,
+		func() (err error) { n, err = s.shared.Strike(ctx, client, window); return err },
+		func() (err error) { n, err = s.local.Strike(ctx, client, window); return err },
+	)
+	return n, err
+}
+
+func (s *fallbackBanStore) Ban(ctx context.Context, client string, base, limit time.Duration) (d time.Duration, err error) {
+	err = s.fallback.run(ctx,
+		func() (err error) { d, err = s.shared.Ban(ctx, client, base, limit); return err },
+		func() (err error) { d, err = s.local.Ban(ctx, client, base, limit); return err },
+	)
+	return d, err
+}
+
+// Banned also holds the bans issued in memory during an outage once Redis
+// is back.
+func (s *fallbackBanStore) Banned(ctx context.Context, client string) (time.Duration, error) {
+	local, err := s.local.Banned(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+	shared := time.Duration(0)
+	err = s.fallback.run(ctx,
+		func() (err error) { shared, err = s.shared.Banned(ctx, client); return err },
+		func() error { return nil },
+	)
+	return max(local, shared), err
+}
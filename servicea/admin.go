@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joaolima7/otel-goexpert/pkg/admin"
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/cron"
+	"github.com/joaolima7/otel-goexpert/pkg/debugcapture"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/redact"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// adminRoutes mounts the admin API under /admin.
+func adminRoutes(cfg config, auditLog *audit.Logger, masker *masking.Masker, capturer *debugcapture.Capturer, tenants *tenantRegistry, sched *cron.Scheduler) http.Handler {
+	r := chi.NewRouter()
+	r.Use(admin.Auth(cfg.AdminToken, auditLog, masker))
+
+	r.Get("/config", func(w http.ResponseWriter, r *http.Request) {
+		httpapi.Render(w, http.StatusOK, redact.Config(cfg), r.Context())
+	})
+	r.Get("/cron", sched.HandleStatus)
+	r.Get("/clock", admin.HandleClock)
+	r.Post("/clock/advance", admin.ClockAdvanceHandler(auditLog))
+	r.Get("/debug/captures", capturer.HandleList)
+	r.Delete("/debug/captures", capturer.HandleClear)
+	r.Mount("/sampling", traceSampler.AdminRoutes(auditLog))
+
+	r.Get("/tenants/{id}/usage", func(w http.ResponseWriter, r *http.Request) {
+		t, ok := tenants.byID[chi.URLParam(r, "id")]
+		if !ok {
+			httpapi.RespondWithError(w, weather.CodeNotFound, "tenant not found", r.Context())
+			return
+		}
+		usage, err := tenants.usage.Usage(r.Context(), t)
+		if err != nil {
+			errlog.Printf("Error reading usage of tenant %s: %v", t.ID, err)
+			httpapi.RespondWithError(w, weather.CodeInternal, "failed to read usage", r.Context())
+			return
+		}
+		httpapi.Render(w, http.StatusOK, usage, r.Context())
+	})
+
+	return r
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// autocertConfig enables automatic certificates from an ACME CA such as
+// Let's Encrypt.
+type autocertConfig struct {
+	Domains  []string
+	CacheDir string
+	Email    string
+	// HTTPAddr serves HTTP-01 challenges and redirects everything else to
+	// HTTPS. TLS-ALPN-01 challenges are answered on the TLS listener.
+	HTTPAddr string
+}
+
+func newAutocertManager(cfg autocertConfig) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		Email:      cfg.Email,
+	}
+}
+
+// serveACMEChallenges answers HTTP-01 challenges on addr until the process
+// exits.
+func serveACMEChallenges(m *autocert.Manager, addr string) {
+	srv := &http.Server{Addr: addr, Handler: m.HTTPHandler(nil)}
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("ACME HTTP challenge listener stopped: %v", err)
+	}
+}
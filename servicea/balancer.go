@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+)
+
+const (
+	lbRoundRobin   = "round_robin"
+	lbLeastPending = "least_pending"
+)
+
+var errNoEndpoints = errors.New("no service B endpoints available")
+
+// endpoint is a single service B instance tracked by the balancer.
+type endpoint struct {
+	URL string
+	// Host overrides the Host header, set when URL addresses an IP that
+	// was discovered behind a host name.
+	Host string
+
+	pending      atomic.Int64
+	failures     int
+	ejectedUntil time.Time
+}
+
+// balancer spreads requests across service B endpoints and temporarily
+// ejects endpoints after consecutive failures. When every endpoint is
+// ejected it keeps sending traffic to the one closest to recovery rather
+// than failing outright.
+type balancer struct {
+	strategy    string
+	maxFailures int
+	ejectFor    time.Duration
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	next      int
+}
+
+func newBalancer(strategy string, maxFailures int, ejectFor time.Duration) *balancer {
+	if strategy != lbRoundRobin && strategy != lbLeastPending {
+		log.Printf("Unknown load balancing strategy %q, using %q", strategy, lbRoundRobin)
+		strategy = lbRoundRobin
+	}
+	return &balancer{
+		strategy:    strategy,
+		maxFailures: maxFailures,
+		ejectFor:    ejectFor,
+	}
+}
+
+// SetEndpoints replaces the endpoint set, keeping the health state of
+// endpoints that are still present.
+func (b *balancer) SetEndpoints(urls []string, host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	existing := make(map[string]*endpoint, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		existing[ep.URL] = ep
+	}
+
+	endpoints := make([]*endpoint, 0, len(urls))
+	for _, u := range urls {
+		if ep, ok := existing[u]; ok {
+			endpoints = append(endpoints, ep)
+			continue
+		}
+		endpoints = append(endpoints, &endpoint{URL: u, Host: host})
+	}
+	b.endpoints = endpoints
+}
+
+// Pick selects the endpoint for the next request and marks it as having
+// one more request in flight. Callers must report the outcome with Done.
+func (b *balancer) Pick() (*endpoint, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.endpoints) == 0 {
+		return nil, errNoEndpoints
+	}
+
+	now := clock.Now()
+	var healthy []*endpoint
+	for _, ep := range b.endpoints {
+		if now.After(ep.ejectedUntil) {
+			healthy = append(healthy, ep)
+		}
+	}
+
+	var picked *endpoint
+	switch {
+	case len(healthy) == 0:
+		picked = b.endpoints[0]
+		for _, ep := range b.endpoints[1:] {
+			if ep.ejectedUntil.Before(picked.ejectedUntil) {
+				picked = ep
+			}
+		}
+	case b.strategy == lbLeastPending:
+		picked = healthy[0]
+		for _, ep := range healthy[1:] {
+			if ep.pending.Load() < picked.pending.Load() {
+				picked = ep
+			}
+		}
+	default:
+		b.next++
+		picked = healthy[b.next%len(healthy)]
+	}
+
+	picked.pending.Add(1)
+	return picked, nil
+}
+
+// Done records the outcome of a request sent to ep.
+func (b *balancer) Done(ep *endpoint, healthy bool) {
+	ep.pending.Add(-1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if healthy {
+		if b.maxFailures > 0 && ep.failures >= b.maxFailures {
+			log.Printf("Service B endpoint %s recovered", ep.URL)
+		}
+		ep.failures = 0
+		ep.ejectedUntil = time.Time{}
+		return
+	}
+
+	ep.failures++
+	if b.maxFailures > 0 && ep.failures >= b.maxFailures {
+		ep.ejectedUntil = clock.Now().Add(b.ejectFor)
+		errlog.Printf("Ejecting service B endpoint %s for %s after %d consecutive failures", ep.URL, b.ejectFor, ep.failures)
+	}
+}
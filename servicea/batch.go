@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type batchRequest struct {
+	Ceps []string `json:"ceps"`
+}
+
+// batchItem is the outcome of one CEP of a batch, in input order, with the
+// CEP as the caller sent it: CEP_MASKING only applies to logs and spans.
+// Status is what POST /cep would have answered for it alone, except that
+// every failure past validation is reported as 502, with Code telling them
+// apart.
+type batchItem struct {
+	Cep        string            `json:"cep"`
+	Status     int               `json:"status"`
+	Code       weather.ErrorCode `json:"code,omitempty"`
+	City       string            `json:"city,omitempty"`
+	TempC      *float64          `json:"temp_C,omitempty"`
+	TempF      *float64          `json:"temp_F,omitempty"`
+	TempK      *float64          `json:"temp_K,omitempty"`
+	Condition  weather.Condition `json:"condition,omitempty"`
+	DurationMs float64           `json:"duration_ms"`
+}
+
+type batchResponse struct {
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Results   []batchItem `json:"results"`
+}
+
+// batchStatus is the status of the batch as a whole: the status shared by
+// every item, or 207 Multi-Status when they differ.
+func batchStatus(items []batchItem) int {
+	status := http.StatusOK
+	for i, item := range items {
+		if i == 0 {
+			status = item.Status
+		} else if item.Status != status {
+			return http.StatusMultiStatus
+		}
+	}
+	return status
+}
+
+// batchItemStatus maps the error code of a failed item to its status.
+func batchItemStatus(code weather.ErrorCode) int {
+	switch code {
+	case weather.CodeInvalidZipcode, weather.CodeZipcodeNotFound:
+		return code.Status()
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// lookupErrorCode maps a failed call to service B to its API error code.
+func lookupErrorCode(err error) weather.ErrorCode {
+	return apperrors.CodeOf(err)
+}
+
+// batchHandler looks up several CEPs at once, concurrency of them at a
+// time, each within itemTimeout. A failed CEP doesn't fail the batch:
+// every item carries its own status, error code and timing. Batches are
+// capped at maxSize CEPs, or at the tenant's max_batch_size when it sets
+// one.
+type batchHandler struct {
+	maxSize     int
+	concurrency int
+	itemTimeout time.Duration
+	// lookup calls service B: it is serviceBClient.Lookup outside of
+	// tests.
+	lookup     func(ctx context.Context, cep string) ([]byte, error)
+	strictness cep.Strictness
+	masker     *masking.Masker
+	tracer     trace.Tracer
+}
+
+func (h *batchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.tracer.Start(r.Context(), "handle_batch_request")
+	defer span.End()
+
+	var req batchRequest
+	if err := httpapi.DecodeRequest(r, &req); err != nil {
+		httpapi.RespondWithDecodeError(w, err, weather.CodeInvalidRequest, "invalid request body", ctx)
+		return
+	}
+	limit := h.maxSize
+	if t, ok := tenantFromContext(ctx); ok && t.MaxBatchSize > 0 {
+		limit = t.MaxBatchSize
+	}
+	if len(req.Ceps) == 0 {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, "ceps must not be empty", ctx)
+		return
+	}
+	if len(req.Ceps) > limit {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, fmt.Sprintf("at most %d ceps per batch", limit), ctx)
+		return
+	}
+	span.SetAttributes(attribute.Int("batch.size", len(req.Ceps)))
+
+	items := make([]batchItem, len(req.Ceps))
+	done := make([]chan struct{}, len(req.Ceps))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	go func() {
+		sem := make(chan struct{}, max(h.concurrency, 1))
+		for i, cep := range req.Ceps {
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem; close(done[i]) }()
+				items[i] = h.lookupItem(ctx, cep)
+			}()
+		}
+	}()
+
+	// A streamed batch is answered 200 before its items are known, so
+	// each line carries its own status.
+	var stream *httpapi.ResponseStream
+	if wantsBatchStream(r) {
+		stream = httpapi.NewResponseStream(w, http.StatusOK, batchStreamType+"; charset=utf-8")
+	}
+	for i := range items {
+		<-done[i]
+		if stream != nil {
+			stream.Encode(items[i])
+		}
+	}
+
+	resp := batchResponse{Results: items}
+	for _, item := range items {
+		if item.Status == http.StatusOK {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+	}
+	status := batchStatus(items)
+	span.SetAttributes(
+		attribute.Int("batch.succeeded", resp.Succeeded),
+		attribute.Int("batch.failed", resp.Failed),
+	)
+	if stream != nil {
+		if err := stream.Flush(); err != nil {
+			errlog.Printf("Error streaming batch: %v", err)
+		}
+		return
+	}
+	httpapi.Render(w, status, resp, ctx)
+}
+
+// batchStreamType is the type a client accepts to have its batch streamed:
+// one item per line, in input order, each written as soon as it and the
+// ones before it are done, rather than the whole batch once the slowest
+// CEP is.
+const batchStreamType = "application/x-ndjson"
+
+// wantsBatchStream reports whether the Accept of r names batchStreamType.
+func wantsBatchStream(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		media, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && media == batchStreamType && params["q"] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupItem looks up raw, which the item reports as given.
+func (h *batchHandler) lookupItem(ctx context.Context, raw string) batchItem {
+	start := time.Now()
+	item := batchItem{Cep: raw}
+
+	fail := func(code weather.ErrorCode) batchItem {
+		item.Status, item.Code = batchItemStatus(code), code
+		item.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		return item
+	}
+	c, err := cep.Normalize(raw)
+	if err != nil || !isValidCep(c, h.strictness) {
+		return fail(weather.CodeInvalidZipcode)
+	}
+	if h.itemTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.itemTimeout)
+		defer cancel()
+	}
+
+	body, err := h.lookup(ctx, c)
+	if err != nil {
+		code := lookupErrorCode(err)
+		if code == weather.CodeInternal {
+			errlog.Printf("Error calling service B for CEP %s: %v", h.masker.Cep(c), err)
+		}
+		return fail(code)
+	}
+	var result weather.Result
+	if err := json.Unmarshal(body, &result); err != nil {
+		errlog.Printf("Error decoding service B response for CEP %s: %v", h.masker.Cep(c), err)
+		return fail(weather.CodeInternal)
+	}
+	item.Status = http.StatusOK
+	item.City = result.City
+	item.TempC, item.TempF, item.TempK = &result.TempC, &result.TempF, &result.TempK
+	item.Condition = result.Condition
+	item.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	return item
+}
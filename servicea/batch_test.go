@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// testTracer and testMeter stand in for the tracer and meter fx provides.
+var (
+	testTracer = tracenoop.NewTracerProvider().Tracer("test")
+	testMeter  = metricnoop.NewMeterProvider().Meter("test")
+)
+
+// fakeServiceB answers the lookups of a batch by CEP: known CEPs resolve,
+// the others fail with the error mapped to them.
+func fakeServiceB(failures map[string]error) func(ctx context.Context, cep string) ([]byte, error) {
+	return func(ctx context.Context, cep string) ([]byte, error) {
+		if err, ok := failures[cep]; ok {
+			return nil, err
+		}
+		return json.Marshal(weather.Result{City: "São Paulo", TempC: 28.5, TempF: 83.3, TempK: 301.5})
+	}
+}
+
+var batchFailures = map[string]error{
+	"00000000": apperrors.ErrCepNotFound,
+	"11111111": apperrors.ErrInvalidCep,
+	"22222222": apperrors.ErrUpstreamTimeout,
+	"33333333": httpapi.WithRetryAfter(apperrors.ErrUpstreamUnavailable, time.Second),
+	"44444444": errors.New("unexpected status code: 500"),
+	"55555555": context.DeadlineExceeded,
+}
+
+func postBatch(t *testing.T, h http.Handler, ceps []string, ctx context.Context) (*httptest.ResponseRecorder, batchResponse) {
+	t.Helper()
+	body, err := json.Marshal(batchRequest{Ceps: ceps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/cep/batch", strings.NewReader(string(body))).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var resp batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response: %v\n%s", err, rec.Body)
+	}
+	return rec, resp
+}
+
+func TestBatchItemStatuses(t *testing.T) {
+	// Masking hides CEPs from the logs, not from the caller who sent them.
+	masker, err := masking.New(string(masking.Truncate), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &batchHandler{maxSize: 100, concurrency: 4, itemTimeout: time.Second, lookup: fakeServiceB(batchFailures), strictness: cep.Format, masker: masker, tracer: testTracer}
+
+	tests := []struct {
+		cep    string
+		status int
+		code   weather.ErrorCode
+	}{
+		{"01001000", http.StatusOK, ""},
+		{"00000000", http.StatusNotFound, weather.CodeZipcodeNotFound},
+		{"123", http.StatusUnprocessableEntity, weather.CodeInvalidZipcode},
+		{"abcdefgh", http.StatusUnprocessableEntity, weather.CodeInvalidZipcode},
+		{"11111111", http.StatusUnprocessableEntity, weather.CodeInvalidZipcode},
+		{"22222222", http.StatusBadGateway, weather.CodeUpstreamTimeout},
+		{"33333333", http.StatusBadGateway, weather.CodeUpstreamUnavailable},
+		{"44444444", http.StatusBadGateway, weather.CodeInternal},
+		{"55555555", http.StatusBadGateway, weather.CodeUpstreamTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cep, func(t *testing.T) {
+			rec, resp := postBatch(t, h, []string{tt.cep}, context.Background())
+			if rec.Code != tt.status {
+				t.Errorf("batch status = %d, want %d", rec.Code, tt.status)
+			}
+			if len(resp.Results) != 1 {
+				t.Fatalf("got %d results, want 1", len(resp.Results))
+			}
+			item := resp.Results[0]
+			if item.Cep != tt.cep {
+				t.Errorf("cep = %q, want %q", item.Cep, tt.cep)
+			}
+			if item.Status != tt.status {
+				t.Errorf("item status = %d, want %d", item.Status, tt.status)
+			}
+			if item.Code != tt.code {
+				t.Errorf("code = %q, want %q", item.Code, tt.code)
+			}
+			if item.DurationMs < 0 {
+				t.Errorf("duration_ms = %v, want >= 0", item.DurationMs)
+			}
+			ok := tt.status == http.StatusOK
+			if ok != (item.City != "" && item.TempC != nil && item.TempF != nil && item.TempK != nil) {
+				t.Errorf("weather fields = %+v, want them only on success", item)
+			}
+		})
+	}
+}
+
+func TestBatchEnvelopeStatus(t *testing.T) {
+	h := &batchHandler{maxSize: 100, concurrency: 4, itemTimeout: time.Second, lookup: fakeServiceB(batchFailures), strictness: cep.Format, tracer: testTracer}
+
+	tests := []struct {
+		name      string
+		ceps      []string
+		status    int
+		succeeded int
+		failed    int
+	}{
+		{"all found", []string{"01001000", "20040002"}, http.StatusOK, 2, 0},
+		{"all not found", []string{"00000000", "00000000"}, http.StatusNotFound, 0, 2},
+		{"all invalid", []string{"123", "11111111"}, http.StatusUnprocessableEntity, 0, 2},
+		{"all upstream failures", []string{"22222222", "33333333", "44444444"}, http.StatusBadGateway, 0, 3},
+		{"found and not found", []string{"01001000", "00000000"}, http.StatusMultiStatus, 1, 1},
+		{"found and invalid", []string{"01001000", "123"}, http.StatusMultiStatus, 1, 1},
+		{"found and upstream failure", []string{"01001000", "22222222"}, http.StatusMultiStatus, 1, 1},
+		{"failures only, mixed", []string{"00000000", "123", "44444444"}, http.StatusMultiStatus, 0, 3},
+		{"everything", []string{"01001000", "00000000", "123", "33333333"}, http.StatusMultiStatus, 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resp := postBatch(t, h, tt.ceps, context.Background())
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if resp.Succeeded != tt.succeeded || resp.Failed != tt.failed {
+				t.Errorf("succeeded/failed = %d/%d, want %d/%d", resp.Succeeded, resp.Failed, tt.succeeded, tt.failed)
+			}
+			if len(resp.Results) != len(tt.ceps) {
+				t.Fatalf("got %d results, want %d", len(resp.Results), len(tt.ceps))
+			}
+			for i, item := range resp.Results {
+				if item.Cep != tt.ceps[i] {
+					t.Errorf("result %d is for %q, want %q: results must keep input order", i, item.Cep, tt.ceps[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBatchItemTimeout(t *testing.T) {
+	slow := func(ctx context.Context, cep string) ([]byte, error) {
+		if cep == "99999999" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return fakeServiceB(nil)(ctx, cep)
+	}
+	h := &batchHandler{maxSize: 100, concurrency: 4, itemTimeout: 20 * time.Millisecond, lookup: slow, strictness: cep.Format, tracer: testTracer}
+
+	rec, resp := postBatch(t, h, []string{"01001000", "99999999"}, context.Background())
+	if rec.Code != http.StatusMultiStatus {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusMultiStatus)
+	}
+	if item := resp.Results[1]; item.Code != weather.CodeUpstreamTimeout || item.DurationMs < 20 {
+		t.Errorf("slow item = %+v, want %s after at least 20ms", item, weather.CodeUpstreamTimeout)
+	}
+	if item := resp.Results[0]; item.Status != http.StatusOK {
+		t.Errorf("fast item status = %d, want %d", item.Status, http.StatusOK)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	h := &batchHandler{maxSize: 3, concurrency: 2, itemTimeout: time.Second, lookup: fakeServiceB(nil), strictness: cep.Format, tracer: testTracer}
+	ceps := func(n int) []string {
+		out := make([]string, n)
+		for i := range out {
+			out[i] = fmt.Sprintf("%08d", 1001000+i)
+		}
+		return out
+	}
+	withTenant := func(size int) context.Context {
+		return context.WithValue(context.Background(), tenantKey{}, &tenant{ID: "acme", MaxBatchSize: size})
+	}
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		n        int
+		accepted bool
+	}{
+		{"empty", context.Background(), 0, false},
+		{"at the limit", context.Background(), 3, true},
+		{"over the limit", context.Background(), 4, false},
+		{"tenant raises the limit", withTenant(5), 5, true},
+		{"tenant lowers the limit", withTenant(1), 2, false},
+		{"tenant without a limit", withTenant(0), 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resp := postBatch(t, h, ceps(tt.n), tt.ctx)
+			if tt.accepted && (rec.Code != http.StatusOK || len(resp.Results) != tt.n) {
+				t.Errorf("status = %d with %d results, want %d with %d: %s", rec.Code, len(resp.Results), http.StatusOK, tt.n, rec.Body)
+			}
+			if !tt.accepted {
+				var errResp httpapi.ErrorResponse
+				json.Unmarshal(rec.Body.Bytes(), &errResp)
+				if rec.Code != weather.CodeInvalidRequest.Status() || errResp.Code != weather.CodeInvalidRequest {
+					t.Errorf("got %d %s, want %d %s", rec.Code, errResp.Code, weather.CodeInvalidRequest.Status(), weather.CodeInvalidRequest)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchStream(t *testing.T) {
+	h := &batchHandler{maxSize: 100, concurrency: 2, itemTimeout: time.Second, lookup: fakeServiceB(batchFailures), strictness: cep.Format, tracer: testTracer}
+	ceps := []string{"01001000", "00000000", "123", "22222222"}
+	body, err := json.Marshal(batchRequest{Ceps: ceps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/cep/batch", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 whatever the items", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/x-ndjson") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+	if len(lines) != len(ceps) {
+		t.Fatalf("got %d lines, want one per CEP:\n%s", len(lines), rec.Body)
+	}
+	wantStatus := []int{http.StatusOK, http.StatusNotFound, http.StatusUnprocessableEntity, http.StatusBadGateway}
+	for i, line := range lines {
+		var item batchItem
+		if err := json.Unmarshal([]byte(line), &item); err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+		if item.Status != wantStatus[i] {
+			t.Errorf("line %d: status = %d, want %d, in input order", i+1, item.Status, wantStatus[i])
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/accesslog"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/slowrequest"
+	"github.com/joaolima7/otel-goexpert/pkg/synthetic"
+)
+
+// withServiceMiddleware wraps h in the middleware the service puts in
+// front of every request, minus tracing and the per-route guards.
+func withServiceMiddleware(h http.Handler) http.Handler {
+	chain := []func(http.Handler) http.Handler{
+		middleware.RequestID,
+		httpapi.RenderMiddleware,
+		synthetic.Middleware,
+		quietAccessLogger().Middleware,
+		middleware.Recoverer,
+		slowrequest.Middleware(time.Minute),
+		httpapi.Timeout(time.Minute),
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	return h
+}
+
+// benchmarkRequest serves the same POST to h on every iteration and fails
+// the benchmark if it doesn't get status back.
+func benchmarkRequest(b *testing.B, h http.Handler, target, body string, status int) {
+	b.Helper()
+	b.ReportAllocs()
+	for b.Loop() {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != status {
+			b.Fatalf("status = %d, want %d: %s", rec.Code, status, rec.Body)
+		}
+	}
+}
+
+// quietAccessLogger is the access logger with its output thrown away, so
+// that the benchmarks measure the logging and not the terminal.
+func quietAccessLogger() *accesslog.Logger {
+	return accesslog.New(io.Discard, "")
+}
+
+func BenchmarkCepRequest(b *testing.B) {
+	h := httpapi.RenderMiddleware(&cepHandler{lookup: fakeServiceB(batchFailures), strictness: cep.Format, tracer: testTracer})
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"found", `{"cep":"01001000"}`, http.StatusOK},
+		{"not found", `{"cep":"00000000"}`, http.StatusNotFound},
+		{"invalid cep", `{"cep":"123"}`, http.StatusUnprocessableEntity},
+		{"malformed body", `{"cep":`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			benchmarkRequest(b, h, "/cep", tt.body, tt.status)
+		})
+	}
+}
+
+func BenchmarkCepRequestFormats(b *testing.B) {
+	h := httpapi.RenderMiddleware(&cepHandler{lookup: fakeServiceB(nil), strictness: cep.Format, tracer: testTracer})
+	for _, format := range []string{"json", "xml", "html", "csv"} {
+		b.Run(format, func(b *testing.B) {
+			benchmarkRequest(b, h, "/cep?format="+format, `{"cep":"01001000"}`, http.StatusOK)
+		})
+	}
+}
+
+// BenchmarkCepRequestMiddleware runs a lookup through the middleware
+// service A wraps every request in, to catch regressions the handler
+// benchmarks can't see.
+func BenchmarkCepRequestMiddleware(b *testing.B) {
+	benchmarkRequest(b, withServiceMiddleware(&cepHandler{lookup: fakeServiceB(nil), strictness: cep.Format, tracer: testTracer}), "/cep", `{"cep":"01001000"}`, http.StatusOK)
+}
+
+func BenchmarkBatchRequest(b *testing.B) {
+	h := httpapi.RenderMiddleware(&batchHandler{maxSize: 100, concurrency: 8, itemTimeout: time.Second, lookup: fakeServiceB(batchFailures), strictness: cep.Format, tracer: testTracer})
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"all found", `{"ceps":["01001000","20040002","30130010","40020000","50010000"]}`, http.StatusOK},
+		{"mixed", `{"ceps":["01001000","00000000","123","22222222","33333333"]}`, http.StatusMultiStatus},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			benchmarkRequest(b, h, "/cep/batch", tt.body, tt.status)
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/compression"
+	"github.com/joaolima7/otel-goexpert/pkg/debugcapture"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/metrics"
+	"github.com/joaolima7/otel-goexpert/pkg/outbound"
+	"github.com/joaolima7/otel-goexpert/pkg/profiling"
+	"github.com/joaolima7/otel-goexpert/pkg/server"
+	"github.com/joaolima7/otel-goexpert/pkg/watchdog"
+)
+
+// config is the resolved configuration of service A, read once at startup.
+// Fields tagged secret are masked by GET /admin/config.
+type config struct {
+	CollectorURL string
+	ServiceBURLs []string
+
+	Metrics metrics.Config
+	// TraceSampleRate is the share of traces sampled where no override of
+	// /admin/sampling applies; see sampling.Sampler.
+	TraceSampleRate float64
+	// Profiling uploads CPU and heap profiles to Pyroscope while its URL
+	// is set; see profiling.Profiler.
+	Profiling profiling.Config
+	// Watchdog warns, and optionally dumps the process, when goroutines,
+	// heap or scheduling lag go past their limits; see watchdog.Watchdog.
+	Watchdog watchdog.Config
+
+	CepMasking  string
+	CepHashSalt string `secret:"true"`
+	// CepValidation is how strictly CEPs are checked before a lookup:
+	// format, or range to also refuse CEPs outside every UF.
+	CepValidation string
+	// StrictJSON rejects request bodies with unknown fields, nulls or
+	// values of the wrong type, reporting each problem; see httpapi.DecodeRequest.
+	StrictJSON bool
+	// ErrorDocsURL is where the docs_url of error responses points, with
+	// {code} replaced by the error code.
+	ErrorDocsURL   string
+	SupportContact string
+	// Compression compresses responses with the encoding the client
+	// prefers; see compression.Middleware.
+	Compression compression.Config
+	// DebugCapture records redacted request and response bodies of the
+	// requests that ask for it; see debugcapture.Capturer.
+	DebugCapture debugcapture.Config
+
+	AuditLogPath         string
+	AccessLogSampling    string
+	SlowRequestThreshold time.Duration
+	RequestTimeout       time.Duration
+	ReadinessGrace       time.Duration
+	// StartupVerify checks the dependencies once at boot and logs a
+	// summary; with StartupStrict a failed hard check aborts the start.
+	StartupVerify        bool
+	StartupStrict        bool
+	StartupVerifyTimeout time.Duration
+	// MaxInFlight enables priority-aware load shedding; see shedding.Shedder.
+	MaxInFlight int
+	// POST /cep/batch takes up to BatchMaxSize CEPs, unless the tenant
+	// sets its own limit, and looks up BatchConcurrency of them at a time,
+	// each within RequestTimeout and all within BatchTimeout.
+	BatchMaxSize     int
+	BatchConcurrency int
+	BatchTimeout     time.Duration
+
+	// ACLAllow and ACLDeny restrict who may call the service, and
+	// AdminACLAllow who may call the admin API, as CIDR lists.
+	// X-Forwarded-For is honored only from TrustedProxies.
+	ACLAllow       []string
+	ACLDeny        []string
+	AdminACLAllow  []string
+	TrustedProxies []string
+
+	// Clients collecting AbuseThreshold invalid or rate limited requests
+	// within AbuseWindow are banned for AbuseBanDuration, doubling on
+	// repeat offenses up to AbuseMaxBan. Bans, and the usage counts
+	// quotas are checked against, live in Redis when RedisURL is set, and
+	// in memory while it is unavailable.
+	AbuseThreshold   int
+	AbuseWindow      time.Duration
+	AbuseBanDuration time.Duration
+	AbuseMaxBan      time.Duration
+	RedisURL         string
+
+	// TenantsFile lists the tenants and their API keys; without it the API
+	// requires no key.
+	TenantsFile string
+	// GeoIPDatabase is a MaxMind City database; with it, /cep requests
+	// without a CEP get the weather of the caller's approximate city, for
+	// every caller when GeoIPFallback is set and otherwise for the tenants
+	// with the geoip_fallback feature.
+	GeoIPDatabase string
+	GeoIPFallback bool
+	// DefaultLocation, a CEP or a city, is answered when the location of a
+	// /cep request can't be resolved; see defaultLocation.
+	DefaultLocation string
+	// ResponseCacheSize is how many answers of service B the response
+	// cache keeps; 0 disables it.
+	ResponseCacheSize int
+	// AdminToken is the bearer token of the admin API, which is disabled
+	// while empty.
+	AdminToken string `secret:"true"`
+
+	// EventBus selects where events are published: none, nats or amqp.
+	EventBus            string
+	EventBusURL         string
+	EventSubjectPrefix  string
+	EventAMQP           amqpConfig
+	UsageExportInterval time.Duration
+	// CronSchedule overrides the schedules of the cron tasks, as
+	// "task=spec;task=spec"; see cron.Scheduler.
+	CronSchedule string
+	// Dashboard serves the embedded dashboard at /dashboard, listing the
+	// last DashboardRecentLookups /cep requests of this instance. Its live
+	// stats are sampled every DashboardStatsInterval. It is off unless
+	// asked for: it shows what others looked up to anyone reaching /cep.
+	Dashboard              bool
+	DashboardRecentLookups int
+	DashboardStatsInterval time.Duration
+
+	// Failed upstream calls are retried up to RetryMaxAttempts in total,
+	// while retries stay within RetryBudgetPercent of the calls made in the
+	// last RetryBudgetWindow (plus RetryBudgetMin).
+	RetryMaxAttempts   int
+	RetryBackoff       time.Duration
+	RetryBudgetPercent int
+	RetryBudgetMin     int
+	RetryBudgetWindow  time.Duration
+
+	// IdempotencyTTL is how long responses are kept for replay under their
+	// Idempotency-Key; zero disables it.
+	IdempotencyTTL     time.Duration
+	IdempotencyMaxKeys int
+	// DedupWindow replays identical requests from the same client without
+	// an Idempotency-Key for this long; zero disables it.
+	DedupWindow time.Duration
+
+	LBStrategy      string
+	LBEjectAfter    int
+	LBEjectDuration time.Duration
+	ConsulAddr      string
+	ConsulService   string
+	DNSRefresh      time.Duration
+
+	// Deterministic pins the clock and the random seeds for reproducible
+	// tests; see clock.DeterministicConfig.
+	Deterministic clock.DeterministicConfig
+
+	Outbound outbound.Config
+	Server   server.Config
+	Autocert autocertConfig
+}
+
+// loadConfig reads the configuration from the environment. It fails when
+// the configuration leaves the service without a service B to call.
+func loadConfig() (config, error) {
+	forceHTTP1 := getEnvBool("FORCE_HTTP1", false)
+
+	cfg := config{
+		CollectorURL:    getEnv("OTEL_COLLECTOR_URL", "otel-collector:4317"),
+		TraceSampleRate: getEnvFloat("TRACE_SAMPLE_RATE", 1),
+		Metrics: metrics.Config{
+			AttributeAllow: splitList(getEnv("METRICS_ATTRIBUTE_ALLOW", "")),
+			Temporality:    getEnv("METRICS_TEMPORALITY", metrics.TemporalityCumulative),
+			Interval:       getEnvDuration("METRICS_EXPORT_INTERVAL", 15*time.Second),
+			Prometheus:     getEnvBool("METRICS_PROMETHEUS", false),
+		},
+		Profiling: profiling.Config{
+			URL:       getEnv("PROFILING_URL", ""),
+			AuthToken: getEnv("PROFILING_AUTH_TOKEN", ""),
+			TenantID:  getEnv("PROFILING_TENANT_ID", ""),
+			Interval:  getEnvDuration("PROFILING_INTERVAL", 15*time.Second),
+			Types:     splitList(getEnv("PROFILING_TYPES", "cpu,heap")),
+		},
+		Watchdog: watchdog.Config{
+			Interval:      getEnvDuration("WATCHDOG_INTERVAL", 5*time.Second),
+			MaxGoroutines: getEnvInt("WATCHDOG_MAX_GOROUTINES", 10000),
+			MaxHeapBytes:  uint64(getEnvInt("WATCHDOG_MAX_HEAP_MB", 512)) << 20,
+			MaxLag:        getEnvDuration("WATCHDOG_MAX_LAG", 250*time.Millisecond),
+			DumpDir:       getEnv("WATCHDOG_DUMP_DIR", ""),
+			DumpCooldown:  getEnvDuration("WATCHDOG_DUMP_COOLDOWN", 10*time.Minute),
+		},
+		ServiceBURLs: splitList(getEnv("SERVICE_B_URLS", getEnv("SERVICE_B_URL", "http://serviceb:8081/weather"))),
+
+		CepMasking:     getEnv("CEP_MASKING", string(masking.None)),
+		CepValidation:  getEnv("CEP_VALIDATION", "format"),
+		CepHashSalt:    getEnv("CEP_HASH_SALT", ""),
+		StrictJSON:     getEnvBool("STRICT_JSON", false),
+		ErrorDocsURL:   getEnv("ERROR_DOCS_URL", "/errors/{code}"),
+		SupportContact: getEnv("SUPPORT_CONTACT", ""),
+		Compression: compression.Config{
+			Encodings:   splitList(getEnv("COMPRESSION_ENCODINGS", "zstd,br,gzip")),
+			GzipLevel:   getEnvInt("COMPRESSION_GZIP_LEVEL", 6),
+			BrotliLevel: getEnvInt("COMPRESSION_BROTLI_LEVEL", compression.DefaultBrotliLevel),
+			ZstdLevel:   getEnvInt("COMPRESSION_ZSTD_LEVEL", 3),
+			MinBytes:    getEnvInt("COMPRESSION_MIN_BYTES", 1024),
+
+			RequestMaxBytes: int64(getEnvInt("REQUEST_MAX_DECOMPRESSED_BYTES", 10<<20)),
+		},
+		DebugCapture: debugcapture.Config{
+			Secret:   getEnv("DEBUG_CAPTURE_SECRET", ""),
+			MaxBytes: getEnvInt("DEBUG_CAPTURE_MAX_BYTES", 4096),
+			Keep:     getEnvInt("DEBUG_CAPTURE_KEEP", 100),
+		},
+
+		AuditLogPath:         getEnv("AUDIT_LOG_PATH", ""),
+		AccessLogSampling:    getEnv("ACCESS_LOG_SAMPLING", ""),
+		SlowRequestThreshold: getEnvDuration("SLOW_REQUEST_THRESHOLD", 2*time.Second),
+		RequestTimeout:       getEnvDuration("REQUEST_TIMEOUT", 5*time.Second),
+		ReadinessGrace:       getEnvDuration("READINESS_GRACE_TIMEOUT", 30*time.Second),
+		StartupVerify:        getEnvBool("STARTUP_VERIFY", true),
+		StartupStrict:        getEnvBool("STARTUP_STRICT", false),
+		StartupVerifyTimeout: getEnvDuration("STARTUP_VERIFY_TIMEOUT", 5*time.Second),
+		MaxInFlight:          getEnvInt("LOAD_SHED_MAX_INFLIGHT", 0),
+		BatchMaxSize:         getEnvInt("BATCH_MAX_SIZE", 100),
+		BatchConcurrency:     getEnvInt("BATCH_CONCURRENCY", 8),
+		BatchTimeout:         getEnvDuration("BATCH_TIMEOUT", 30*time.Second),
+
+		ACLAllow:       splitList(getEnv("ACL_ALLOW", "")),
+		ACLDeny:        splitList(getEnv("ACL_DENY", "")),
+		AdminACLAllow:  splitList(getEnv("ADMIN_ACL_ALLOW", "")),
+		TrustedProxies: splitList(getEnv("TRUSTED_PROXIES", "")),
+
+		AbuseThreshold:   getEnvInt("ABUSE_THRESHOLD", 0),
+		AbuseWindow:      getEnvDuration("ABUSE_WINDOW", time.Minute),
+		AbuseBanDuration: getEnvDuration("ABUSE_BAN_DURATION", 5*time.Minute),
+		AbuseMaxBan:      getEnvDuration("ABUSE_MAX_BAN", 24*time.Hour),
+		RedisURL:         getEnv("REDIS_URL", ""),
+
+		TenantsFile:       getEnv("TENANTS_FILE", ""),
+		GeoIPDatabase:     getEnv("GEOIP_DATABASE", ""),
+		GeoIPFallback:     getEnvBool("GEOIP_FALLBACK", false),
+		DefaultLocation:   getEnv("DEFAULT_LOCATION", ""),
+		ResponseCacheSize: getEnvInt("RESPONSE_CACHE_SIZE", 0),
+		AdminToken:        getEnv("ADMIN_TOKEN", ""),
+
+		EventBus:           getEnv("EVENT_BUS", "none"),
+		EventBusURL:        getEnv("EVENT_BUS_URL", "nats://nats:4222"),
+		EventSubjectPrefix: getEnv("EVENT_SUBJECT_PREFIX", "otel-goexpert."),
+		EventAMQP: amqpConfig{
+			Exchange:     getEnv("EVENT_AMQP_EXCHANGE", "otel-goexpert.events"),
+			ExchangeType: getEnv("EVENT_AMQP_EXCHANGE_TYPE", "topic"),
+			RoutingKey:   getEnv("EVENT_AMQP_ROUTING_KEY", ""),
+		},
+		UsageExportInterval:    getEnvDuration("USAGE_EXPORT_INTERVAL", time.Minute),
+		CronSchedule:           getEnv("CRON_SCHEDULE", ""),
+		Dashboard:              getEnvBool("DASHBOARD_ENABLED", false),
+		DashboardRecentLookups: getEnvInt("DASHBOARD_RECENT_LOOKUPS", 50),
+		DashboardStatsInterval: getEnvDuration("DASHBOARD_STATS_INTERVAL", 2*time.Second),
+
+		RetryMaxAttempts:   getEnvInt("RETRY_MAX_ATTEMPTS", 2),
+		RetryBackoff:       getEnvDuration("RETRY_BACKOFF", 100*time.Millisecond),
+		RetryBudgetPercent: getEnvInt("RETRY_BUDGET_PERCENT", 10),
+		RetryBudgetMin:     getEnvInt("RETRY_BUDGET_MIN", 10),
+		RetryBudgetWindow:  getEnvDuration("RETRY_BUDGET_WINDOW", 10*time.Second),
+
+		IdempotencyTTL:     getEnvDuration("IDEMPOTENCY_TTL", 10*time.Minute),
+		IdempotencyMaxKeys: getEnvInt("IDEMPOTENCY_MAX_KEYS", 10000),
+		DedupWindow:        getEnvDuration("DEDUP_WINDOW", 0),
+
+		LBStrategy:      getEnv("SERVICE_B_LB_STRATEGY", lbRoundRobin),
+		LBEjectAfter:    getEnvInt("SERVICE_B_EJECT_AFTER", 3),
+		LBEjectDuration: getEnvDuration("SERVICE_B_EJECT_DURATION", 30*time.Second),
+		ConsulAddr:      getEnv("CONSUL_ADDR", ""),
+		ConsulService:   getEnv("SERVICE_B_CONSUL_SERVICE", "serviceb"),
+		DNSRefresh:      getEnvDuration("SERVICE_B_DNS_REFRESH", 0),
+
+		Deterministic: clock.DeterministicConfig{
+			Enabled: getEnvBool("DETERMINISTIC_MODE", false),
+			Seed:    uint64(getEnvInt("DETERMINISTIC_SEED", 1)),
+			Start:   getEnv("DETERMINISTIC_START", "2024-01-01T00:00:00Z"),
+		},
+		Outbound: outbound.Config{
+			ForceHTTP1:          forceHTTP1,
+			MaxIdleConns:        getEnvInt("OUTBOUND_MAX_IDLE_CONNS", 100),
+			MaxIdleConnsPerHost: getEnvInt("OUTBOUND_MAX_IDLE_CONNS_PER_HOST", 10),
+			MaxConnsPerHost:     getEnvInt("OUTBOUND_MAX_CONNS_PER_HOST", 0),
+			IdleConnTimeout:     getEnvDuration("OUTBOUND_IDLE_CONN_TIMEOUT", 90*time.Second),
+			TLSHandshakeTimeout: getEnvDuration("OUTBOUND_TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+			H2C:                 getEnvBool("SERVICE_B_H2C", false),
+			CABundlePath:        getEnv("OUTBOUND_CA_BUNDLE", ""),
+			InsecureSkipVerify:  getEnvBool("OUTBOUND_INSECURE_SKIP_VERIFY", false),
+			Telemetry: outbound.TelemetryConfig{
+				ClientExclude:  splitList(getEnv("OTEL_HTTP_CLIENT_EXCLUDE", "")),
+				ClientSpanName: getEnv("OTEL_HTTP_CLIENT_SPAN_NAME", ""),
+				PeerNames:      outbound.ParsePeerNames(splitList(getEnv("OTEL_HTTP_PEER_NAMES", ""))),
+			},
+		},
+		Server: server.Config{
+			Addr:            ":" + getEnv("PORT", "8080"),
+			TLSCertFile:     getEnv("TLS_CERT_FILE", ""),
+			TLSKeyFile:      getEnv("TLS_KEY_FILE", ""),
+			ForceHTTP1:      forceHTTP1,
+			H2C:             getEnvBool("H2C_ENABLED", true),
+			ReusePort:       getEnvBool("REUSE_PORT", false),
+			DrainTimeout:    getEnvDuration("SHUTDOWN_DRAIN_TIMEOUT", 10*time.Second),
+			ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 25*time.Second),
+		},
+		Autocert: autocertConfig{
+			Domains:  splitList(getEnv("ACME_DOMAINS", "")),
+			CacheDir: getEnv("ACME_CACHE_DIR", "autocert-cache"),
+			Email:    getEnv("ACME_EMAIL", ""),
+			HTTPAddr: getEnv("ACME_HTTP_ADDR", ":80"),
+		},
+	}
+	if len(cfg.ServiceBURLs) == 0 {
+		return config{}, errors.New("SERVICE_B_URLS names no service B URL")
+	}
+	return cfg, nil
+}
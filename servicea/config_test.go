@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestLoadConfigRequiresServiceBURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		urls    string
+		wantErr bool
+	}{
+		{"single", "http://serviceb:8081/weather", false},
+		{"several", "http://b1:8081/weather, http://b2:8081/weather", false},
+		{"empty", "", true},
+		{"separator only", ",", true},
+		{"blanks", " , ", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SERVICE_B_URLS", tt.urls)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(cfg.ServiceBURLs) == 0 {
+				t.Error("loadConfig() left ServiceBURLs empty")
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+)
+
+// consulDiscovery watches the passing instances of a Consul service with
+// blocking queries and feeds them to the balancer.
+type consulDiscovery struct {
+	addr     string
+	service  string
+	base     *url.URL
+	balancer *balancer
+	client   *http.Client
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// newConsulDiscovery builds endpoint URLs from the scheme and path of
+// rawURL and the address/port of each registered instance.
+func newConsulDiscovery(consulAddr, service, rawURL string, b *balancer) (*consulDiscovery, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service URL: %w", err)
+	}
+	return &consulDiscovery{
+		addr:     consulAddr,
+		service:  service,
+		base:     base,
+		balancer: b,
+		client:   &http.Client{Timeout: 90 * time.Second},
+	}, nil
+}
+
+// Run watches the service until ctx is done, backing off on errors and
+// keeping the last known instances meanwhile.
+func (d *consulDiscovery) Run(ctx context.Context) {
+	var index uint64
+	for ctx.Err() == nil {
+		urls, next, err := d.fetch(ctx, index)
+		if err != nil {
+			errlog.Printf("Error querying Consul for %s: %v", d.service, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		// Consul may reset the index; start over rather than block forever.
+		if next < index {
+			next = 0
+		}
+		index = next
+		d.balancer.SetEndpoints(urls, "")
+	}
+}
+
+func (d *consulDiscovery) fetch(ctx context.Context, index uint64) ([]string, uint64, error) {
+	query := url.Values{}
+	query.Set("passing", "true")
+	query.Set("wait", "60s")
+	query.Set("index", strconv.FormatUint(index, 10))
+	endpoint := fmt.Sprintf("%s/v1/health/service/%s?%s", d.addr, url.PathEscape(d.service), query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating request: %w", err)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("error decoding Consul response: %w", err)
+	}
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+
+	urls := make([]string, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		u := *d.base
+		u.Host = net.JoinHostPort(host, strconv.Itoa(e.Service.Port))
+		urls = append(urls, u.String())
+	}
+	slices.Sort(urls)
+
+	if index == 0 || len(urls) == 0 {
+		log.Printf("Consul reports %d passing instances of %s", len(urls), d.service)
+	}
+	return urls, next, nil
+}
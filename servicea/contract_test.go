@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// contractPath is the contract between service A and service B, shared
+// with service B's provider tests. Service A is the consumer: it pins what
+// it sends to POST /weather and what it makes of each response.
+const contractPath = "../contracts/servicea-serviceb.json"
+
+type contract struct {
+	Consumer     string        `json:"consumer"`
+	Provider     string        `json:"provider"`
+	Interactions []interaction `json:"interactions"`
+}
+
+// interaction is one request of the consumer and the response the provider
+// answers it with in the given state. Response bodies are examples: the
+// provider must answer with the same fields and JSON types, and with the
+// same values for the fields listed in Exact. ConsumerOutcome is what the
+// consumer makes of the response.
+type interaction struct {
+	Description   string `json:"description"`
+	ProviderState string `json:"provider_state"`
+	Request       struct {
+		Method  string            `json:"method"`
+		Path    string            `json:"path"`
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"`
+	} `json:"request"`
+	Response struct {
+		Status  int               `json:"status"`
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"`
+		Exact   []string          `json:"exact"`
+	} `json:"response"`
+	ConsumerOutcome string `json:"consumer_outcome"`
+}
+
+func loadContract(t *testing.T) contract {
+	t.Helper()
+	data, err := os.ReadFile(contractPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c contract
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatalf("parsing %s: %v", contractPath, err)
+	}
+	return c
+}
+
+// consumerOutcomes maps the outcomes named in the contract to the error
+// serviceBClient must return and the API error code service A answers with.
+var consumerOutcomes = map[string]struct {
+	err  error
+	code weather.ErrorCode
+}{
+	"ok":                   {nil, ""},
+	"cep_not_found":        {apperrors.ErrCepNotFound, weather.CodeZipcodeNotFound},
+	"invalid_cep":          {apperrors.ErrInvalidCep, weather.CodeInvalidZipcode},
+	"upstream_timeout":     {apperrors.ErrUpstreamTimeout, weather.CodeUpstreamTimeout},
+	"upstream_unavailable": {apperrors.ErrUpstreamUnavailable, weather.CodeUpstreamUnavailable},
+	"internal":             {nil, weather.CodeInternal},
+}
+
+// TestServiceBContract replays every response of the contract to service
+// A's client and checks that it sent the request the contract expects and
+// made of the response what the contract says.
+func TestServiceBContract(t *testing.T) {
+	c := loadContract(t)
+	for _, it := range c.Interactions {
+		t.Run(it.Description, func(t *testing.T) {
+			want, ok := consumerOutcomes[it.ConsumerOutcome]
+			if !ok {
+				t.Fatalf("unknown consumer outcome %q", it.ConsumerOutcome)
+			}
+
+			var calls int
+			fakeB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				body, _ := io.ReadAll(r.Body)
+				if r.Method != it.Request.Method || r.URL.Path != it.Request.Path {
+					t.Errorf("request = %s %s, want %s %s", r.Method, r.URL.Path, it.Request.Method, it.Request.Path)
+				}
+				if !jsonEqual(body, it.Request.Body) {
+					t.Errorf("request body = %s, want %s", body, it.Request.Body)
+				}
+				for k, v := range it.Request.Headers {
+					if got := r.Header.Get(k); got != v {
+						t.Errorf("request %s = %q, want %q", k, got, v)
+					}
+				}
+				for k, v := range it.Response.Headers {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(it.Response.Status)
+				w.Write(it.Response.Body)
+			}))
+			defer fakeB.Close()
+			serviceB, _ := newTestServiceBClient(fakeB.URL+it.Request.Path, 1)
+
+			var req struct {
+				Cep  string `json:"cep"`
+				City string `json:"city"`
+			}
+			if err := json.Unmarshal(it.Request.Body, &req); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			call := func() ([]byte, error) { return serviceB.Lookup(ctx, req.Cep) }
+			if req.City != "" {
+				call = func() ([]byte, error) { return serviceB.LookupCity(ctx, req.City) }
+			}
+			body, err := call()
+			if calls != 1 {
+				t.Errorf("service B got %d requests, want 1", calls)
+			}
+
+			if it.ConsumerOutcome == "ok" {
+				if err != nil {
+					t.Fatalf("Lookup: %v", err)
+				}
+				var got, example weather.Result
+				if err := json.Unmarshal(body, &got); err != nil {
+					t.Fatalf("decoding %s: %v", body, err)
+				}
+				json.Unmarshal(it.Response.Body, &example)
+				if got != example {
+					t.Errorf("result = %+v, want %+v", got, example)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Lookup succeeded, want %s", it.ConsumerOutcome)
+			}
+			if want.err != nil && !errors.Is(err, want.err) {
+				t.Errorf("error = %v, want %v", err, want.err)
+			}
+			if code := lookupErrorCode(err); code != want.code {
+				t.Errorf("error code = %s, want %s", code, want.code)
+			}
+			if v, ok := it.Response.Headers["Retry-After"]; ok {
+				secs, _ := strconv.Atoi(v)
+				if got := httpapi.RetryAfterOf(err); got != time.Duration(secs)*time.Second {
+					t.Errorf("retry after = %s, want %ss", got, v)
+				}
+			}
+		})
+	}
+}
+
+func jsonEqual(a, b []byte) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// dashboardFiles holds the single-page dashboard served at /dashboard.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardStatsTimeout bounds the call to service B's /stats.
+const dashboardStatsTimeout = 3 * time.Second
+
+// recentLookup is one /cep request as shown on the dashboard. CEPs are
+// masked like everywhere else they leave the process.
+type recentLookup struct {
+	Cep        string            `json:"cep"`
+	Status     int               `json:"status"`
+	Code       weather.ErrorCode `json:"code,omitempty"`
+	City       string            `json:"city,omitempty"`
+	TempC      *float64          `json:"temp_C,omitempty"`
+	DurationMs float64           `json:"duration_ms"`
+	Time       time.Time         `json:"time"`
+}
+
+// lookupFeed keeps the most recent /cep requests in a ring buffer.
+type lookupFeed struct {
+	mu   sync.Mutex
+	buf  []recentLookup
+	next int
+	full bool
+}
+
+func newLookupFeed(size int) *lookupFeed {
+	return &lookupFeed{buf: make([]recentLookup, max(size, 1))}
+}
+
+func (f *lookupFeed) Record(l recentLookup) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf[f.next] = l
+	f.next = (f.next + 1) % len(f.buf)
+	if f.next == 0 {
+		f.full = true
+	}
+}
+
+// Recent returns the recorded lookups, newest first.
+func (f *lookupFeed) Recent() []recentLookup {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.next
+	if f.full {
+		n = len(f.buf)
+	}
+	out := make([]recentLookup, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, f.buf[(f.next-i+len(f.buf))%len(f.buf)])
+	}
+	return out
+}
+
+// dashboard serves the embedded single-page dashboard. It records the
+// /cep requests of this instance and pushes them, along with service B's
+// /stats sampled every interval, to the browsers over server-sent events.
+type dashboard struct {
+	feed     *lookupFeed
+	hub      *sseHub
+	interval time.Duration
+	serviceB *serviceBClient
+	masker   *masking.Masker
+
+	// lookups and failures count the /cep requests since the last tick,
+	// for the request and error rates.
+	lookups  atomic.Int64
+	failures atomic.Int64
+
+	mu   sync.Mutex
+	last *dashboardTick
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// dashboardTick is the periodic "stats" event: the /cep request and error
+// rates of this instance over the last interval and the /stats of a
+// service B instance, passed through.
+type dashboardTick struct {
+	Time          time.Time       `json:"time"`
+	RequestRate   float64         `json:"request_rate"`
+	ErrorRate     float64         `json:"error_rate"`
+	ServiceB      json.RawMessage `json:"service_b,omitempty"`
+	ServiceBError string          `json:"service_b_error,omitempty"`
+}
+
+// dashboardSnapshot is sent to a client when it connects, and served by
+// GET /dashboard/api/stats for scripts.
+type dashboardSnapshot struct {
+	Recent []recentLookup `json:"recent"`
+	Stats  *dashboardTick `json:"stats,omitempty"`
+}
+
+func newDashboard(recent int, interval time.Duration, serviceB *serviceBClient, masker *masking.Masker, meter metric.Meter) *dashboard {
+	return &dashboard{
+		feed:     newLookupFeed(recent),
+		hub:      newSSEHub(meter),
+		interval: interval,
+		serviceB: serviceB,
+		masker:   masker,
+	}
+}
+
+// Start samples the stats every interval while clients are connected.
+func (d *dashboard) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel, d.done = cancel, make(chan struct{})
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				d.tick(ctx, now.Sub(last))
+				last = now
+			}
+		}
+	}()
+}
+
+func (d *dashboard) Stop() {
+	if d.cancel != nil {
+		d.cancel()
+		<-d.done
+	}
+	d.hub.Close()
+}
+
+// tick computes the rates over elapsed and, when someone is watching,
+// fetches service B's stats once for every client.
+func (d *dashboard) tick(ctx context.Context, elapsed time.Duration) {
+	lookups, failures := d.lookups.Swap(0), d.failures.Swap(0)
+	if d.hub.Clients() == 0 {
+		return
+	}
+	t := &dashboardTick{Time: time.Now().UTC(), RequestRate: float64(lookups) / elapsed.Seconds()}
+	if lookups > 0 {
+		t.ErrorRate = float64(failures) / float64(lookups)
+	}
+	body, err := d.serviceB.Stats(ctx)
+	if err != nil {
+		t.ServiceBError = err.Error()
+	} else {
+		t.ServiceB = body
+	}
+
+	d.mu.Lock()
+	d.last = t
+	d.mu.Unlock()
+	d.hub.Publish("stats", t)
+}
+
+func (d *dashboard) snapshot() dashboardSnapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return dashboardSnapshot{Recent: d.feed.Recent(), Stats: d.last}
+}
+
+// Middleware records the /cep requests that pass through it. The request
+// body is teed while the handler decodes it, and the response is observed
+// as it is rendered, in whatever format the client asked for.
+func (d *dashboard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqBody bytes.Buffer
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, &reqBody), r.Body}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		var l recentLookup
+		ctx := httpapi.WithRenderObserver(r.Context(), func(_ int, v any) {
+			switch v := v.(type) {
+			case weather.Result:
+				l.City, l.TempC = v.City, &v.TempC
+			case httpapi.ErrorResponse:
+				l.Code = v.Code
+			}
+		})
+
+		start := time.Now()
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		var req CepRequest
+		json.Unmarshal(reqBody.Bytes(), &req)
+		l.Cep = d.masker.Cep(req.Cep)
+		l.Status = ww.Status()
+		l.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+		l.Time = start.UTC()
+
+		d.lookups.Add(1)
+		if l.Status >= http.StatusInternalServerError {
+			d.failures.Add(1)
+		}
+		d.feed.Record(l)
+		d.hub.Publish("lookup", l)
+	})
+}
+
+// Routes serves the embedded dashboard, its event stream and a snapshot
+// endpoint.
+func (d *dashboard) Routes() (http.Handler, error) {
+	assets, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dashboard assets: %w", err)
+	}
+	r := chi.NewRouter()
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, assets, "index.html")
+	})
+	r.Get("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		httpapi.Render(w, http.StatusOK, d.snapshot(), r.Context())
+	})
+	r.Get("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		d.hub.Serve(w, r, "snapshot", d.snapshot())
+	})
+	r.Handle("/*", http.StripPrefix("/dashboard/", http.FileServerFS(assets)))
+	return r, nil
+}
+
+// Stats reads GET /stats from the service B endpoint picked by the
+// balancer.
+func (c *serviceBClient) Stats(ctx context.Context) (json.RawMessage, error) {
+	ctx, span := c.tracer.Start(ctx, "fetch_service_b_stats")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, dashboardStatsTimeout)
+	defer cancel()
+
+	ep, err := c.endpoints.Pick()
+	if err != nil {
+		return nil, err
+	}
+	healthy := false
+	defer func() { c.endpoints.Done(ep, healthy) }()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", serviceBStatsURL(ep.URL), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	if ep.Host != "" {
+		req.Host = ep.Host
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling service B: %w", err)
+	}
+	defer resp.Body.Close()
+	healthy = resp.StatusCode < http.StatusInternalServerError
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("service B answered /stats with status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading service B stats: %w", err)
+	}
+	return body, nil
+}
+
+// serviceBStatsURL points at the /stats endpoint of the service B instance
+// behind rawURL.
+func serviceBStatsURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Path = "/stats"
+	u.RawQuery = ""
+	return u.String()
+}
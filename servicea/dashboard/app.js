@@ -0,0 +1,185 @@
+"use strict";
+
+// The dashboard listens to /dashboard/api/events: a "snapshot" when it
+// connects, a "lookup" for every /cep request this instance of service A
+// serves and a "stats" sample (request rate and service B's /stats) at a
+// fixed interval. EventSource reconnects on its own if the stream drops.
+const MAX_ROWS = 50;
+const MAX_POINTS = 90;
+const COLORS = ["#0969da", "#cf222e", "#1a7f37", "#9a6700", "#8250df", "#bf3989"];
+
+const $ = (sel) => document.querySelector(sel);
+
+const recent = [];
+const rateSeries = [];
+const latencySeries = new Map();
+
+function cell(text, cls) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (cls) td.className = cls;
+  return td;
+}
+
+function fillRows(tbody, rows) {
+  tbody.replaceChildren(...rows.map((cells) => {
+    const tr = document.createElement("tr");
+    tr.append(...cells);
+    return tr;
+  }));
+}
+
+function fillList(ol, items, label) {
+  ol.replaceChildren(...items.map((item) => {
+    const li = document.createElement("li");
+    li.textContent = `${label(item)} (${item.count})`;
+    return li;
+  }));
+}
+
+const ms = (v) => `${Math.round(v)} ms`;
+const pct = (v) => `${(v * 100).toFixed(1)}%`;
+
+function setStatus(text, cls) {
+  $("#status").textContent = text;
+  $("#status").className = cls;
+}
+
+function renderServiceB(stats) {
+  const cache = stats.cache || {};
+  $("#hit-ratio").textContent = pct(cache.hit_ratio || 0);
+  $("#cache-entries").textContent = cache.entries ?? "–";
+  $("#cache-hits").textContent = cache.hits ?? "–";
+  $("#cache-misses").textContent = cache.misses ?? "–";
+
+  const providers = (stats.providers && stats.providers.providers) || [];
+  fillRows($("#providers tbody"), providers.map((p) => [
+    cell(p.kind),
+    cell(p.name),
+    cell(p.state, p.state === "healthy" ? "ok" : "bad"),
+    cell(p.score.toFixed(2), p.score >= 0.8 ? "ok" : p.score >= 0.5 ? "warn" : "bad"),
+    cell(pct(p.error_rate)),
+    cell(ms(p.avg_latency_ms)),
+    cell(ms(p.p95_latency_ms)),
+  ]));
+
+  fillList($("#top-ceps"), stats.top_ceps || [], (e) => e.key);
+  fillList($("#top-cities"), stats.top_cities || [], (e) => e.key);
+}
+
+function renderRecent() {
+  fillRows($("#recent tbody"), recent.map((l) => [
+    cell(new Date(l.time).toLocaleTimeString()),
+    cell(l.cep),
+    cell(l.code ? `${l.status} ${l.code}` : String(l.status), l.status < 400 ? "ok" : l.status < 500 ? "warn" : "bad"),
+    cell(l.city || ""),
+    cell(l.temp_C != null ? `${l.temp_C.toFixed(1)} °C` : ""),
+    cell(ms(l.duration_ms)),
+  ]));
+}
+
+function push(series, value) {
+  series.push(value);
+  if (series.length > MAX_POINTS) series.shift();
+}
+
+// drawChart plots each series as a line scaled to the largest value.
+function drawChart(canvas, lines) {
+  const ctx = canvas.getContext("2d");
+  const { width, height } = canvas;
+  ctx.clearRect(0, 0, width, height);
+
+  const top = Math.max(1, ...lines.flatMap((l) => l.points)) * 1.1;
+  ctx.fillStyle = "#6b7385";
+  ctx.font = "11px system-ui, sans-serif";
+  ctx.fillText(top.toFixed(top < 10 ? 1 : 0), 2, 12);
+
+  const step = width / (MAX_POINTS - 1);
+  for (const line of lines) {
+    ctx.strokeStyle = line.color;
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    const offset = MAX_POINTS - line.points.length;
+    line.points.forEach((v, i) => {
+      const x = (offset + i) * step;
+      const y = height - (v / top) * height;
+      if (i === 0) ctx.moveTo(x, y); else ctx.lineTo(x, y);
+    });
+    ctx.stroke();
+  }
+}
+
+function renderStats(stats) {
+  if (!stats) return;
+  push(rateSeries, stats.request_rate);
+  $("#rate-now").textContent = stats.request_rate.toFixed(2);
+  $("#error-now").textContent = pct(stats.error_rate);
+  drawChart($("#rate-chart"), [{ color: COLORS[0], points: rateSeries }]);
+
+  if (!stats.service_b) {
+    setStatus(`serviço B indisponível: ${stats.service_b_error}`, "bad");
+    return;
+  }
+  renderServiceB(stats.service_b);
+
+  const providers = (stats.service_b.providers && stats.service_b.providers.providers) || [];
+  for (const p of providers) {
+    const key = `${p.kind}/${p.name}`;
+    if (!latencySeries.has(key)) latencySeries.set(key, []);
+    push(latencySeries.get(key), p.p95_latency_ms);
+  }
+  const lines = [...latencySeries.entries()].map(([key, points], i) => ({ key, points, color: COLORS[i % COLORS.length] }));
+  drawChart($("#latency-chart"), lines);
+  $("#latency-legend").replaceChildren(...lines.map((l) => {
+    const span = document.createElement("span");
+    span.style.setProperty("--swatch", l.color);
+    span.textContent = l.key;
+    return span;
+  }));
+
+  setStatus(`ao vivo · ${new Date(stats.time).toLocaleTimeString()}`, "ok");
+}
+
+function connect() {
+  const events = new EventSource("/dashboard/api/events");
+  events.addEventListener("snapshot", (ev) => {
+    const data = JSON.parse(ev.data);
+    recent.splice(0, recent.length, ...(data.recent || []).slice(0, MAX_ROWS));
+    renderRecent();
+    renderStats(data.stats);
+  });
+  events.addEventListener("lookup", (ev) => {
+    recent.unshift(JSON.parse(ev.data));
+    recent.length = Math.min(recent.length, MAX_ROWS);
+    renderRecent();
+  });
+  events.addEventListener("stats", (ev) => renderStats(JSON.parse(ev.data)));
+  events.addEventListener("goaway", () => setStatus("servidor reiniciando, reconectando…", "warn"));
+  events.onerror = () => setStatus("reconectando…", "warn");
+}
+
+$("#api-key").value = localStorage.getItem("apiKey") || "";
+
+$("#search-form").addEventListener("submit", async (ev) => {
+  ev.preventDefault();
+  const apiKey = $("#api-key").value.trim();
+  localStorage.setItem("apiKey", apiKey);
+  const headers = { "Content-Type": "application/json" };
+  if (apiKey) headers["X-API-Key"] = apiKey;
+
+  const out = $("#search-result");
+  out.textContent = "consultando…";
+  try {
+    const resp = await fetch("/cep", {
+      method: "POST",
+      headers,
+      body: JSON.stringify({ cep: $("#cep").value.trim() }),
+    });
+    const body = await resp.json();
+    out.textContent = `${resp.status}\n${JSON.stringify(body, null, 2)}`;
+  } catch (err) {
+    out.textContent = `erro: ${err}`;
+  }
+});
+
+connect();
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// defaultLocation is the CEP or city, such as the company's headquarters,
+// whose weather a kiosk or a dashboard shows rather than an error when the
+// caller sent no CEP and couldn't be located, or sent a CEP no provider
+// knows. Malformed CEPs are still refused: they are the caller's bug.
+type defaultLocation struct {
+	cep    string
+	city   string
+	masker *masking.Masker
+	used   metric.Int64Counter
+}
+
+// newDefaultLocation returns nil for an empty location. A location that
+// normalizes to a valid CEP, such as 01001-000, is a CEP; anything else is
+// a city under strictness.
+func newDefaultLocation(location string, strictness cep.Strictness, masker *masking.Masker, meter metric.Meter) *defaultLocation {
+	location = strings.TrimSpace(location)
+	if location == "" {
+		return nil
+	}
+	d := &defaultLocation{city: location, masker: masker}
+	if c, err := cep.Normalize(location); err == nil && isValidCep(c, strictness) {
+		d.cep, d.city = c, ""
+	}
+	var err error
+	d.used, err = meter.Int64Counter("location.default_fallbacks",
+		metric.WithDescription("Requests answered with the default location, by reason"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		log.Printf("Error creating default location counter: %v", err)
+	}
+	return d
+}
+
+func (d *defaultLocation) String() string {
+	if d.cep != "" {
+		return "CEP " + d.masker.Cep(d.cep)
+	}
+	return d.city
+}
+
+// Query looks up the weather of the default location, a CEP through
+// lookup and a city through lookupCity, for reason: no_cep or not_found.
+func (d *defaultLocation) Query(ctx context.Context, lookup, lookupCity func(ctx context.Context, location string) ([]byte, error), reason string) ([]byte, error) {
+	if d.used != nil {
+		d.used.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", reason)))
+	}
+	if d.cep != "" {
+		return lookup(ctx, d.cep)
+	}
+	return lookupCity(ctx, d.city)
+}
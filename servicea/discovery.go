@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+)
+
+// dnsDiscovery resolves every address behind the host of a URL (e.g. a
+// headless Kubernetes service) and feeds them to the balancer,
+// re-resolving periodically instead of pinning to a single backend.
+type dnsDiscovery struct {
+	base     *url.URL
+	interval time.Duration
+	resolver *net.Resolver
+	balancer *balancer
+	addrs    []string
+}
+
+func newDNSDiscovery(rawURL string, interval time.Duration, b *balancer) (*dnsDiscovery, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service URL: %w", err)
+	}
+	return &dnsDiscovery{
+		base:     base,
+		interval: interval,
+		resolver: net.DefaultResolver,
+		balancer: b,
+	}, nil
+}
+
+// Run resolves the host immediately and then on every interval until ctx
+// is done. Failed lookups keep the last known addresses.
+func (d *dnsDiscovery) Run(ctx context.Context) {
+	if err := d.resolve(ctx); err != nil {
+		log.Printf("Error resolving %s: %v", d.base.Hostname(), err)
+	}
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.resolve(ctx); err != nil {
+				errlog.Printf("Error resolving %s: %v", d.base.Hostname(), err)
+			}
+		}
+	}
+}
+
+func (d *dnsDiscovery) resolve(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ips, err := d.resolver.LookupHost(ctx, d.base.Hostname())
+	if err != nil {
+		return err
+	}
+	slices.Sort(ips)
+	if slices.Equal(ips, d.addrs) {
+		return nil
+	}
+
+	log.Printf("Resolved %s to %v", d.base.Hostname(), ips)
+	d.addrs = ips
+
+	urls := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		u := *d.base
+		if port := d.base.Port(); port != "" {
+			u.Host = net.JoinHostPort(ip, port)
+		} else {
+			u.Host = ip
+		}
+		urls = append(urls, u.String())
+	}
+	// The original host is kept as the Host header so virtual hosting
+	// keeps working when dialing an address directly.
+	d.balancer.SetEndpoints(urls, d.base.Host)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// event is the envelope of everything published to the event bus.
+type event struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Source string          `json:"source"`
+	Time   time.Time       `json:"time"`
+	Data   json.RawMessage `json:"data"`
+}
+
+func newEvent(eventType string, data any) (event, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return event{}, fmt.Errorf("error encoding %s event: %w", eventType, err)
+	}
+	id := make([]byte, 16)
+	clock.RandomBytes(id)
+	return event{
+		ID:     hex.EncodeToString(id),
+		Type:   eventType,
+		Source: "service-a",
+		Time:   clock.Now().UTC(),
+		Data:   payload,
+	}, nil
+}
+
+// eventPublisher sends events to the bus selected by EVENT_BUS. Subjects
+// are relative; each backend applies the configured prefix.
+type eventPublisher interface {
+	Publish(ctx context.Context, subject string, e event) error
+	Close() error
+}
+
+// newEventPublisher connects to the event bus. "none" discards events.
+func newEventPublisher(bus, url, prefix string, amqpCfg amqpConfig, tracer trace.Tracer) (eventPublisher, error) {
+	switch bus {
+	case "", "none":
+		return noopPublisher{}, nil
+	case "nats":
+		conn, err := nats.Connect(url, nats.Name("service-a"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		return &natsPublisher{conn: conn, prefix: prefix, tracer: tracer}, nil
+	case "amqp":
+		return newAMQPPublisher(url, prefix, amqpCfg, tracer)
+	default:
+		return nil, fmt.Errorf("unknown event bus %q", bus)
+	}
+}
+
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(context.Context, string, event) error { return nil }
+func (noopPublisher) Close() error                                 { return nil }
+
+type natsPublisher struct {
+	conn   *nats.Conn
+	prefix string
+	tracer trace.Tracer
+}
+
+// Publish sends e under a producer span and carries the trace context in
+// the message headers.
+func (p *natsPublisher) Publish(ctx context.Context, subject string, e event) error {
+	subject = p.prefix + subject
+	ctx, span := p.tracer.Start(ctx, "publish "+subject, trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", subject),
+			attribute.String("messaging.message.id", e.ID),
+			attribute.String("event.type", e.Type),
+		))
+	defer span.End()
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding event: %w", err)
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = payload
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(http.Header(msg.Header)))
+
+	if err := p.conn.PublishMsg(msg); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("error publishing to %s: %w", subject, err)
+	}
+	return nil
+}
+
+func (p *natsPublisher) Close() error {
+	return p.conn.Drain()
+}
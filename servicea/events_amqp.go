@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// amqpConfig selects where events go on an AMQP broker. RoutingKey may
+// contain {subject}, replaced by the event subject; when empty the routing
+// key is the prefixed subject, as with NATS.
+type amqpConfig struct {
+	Exchange     string
+	ExchangeType string
+	RoutingKey   string
+}
+
+// amqpPublisher publishes events to a RabbitMQ exchange with publisher
+// confirms, so Publish only succeeds once the broker has taken the message.
+// The connection is re-established on the next publish after it drops.
+type amqpPublisher struct {
+	url    string
+	prefix string
+	cfg    amqpConfig
+	tracer trace.Tracer
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+func newAMQPPublisher(url, prefix string, cfg amqpConfig, tracer trace.Tracer) (*amqpPublisher, error) {
+	if cfg.Exchange == "" {
+		return nil, errors.New("AMQP exchange is required")
+	}
+	p := &amqpPublisher{url: url, prefix: prefix, cfg: cfg, tracer: tracer}
+	if _, err := p.channel(); err != nil {
+		log.Printf("AMQP broker unavailable, retrying on publish: %v", err)
+	}
+	return p, nil
+}
+
+// channel returns the open confirm-mode channel, reconnecting if needed.
+func (p *amqpPublisher) channel() (*amqp.Channel, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch != nil && !p.ch.IsClosed() {
+		return p.ch, nil
+	}
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.ch = nil, nil
+	}
+
+	conn, err := amqp.DialConfig(p.url, amqp.Config{Properties: amqp.Table{"connection_name": "service-a"}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to AMQP broker: %w", err)
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.ExchangeDeclare(p.cfg.Exchange, p.cfg.ExchangeType, true, false, false, false, nil)
+	}
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to set up AMQP channel: %w", err)
+	}
+	p.conn, p.ch = conn, ch
+	return ch, nil
+}
+
+func (p *amqpPublisher) routingKey(subject string) string {
+	if p.cfg.RoutingKey == "" {
+		return p.prefix + subject
+	}
+	return strings.ReplaceAll(p.cfg.RoutingKey, "{subject}", subject)
+}
+
+// Publish sends e under a producer span, carries the trace context in the
+// message headers and waits for the broker's confirm.
+func (p *amqpPublisher) Publish(ctx context.Context, subject string, e event) error {
+	key := p.routingKey(subject)
+	ctx, span := p.tracer.Start(ctx, "publish "+p.cfg.Exchange, trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination.name", p.cfg.Exchange),
+			attribute.String("messaging.rabbitmq.destination.routing_key", key),
+			attribute.String("messaging.message.id", e.ID),
+			attribute.String("event.type", e.Type),
+		))
+	defer span.End()
+
+	err := p.publish(ctx, key, e)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func (p *amqpPublisher) publish(ctx context.Context, key string, e event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding event: %w", err)
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	headers := amqp.Table{}
+	for k, v := range carrier {
+		headers[k] = v
+	}
+
+	ch, err := p.channel()
+	if err != nil {
+		return err
+	}
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, p.cfg.Exchange, key, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    e.ID,
+		Type:         e.Type,
+		Timestamp:    e.Time,
+		Headers:      headers,
+		Body:         payload,
+	})
+	if err != nil {
+		return fmt.Errorf("error publishing to %s: %w", p.cfg.Exchange, err)
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error waiting for confirm from %s: %w", p.cfg.Exchange, err)
+	}
+	if !acked {
+		return fmt.Errorf("broker rejected event %s on %s", e.ID, p.cfg.Exchange)
+	}
+	return nil
+}
+
+func (p *amqpPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.Close()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/netacl"
+	"github.com/oschwald/maxminddb-golang"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// geoIPFeature is the tenant feature that turns the GeoIP fallback on for
+// the tenant's requests while GEOIP_FALLBACK is off for everyone else.
+const geoIPFeature = "geoip_fallback"
+
+// geoLocator finds the city of a caller's address in a MaxMind City
+// database (GeoLite2-City or GeoIP2-City). The database is memory-mapped
+// and searched in process, so a lookup costs microseconds and no call to
+// MaxMind. Addresses are only city-accurate, often less on mobile and
+// corporate networks, which is why the answer is flagged as approximate.
+type geoLocator struct {
+	db *maxminddb.Reader
+	// proxies resolves the client address behind TRUSTED_PROXIES.
+	proxies *netacl.ACL
+	// all enables the fallback for every caller; otherwise only tenants
+	// with geoIPFeature get it.
+	all     bool
+	lookups metric.Int64Counter
+}
+
+// geoRecord is the part of a City database record the fallback reads.
+type geoRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+func newGeoLocator(path string, all bool, trustedProxies []string, meter metric.Meter) (*geoLocator, error) {
+	proxies, err := netacl.New(nil, nil, trustedProxies, nil)
+	if err != nil {
+		return nil, err
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database %s: %w", path, err)
+	}
+	if !strings.Contains(db.Metadata.DatabaseType, "City") {
+		db.Close()
+		return nil, fmt.Errorf("GeoIP database %s is a %s database, want a City one", path, db.Metadata.DatabaseType)
+	}
+	g := &geoLocator{db: db, proxies: proxies, all: all}
+	g.lookups, err = meter.Int64Counter("geoip.lookups",
+		metric.WithDescription("Callers without a CEP located by their address, by outcome"),
+		metric.WithUnit("{lookup}"),
+	)
+	if err != nil {
+		log.Printf("Error creating GeoIP lookup counter: %v", err)
+	}
+	log.Printf("GeoIP fallback using %s (%s, built %d)", path, db.Metadata.DatabaseType, db.Metadata.BuildEpoch)
+	return g, nil
+}
+
+// EnabledFor reports whether the fallback applies to r.
+func (g *geoLocator) EnabledFor(r *http.Request) bool {
+	if g == nil {
+		return false
+	}
+	if g.all {
+		return true
+	}
+	t, ok := tenantFromContext(r.Context())
+	return ok && t.HasFeature(geoIPFeature)
+}
+
+// Locate returns the city the caller of r is in, named in Portuguese when
+// the database has the name, as the CEP providers name cities, and in
+// English otherwise.
+func (g *geoLocator) Locate(r *http.Request) (string, bool) {
+	city, outcome := g.locate(r)
+	if g.lookups != nil {
+		g.lookups.Add(r.Context(), 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+	}
+	return city, outcome == "located"
+}
+
+func (g *geoLocator) locate(r *http.Request) (string, string) {
+	addr, ok := g.proxies.ClientAddr(r)
+	if !ok || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return "", "not_found"
+	}
+	var rec geoRecord
+	if err := g.db.Lookup(net.IP(addr.AsSlice()), &rec); err != nil {
+		errlog.Printf("Error looking up %s in the GeoIP database: %v", addr, err)
+		return "", "error"
+	}
+	for _, lang := range []string{"pt-BR", "en"} {
+		if name := rec.City.Names[lang]; name != "" {
+			return name, "located"
+		}
+	}
+	return "", "not_found"
+}
+
+func (g *geoLocator) Close() error {
+	return g.db.Close()
+}
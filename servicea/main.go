@@ -3,197 +3,414 @@ package main
 import (
 	"bytes"
 	"context"
+	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/buildinfo"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/retry"
+	"github.com/joaolima7/otel-goexpert/pkg/sampling"
+	"github.com/joaolima7/otel-goexpert/pkg/server"
+	"github.com/joaolima7/otel-goexpert/pkg/shedding"
+	"github.com/joaolima7/otel-goexpert/pkg/slowrequest"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
-var (
-	serviceBURL string
-	tracer      trace.Tracer
-)
-
 type CepRequest struct {
 	Cep string `json:"cep"`
 }
 
-type ErrorResponse struct {
-	Message string `json:"message"`
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := clock.SetDeterministic(cfg.Deterministic); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	log.Printf("Service A %s (commit %s, built %s, %s)", buildinfo.Current.Version, buildinfo.Current.GitCommit, buildinfo.Current.BuildDate, buildinfo.Current.GoVersion)
+
+	var srv *http.Server
+	app := fx.New(appOptions(cfg), fx.Populate(&srv))
+
+	startCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := app.Start(startCtx); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
+
+	fmt.Printf("Service A listening on %s...\n", cfg.Server.Addr)
+	deadline, err := server.Run(srv, cfg.Server, nil)
+	if err != nil {
+		log.Printf("Server error: %v", err)
+	}
+
+	stopCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := app.Stop(stopCtx); err != nil {
+		log.Printf("Error during shutdown: %v", err)
+	}
 }
 
-func main() {
-	serviceBURL = getEnv("SERVICE_B_URL", "http://serviceb:8081/weather")
-	collectorURL := getEnv("OTEL_COLLECTOR_URL", "otel-collector:4317")
+type healthResponse struct {
+	Status string `json:"status"`
+}
 
-	tp, err := initTracer(collectorURL)
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	httpapi.Render(w, http.StatusOK, healthResponse{Status: "ok"}, r.Context())
+}
+
+// withQuery sets the query parameter key of rawURL to value.
+func withQuery(rawURL, key, value string) string {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		log.Fatalf("Failed to initialize tracer: %v", err)
+		return rawURL
 	}
-	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := tp.Shutdown(ctx); err != nil {
-			log.Fatalf("Error shutting down tracer provider: %v", err)
-		}
-	}()
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
 
-	r := chi.NewRouter()
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
+// serviceBHealthURL points at the /healthz endpoint of the service B
+// instance behind rawURL.
+func serviceBHealthURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Path = "/healthz"
+	u.RawQuery = ""
+	return u.String()
+}
 
-	r.Post("/cep", handleCepRequest)
+// cepHandler looks up the weather of one CEP. A request without a CEP
+// gets the weather of the caller's approximate city instead, where geo
+// applies to it, and failing that, or when the CEP is not found, that of
+// fallback, if set. It serves POST /cep, with the CEP in the body, and GET
+// /cep/{cep}, whose answers caches may keep for as long as service B
+// allows.
+type cepHandler struct {
+	// lookup and lookupCity call service B: they are the methods of
+	// serviceBClient outside of tests and benchmarks.
+	lookup     func(ctx context.Context, cep string) ([]byte, error)
+	lookupCity func(ctx context.Context, city string) ([]byte, error)
+	geo        *geoLocator
+	fallback   *defaultLocation
+	strictness cep.Strictness
+	masker     *masking.Masker
+	tracer     trace.Tracer
+}
 
-	port := getEnv("PORT", "8080")
-	fmt.Printf("Service A listening on port %s...\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+// serviceBErrorMessages are the messages a failed call to service B is
+// answered with, by its code; a code missing here is answered with the
+// error itself.
+var serviceBErrorMessages = map[weather.ErrorCode]string{
+	weather.CodeZipcodeNotFound:     "can not find zipcode",
+	weather.CodeInvalidZipcode:      "invalid zipcode",
+	weather.CodeUpstreamTimeout:     "request timeout",
+	weather.CodeUpstreamUnavailable: "service unavailable",
+	weather.CodeInternal:            "internal server error",
 }
 
-func handleCepRequest(w http.ResponseWriter, r *http.Request) {
-	ctx, span := tracer.Start(r.Context(), "handle_cep_request")
+func (h *cepHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.tracer.Start(r.Context(), "handle_cep_request")
 	defer span.End()
+	if extended, _ := strconv.ParseBool(r.URL.Query().Get("extended")); extended {
+		ctx = context.WithValue(ctx, extendedKey{}, true)
+	}
 
+	ctx, caching := withUpstreamCaching(ctx, hasCacheDirective(r.Header.Get("Cache-Control"), "no-cache"))
+
+	endValidate := slowrequest.StartPhase(ctx, "validate")
 	var req CepRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusUnprocessableEntity, "invalid zipcode", ctx)
-		return
+	if r.Method == http.MethodPost {
+		if err := httpapi.DecodeRequest(r, &req); err != nil {
+			httpapi.RespondWithDecodeError(w, err, weather.CodeInvalidZipcode, "invalid zipcode", ctx)
+			return
+		}
+	} else {
+		req.Cep = chi.URLParam(r, "cep")
+	}
+	// An empty CEP is looked up by the client's location instead; any
+	// other is read in one form from here on.
+	if req.Cep != "" {
+		c, err := cep.Normalize(req.Cep)
+		if err != nil {
+			httpapi.RespondWithError(w, weather.CodeInvalidZipcode, "invalid zipcode", ctx)
+			return
+		}
+		req.Cep = c
+	}
+
+	span.SetAttributes(attribute.String("cep", h.masker.Cep(req.Cep)))
+
+	query := func(ctx context.Context) ([]byte, error) { return h.lookup(ctx, req.Cep) }
+	approximate := false
+	if req.Cep == "" && h.geo.EnabledFor(r) {
+		if city, ok := h.geo.Locate(r); ok {
+			query = func(ctx context.Context) ([]byte, error) { return h.lookupCity(ctx, city) }
+			approximate = true
+		}
+	}
+	isDefault := false
+	if req.Cep == "" && !approximate && h.fallback != nil {
+		query = func(ctx context.Context) ([]byte, error) {
+			return h.fallback.Query(ctx, h.lookup, h.lookupCity, "no_cep")
+		}
+		isDefault = true
 	}
 
-	if !isValidCep(req.Cep) {
-		respondWithError(w, http.StatusUnprocessableEntity, "invalid zipcode", ctx)
+	if !approximate && !isDefault && !isValidCep(req.Cep, h.strictness) {
+		httpapi.RespondWithError(w, weather.CodeInvalidZipcode, "invalid zipcode", ctx)
 		return
 	}
+	endValidate()
 
-	resp, err := callServiceB(ctx, req.Cep)
+	endServiceB := slowrequest.StartPhase(ctx, "service_b")
+	resp, err := query(ctx)
+	if errors.Is(err, apperrors.ErrCepNotFound) && !isDefault && h.fallback != nil {
+		resp, err = h.fallback.Query(ctx, h.lookup, h.lookupCity, "not_found")
+		approximate, isDefault = false, true
+	}
+	endServiceB()
+	span.SetAttributes(attribute.Bool("location.approximate", approximate), attribute.Bool("location.default", isDefault))
 	if err != nil {
-		if errors.Is(err, ErrCepNotFound) {
-			respondWithError(w, http.StatusNotFound, "can not find zipcode", ctx)
-			return
+		if isDefault {
+			errlog.Printf("Error looking up the default location %s: %v", h.fallback, err)
 		}
-		if errors.Is(err, ErrInvalidCep) {
-			respondWithError(w, http.StatusUnprocessableEntity, "invalid zipcode", ctx)
-			return
+		code := apperrors.CodeOf(err)
+		switch code {
+		case weather.CodeUpstreamUnavailable:
+			httpapi.SetRetryAfter(w, httpapi.RetryAfterOf(err))
+		case weather.CodeInternal:
+			errlog.Printf("Error calling service B for CEP %s: %v", h.masker.Cep(req.Cep), err)
+		}
+		msg, ok := serviceBErrorMessages[code]
+		if !ok {
+			msg = err.Error()
 		}
-		respondWithError(w, http.StatusInternalServerError, "internal server error", ctx)
+		httpapi.RespondWithError(w, code, msg, ctx)
+		return
+	}
+
+	endEncode := slowrequest.StartPhase(ctx, "encode")
+	var result weather.Result
+	if err := json.Unmarshal(resp, &result); err != nil {
+		errlog.Printf("Error decoding service B response for CEP %s: %v", h.masker.Cep(req.Cep), err)
+		httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", ctx)
 		return
 	}
+	result.Approximate = approximate
+	result.DefaultLocation = isDefault
+	// An approximate answer depends on the caller's address.
+	cacheControl := caching.cacheControl
+	if approximate && cacheControl != "" {
+		cacheControl = "private, " + cacheControl
+	}
+	httpapi.RenderCacheable(w, r, result, cacheControl, ctx)
+	endEncode()
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(resp)
+// deadlineHeader forwards the remaining time budget of the request to
+// service B as a relative duration.
+const deadlineHeader = "X-Request-Deadline"
+
+// extendedKey marks, in the request context, a request that asked with
+// ?extended=true for the provider details of its answer, which service B
+// is asked for in turn.
+type extendedKey struct{}
+
+// serviceBClient calls service B on the endpoint picked by endpoints,
+// retrying as retry allows, and keeps its answers in cache, which is nil
+// when RESPONSE_CACHE_SIZE is 0.
+type serviceBClient struct {
+	endpoints *balancer
+	client    *http.Client
+	retry     retry.Policy
+	cache     *serviceBCache
+	tracer    trace.Tracer
 }
 
-var (
-	ErrCepNotFound = errors.New("cep not found")
-	ErrInvalidCep  = errors.New("invalid cep")
-)
+// Lookup asks service B for the weather of a CEP.
+func (c *serviceBClient) Lookup(ctx context.Context, cep string) ([]byte, error) {
+	return c.call(ctx, weather.Location{Cep: cep})
+}
 
-func callServiceB(ctx context.Context, cep string) ([]byte, error) {
-	ctx, span := tracer.Start(ctx, "call_service_b")
+// LookupCity asks service B for the weather of a city rather than of a
+// CEP.
+func (c *serviceBClient) LookupCity(ctx context.Context, city string) ([]byte, error) {
+	return c.call(ctx, weather.Location{City: city})
+}
+
+func (c *serviceBClient) call(ctx context.Context, query weather.Location) ([]byte, error) {
+	ctx, span := c.tracer.Start(ctx, "call_service_b")
 	defer span.End()
 
-	reqBody, err := json.Marshal(map[string]string{"cep": cep})
+	reqBody, err := json.Marshal(query)
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling request: %w", err)
 	}
+	caching := upstreamCachingFrom(ctx)
+	if caching == nil || !caching.revalidate {
+		if body, ttl, ok := c.cache.Get(ctx, responseCacheKey(ctx, reqBody)); ok {
+			span.SetAttributes(attribute.Bool("response_cache.hit", true))
+			if caching != nil {
+				caching.cacheControl = fmt.Sprintf("max-age=%d", int(ttl.Seconds()))
+			}
+			return body, nil
+		}
+	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", serviceBURL, bytes.NewBuffer(reqBody))
+	var body []byte
+	err = c.retry.Do(ctx, "serviceb", func(ctx context.Context) (bool, error) {
+		b, retryable, err := c.callOnce(ctx, reqBody)
+		body = b
+		return retryable, err
+	})
+	return body, err
+}
+
+// callOnce sends one attempt to the endpoint picked by the balancer and
+// reports whether a failure is worth retrying elsewhere.
+func (c *serviceBClient) callOnce(ctx context.Context, reqBody []byte) ([]byte, bool, error) {
+	ep, err := c.endpoints.Pick()
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
+		return nil, false, err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("service_b.endpoint", ep.URL))
+
+	healthy := false
+	defer func() { c.endpoints.Done(ep, healthy) }()
+
+	target := ep.URL
+	if extended, _ := ctx.Value(extendedKey{}).(bool); extended {
+		target = withQuery(target, "extended", "true")
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, false, fmt.Errorf("error creating request: %w", err)
+	}
+	if ep.Host != "" {
+		req.Host = ep.Host
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(deadlineHeader, fmt.Sprintf("%dms", time.Until(deadline).Milliseconds()))
+	}
+	if priority, ok := shedding.Priority(ctx); ok {
+		req.Header.Set(shedding.PriorityHeader, priority)
+	}
 
-	client := http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
-	resp, err := client.Do(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error calling service B: %w", err)
+		// A request abandoned by the caller says nothing about the endpoint.
+		healthy = ctx.Err() != nil
+		return nil, true, fmt.Errorf("error calling service B: %w", err)
 	}
 	defer resp.Body.Close()
+	healthy = resp.StatusCode < http.StatusInternalServerError || resp.StatusCode == http.StatusGatewayTimeout
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %w", err)
+		return nil, true, fmt.Errorf("error reading response body: %w", err)
 	}
 
 	if resp.StatusCode == http.StatusNotFound {
-		return nil, ErrCepNotFound
+		return nil, false, apperrors.ErrCepNotFound
 	}
 	if resp.StatusCode == http.StatusUnprocessableEntity {
-		return nil, ErrInvalidCep
+		return nil, false, apperrors.ErrInvalidCep
+	}
+	if resp.StatusCode == http.StatusGatewayTimeout {
+		return nil, false, apperrors.ErrUpstreamTimeout
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return nil, true, httpapi.WithRetryAfter(apperrors.ErrUpstreamUnavailable, httpapi.ParseRetryAfter(resp.Header.Get("Retry-After")))
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, resp.StatusCode >= http.StatusInternalServerError, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
-	return body, nil
+	cacheControl := resp.Header.Get("Cache-Control")
+	c.cache.Set(responseCacheKey(ctx, reqBody), body, cacheControl)
+	if caching := upstreamCachingFrom(ctx); caching != nil {
+		caching.cacheControl = cacheControl
+	}
+	return body, false, nil
 }
 
-func isValidCep(cep string) bool {
-	re := regexp.MustCompile(`^\d{8}$`)
-	return re.MatchString(cep)
+// parseCepValidation reads CEP_VALIDATION, how much of a CEP isValidCep
+// checks.
+func parseCepValidation(strictness string) cep.Strictness {
+	st, err := cep.ParseStrictness(strictness)
+	if err != nil {
+		log.Printf("Unknown CEP_VALIDATION %q, falling back to %q", strictness, cep.Format)
+		st = cep.Format
+	}
+	return st
 }
 
-func respondWithError(w http.ResponseWriter, statusCode int, message string, ctx context.Context) {
-	span := trace.SpanFromContext(ctx)
-	span.AddEvent("error_response", trace.WithAttributes(
-		semconv.HTTPStatusCodeKey.Int(statusCode),
-	))
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(ErrorResponse{Message: message})
+// isValidCep reports whether s is a CEP worth looking up: 8 digits and,
+// with CEP_VALIDATION=range, in the range of a UF.
+func isValidCep(s string, strictness cep.Strictness) bool {
+	return cep.Validate(s, strictness) == nil
 }
 
-func initTracer(collectorURL string) (*sdktrace.TracerProvider, error) {
+// initTracer also returns its connection to the collector, which the
+// readiness and startup checks watch.
+func initTracer(collectorURL string) (*sdktrace.TracerProvider, *grpc.ClientConn, error) {
 	ctx := context.Background()
 
-	conn, err := grpc.DialContext(ctx, collectorURL, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	conn, err := grpc.NewClient(collectorURL, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gRPC connection to collector: %w", err)
+		return nil, nil, fmt.Errorf("failed to create gRPC connection to collector: %w", err)
 	}
 
 	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		return nil, nil, fmt.Errorf("failed to create trace exporter: %w", err)
 	}
 
-	res, err := resource.New(ctx,
-		resource.WithAttributes(
-			semconv.ServiceNameKey.String("service-a"),
-		),
-	)
+	res, err := buildinfo.NewResource(ctx, "service-a")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create resource: %w", err)
+		return nil, nil, fmt.Errorf("failed to create resource: %w", err)
 	}
 
 	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSampler(traceSampler),
 		sdktrace.WithBatcher(exporter),
 		sdktrace.WithResource(res),
 	)
 	otel.SetTracerProvider(tp)
 	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
-	tracer = tp.Tracer("service-a")
 
-	return tp, nil
+	return tp, conn, nil
 }
 
 func getEnv(key, fallback string) string {
@@ -202,3 +419,79 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s=%q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s=%q, using %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s=%q, using %d", key, value, fallback)
+		return fallback
+	}
+	return i
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid number for %s=%q, using %g", key, value, fallback)
+		return fallback
+	}
+	return f
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// templateFiles holds the HTML view of Result. The layout and the other
+// views come with httpapi.
+//
+//go:embed templates
+var templateFiles embed.FS
+
+func init() {
+	httpapi.ParseTemplates(templateFiles, "templates/*.html")
+}
+
+// traceSampler is the sampler of the tracer provider.
+var traceSampler = sampling.New(tenantBaggageKey)
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// serviceBCache is a small in-process cache of the answers of service B,
+// keyed by the request sent for them. It keeps them for as long as their
+// Cache-Control lets a shared cache keep them, so that repeat lookups are
+// answered at the edge without another call to service B. Answers marked
+// no-store, no-cache or private, or without a max-age, are not kept.
+type serviceBCache struct {
+	mu         sync.Mutex
+	entries    map[string]cachedAnswer
+	maxEntries int
+	lookups    metric.Int64Counter
+}
+
+type cachedAnswer struct {
+	body      []byte
+	expiresAt time.Time
+}
+
+// newServiceBCache returns nil for a maxEntries of 0.
+func newServiceBCache(maxEntries int, meter metric.Meter) *serviceBCache {
+	if maxEntries <= 0 {
+		return nil
+	}
+	c := &serviceBCache{entries: make(map[string]cachedAnswer), maxEntries: maxEntries}
+	var err error
+	c.lookups, err = meter.Int64Counter("serviceb.response_cache.lookups",
+		metric.WithDescription("Lookups of service B answers in the response cache, by outcome"),
+		metric.WithUnit("{lookup}"),
+	)
+	if err != nil {
+		log.Printf("Error creating response cache counter: %v", err)
+	}
+	return c
+}
+
+// responseCacheKey is the cache key of the answer to reqBody, which
+// depends on whether the request asked for the extended answer.
+func responseCacheKey(ctx context.Context, reqBody []byte) string {
+	if extended, _ := ctx.Value(extendedKey{}).(bool); extended {
+		return "extended " + string(reqBody)
+	}
+	return string(reqBody)
+}
+
+// Get returns the answer kept under key and how long it stays fresh.
+func (c *serviceBCache) Get(ctx context.Context, key string) ([]byte, time.Duration, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	now := clock.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.expiresAt) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if c.lookups != nil {
+		outcome := "miss"
+		if ok {
+			outcome = "hit"
+		}
+		c.lookups.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+	}
+	if !ok {
+		return nil, 0, false
+	}
+	return e.body, e.expiresAt.Sub(now), true
+}
+
+// Set keeps body under key for as long as cacheControl, the Cache-Control
+// service B answered with, allows.
+func (c *serviceBCache) Set(key string, body []byte, cacheControl string) {
+	if c == nil {
+		return
+	}
+	ttl, ok := sharedMaxAge(cacheControl)
+	if !ok {
+		return
+	}
+	now := clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evictLocked(now)
+	}
+	c.entries[key] = cachedAnswer{body: body, expiresAt: now.Add(ttl)}
+}
+
+// evictLocked drops the expired answers or, when none is, the one closest
+// to expiring.
+func (c *serviceBCache) evictLocked(now time.Time) {
+	var next string
+	for k, e := range c.entries {
+		if !now.Before(e.expiresAt) {
+			delete(c.entries, k)
+			continue
+		}
+		if next == "" || e.expiresAt.Before(c.entries[next].expiresAt) {
+			next = k
+		}
+	}
+	if len(c.entries) >= c.maxEntries {
+		delete(c.entries, next)
+	}
+}
+
+// sharedMaxAge reads from a Cache-Control how long a shared cache may keep
+// the response: s-maxage, else max-age. It is false for responses a shared
+// cache must not keep, or must revalidate before every use.
+func sharedMaxAge(cacheControl string) (time.Duration, bool) {
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return 0, false
+		case "max-age":
+			if err == nil {
+				maxAge = seconds
+			}
+		case "s-maxage":
+			if err == nil {
+				sMaxAge = seconds
+			}
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge <= 0 {
+		return 0, false
+	}
+	return time.Duration(maxAge) * time.Second, true
+}
+
+// hasCacheDirective reports whether a Cache-Control names directive.
+func hasCacheDirective(cacheControl, directive string) bool {
+	for _, d := range strings.Split(cacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamCaching carries between a /cep handler and the calls to service
+// B it makes how the answer may be cached.
+type upstreamCaching struct {
+	// revalidate skips the response cache, for requests sent with
+	// Cache-Control: no-cache.
+	revalidate bool
+	// cacheControl is the Cache-Control of the answer: service B's, or, for
+	// an answer from the response cache, the time it has left.
+	cacheControl string
+}
+
+type upstreamCachingKey struct{}
+
+func withUpstreamCaching(ctx context.Context, revalidate bool) (context.Context, *upstreamCaching) {
+	c := &upstreamCaching{revalidate: revalidate}
+	return context.WithValue(ctx, upstreamCachingKey{}, c), c
+}
+
+// upstreamCachingFrom returns the upstreamCaching of ctx, or nil for the
+// calls of batches and background tasks, which don't pass it on.
+func upstreamCachingFrom(ctx context.Context) *upstreamCaching {
+	c, _ := ctx.Value(upstreamCachingKey{}).(*upstreamCaching)
+	return c
+}
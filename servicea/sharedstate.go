@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// sharedStateRetry is how long a replica keeps to its local state after
+// Redis fails before trying it again.
+const sharedStateRetry = 5 * time.Second
+
+func newRedisClient(redisURL string) (*redis.Client, error) {
+	if !strings.Contains(redisURL, "://") {
+		redisURL = "redis://" + redisURL
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return redis.NewClient(opts), nil
+}
+
+// stateFallback tracks whether the Redis behind a shared store is
+// reachable. Once a call fails, calls go to the local store for
+// sharedStateRetry, so an outage costs one timeout per period rather than
+// one per request, and the replica enforces its own counts until Redis is
+// back.
+type stateFallback struct {
+	store     string
+	mu        sync.Mutex
+	retryAt   time.Time
+	fallbacks metric.Int64Counter
+}
+
+func newStateFallback(store string, meter metric.Meter) *stateFallback {
+	f := &stateFallback{store: store}
+	var err error
+	f.fallbacks, err = meter.Int64Counter("shared_state.fallbacks",
+		metric.WithDescription("Calls served from local state because Redis was unavailable, by store"),
+		metric.WithUnit("{call}"),
+	)
+	if err != nil {
+		log.Printf("Error creating shared state fallback counter: %v", err)
+	}
+	return f
+}
+
+// run calls shared, unless Redis is known to be down, and local when it is
+// or shared fails. Real time is used, not clock.Now: a pinned clock must
+// not keep a replica off Redis for good.
+func (f *stateFallback) run(ctx context.Context, shared, local func() error) error {
+	f.mu.Lock()
+	down := !f.retryAt.IsZero() && time.Now().Before(f.retryAt)
+	f.mu.Unlock()
+
+	if !down {
+		err := shared()
+		if err == nil {
+			f.recovered()
+			return nil
+		}
+		// A request that went away says nothing about Redis.
+		if ctx.Err() != nil {
+			return err
+		}
+		f.mu.Lock()
+		if f.retryAt.IsZero() {
+			errlog.Printf("Redis unavailable for %s state, falling back to local state: %v", f.store, err)
+		}
+		f.retryAt = time.Now().Add(sharedStateRetry)
+		f.mu.Unlock()
+	}
+	if f.fallbacks != nil {
+		f.fallbacks.Add(ctx, 1, metric.WithAttributes(attribute.String("store", f.store)))
+	}
+	return local()
+}
+
+func (f *stateFallback) recovered() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.retryAt.IsZero() {
+		log.Printf("Redis reachable again, %s state is shared again", f.store)
+		f.retryAt = time.Time{}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/retry"
+	"github.com/joaolima7/otel-goexpert/pkg/soak"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// soakRequests is the traffic each soak client cycles through: lookups
+// that go to service B, failures, every response format and batches.
+var soakRequests = []struct {
+	path, body string
+	status     int
+}{
+	{"/cep", `{"cep":"01001000"}`, http.StatusOK},
+	{"/cep", `{"cep":"00000000"}`, http.StatusNotFound},
+	{"/cep", `{"cep":"123"}`, http.StatusUnprocessableEntity},
+	{"/cep?format=xml", `{"cep":"01001000"}`, http.StatusOK},
+	{"/cep?format=html", `{"cep":"01001000"}`, http.StatusOK},
+	{"/cep?format=csv", `{"cep":"01001000"}`, http.StatusOK},
+	{"/cep/batch", `{"ceps":["01001000","20040002","00000000","123"]}`, http.StatusMultiStatus},
+}
+
+// newFakeServiceB answers /weather like service B does, over HTTP, so that
+// the soak also goes through service A's client, balancer and retries.
+func newFakeServiceB() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req CepRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		if req.Cep == "00000000" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(httpapi.ErrorResponse{Message: "can not find zipcode", Code: weather.CodeZipcodeNotFound})
+			return
+		}
+		json.NewEncoder(w).Encode(weather.Result{City: "São Paulo", TempC: 28.5, TempF: 83.3, TempK: 301.5})
+	}))
+}
+
+// newTestServiceBClient returns a client of the service B at url, with up
+// to attempts tries per lookup, and the transport it goes through.
+func newTestServiceBClient(url string, attempts int) (*serviceBClient, *http.Transport) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	endpoints := newBalancer(lbRoundRobin, 3, time.Second)
+	endpoints.SetEndpoints([]string{url}, "")
+	return &serviceBClient{
+		endpoints: endpoints,
+		client:    &http.Client{Transport: transport},
+		retry:     retry.Policy{Budget: retry.NewBudget(0.2, 10, time.Minute, testMeter), MaxAttempts: attempts, Backoff: 10 * time.Millisecond},
+		tracer:    testTracer,
+	}, transport
+}
+
+func TestSoak(t *testing.T) {
+	duration := soak.Duration(t)
+
+	fakeB := newFakeServiceB()
+	defer fakeB.Close()
+	serviceB, upstream := newTestServiceBClient(fakeB.URL+"/weather", 2)
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /cep", &cepHandler{lookup: serviceB.Lookup, strictness: cep.Format, tracer: testTracer})
+	mux.Handle("POST /cep/batch", &batchHandler{maxSize: 100, concurrency: 8, itemTimeout: time.Second, lookup: serviceB.Lookup, strictness: cep.Format, tracer: testTracer})
+	srv := httptest.NewServer(withServiceMiddleware(mux))
+	defer srv.Close()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	httpc := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	next := make([]int, soak.Concurrency())
+	drive := func(ctx context.Context, c int) error {
+		r := soakRequests[next[c]%len(soakRequests)]
+		next[c]++
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+r.path, strings.NewReader(r.body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := httpc.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != r.status {
+			return fmt.Errorf("POST %s: status %d, want %d", r.path, resp.StatusCode, r.status)
+		}
+		return nil
+	}
+	settle := func() {
+		transport.CloseIdleConnections()
+		upstream.CloseIdleConnections()
+	}
+	soak.Run(t, duration, drive, settle)
+}
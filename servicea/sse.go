@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// sseKeepAlive is how often an idle stream gets a comment line, so proxies
+// don't close it.
+const sseKeepAlive = 15 * time.Second
+
+// sseReconnectDelay is how long clients are told to wait before
+// reconnecting when the server goes away: long enough for a restarted or
+// upgraded process to be listening, short enough to go unnoticed.
+const sseReconnectDelay = 2 * time.Second
+
+// sseClientBuffer is how many events a client may fall behind before new
+// ones are dropped for it.
+const sseClientBuffer = 64
+
+type sseEvent struct {
+	name string
+	data []byte
+}
+
+// sseHub fans events out to the connected server-sent event clients. Each
+// event is encoded once; a client that can't keep up loses events rather
+// than holding up the others.
+type sseHub struct {
+	mu      sync.Mutex
+	clients map[chan sseEvent]struct{}
+	closed  bool
+
+	dropped metric.Int64Counter
+}
+
+func newSSEHub(meter metric.Meter) *sseHub {
+	h := &sseHub{clients: make(map[chan sseEvent]struct{})}
+	_, err := meter.Int64ObservableGauge("sse.clients",
+		metric.WithDescription("Connected server-sent event clients"),
+		metric.WithUnit("{client}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(h.Clients()))
+			return nil
+		}),
+	)
+	if err != nil {
+		log.Printf("Failed to create SSE clients gauge: %v", err)
+	}
+	h.dropped, err = meter.Int64Counter("sse.events.dropped",
+		metric.WithDescription("Events dropped for server-sent event clients that fell behind"),
+		metric.WithUnit("{event}"),
+	)
+	if err != nil {
+		log.Printf("Failed to create SSE dropped events counter: %v", err)
+	}
+	return h
+}
+
+func (h *sseHub) Clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Publish sends v, encoded as JSON, to every client as event name.
+func (h *sseHub) Publish(name string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		errlog.Printf("Error encoding %s event: %v", name, err)
+		return
+	}
+	e := sseEvent{name: name, data: data}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- e:
+		default:
+			if h.dropped != nil {
+				h.dropped.Add(context.Background(), 1)
+			}
+		}
+	}
+}
+
+func (h *sseHub) subscribe() (chan sseEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, false
+	}
+	ch := make(chan sseEvent, sseClientBuffer)
+	h.clients[ch] = struct{}{}
+	return ch, true
+}
+
+func (h *sseHub) unsubscribe(ch chan sseEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[ch]; ok {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// Close ends every stream, after a "goaway" event telling the client when
+// to reconnect. It is registered to run when the server starts shutting
+// down, since open streams would otherwise hold up the drain.
+func (h *sseHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.clients {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// Serve streams the events to one client, starting with initial sent as
+// event first, until the client goes away or the hub is closed.
+func (h *sseHub) Serve(w http.ResponseWriter, r *http.Request, first string, initial any) {
+	rc := http.NewResponseController(w)
+	ch, ok := h.subscribe()
+	if !ok {
+		httpapi.RespondWithError(w, weather.CodeOverloaded, "shutting down", r.Context())
+		return
+	}
+	defer h.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	data, err := json.Marshal(initial)
+	if err != nil {
+		errlog.Printf("Error encoding %s event: %v", first, err)
+		return
+	}
+	if writeSSE(w, sseEvent{name: first, data: data}) != nil || rc.Flush() != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				if writeGoAway(w) == nil {
+					rc.Flush()
+				}
+				return
+			}
+			err = writeSSE(w, e)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, e sseEvent) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, e.data)
+	return err
+}
+
+// writeGoAway tells the client the server is shutting down, and sets its
+// reconnection delay so that it comes back once another process serves.
+func writeGoAway(w http.ResponseWriter) error {
+	_, err := fmt.Fprintf(w, "retry: %d\nevent: goaway\ndata: {\"reason\":\"shutting down\"}\n\n", sseReconnectDelay.Milliseconds())
+	return err
+}
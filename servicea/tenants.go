@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/accesslog"
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/netacl"
+	"github.com/joaolima7/otel-goexpert/pkg/shedding"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// tenantBaggageKey carries the tenant ID to service B.
+const tenantBaggageKey = "tenant.id"
+
+// tenant is a customer of the API with its own keys and limits.
+type tenant struct {
+	ID      string   `json:"id"`
+	APIKeys []apiKey `json:"api_keys"`
+	// RateLimit is in requests per second; zero means unlimited.
+	RateLimit float64 `json:"rate_limit"`
+	Burst     int     `json:"burst"`
+	// Priority, when set, replaces the X-Priority sent by the client.
+	Priority     string   `json:"priority"`
+	Features     []string `json:"features"`
+	MaxBatchSize int      `json:"max_batch_size"`
+	DefaultUnits string   `json:"default_units"`
+	// DailyQuota and MonthlyQuota are hard request limits; zero means none.
+	// Past SoftQuotaPercent of either, responses carry a Warning header.
+	DailyQuota       int64 `json:"daily_quota"`
+	MonthlyQuota     int64 `json:"monthly_quota"`
+	SoftQuotaPercent int   `json:"soft_quota_percent"`
+	// DebugCapture captures every request of the tenant; see
+	// debugcapture.Capturer.
+	DebugCapture bool `json:"debug_capture"`
+
+	limiter *rate.Limiter
+}
+
+// apiKey is a key of a tenant. In the tenants file it is either the key
+// itself or, to restrict it to web pages, an object listing the origins it
+// may be sent from, such as {"key": "...", "allowed_origins":
+// ["https://app.example.com", "https://*.example.com"]}.
+type apiKey struct {
+	Key string `json:"key"`
+	// AllowedOrigins, when set, are the only origins the key is accepted
+	// from; see originAllowed.
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+func (k *apiKey) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &k.Key); err == nil {
+		return nil
+	}
+	type plain apiKey
+	return json.Unmarshal(data, (*plain)(k))
+}
+
+// validateOrigin checks an allowed_origins entry: a scheme and a host,
+// whose leftmost label may be * for any subdomain, and nothing else.
+func validateOrigin(origin string) error {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid allowed origin %q: want scheme://host[:port]", origin)
+	}
+	if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+		return fmt.Errorf("invalid allowed origin %q: only the leftmost label may be *", origin)
+	}
+	return nil
+}
+
+// requestOrigin is the origin r was sent from: its Origin header or,
+// without one, the scheme and host of its Referer. Browsers set both and
+// pages can't forge them, so a key restricted to some origins can't be
+// reused by other sites; clients outside a browser can still send
+// anything, so the restriction is no substitute for keeping keys secret.
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return origin
+	}
+	if u, err := url.Parse(r.Header.Get("Referer")); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return ""
+}
+
+// originAllowed reports whether origin matches one of allowed. Schemes and
+// hosts compare without case, and https://*.example.com matches every
+// subdomain of example.com but not example.com itself. A request with no
+// origin matches nothing.
+func originAllowed(origin string, allowed []string) bool {
+	u, err := url.Parse(strings.ToLower(origin))
+	if origin == "" || err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		pattern, err := url.Parse(strings.ToLower(a))
+		if err != nil || pattern.Scheme != u.Scheme {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(pattern.Host, "*"); ok {
+			if strings.HasSuffix(u.Host, suffix) && len(u.Host) > len(suffix) {
+				return true
+			}
+		} else if pattern.Host == u.Host {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tenant) softQuotaPercent() int {
+	if t.SoftQuotaPercent <= 0 {
+		return 80
+	}
+	return t.SoftQuotaPercent
+}
+
+func (t *tenant) HasFeature(name string) bool {
+	return slices.Contains(t.Features, name)
+}
+
+type tenantKey struct{}
+
+// tenantFromContext returns the tenant that authenticated the request.
+func tenantFromContext(ctx context.Context) (*tenant, bool) {
+	t, ok := ctx.Value(tenantKey{}).(*tenant)
+	return t, ok
+}
+
+// debugCaptureEnabledFor reports whether the tenant of r has debug capture
+// turned on.
+func debugCaptureEnabledFor(r *http.Request) bool {
+	t, ok := tenantFromContext(r.Context())
+	return ok && t.DebugCapture
+}
+
+// samplingTenant returns the ID of the tenant whose API key r carries, for
+// the sampler, which runs before Middleware.
+func (reg *tenantRegistry) samplingTenant(r *http.Request) string {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return ""
+	}
+	if k, ok := reg.lookup(key); ok {
+		return k.tenant.ID
+	}
+	return ""
+}
+
+// tenantRegistry maps API keys to tenants. With no tenants configured the
+// API stays open and requests are served anonymously.
+type tenantRegistry struct {
+	byKey    map[[32]byte]registeredKey
+	byID     map[string]*tenant
+	usage    *usageMeter
+	auditLog *audit.Logger
+	requests metric.Int64Counter
+}
+
+// loadTenants reads the tenant list from a JSON file; an empty path
+// disables API-key authentication. Usage is counted in store and
+// authentications are recorded in auditLog.
+func loadTenants(path string, store usageStore, auditLog *audit.Logger, meter metric.Meter) (*tenantRegistry, error) {
+	reg := &tenantRegistry{
+		byKey:    make(map[[32]byte]registeredKey),
+		byID:     make(map[string]*tenant),
+		usage:    newUsageMeter(store),
+		auditLog: auditLog,
+	}
+
+	var err error
+	reg.requests, err = meter.Int64Counter("http.server.tenant.requests",
+		metric.WithDescription("Authenticated requests, by tenant and outcome"),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		log.Printf("Error creating tenant request counter: %v", err)
+	}
+
+	if path == "" {
+		return reg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+	var tenants []*tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+
+	for _, t := range tenants {
+		if t.ID == "" {
+			return nil, fmt.Errorf("tenant without id in %s", path)
+		}
+		if _, dup := reg.byID[t.ID]; dup {
+			return nil, fmt.Errorf("duplicate tenant %s", t.ID)
+		}
+		reg.byID[t.ID] = t
+		if t.Priority != "" {
+			if !shedding.ValidPriority(t.Priority) {
+				return nil, fmt.Errorf("tenant %s: unknown priority %q", t.ID, t.Priority)
+			}
+		}
+		if t.RateLimit > 0 {
+			t.limiter = rate.NewLimiter(rate.Limit(t.RateLimit), max(t.Burst, 1))
+		}
+		for _, key := range t.APIKeys {
+			if key.Key == "" {
+				return nil, fmt.Errorf("tenant %s: empty API key", t.ID)
+			}
+			for _, origin := range key.AllowedOrigins {
+				if err := validateOrigin(origin); err != nil {
+					return nil, fmt.Errorf("tenant %s: %w", t.ID, err)
+				}
+			}
+			hash := sha256.Sum256([]byte(key.Key))
+			if _, dup := reg.byKey[hash]; dup {
+				return nil, fmt.Errorf("tenant %s: API key already assigned", t.ID)
+			}
+			reg.byKey[hash] = registeredKey{tenant: t, allowedOrigins: key.AllowedOrigins}
+		}
+	}
+	log.Printf("Loaded %d tenants", len(tenants))
+	return reg, nil
+}
+
+// registeredKey is an API key as the registry keeps it.
+type registeredKey struct {
+	tenant         *tenant
+	allowedOrigins []string
+}
+
+// lookup finds key. Keys are looked up by hash, so the lookup time doesn't
+// depend on how much of a key matches.
+func (reg *tenantRegistry) lookup(key string) (registeredKey, bool) {
+	k, ok := reg.byKey[sha256.Sum256([]byte(key))]
+	return k, ok
+}
+
+// apiKeyID names key in the audit log without revealing it: the first
+// bytes of its hash.
+func apiKeyID(key string) string {
+	if key == "" {
+		return "none"
+	}
+	hash := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(hash[:4])
+}
+
+// Middleware authenticates the API key, checks the origin it is restricted
+// to, applies the tenant's rate limit, quotas and priority, and tags the
+// span, metrics, logs and outgoing baggage with the tenant ID. Every
+// authentication, accepted or not, goes to the audit log.
+func (reg *tenantRegistry) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(reg.byKey) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rawKey := r.Header.Get(apiKeyHeader)
+		key, ok := reg.lookup(rawKey)
+		if !ok {
+			reg.auditLog.Record(r.Context(), apiKeyID(rawKey), "api_key.auth", "denied", map[string]string{
+				"reason": "invalid_key",
+				"route":  r.URL.Path,
+			})
+			httpapi.RespondWithError(w, weather.CodeUnauthorized, "invalid api key", r.Context())
+			return
+		}
+		t := key.tenant
+
+		ctx := r.Context()
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("tenant.id", t.ID))
+		accesslog.Annotate(ctx, slog.String("tenant_id", t.ID))
+
+		outcome := "accepted"
+		defer func() {
+			result := "success"
+			if outcome != "accepted" {
+				result = "denied"
+			}
+			reg.auditLog.Record(ctx, t.ID, "api_key.auth", result, map[string]string{
+				"key":    apiKeyID(rawKey),
+				"reason": outcome,
+				"route":  r.URL.Path,
+			})
+			if reg.requests != nil {
+				reg.requests.Add(ctx, 1, metric.WithAttributes(
+					attribute.String("tenant.id", t.ID),
+					attribute.String("outcome", outcome),
+				))
+			}
+		}()
+
+		if len(key.allowedOrigins) > 0 && !originAllowed(requestOrigin(r), key.allowedOrigins) {
+			outcome = "origin_denied"
+			httpapi.RespondWithError(w, weather.CodeForbidden, "api key not allowed from this origin", ctx)
+			return
+		}
+		if t.limiter != nil && !t.limiter.AllowN(clock.Now(), 1) {
+			outcome = "rate_limited"
+			httpapi.SetRetryAfter(w, nextTokenDelay(t.limiter))
+			httpapi.RespondWithError(w, weather.CodeRateLimited, "rate limit exceeded", ctx)
+			return
+		}
+		decision := reg.usage.Consume(ctx, t)
+		writeQuotaHeaders(w, decision)
+		if !decision.allowed {
+			outcome = "quota_exceeded"
+			httpapi.SetRetryAfter(w, decision.retryAfter)
+			httpapi.RespondWithError(w, weather.CodeQuotaExceeded, "quota exceeded", ctx)
+			return
+		}
+		if t.Priority != "" {
+			r.Header.Set(shedding.PriorityHeader, t.Priority)
+		}
+
+		ctx = context.WithValue(ctx, tenantKey{}, t)
+		if member, err := baggage.NewMember(tenantBaggageKey, t.ID); err == nil {
+			if bag, err := baggage.FromContext(ctx).SetMember(member); err == nil {
+				ctx = baggage.ContextWithBaggage(ctx, bag)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// nextTokenDelay returns how long until l grants its next token.
+func nextTokenDelay(l *rate.Limiter) time.Duration {
+	now := clock.Now()
+	r := l.ReserveN(now, 1)
+	defer r.CancelAt(now)
+	return r.DelayFrom(now)
+}
+
+// requestCaller names who sent r, to keep the idempotency keys of
+// different callers apart: the tenant its API key authenticated or,
+// without one, its address as acl tells it. Baggage is left out, since any
+// client can set it.
+func requestCaller(acl *netacl.ACL) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if t, ok := tenantFromContext(r.Context()); ok {
+			return "tenant " + t.ID
+		}
+		if addr, ok := acl.ClientAddr(r); ok {
+			return "client " + addr.String()
+		}
+		return "client " + r.RemoteAddr
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/redis/go-redis/v9"
+)
+
+// tenantUsage counts the requests of one tenant in the current UTC day and
+// month.
+type tenantUsage struct {
+	Day          string `json:"day"`
+	DayCount     int64  `json:"day_count"`
+	Month        string `json:"month"`
+	MonthCount   int64  `json:"month_count"`
+	DailyQuota   int64  `json:"daily_quota,omitempty"`
+	MonthlyQuota int64  `json:"monthly_quota,omitempty"`
+}
+
+// usagePeriod is the UTC day and month a request is counted in.
+type usagePeriod struct {
+	day, month       string
+	dayEnd, monthEnd time.Time
+}
+
+func usagePeriodAt(now time.Time) usagePeriod {
+	now = now.UTC()
+	return usagePeriod{
+		day:      now.Format("2006-01-02"),
+		month:    now.Format("2006-01"),
+		dayEnd:   time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC),
+		monthEnd: time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// usageStore keeps the request counts of the tenants. The Redis
+// implementation shares them between replicas, so quotas hold for the
+// service rather than for each replica.
+type usageStore interface {
+	// Consume counts a request of tenantID in period p unless its daily or
+	// monthly count already reached dayQuota or monthQuota (zero for no
+	// quota). It returns the counts and whether the request was counted.
+	Consume(ctx context.Context, tenantID string, p usagePeriod, dayQuota, monthQuota int64) (day, month int64, counted bool, err error)
+	// Counts returns the counts of tenantID in period p.
+	Counts(ctx context.Context, tenantID string, p usagePeriod) (day, month int64, err error)
+}
+
+// usageMeter tracks per-tenant usage against the tenants' quotas.
+type usageMeter struct {
+	store usageStore
+}
+
+func newUsageMeter(store usageStore) *usageMeter {
+	return &usageMeter{store: store}
+}
+
+// quotaDecision is the outcome of counting one request.
+type quotaDecision struct {
+	allowed bool
+	// limit and remaining describe the tightest quota, if any.
+	limit     int64
+	remaining int64
+	warning   string
+	// retryAfter is how long a rejected request has to wait for its
+	// quota to reset.
+	retryAfter time.Duration
+}
+
+// Consume counts a request for t unless it would exceed a hard quota.
+// Past the soft threshold the request goes through with a warning.
+func (m *usageMeter) Consume(ctx context.Context, t *tenant) quotaDecision {
+	now := clock.Now().UTC()
+	p := usagePeriodAt(now)
+	day, month, counted, err := m.store.Consume(ctx, t.ID, p, t.DailyQuota, t.MonthlyQuota)
+	if err != nil {
+		// Fail open: a store outage must not lock tenants out.
+		errlog.Printf("Error counting usage of tenant %s: %v", t.ID, err)
+		return quotaDecision{allowed: true}
+	}
+	if !counted {
+		if t.MonthlyQuota > 0 && month >= t.MonthlyQuota {
+			return quotaDecision{allowed: false, retryAfter: p.monthEnd.Sub(now)}
+		}
+		return quotaDecision{allowed: false, retryAfter: p.dayEnd.Sub(now)}
+	}
+
+	d := quotaDecision{allowed: true, remaining: -1}
+	check := func(period string, used, quota int64) {
+		if quota <= 0 {
+			return
+		}
+		if remaining := quota - used; d.remaining < 0 || remaining < d.remaining {
+			d.limit, d.remaining = quota, remaining
+		}
+		if used*100 >= quota*int64(t.softQuotaPercent()) {
+			d.warning = fmt.Sprintf("%s quota %d%% used", period, used*100/quota)
+		}
+	}
+	check("daily", day, t.DailyQuota)
+	check("monthly", month, t.MonthlyQuota)
+	return d
+}
+
+// Usage returns a snapshot of t's usage.
+func (m *usageMeter) Usage(ctx context.Context, t *tenant) (tenantUsage, error) {
+	p := usagePeriodAt(clock.Now())
+	day, month, err := m.store.Counts(ctx, t.ID, p)
+	if err != nil {
+		return tenantUsage{}, err
+	}
+	return tenantUsage{
+		Day:          p.day,
+		DayCount:     day,
+		Month:        p.month,
+		MonthCount:   month,
+		DailyQuota:   t.DailyQuota,
+		MonthlyQuota: t.MonthlyQuota,
+	}, nil
+}
+
+// memoryUsageStore keeps the counts in process memory.
+type memoryUsageStore struct {
+	mu    sync.Mutex
+	usage map[string]*tenantUsage
+}
+
+func newMemoryUsageStore() *memoryUsageStore {
+	return &memoryUsageStore{usage: make(map[string]*tenantUsage)}
+}
+
+// currentLocked returns the usage of tenantID rolled over to p.
+func (s *memoryUsageStore) currentLocked(tenantID string, p usagePeriod) *tenantUsage {
+	u, ok := s.usage[tenantID]
+	if !ok {
+		u = &tenantUsage{}
+		s.usage[tenantID] = u
+	}
+	if u.Day != p.day {
+		u.Day, u.DayCount = p.day, 0
+	}
+	if u.Month != p.month {
+		u.Month, u.MonthCount = p.month, 0
+	}
+	return u
+}
+
+func (s *memoryUsageStore) Consume(_ context.Context, tenantID string, p usagePeriod, dayQuota, monthQuota int64) (int64, int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.currentLocked(tenantID, p)
+	if (monthQuota > 0 && u.MonthCount >= monthQuota) || (dayQuota > 0 && u.DayCount >= dayQuota) {
+		return u.DayCount, u.MonthCount, false, nil
+	}
+	u.DayCount++
+	u.MonthCount++
+	return u.DayCount, u.MonthCount, true, nil
+}
+
+func (s *memoryUsageStore) Counts(_ context.Context, tenantID string, p usagePeriod) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.currentLocked(tenantID, p)
+	return u.DayCount, u.MonthCount, nil
+}
+
+// consumeScript checks both quotas and counts the request in one step, so
+// that replicas counting at once can't together go past a quota.
+var consumeScript = redis.NewScript(`
+local day = tonumber(redis.call('GET', KEYS[1]) or '0')
+local month = tonumber(redis.call('GET', KEYS[2]) or '0')
+local dayQuota, monthQuota = tonumber(ARGV[1]), tonumber(ARGV[2])
+if (monthQuota > 0 and month >= monthQuota) or (dayQuota > 0 and day >= dayQuota) then
+	return {day, month, 0}
+end
+day = redis.call('INCR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+month = redis.call('INCR', KEYS[2])
+redis.call('EXPIRE', KEYS[2], ARGV[4])
+return {day, month, 1}
+`)
+
+// redisUsageStore keeps the counts in Redis under keyPrefix, one key per
+// tenant and period, expiring a day after the period ends.
+type redisUsageStore struct {
+	client    *redis.Client
+	keyPrefix string
+}
+
+func newRedisUsageStore(client *redis.Client, keyPrefix string) *redisUsageStore {
+	return &redisUsageStore{client: client, keyPrefix: keyPrefix}
+}
+
+// keys returns the day and month keys of tenantID. The tenant is a hash
+// tag, so both land on the same Redis Cluster slot, as the script needs.
+func (s *redisUsageStore) keys(tenantID string, p usagePeriod) []string {
+	prefix := s.keyPrefix + "{" + tenantID + "}:"
+	return []string{prefix + "day:" + p.day, prefix + "month:" + p.month}
+}
+
+func (s *redisUsageStore) Consume(ctx context.Context, tenantID string, p usagePeriod, dayQuota, monthQuota int64) (int64, int64, bool, error) {
+	// Expiry is relative, so that it holds whatever clock.Now says.
+	now := clock.Now()
+	ttl := func(end time.Time) int64 { return int64((end.Sub(now) + 24*time.Hour) / time.Second) }
+	res, err := consumeScript.Run(ctx, s.client, s.keys(tenantID, p),
+		dayQuota, monthQuota, ttl(p.dayEnd), ttl(p.monthEnd)).Int64Slice()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if len(res) != 3 {
+		return 0, 0, false, fmt.Errorf("unexpected usage script result %v", res)
+	}
+	return res[0], res[1], res[2] == 1, nil
+}
+
+func (s *redisUsageStore) Counts(ctx context.Context, tenantID string, p usagePeriod) (int64, int64, error) {
+	vals, err := s.client.MGet(ctx, s.keys(tenantID, p)...).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	var counts [2]int64
+	for i, v := range vals {
+		if v, ok := v.(string); ok {
+			counts[i], _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return counts[0], counts[1], nil
+}
+
+// fallbackUsageStore keeps the counts in Redis, and in memory while Redis
+// is unavailable. Requests counted in memory are not carried over to
+// Redis, so during an outage each replica enforces the quotas on its own.
+type fallbackUsageStore struct {
+	shared   usageStore
+	local    usageStore
+	fallback *stateFallback
+}
+
+func (s *fallbackUsageStore) Consume(ctx context.Context, tenantID string, p usagePeriod, dayQuota, monthQuota int64) (day, month int64, counted bool, err error) {
+	err = s.fallback.run(ctx,
+		func() (err error) {
+			day, month, counted, err = s.shared.Consume(ctx, tenantID, p, dayQuota, monthQuota)
+			return err
+		},
+		func() (err error) {
+			day, month, counted, err = s.local.Consume(ctx, tenantID, p, dayQuota, monthQuota)
+			return err
+		},
+	)
+	return day, month, counted, err
+}
+
+func (s *fallbackUsageStore) Counts(ctx context.Context, tenantID string, p usagePeriod) (day, month int64, err error) {
+	err = s.fallback.run(ctx,
+		func() (err error) { day, month, err = s.shared.Counts(ctx, tenantID, p); return err },
+		func() (err error) { day, month, err = s.local.Counts(ctx, tenantID, p); return err },
+	)
+	return day, month, err
+}
+
+// writeQuotaHeaders reports the tightest quota to the client.
+func writeQuotaHeaders(w http.ResponseWriter, d quotaDecision) {
+	if d.limit > 0 {
+		w.Header().Set("X-Quota-Limit", strconv.FormatInt(d.limit, 10))
+		w.Header().Set("X-Quota-Remaining", strconv.FormatInt(d.remaining, 10))
+	}
+	if d.warning != "" {
+		w.Header().Set("Warning", fmt.Sprintf(`299 - "%s"`, d.warning))
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// usageRecord is the consumption of one tenant on one endpoint over an
+// export period.
+type usageRecord struct {
+	TenantID    string    `json:"tenant_id"`
+	Endpoint    string    `json:"endpoint"`
+	Count       int64     `json:"count"`
+	Bytes       int64     `json:"bytes"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+}
+
+type usageRecordKey struct {
+	tenantID string
+	endpoint string
+}
+
+// usageExporter accumulates per-tenant consumption and publishes it as
+// usage.recorded events for billing and analytics on every Flush.
+type usageExporter struct {
+	mu        sync.Mutex
+	records   map[usageRecordKey]*usageRecord
+	since     time.Time
+	publisher eventPublisher
+	tracer    trace.Tracer
+}
+
+func newUsageExporter(publisher eventPublisher, tracer trace.Tracer) *usageExporter {
+	return &usageExporter{
+		records:   make(map[usageRecordKey]*usageRecord),
+		since:     clock.Now().UTC(),
+		publisher: publisher,
+		tracer:    tracer,
+	}
+}
+
+// Middleware counts the requests and response bytes of authenticated
+// tenants. It must run after the tenant middleware.
+func (u *usageExporter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := tenantFromContext(r.Context())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		endpoint := r.Method + " " + r.URL.Path
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			endpoint = r.Method + " " + rctx.RoutePattern()
+		}
+		u.record(t.ID, endpoint, int64(ww.BytesWritten()))
+	})
+}
+
+func (u *usageExporter) record(tenantID, endpoint string, bytes int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	key := usageRecordKey{tenantID, endpoint}
+	rec, ok := u.records[key]
+	if !ok {
+		rec = &usageRecord{TenantID: tenantID, Endpoint: endpoint}
+		u.records[key] = rec
+	}
+	rec.Count++
+	rec.Bytes += bytes
+}
+
+// Flush publishes the records accumulated since the last flush. It runs as
+// the usage_rollup cron task and once more on shutdown; records that fail to
+// publish are logged and counted in the returned error.
+func (u *usageExporter) Flush(ctx context.Context) error {
+	u.mu.Lock()
+	records, start := u.records, u.since
+	u.records = make(map[usageRecordKey]*usageRecord)
+	u.since = clock.Now().UTC()
+	u.mu.Unlock()
+
+	ctx, span := u.tracer.Start(ctx, "export_usage")
+	defer span.End()
+
+	failed := 0
+	for _, rec := range records {
+		rec.PeriodStart, rec.PeriodEnd = start, u.since
+		e, err := newEvent("usage.recorded", rec)
+		if err == nil {
+			err = u.publisher.Publish(ctx, "usage", e)
+		}
+		if err != nil {
+			errlog.Printf("Error exporting usage of tenant %s: %v", rec.TenantID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to export %d of %d usage records", failed, len(records))
+	}
+	return nil
+}
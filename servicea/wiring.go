@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/accesslog"
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/buildinfo"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/compression"
+	"github.com/joaolima7/otel-goexpert/pkg/cron"
+	"github.com/joaolima7/otel-goexpert/pkg/debugcapture"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/health"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/idempotency"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/metrics"
+	"github.com/joaolima7/otel-goexpert/pkg/netacl"
+	"github.com/joaolima7/otel-goexpert/pkg/outbound"
+	"github.com/joaolima7/otel-goexpert/pkg/profiling"
+	"github.com/joaolima7/otel-goexpert/pkg/retry"
+	"github.com/joaolima7/otel-goexpert/pkg/sampling"
+	"github.com/joaolima7/otel-goexpert/pkg/server"
+	"github.com/joaolima7/otel-goexpert/pkg/shedding"
+	"github.com/joaolima7/otel-goexpert/pkg/slowrequest"
+	"github.com/joaolima7/otel-goexpert/pkg/synthetic"
+	"github.com/joaolima7/otel-goexpert/pkg/watchdog"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+	"google.golang.org/grpc"
+)
+
+// appOptions describes how the components of service A are built and
+// started. Alternate wirings (tests, an all-in-one binary) can reuse it and
+// override individual providers with fx.Decorate or fx.Replace.
+func appOptions(cfg config) fx.Option {
+	return fx.Options(
+		fx.Supply(cfg),
+		fx.Provide(
+			provideTracerProvider,
+			provideTracer,
+			provideMeterProvider,
+			provideMeter,
+			provideAuditLogger,
+			provideCepMasker,
+			provideDebugCapturer,
+			provideHTTPClient,
+			provideBalancer,
+			provideServiceBClient,
+			provideCepStrictness,
+			provideDefaultLocation,
+			provideTenants,
+			provideGeoLocator,
+			provideRedis,
+			provideBanStore,
+			provideUsageStore,
+			provideEventPublisher,
+			provideUsageExporter,
+			provideScheduler,
+			provideDashboard,
+			provideReadiness,
+			provideCepHandler,
+			provideBatchHandler,
+			provideRouter,
+			provideServer,
+		),
+		fx.Invoke(flushTelemetryLast, stopErrorLog, startProfiler, startWatchdog, verifyDependencies),
+		fx.NopLogger,
+	)
+}
+
+// provideTracerProvider also returns the connection to the collector.
+func provideTracerProvider(lc fx.Lifecycle, cfg config) (*sdktrace.TracerProvider, *grpc.ClientConn, error) {
+	traceSampler.SetRate(cfg.TraceSampleRate)
+	tp, conn, err := initTracer(cfg.CollectorURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize tracer: %w", err)
+	}
+	lc.Append(fx.StopHook(tp.Shutdown))
+	return tp, conn, nil
+}
+
+func provideTracer(tp *sdktrace.TracerProvider) trace.Tracer {
+	return tp.Tracer("service-a")
+}
+
+// provideMeterProvider also returns the Prometheus endpoint, nil unless
+// METRICS_PROMETHEUS is set.
+func provideMeterProvider(lc fx.Lifecycle, cfg config) (*sdkmetric.MeterProvider, *metrics.PrometheusEndpoint, error) {
+	prom, err := metrics.NewPrometheusEndpoint(cfg.Metrics)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize meter: %w", err)
+	}
+	mp, err := metrics.NewMeterProvider("service-a", cfg.CollectorURL, cfg.Metrics, prom)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize meter: %w", err)
+	}
+	lc.Append(fx.StopHook(mp.Shutdown))
+	return mp, prom, nil
+}
+
+func provideMeter(mp *sdkmetric.MeterProvider) metric.Meter {
+	return mp.Meter("service-a")
+}
+
+// flushTelemetryLast builds the tracer and meter providers before any
+// other component. fx runs stop hooks in the reverse order, so they are
+// shut down, flushing what they hold, only once everything else has
+// drained and stopped, and the spans and metrics of the shutdown itself
+// are exported too.
+func flushTelemetryLast(*sdktrace.TracerProvider, *sdkmetric.MeterProvider) {}
+
+// stopErrorLog flushes the errors errlog held back once the rest has
+// stopped.
+func stopErrorLog(lc fx.Lifecycle) {
+	lc.Append(fx.StopHook(errlog.Stop))
+}
+
+// startProfiler uploads continuous profiles while PROFILING_URL is set.
+func startProfiler(lc fx.Lifecycle, cfg config) {
+	if cfg.Profiling.URL == "" || cfg.Profiling.Interval <= 0 {
+		return
+	}
+	p := profiling.New("service-a", cfg.Profiling)
+	lc.Append(fx.StartStopHook(p.Start, p.Stop))
+}
+
+// startWatchdog samples the process unless WATCHDOG_INTERVAL is zero.
+func startWatchdog(lc fx.Lifecycle, cfg config, meter metric.Meter) {
+	if cfg.Watchdog.Interval <= 0 {
+		return
+	}
+	w := watchdog.New("service-a", cfg.Watchdog, meter)
+	lc.Append(fx.StartStopHook(w.Start, w.Stop))
+}
+
+// provideCepMasker masks CEPs as CEP_MASKING says.
+func provideCepMasker(cfg config) (*masking.Masker, error) {
+	return masking.New(cfg.CepMasking, cfg.CepHashSalt)
+}
+
+func provideDebugCapturer(cfg config, masker *masking.Masker, auditLog *audit.Logger) *debugcapture.Capturer {
+	return debugcapture.New(cfg.DebugCapture, debugCaptureEnabledFor, masker, auditLog)
+}
+
+func provideHTTPClient(cfg config, capturer *debugcapture.Capturer, meter metric.Meter) (*http.Client, error) {
+	client, err := outbound.NewClient(cfg.Outbound, meter, capturer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize outbound transport: %w", err)
+	}
+	return client, nil
+}
+
+func provideAuditLogger(lc fx.Lifecycle, cfg config) (*audit.Logger, error) {
+	auditLog, err := audit.New(cfg.AuditLogPath, "service-a")
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize audit log: %w", err)
+	}
+	lc.Append(fx.StopHook(auditLog.Close))
+	auditLog.Record(context.Background(), "system", "config.load", "success", map[string]string{
+		"collector_url":  cfg.CollectorURL,
+		"service_b_urls": strings.Join(cfg.ServiceBURLs, ","),
+	})
+	return auditLog, nil
+}
+
+// provideBalancer builds the service B balancer and, when configured,
+// starts the discovery source that keeps its endpoints up to date.
+func provideBalancer(lc fx.Lifecycle, cfg config) (*balancer, error) {
+	b := newBalancer(cfg.LBStrategy, cfg.LBEjectAfter, cfg.LBEjectDuration)
+	b.SetEndpoints(cfg.ServiceBURLs, "")
+
+	var run func(ctx context.Context)
+	switch {
+	case cfg.ConsulAddr != "":
+		if len(cfg.ServiceBURLs) != 1 {
+			return nil, fmt.Errorf("CONSUL_ADDR requires a single service B URL, got %d", len(cfg.ServiceBURLs))
+		}
+		discovery, err := newConsulDiscovery(cfg.ConsulAddr, cfg.ConsulService, cfg.ServiceBURLs[0], b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize service B discovery: %w", err)
+		}
+		run = discovery.Run
+	case cfg.DNSRefresh > 0:
+		if len(cfg.ServiceBURLs) != 1 {
+			return nil, fmt.Errorf("SERVICE_B_DNS_REFRESH requires a single service B URL, got %d", len(cfg.ServiceBURLs))
+		}
+		discovery, err := newDNSDiscovery(cfg.ServiceBURLs[0], cfg.DNSRefresh, b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize service B discovery: %w", err)
+		}
+		run = discovery.Run
+	}
+
+	if run != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		lc.Append(fx.StartStopHook(
+			func() { go run(ctx) },
+			cancel,
+		))
+	}
+	return b, nil
+}
+
+// provideServiceBClient calls service B through b, retrying within the
+// RETRY_* budget.
+func provideServiceBClient(cfg config, b *balancer, client *http.Client, meter metric.Meter, tracer trace.Tracer) *serviceBClient {
+	return &serviceBClient{
+		endpoints: b,
+		client:    client,
+		retry: retry.Policy{
+			Budget:      retry.NewBudget(float64(cfg.RetryBudgetPercent)/100, cfg.RetryBudgetMin, cfg.RetryBudgetWindow, meter),
+			MaxAttempts: cfg.RetryMaxAttempts,
+			Backoff:     cfg.RetryBackoff,
+		},
+		cache:  newServiceBCache(cfg.ResponseCacheSize, meter),
+		tracer: tracer,
+	}
+}
+
+// provideCepStrictness reads CEP_VALIDATION.
+func provideCepStrictness(cfg config) cep.Strictness {
+	return parseCepValidation(cfg.CepValidation)
+}
+
+// provideDefaultLocation returns nil when DEFAULT_LOCATION is not set.
+func provideDefaultLocation(cfg config, strictness cep.Strictness, masker *masking.Masker, meter metric.Meter) *defaultLocation {
+	fallback := newDefaultLocation(cfg.DefaultLocation, strictness, masker, meter)
+	if fallback != nil {
+		log.Printf("Unresolved locations fall back to %s", fallback)
+	}
+	return fallback
+}
+
+func provideCepHandler(serviceB *serviceBClient, geo *geoLocator, fallback *defaultLocation, strictness cep.Strictness, masker *masking.Masker, tracer trace.Tracer) *cepHandler {
+	return &cepHandler{
+		lookup:     serviceB.Lookup,
+		lookupCity: serviceB.LookupCity,
+		geo:        geo,
+		fallback:   fallback,
+		strictness: strictness,
+		masker:     masker,
+		tracer:     tracer,
+	}
+}
+
+func provideBatchHandler(cfg config, serviceB *serviceBClient, strictness cep.Strictness, masker *masking.Masker, tracer trace.Tracer) *batchHandler {
+	return &batchHandler{
+		maxSize:     cfg.BatchMaxSize,
+		concurrency: cfg.BatchConcurrency,
+		itemTimeout: cfg.RequestTimeout,
+		lookup:      serviceB.Lookup,
+		strictness:  strictness,
+		masker:      masker,
+		tracer:      tracer,
+	}
+}
+
+func provideReadiness(lc fx.Lifecycle, cfg config, collector *grpc.ClientConn, client *http.Client) *health.Readiness {
+	ready := health.NewReadiness()
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.Append(fx.StartStopHook(
+		func() {
+			go ready.Run(ctx, cfg.ReadinessGrace, []health.ReadinessCheck{
+				{Name: "collector", Check: health.GRPCConnCheck(collector)},
+				{Name: "service_b", Check: health.HTTPReachableCheck(client, serviceBHealthURL(cfg.ServiceBURLs[0]))},
+			})
+		},
+		cancel,
+	))
+	return ready
+}
+
+// verifyDependencies checks the collector and service B before the server
+// starts accepting requests.
+func verifyDependencies(lc fx.Lifecycle, cfg config, collector *grpc.ClientConn, client *http.Client) {
+	if !cfg.StartupVerify {
+		return
+	}
+	lc.Append(fx.StartHook(func(ctx context.Context) error {
+		return health.VerifyStartup(ctx, cfg.StartupVerifyTimeout, cfg.StartupStrict, []health.StartupCheck{
+			{
+				Name:  "collector",
+				Hint:  "check OTEL_COLLECTOR_URL and that the collector accepts OTLP/gRPC; telemetry is dropped meanwhile",
+				Check: health.GRPCConnCheck(collector),
+			},
+			{
+				Name:  "service_b",
+				Hint:  "check SERVICE_B_URL(S) and that service B is running; requests fail until it is reachable",
+				Hard:  true,
+				Check: health.HTTPReachableCheck(client, serviceBHealthURL(cfg.ServiceBURLs[0])),
+			},
+		})
+	}))
+}
+
+func provideTenants(cfg config, usage usageStore, auditLog *audit.Logger, meter metric.Meter) (*tenantRegistry, error) {
+	reg, err := loadTenants(cfg.TenantsFile, usage, auditLog, meter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tenants: %w", err)
+	}
+	return reg, nil
+}
+
+// provideGeoLocator opens GEOIP_DATABASE, or returns nil without one.
+func provideGeoLocator(lc fx.Lifecycle, cfg config, meter metric.Meter) (*geoLocator, error) {
+	if cfg.GeoIPDatabase == "" {
+		if cfg.GeoIPFallback {
+			return nil, fmt.Errorf("GEOIP_FALLBACK requires GEOIP_DATABASE")
+		}
+		return nil, nil
+	}
+	geo, err := newGeoLocator(cfg.GeoIPDatabase, cfg.GeoIPFallback, cfg.TrustedProxies, meter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize GeoIP fallback: %w", err)
+	}
+	lc.Append(fx.StopHook(geo.Close))
+	return geo, nil
+}
+
+// provideRedis connects to REDIS_URL, where bans and usage counts are
+// shared between replicas; without it they are kept per replica.
+func provideRedis(lc fx.Lifecycle, cfg config) (*redis.Client, error) {
+	if cfg.RedisURL == "" {
+		return nil, nil
+	}
+	client, err := newRedisClient(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	lc.Append(fx.StopHook(client.Close))
+	return client, nil
+}
+
+func provideBanStore(client *redis.Client, meter metric.Meter) banStore {
+	if client == nil {
+		return newMemoryBanStore()
+	}
+	return &fallbackBanStore{
+		shared:   newRedisBanStore(client, "service-a:abuse:"),
+		local:    newMemoryBanStore(),
+		fallback: newStateFallback("abuse", meter),
+	}
+}
+
+func provideUsageStore(client *redis.Client, meter metric.Meter) usageStore {
+	if client == nil {
+		return newMemoryUsageStore()
+	}
+	return &fallbackUsageStore{
+		shared:   newRedisUsageStore(client, "service-a:usage:"),
+		local:    newMemoryUsageStore(),
+		fallback: newStateFallback("usage", meter),
+	}
+}
+
+func provideEventPublisher(lc fx.Lifecycle, cfg config, tracer trace.Tracer) (eventPublisher, error) {
+	publisher, err := newEventPublisher(cfg.EventBus, cfg.EventBusURL, cfg.EventSubjectPrefix, cfg.EventAMQP, tracer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize event bus: %w", err)
+	}
+	lc.Append(fx.StopHook(publisher.Close))
+	return publisher, nil
+}
+
+// provideUsageExporter collects tenant consumption; the usage_rollup cron
+// task publishes it. The last period is flushed on stop, before the event
+// bus is closed.
+func provideUsageExporter(lc fx.Lifecycle, cfg config, publisher eventPublisher, tracer trace.Tracer) *usageExporter {
+	exporter := newUsageExporter(publisher, tracer)
+	if cfg.UsageExportInterval > 0 {
+		lc.Append(fx.StopHook(func() { exporter.Flush(context.Background()) }))
+	}
+	return exporter
+}
+
+// provideScheduler registers the recurring tasks. The usage rollup follows
+// USAGE_EXPORT_INTERVAL unless CRON_SCHEDULE overrides it.
+func provideScheduler(lc fx.Lifecycle, cfg config, tracer trace.Tracer, usage *usageExporter) (*cron.Scheduler, error) {
+	rollupSpec := ""
+	if cfg.UsageExportInterval > 0 {
+		rollupSpec = "@every " + cfg.UsageExportInterval.String()
+	}
+	sched, err := cron.New(cfg.CronSchedule, []cron.Task{
+		{Name: "usage_rollup", Spec: rollupSpec, Run: usage.Flush},
+	}, tracer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize cron: %w", err)
+	}
+	log.Printf("Cron tasks: %s", sched.Describe())
+	lc.Append(fx.StartStopHook(sched.Start, sched.Stop))
+	return sched, nil
+}
+
+// provideDashboard returns nil when the dashboard is disabled.
+func provideDashboard(lc fx.Lifecycle, cfg config, serviceB *serviceBClient, masker *masking.Masker, meter metric.Meter) *dashboard {
+	if !cfg.Dashboard {
+		return nil
+	}
+	dash := newDashboard(cfg.DashboardRecentLookups, cfg.DashboardStatsInterval, serviceB, masker, meter)
+	lc.Append(fx.StartStopHook(dash.Start, dash.Stop))
+	return dash
+}
+
+func provideRouter(cfg config, auditLog *audit.Logger, masker *masking.Masker, capturer *debugcapture.Capturer, ready *health.Readiness, tenants *tenantRegistry, usage *usageExporter, bans banStore, sched *cron.Scheduler, dash *dashboard, prom *metrics.PrometheusEndpoint, lookup *cepHandler, batch *batchHandler, meter metric.Meter) (http.Handler, error) {
+	acl, err := netacl.New(cfg.ACLAllow, cfg.ACLDeny, cfg.TrustedProxies, auditLog)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network ACL: %w", err)
+	}
+	adminACL, err := netacl.New(cfg.AdminACLAllow, cfg.ACLDeny, cfg.TrustedProxies, auditLog)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin network ACL: %w", err)
+	}
+	idempotent := idempotency.New(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys, requestCaller(acl))
+	dedup := idempotency.New(cfg.DedupWindow, cfg.IdempotencyMaxKeys, requestCaller(acl))
+	abuse := newAbuseGuard(bans, acl, cfg.AbuseThreshold, cfg.AbuseWindow, cfg.AbuseBanDuration, cfg.AbuseMaxBan, auditLog, meter)
+
+	r := chi.NewRouter()
+	r.Use(httpapi.Options{
+		StrictJSON:     cfg.StrictJSON,
+		ErrorDocsURL:   cfg.ErrorDocsURL,
+		SupportContact: cfg.SupportContact,
+	}.Middleware)
+	r.Use(middleware.RequestID)
+	r.Use(httpapi.RenderMiddleware)
+	r.Use(synthetic.Middleware)
+	r.Use(accesslog.New(os.Stdout, cfg.AccessLogSampling).Middleware)
+	r.Use(compression.Middleware(cfg.Compression))
+	r.Use(compression.DecompressRequests(cfg.Compression.RequestMaxBytes))
+	r.Use(middleware.Recoverer)
+	r.Use(slowrequest.Middleware(cfg.SlowRequestThreshold))
+	r.Use(middleware.GetHead)
+	r.Use(httpapi.OptionsMiddleware(r))
+	r.NotFound(httpapi.HandleNotFound)
+	r.MethodNotAllowed(httpapi.MethodNotAllowedHandler(r))
+
+	r.Get("/healthz", handleHealthz)
+	r.Method("GET", "/readyz", ready)
+	r.Get("/errors", httpapi.HandleErrorCatalog)
+	r.Get("/errors/{code}", httpapi.HandleErrorDefinition)
+	r.Get("/version", buildinfo.HandleVersion)
+	if prom != nil {
+		r.With(adminACL.Middleware).Method("GET", "/metrics", prom)
+	}
+	cep := r.With(acl.Middleware, abuse.Middleware, tenants.Middleware, usage.Middleware, capturer.Middleware)
+	shedder := shedding.New(cfg.MaxInFlight, meter)
+	cep.With(shedder.Middleware, httpapi.Timeout(cfg.BatchTimeout), idempotent.Middleware).
+		Method("POST", "/cep/batch", batch)
+	if dash != nil {
+		routes, err := dash.Routes()
+		if err != nil {
+			return nil, err
+		}
+		r.With(acl.Middleware).Mount("/dashboard", routes)
+		cep = cep.With(dash.Middleware)
+	}
+	cep.With(shedder.Middleware, httpapi.Timeout(cfg.RequestTimeout), idempotent.Middleware, dedup.DedupMiddleware).Method("POST", "/cep", lookup)
+	cep.With(shedder.Middleware, httpapi.Timeout(cfg.RequestTimeout), dedup.DedupMiddleware).Method("GET", "/cep/{cep}", lookup)
+	r.With(adminACL.Middleware).Mount("/admin", adminRoutes(cfg, auditLog, masker, capturer, tenants, sched))
+
+	return sampling.HintsMiddleware(tenants.samplingTenant)(otelhttp.NewHandler(r, "service-a")), nil
+}
+
+func provideServer(lc fx.Lifecycle, cfg config, handler http.Handler, dash *dashboard) *http.Server {
+	srv := server.New(cfg.Server, handler)
+	if dash != nil {
+		srv.RegisterOnShutdown(dash.hub.Close)
+	}
+	if len(cfg.Autocert.Domains) > 0 {
+		m := newAutocertManager(cfg.Autocert)
+		srv.TLSConfig = m.TLSConfig()
+		lc.Append(fx.StartHook(func() {
+			go serveACMEChallenges(m, cfg.Autocert.HTTPAddr)
+			log.Printf("Automatic TLS enabled for %v", cfg.Autocert.Domains)
+		}))
+	}
+	return srv
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joaolima7/otel-goexpert/pkg/admin"
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/cron"
+	"github.com/joaolima7/otel-goexpert/pkg/debugcapture"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/redact"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// adminAPI serves the admin API, mounted under /admin.
+type adminAPI struct {
+	cfg        config
+	auditLog   *audit.Logger
+	masker     *masking.Masker
+	capturer   *debugcapture.Capturer
+	sched      *cron.Scheduler
+	resolver   *weatherResolver
+	lookups    LookupRepository
+	subs       SubscriptionRepository
+	notifier   *subscriptionNotifier
+	jobs       *jobRunner
+	dead       *deadLetterQueue
+	outbox     *outboxRelay
+	strictness cep.Strictness
+	tracer     trace.Tracer
+}
+
+// Routes builds the router of the admin API.
+func (a *adminAPI) Routes() http.Handler {
+	cfg, auditLog, c, subs := a.cfg, a.auditLog, a.resolver.cache, a.subs
+	r := chi.NewRouter()
+	r.Use(admin.Auth(cfg.AdminToken, auditLog, a.masker))
+
+	r.Get("/config", func(w http.ResponseWriter, r *http.Request) {
+		httpapi.Render(w, http.StatusOK, redact.Config(cfg), r.Context())
+	})
+	r.Post("/selftest", a.handleSelftest)
+	r.Get("/cron", a.sched.HandleStatus)
+	r.Get("/endpoints", handleEndpoints)
+	r.Get("/clock", admin.HandleClock)
+	r.Post("/clock/advance", admin.ClockAdvanceHandler(auditLog))
+	r.Get("/debug/captures", a.capturer.HandleList)
+	r.Delete("/debug/captures", a.capturer.HandleClear)
+	r.Mount("/sampling", traceSampler.AdminRoutes(auditLog))
+
+	r.Get("/cache", func(w http.ResponseWriter, r *http.Request) {
+		httpapi.Render(w, http.StatusOK, c.Stats(10), r.Context())
+	})
+	r.Delete("/cache", func(w http.ResponseWriter, r *http.Request) {
+		c.Flush(r.Context())
+		auditLog.Record(r.Context(), "admin", "cache.flush", "success", nil)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r.Post("/cache/import", handleCacheImport(a.jobs, cfg.JobMaxCeps, auditLog))
+	r.Get("/cache/export", handleCacheExport(c, auditLog))
+	r.Post("/cache/restore", handleCacheRestore(c, auditLog))
+	r.Post("/history/backfill", a.handleHistoryBackfill)
+	r.Get("/cache/{key}", func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := c.Peek(chi.URLParam(r, "key"))
+		if !ok {
+			httpapi.RespondWithError(w, weather.CodeNotFound, "cache key not found", r.Context())
+			return
+		}
+		httpapi.Render(w, http.StatusOK, entry, r.Context())
+	})
+	r.Delete("/cache/{key}", func(w http.ResponseWriter, r *http.Request) {
+		key := chi.URLParam(r, "key")
+		c.Invalidate(r.Context(), key)
+		auditLog.Record(r.Context(), "admin", "cache.invalidate", "success", map[string]string{
+			"key": maskCacheKey(key, a.masker),
+		})
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Post("/subscriptions", a.handleCreateSubscription)
+	r.Get("/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		list, err := subs.ListSubscriptions(r.Context())
+		if err != nil {
+			errlog.Printf("Error listing subscriptions: %v", err)
+			httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", r.Context())
+			return
+		}
+		httpapi.Render(w, http.StatusOK, list, r.Context())
+	})
+	r.Get("/subscriptions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		sub, err := subs.GetSubscription(r.Context(), chi.URLParam(r, "id"))
+		if errors.Is(err, ErrNotFound) {
+			httpapi.RespondWithError(w, weather.CodeNotFound, "subscription not found", r.Context())
+			return
+		}
+		if err != nil {
+			errlog.Printf("Error loading subscription: %v", err)
+			httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", r.Context())
+			return
+		}
+		httpapi.Render(w, http.StatusOK, sub, r.Context())
+	})
+	r.Delete("/subscriptions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		err := subs.DeleteSubscription(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			httpapi.RespondWithError(w, weather.CodeNotFound, "subscription not found", r.Context())
+			return
+		}
+		if err != nil {
+			errlog.Printf("Error deleting subscription: %v", err)
+			httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", r.Context())
+			return
+		}
+		auditLog.Record(r.Context(), "admin", "subscription.delete", "success", map[string]string{"id": id})
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Get("/dead-letters", a.handleListDeadLetters)
+	r.Post("/dead-letters/replay", a.handleReplayDeadLetters)
+	r.Get("/dead-letters/{id}", a.handleGetDeadLetter)
+	r.Delete("/dead-letters/{id}", a.handleDeleteDeadLetter)
+	r.Post("/dead-letters/{id}/replay", a.handleReplayDeadLetter)
+
+	return r
+}
+
+type createSubscriptionRequest struct {
+	Cep         string   `json:"cep"`
+	Channel     string   `json:"channel"`
+	CallbackURL string   `json:"callback_url"`
+	Email       string   `json:"email"`
+	Secret      string   `json:"secret"`
+	MinTempC    *float64 `json:"min_temp_C"`
+	MaxTempC    *float64 `json:"max_temp_C"`
+}
+
+// createSubscriptionResponse is the only place the signing secret is
+// returned.
+type createSubscriptionResponse struct {
+	Subscription
+	Secret string `json:"secret,omitempty"`
+}
+
+func (a *adminAPI) handleCreateSubscription(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req createSubscriptionRequest
+	if err := httpapi.DecodeRequest(r, &req); err != nil {
+		httpapi.RespondWithDecodeError(w, err, weather.CodeInvalidRequest, "invalid subscription", ctx)
+		return
+	}
+	if !isValidCep(req.Cep, a.strictness) {
+		httpapi.RespondWithError(w, weather.CodeInvalidZipcode, "invalid zipcode", ctx)
+		return
+	}
+	if req.MinTempC == nil && req.MaxTempC == nil {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, "min_temp_C or max_temp_C is required", ctx)
+		return
+	}
+	if req.Channel == "" {
+		req.Channel = channelWebhook
+	}
+	n, ok := a.notifier.notifiers[req.Channel]
+	if !ok {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, fmt.Sprintf("unsupported channel %q, available: %s", req.Channel, notifierChannels(a.notifier.notifiers)), ctx)
+		return
+	}
+	// Only webhooks are signed.
+	if req.Channel == channelWebhook && req.Secret == "" {
+		req.Secret = randomHex(32)
+	}
+
+	sub := Subscription{
+		ID:          randomHex(8),
+		Cep:         req.Cep,
+		Channel:     req.Channel,
+		CallbackURL: req.CallbackURL,
+		Email:       req.Email,
+		Secret:      req.Secret,
+		MinTempC:    req.MinTempC,
+		MaxTempC:    req.MaxTempC,
+		CreatedAt:   clock.Now().UTC(),
+	}
+	if err := n.Validate(sub); err != nil {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, err.Error(), ctx)
+		return
+	}
+	if err := a.subs.CreateSubscription(ctx, sub); err != nil {
+		errlog.Printf("Error creating subscription: %v", err)
+		httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", ctx)
+		return
+	}
+	a.auditLog.Record(ctx, "admin", "subscription.create", "success", map[string]string{
+		"id":      sub.ID,
+		"cep":     a.masker.Cep(sub.Cep),
+		"channel": sub.Channel,
+	})
+	httpapi.Render(w, http.StatusCreated, createSubscriptionResponse{Subscription: sub, Secret: sub.Secret}, r.Context())
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	clock.RandomBytes(b)
+	return hex.EncodeToString(b)
+}
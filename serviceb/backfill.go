@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/shedding"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// backfillPageSize is how many lookups a history backfill reads, and
+// writes to the outbox, at a time.
+const backfillPageSize = 500
+
+// historyBackfillRequest selects the lookups POST
+// /admin/history/backfill replays: those created from Since until Until,
+// now by default, of Ceps, or of every CEP when it is empty.
+type historyBackfillRequest struct {
+	Since time.Time  `json:"since"`
+	Until *time.Time `json:"until,omitempty"`
+	Ceps  []string   `json:"ceps,omitempty"`
+}
+
+// historyBackfill is a backfill accepted for the worker pool. Ceps are
+// masked, as the history keeps them.
+type historyBackfill struct {
+	ID    string    `json:"id"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	Ceps  []string  `json:"ceps,omitempty"`
+}
+
+// handleHistoryBackfill replays stored lookups as weather updates through
+// the outbox, so consumers attached to the broker after the fact can start
+// from past data. It answers 202 once the backfill is queued on the
+// worker pool; the relay publishes the updates after the ones already
+// waiting.
+func (a *adminAPI) handleHistoryBackfill(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if a.outbox == nil {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, "history backfill needs the MQTT or NATS output (MQTT_BROKER_URL or NATS_URL)", ctx)
+		return
+	}
+	var req historyBackfillRequest
+	if err := httpapi.DecodeRequest(r, &req); err != nil {
+		httpapi.RespondWithDecodeError(w, err, weather.CodeInvalidRequest, "invalid request body", ctx)
+		return
+	}
+	b := historyBackfill{ID: randomHex(8), Since: req.Since.UTC(), Until: clock.Now().UTC()}
+	if req.Until != nil {
+		b.Until = req.Until.UTC()
+	}
+	if req.Since.IsZero() || !b.Since.Before(b.Until) {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, "since is required and must be before until", ctx)
+		return
+	}
+	for _, raw := range req.Ceps {
+		c, err := cep.Normalize(raw)
+		if err != nil || !isValidCep(c, a.strictness) {
+			httpapi.RespondWithError(w, weather.CodeInvalidZipcode, "invalid zipcode", ctx)
+			return
+		}
+		b.Ceps = append(b.Ceps, a.masker.Cep(c))
+	}
+
+	err := a.jobs.pool.Submit("history_backfill", -1, func(ctx context.Context) {
+		ctx, span := a.tracer.Start(ctx, "history_backfill", trace.WithNewRoot(),
+			trace.WithAttributes(attribute.String("backfill.id", b.ID)))
+		defer span.End()
+		n, err := backfillHistory(ctx, a.lookups, a.outbox, b)
+		span.SetAttributes(attribute.Int("backfill.lookups", n))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			errlog.Printf("History backfill %s stopped after %d lookups: %v", b.ID, n, err)
+			return
+		}
+		log.Printf("History backfill %s queued %d lookups for publishing", b.ID, n)
+	})
+	if err != nil {
+		httpapi.SetRetryAfter(w, shedding.RetryAfter)
+		httpapi.RespondWithError(w, weather.CodeOverloaded, "worker pool is full", ctx)
+		return
+	}
+	a.auditLog.Record(ctx, "admin", "history.backfill", "success", map[string]string{
+		"backfill_id": b.ID,
+		"since":       b.Since.Format(time.RFC3339),
+		"until":       b.Until.Format(time.RFC3339),
+		"ceps":        strconv.Itoa(len(b.Ceps)),
+	})
+	httpapi.Render(w, http.StatusAccepted, b, ctx)
+}
+
+// backfillHistory writes the weather updates of the lookups b selects to
+// the outbox, a page at a time, and returns how many it wrote. Each update
+// carries the ID the lookup was published under live (see
+// weatherUpdateID), so consumers that deduplicate by ID count a lookup
+// once, however many backfills overlap it.
+func backfillHistory(ctx context.Context, lookups LookupRepository, relay *outboxRelay, b historyBackfill) (int, error) {
+	ceps := make(map[string]bool, len(b.Ceps))
+	for _, c := range b.Ceps {
+		ceps[c] = true
+	}
+	n := 0
+	var afterID int64
+	for {
+		page, err := lookups.ScanLookups(ctx, b.Since, b.Until, afterID, backfillPageSize)
+		if err != nil {
+			return n, err
+		}
+		msgs := make([]OutboxMessage, 0, len(page))
+		for _, l := range page {
+			afterID = l.ID
+			if len(ceps) > 0 && !ceps[l.Cep] {
+				continue
+			}
+			msg, err := weatherUpdateMessage(outboxWeatherBackfill, l)
+			if err != nil {
+				return n, err
+			}
+			msg.CreatedAt = clock.Now()
+			msgs = append(msgs, msg)
+		}
+		if len(msgs) > 0 {
+			if err := relay.repo.AppendOutbox(ctx, msgs); err != nil {
+				return n, err
+			}
+			n += len(msgs)
+			relay.Wake()
+		}
+		if len(page) < backfillPageSize {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+)
+
+// routingPolicy decides which healthy provider of a chain is asked first.
+type routingPolicy string
+
+const (
+	// routeOrdered always starts with the first healthy provider.
+	routeOrdered routingPolicy = "ordered"
+	// routeWeighted picks the first provider in proportion to the
+	// configured weights, falling back to ordered when none is set.
+	routeWeighted routingPolicy = "weighted"
+	// routeLatency picks the provider with the lowest recent p95 latency.
+	routeLatency routingPolicy = "latency"
+)
+
+func parseRoutingPolicy(s string) (routingPolicy, error) {
+	switch p := routingPolicy(s); p {
+	case routeOrdered, routeWeighted, routeLatency:
+		return p, nil
+	case "":
+		return routeWeighted, nil
+	default:
+		return "", fmt.Errorf("unknown provider routing %q (want ordered, weighted or latency)", s)
+	}
+}
+
+// orderProviders returns entries in the order to try them for one call:
+// the healthy ones, led by the one policy picks, then the demoted ones.
+// Apart from the pick, the configured order is kept.
+func orderProviders[E any](entries []E, policy routingPolicy, weight func(E) int, health func(E) *trackedProvider) []E {
+	var healthy, demoted []E
+	for _, e := range entries {
+		if health(e).Healthy() {
+			healthy = append(healthy, e)
+		} else {
+			demoted = append(demoted, e)
+		}
+	}
+
+	first := 0
+	if len(healthy) > 1 {
+		switch policy {
+		case routeWeighted:
+			first = pickWeighted(healthy, weight)
+		case routeLatency:
+			first = pickFastest(healthy, health)
+		}
+	}
+
+	ordered := make([]E, 0, len(entries))
+	if len(healthy) > 0 {
+		ordered = append(ordered, healthy[first])
+		ordered = append(ordered, healthy[:first]...)
+		ordered = append(ordered, healthy[first+1:]...)
+	}
+	return append(ordered, demoted...)
+}
+
+func pickWeighted[E any](entries []E, weight func(E) int) int {
+	total := 0
+	for _, e := range entries {
+		total += weight(e)
+	}
+	if total == 0 {
+		return 0
+	}
+	n := clock.Random().IntN(total)
+	for i, e := range entries {
+		if n < weight(e) {
+			return i
+		}
+		n -= weight(e)
+	}
+	return 0
+}
+
+// pickFastest returns the entry with the lowest p95. Providers without
+// recent samples report zero and are therefore tried, which keeps their
+// latency known.
+func pickFastest[E any](entries []E, health func(E) *trackedProvider) int {
+	best := 0
+	bestP95 := health(entries[0]).P95()
+	for i, e := range entries[1:] {
+		if p95 := health(e).P95(); p95 < bestP95 {
+			best, bestP95 = i+1, p95
+		}
+	}
+	return best
+}
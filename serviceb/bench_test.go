@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/accesslog"
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/slowrequest"
+	"github.com/joaolima7/otel-goexpert/pkg/synthetic"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// testTracer and testMeter stand in for the tracer and meter fx provides.
+var (
+	testTracer = tracenoop.NewTracerProvider().Tracer("test")
+	testMeter  = metricnoop.NewMeterProvider().Meter("test")
+)
+
+// fakeCepProvider resolves CEPs from a map, without leaving the process.
+type fakeCepProvider map[string]string
+
+func (fakeCepProvider) Name() string { return "fake" }
+
+func (p fakeCepProvider) City(_ context.Context, cep string) (string, error) {
+	if city, ok := p[cep]; ok {
+		return city, nil
+	}
+	return "", apperrors.ErrCepNotFound
+}
+
+// newFakeWeatherHandler builds a weather handler on in-memory CEP and
+// weather providers, storage and stats, and silences the log for the rest
+// of the test. A cache of zero entries makes every lookup a miss.
+func newFakeWeatherHandler(tb testing.TB, cacheEntries int) *weatherHandler {
+	tb.Helper()
+	logOutput := log.Writer()
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(logOutput) })
+
+	tracker := newHealthTracker(healthConfig{Window: 20}, testMeter)
+	ceps := &cepChain{
+		policy:  routeOrdered,
+		tracker: tracker,
+		entries: []cepChainEntry{{
+			provider: fakeCepProvider{"01001000": "São Paulo", "20040002": "Rio de Janeiro"},
+			health:   tracker.Register("cep", "fake", nil),
+		}},
+	}
+	weather := &weatherChain{
+		policy:  routeOrdered,
+		tracker: tracker,
+		entries: []weatherChainEntry{{
+			provider: stubWeatherProvider{tempC: 28.5},
+			health:   tracker.Register("weather", "stub", nil),
+		}},
+	}
+	storage := newMemoryStorage(0)
+	return &weatherHandler{
+		resolver:   &weatherResolver{ceps: ceps, weather: weather, cache: newLookupCache(cacheEntries), cacheTTL: time.Hour, tracer: testTracer},
+		stats:      newQueryStats(100),
+		lookups:    storage,
+		subs:       storage,
+		notifier:   &subscriptionNotifier{subs: storage, tracer: testTracer},
+		strictness: cep.Format,
+		tracer:     testTracer,
+	}
+}
+
+// quietAccessLogger is the access logger with its output thrown away, so
+// that the benchmarks measure the logging and not the terminal.
+func quietAccessLogger() *accesslog.Logger {
+	return accesslog.New(io.Discard, "")
+}
+
+// withServiceMiddleware wraps h in the middleware the service puts in
+// front of every request, minus tracing and the per-route guards.
+func withServiceMiddleware(h http.Handler) http.Handler {
+	chain := []func(http.Handler) http.Handler{
+		middleware.RequestID,
+		httpapi.RenderMiddleware,
+		synthetic.Middleware,
+		quietAccessLogger().Middleware,
+		tenantMiddleware,
+		middleware.Recoverer,
+		deadlineMiddleware,
+		slowrequest.Middleware(time.Minute),
+		httpapi.Timeout(time.Minute),
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	return h
+}
+
+// benchmarkRequest serves the same POST to h on every iteration and fails
+// the benchmark if it doesn't get status back.
+func benchmarkRequest(b *testing.B, h http.Handler, target, body string, status int) {
+	b.Helper()
+	b.ReportAllocs()
+	for b.Loop() {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != status {
+			b.Fatalf("status = %d, want %d: %s", rec.Code, status, rec.Body)
+		}
+	}
+}
+
+func BenchmarkWeatherRequest(b *testing.B) {
+	tests := []struct {
+		name         string
+		cacheEntries int
+		body         string
+		status       int
+	}{
+		{"cache hit", 100, `{"cep":"01001000"}`, http.StatusOK},
+		{"cache miss", 0, `{"cep":"01001000"}`, http.StatusOK},
+		{"not found", 100, `{"cep":"00000000"}`, http.StatusNotFound},
+		{"invalid cep", 100, `{"cep":"123"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			h := newFakeWeatherHandler(b, tt.cacheEntries)
+			benchmarkRequest(b, httpapi.RenderMiddleware(h), "/weather", tt.body, tt.status)
+		})
+	}
+}
+
+func BenchmarkWeatherRequestFormats(b *testing.B) {
+	h := httpapi.RenderMiddleware(newFakeWeatherHandler(b, 100))
+	for _, format := range []string{"json", "xml", "html", "csv"} {
+		b.Run(format, func(b *testing.B) {
+			benchmarkRequest(b, h, "/weather?format="+format, `{"cep":"01001000"}`, http.StatusOK)
+		})
+	}
+}
+
+// BenchmarkWeatherRequestMiddleware runs a cached lookup through the
+// middleware service B wraps every request in, to catch regressions the
+// handler benchmarks can't see.
+func BenchmarkWeatherRequestMiddleware(b *testing.B) {
+	benchmarkRequest(b, withServiceMiddleware(newFakeWeatherHandler(b, 100)), "/weather", `{"cep":"01001000"}`, http.StatusOK)
+}
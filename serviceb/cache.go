@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+)
+
+// cepCacheKey is the cache key of the ViaCEP resolution of a CEP.
+func cepCacheKey(cep string) string {
+	return "cep:" + cep
+}
+
+// maskCacheKey masks the CEP of a cache key before it is logged or
+// audited. Keys of other kinds are returned as they are.
+func maskCacheKey(key string, masker *masking.Masker) string {
+	if cep, ok := strings.CutPrefix(key, cepCacheKey("")); ok {
+		return cepCacheKey(masker.Cep(cep))
+	}
+	return key
+}
+
+type cacheEntry struct {
+	Value     string
+	StoredAt  time.Time
+	ExpiresAt time.Time
+}
+
+// cacheInvalidator broadcasts invalidations to the other replicas. An
+// empty key means the whole cache.
+type cacheInvalidator interface {
+	Publish(ctx context.Context, key string) error
+}
+
+// lookupCache is the in-process (L1) cache of upstream lookups. Entries
+// filled on a miss stay local; Refresh, Invalidate and Flush are also
+// broadcast so every replica drops its stale copy.
+type lookupCache struct {
+	mu          sync.Mutex
+	entries     map[string]cacheEntry
+	maxEntries  int
+	invalidator cacheInvalidator
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newLookupCache(maxEntries int) *lookupCache {
+	return &lookupCache{entries: make(map[string]cacheEntry), maxEntries: maxEntries}
+}
+
+func (c *lookupCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && clock.Now().After(entry.ExpiresAt) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return "", false
+	}
+	c.hits.Add(1)
+	return entry.Value, true
+}
+
+// Set stores a freshly fetched value without telling other replicas.
+func (c *lookupCache) Set(key, value string, ttl time.Duration) {
+	if c.maxEntries <= 0 || ttl <= 0 {
+		return
+	}
+	now := clock.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evictOldestLocked()
+	}
+	c.entries[key] = cacheEntry{Value: value, StoredAt: now, ExpiresAt: now.Add(ttl)}
+}
+
+// Refresh replaces a value and has the other replicas drop theirs.
+func (c *lookupCache) Refresh(ctx context.Context, key, value string, ttl time.Duration) {
+	c.Set(key, value, ttl)
+	c.broadcast(ctx, key)
+}
+
+// Invalidate drops key here and on every other replica.
+func (c *lookupCache) Invalidate(ctx context.Context, key string) {
+	c.drop(key)
+	c.broadcast(ctx, key)
+}
+
+// Flush empties the cache here and on every other replica.
+func (c *lookupCache) Flush(ctx context.Context) {
+	c.dropAll()
+	c.broadcast(ctx, "")
+}
+
+func (c *lookupCache) drop(key string) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
+
+func (c *lookupCache) dropAll() {
+	c.mu.Lock()
+	c.entries = make(map[string]cacheEntry)
+	c.mu.Unlock()
+}
+
+func (c *lookupCache) broadcast(ctx context.Context, key string) {
+	if c.invalidator == nil {
+		return
+	}
+	if err := c.invalidator.Publish(ctx, key); err != nil {
+		errlog.Printf("Error broadcasting cache invalidation for %q: %v", key, err)
+	}
+}
+
+func (c *lookupCache) evictOldestLocked() {
+	var (
+		oldestKey string
+		oldest    time.Time
+	)
+	for key, entry := range c.entries {
+		if oldestKey == "" || entry.StoredAt.Before(oldest) {
+			oldestKey, oldest = key, entry.StoredAt
+		}
+	}
+	delete(c.entries, oldestKey)
+}
+
+// Snapshot returns the unexpired entries, oldest first.
+func (c *lookupCache) Snapshot() []cachedEntryView {
+	now := clock.Now()
+	c.mu.Lock()
+	views := make([]cachedEntryView, 0, len(c.entries))
+	for key, entry := range c.entries {
+		if now.After(entry.ExpiresAt) {
+			continue
+		}
+		views = append(views, cachedEntryView{Key: key, Value: entry.Value, StoredAt: entry.StoredAt, ExpiresAt: entry.ExpiresAt})
+	}
+	c.mu.Unlock()
+	slices.SortFunc(views, func(a, b cachedEntryView) int { return a.StoredAt.Compare(b.StoredAt) })
+	return views
+}
+
+// Restore stores an entry taken from another instance's snapshot, keeping
+// its timestamps, so it expires when it would have there. Expired entries
+// are skipped; it reports whether v was stored.
+func (c *lookupCache) Restore(v cachedEntryView) bool {
+	if c.maxEntries <= 0 || !clock.Now().Before(v.ExpiresAt) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[v.Key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evictOldestLocked()
+	}
+	c.entries[v.Key] = cacheEntry{Value: v.Value, StoredAt: v.StoredAt, ExpiresAt: v.ExpiresAt}
+	return true
+}
+
+// cacheStats summarizes the cache for the admin API.
+type cacheStats struct {
+	Entries  int               `json:"entries"`
+	Hits     int64             `json:"hits"`
+	Misses   int64             `json:"misses"`
+	HitRatio float64           `json:"hit_ratio"`
+	Oldest   []cachedEntryView `json:"oldest"`
+}
+
+type cachedEntryView struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	StoredAt  time.Time `json:"stored_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Peek returns the entry under key without counting a hit or miss.
+func (c *lookupCache) Peek(key string) (cachedEntryView, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || clock.Now().After(entry.ExpiresAt) {
+		return cachedEntryView{}, false
+	}
+	return cachedEntryView{Key: key, Value: entry.Value, StoredAt: entry.StoredAt, ExpiresAt: entry.ExpiresAt}, true
+}
+
+// Stats reports entry counts, the hit ratio and the oldest n entries.
+func (c *lookupCache) Stats(n int) cacheStats {
+	c.mu.Lock()
+	views := make([]cachedEntryView, 0, len(c.entries))
+	for key, entry := range c.entries {
+		views = append(views, cachedEntryView{Key: key, Value: entry.Value, StoredAt: entry.StoredAt, ExpiresAt: entry.ExpiresAt})
+	}
+	c.mu.Unlock()
+	count := len(views)
+
+	slices.SortFunc(views, func(a, b cachedEntryView) int { return a.StoredAt.Compare(b.StoredAt) })
+	if len(views) > n {
+		views = views[:n]
+	}
+
+	stats := cacheStats{
+		Entries: count,
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Oldest:  views,
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// cacheImportEntry is one line of a cache import: a CEP and, optionally,
+// the city it is already known to belong to.
+type cacheImportEntry struct {
+	Cep  string `json:"cep"`
+	City string `json:"city"`
+}
+
+// handleCacheImport warms the CEP cache from a list sent as CSV (cep and
+// an optional city per row, with an optional header) or NDJSON (one
+// {"cep", "city"} object per line). The CEPs are resolved and cached by a
+// cache_import job on the worker pool, followed through GET /jobs/{id};
+// those that come with a city skip the providers.
+func handleCacheImport(jr *jobRunner, maxCeps int, auditLog *audit.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+		var (
+			entries []cacheImportEntry
+			err     error
+		)
+		if mediaType == "text/csv" {
+			entries, err = readCacheImportCSV(r.Body, maxCeps)
+		} else {
+			entries, err = readCacheImportNDJSON(r.Body, maxCeps)
+		}
+		if err != nil {
+			httpapi.RespondWithDecodeError(w, err, weather.CodeInvalidRequest, err.Error(), ctx)
+			return
+		}
+		if len(entries) == 0 {
+			httpapi.RespondWithError(w, weather.CodeInvalidRequest, "no ceps to import", ctx)
+			return
+		}
+
+		ceps := make([]string, len(entries))
+		cities := make([]string, len(entries))
+		for i, e := range entries {
+			ceps[i], cities[i] = e.Cep, e.City
+		}
+		j, ok := startJob(w, r, jr, jobCacheImport, ceps, cities)
+		if !ok {
+			return
+		}
+		auditLog.Record(ctx, "admin", "cache.import", "success", map[string]string{
+			"job_id": j.ID,
+			"ceps":   strconv.Itoa(len(entries)),
+		})
+	}
+}
+
+func readCacheImportCSV(body io.Reader, maxCeps int) ([]cacheImportEntry, error) {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var entries []cacheImportEntry
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid csv: %w", err)
+		}
+		cep := strings.TrimSpace(record[0])
+		if line == 1 && strings.EqualFold(cep, "cep") {
+			continue
+		}
+		if cep == "" {
+			continue
+		}
+		e := cacheImportEntry{Cep: cep}
+		if len(record) > 1 {
+			e.City = strings.TrimSpace(record[1])
+		}
+		if len(entries) == maxCeps {
+			return nil, fmt.Errorf("at most %d ceps per import", maxCeps)
+		}
+		entries = append(entries, e)
+	}
+}
+
+func readCacheImportNDJSON(body io.Reader, maxCeps int) ([]cacheImportEntry, error) {
+	var entries []cacheImportEntry
+	scanner := bufio.NewScanner(body)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var e cacheImportEntry
+		if err := json.Unmarshal([]byte(text), &e); err != nil {
+			return nil, fmt.Errorf("invalid ndjson on line %d: %v", line, err)
+		}
+		if len(entries) == maxCeps {
+			return nil, fmt.Errorf("at most %d ceps per import", maxCeps)
+		}
+		e.Cep, e.City = strings.TrimSpace(e.Cep), strings.TrimSpace(e.City)
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading body: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// cacheRestoreResult reports what POST /admin/cache/restore did.
+type cacheRestoreResult struct {
+	Restored int `json:"restored"`
+	Skipped  int `json:"skipped"`
+}
+
+// handleCacheExport writes the unexpired cache entries as NDJSON, one
+// {"key", "value", "stored_at", "expires_at"} object per line, oldest
+// first. POST /admin/cache/restore takes the same format.
+func handleCacheExport(c *lookupCache, auditLog *audit.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries := c.Snapshot()
+		w.Header().Set("Content-Disposition", `attachment; filename="cache.ndjson"`)
+		stream := httpapi.NewResponseStream(w, http.StatusOK, "application/x-ndjson; charset=utf-8")
+		for _, e := range entries {
+			if err := stream.Encode(e); err != nil {
+				errlog.Printf("Error writing cache export: %v", err)
+				return
+			}
+		}
+		auditLog.Record(r.Context(), "admin", "cache.export", "success", map[string]string{
+			"entries": strconv.Itoa(len(entries)),
+		})
+	}
+}
+
+// handleCacheRestore loads an export of another instance into this one's
+// cache, so a new deployment can start warm. Entries keep their expiry,
+// and the ones that expired in transit are skipped. The restore is local:
+// it isn't broadcast to the other replicas.
+func handleCacheRestore(c *lookupCache, auditLog *audit.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var entries []cachedEntryView
+		scanner := bufio.NewScanner(r.Body)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			var e cachedEntryView
+			if err := json.Unmarshal([]byte(text), &e); err != nil {
+				httpapi.RespondWithError(w, weather.CodeInvalidRequest, fmt.Sprintf("invalid ndjson on line %d: %v", line, err), ctx)
+				return
+			}
+			if e.Key == "" {
+				httpapi.RespondWithError(w, weather.CodeInvalidRequest, fmt.Sprintf("missing key on line %d", line), ctx)
+				return
+			}
+			entries = append(entries, e)
+		}
+		if err := scanner.Err(); err != nil {
+			httpapi.RespondWithDecodeError(w, err, weather.CodeInvalidRequest, "error reading body", ctx)
+			return
+		}
+
+		var result cacheRestoreResult
+		for _, e := range entries {
+			if c.Restore(e) {
+				result.Restored++
+			} else {
+				result.Skipped++
+			}
+		}
+		auditLog.Record(ctx, "admin", "cache.restore", "success", map[string]string{
+			"restored": strconv.Itoa(result.Restored),
+			"skipped":  strconv.Itoa(result.Skipped),
+		})
+		httpapi.Render(w, http.StatusOK, result, ctx)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CepProvider resolves a CEP to its city. Implementations live in their
+// own file and register themselves from an init function, like the
+// weather providers.
+type CepProvider interface {
+	Name() string
+	// City returns the city of cep, or apperrors.ErrCepNotFound when the provider
+	// does not know it.
+	City(ctx context.Context, cep string) (string, error)
+}
+
+// cepProviderFactory builds a provider from the service configuration.
+// The provider calls its API through up and masks the CEPs it logs with
+// masker.
+type cepProviderFactory func(cfg config, up *upstreamClient, masker *masking.Masker) (CepProvider, error)
+
+var cepProviderFactories = make(map[string]cepProviderFactory)
+
+func registerCepProvider(name string, factory cepProviderFactory) {
+	if _, dup := cepProviderFactories[name]; dup {
+		panic("CEP provider registered twice: " + name)
+	}
+	cepProviderFactories[name] = factory
+}
+
+// cepProviderConfig is one entry of CEP_PROVIDERS_FILE. Under weighted
+// routing, Weight is the share of lookups the provider answers first;
+// providers with no weight are only used as fallbacks. Timeout bounds each call to the provider.
+type cepProviderConfig struct {
+	Name    string `json:"name"`
+	Weight  int    `json:"weight"`
+	Timeout string `json:"timeout"`
+}
+
+// loadCepProviderConfig reads the chain from path, defaulting to ViaCEP
+// alone.
+func loadCepProviderConfig(path string) ([]cepProviderConfig, error) {
+	if path == "" {
+		return []cepProviderConfig{{Name: "viacep", Weight: 100}}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CEP providers file: %w", err)
+	}
+	var entries []cepProviderConfig
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse CEP providers file: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no CEP providers in %s", path)
+	}
+	return entries, nil
+}
+
+type cepChainEntry struct {
+	provider CepProvider
+	weight   int
+	timeout  time.Duration
+	health   *trackedProvider
+}
+
+// cepChain asks a healthy provider picked by its routing policy first,
+// then the others in their configured order until one answers. Demoted
+// providers are only asked after all the healthy ones.
+type cepChain struct {
+	entries []cepChainEntry
+	policy  routingPolicy
+	tracker *healthTracker
+}
+
+func newCepChain(cfg config, tracker *healthTracker, up *upstreamClient, masker *masking.Masker) (*cepChain, error) {
+	entries, err := loadCepProviderConfig(cfg.CepProvidersFile)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := parseRoutingPolicy(cfg.ProviderRouting)
+	if err != nil {
+		return nil, err
+	}
+	chain := &cepChain{policy: policy, tracker: tracker}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		factory, ok := cepProviderFactories[e.Name]
+		if !ok {
+			available := slices.Sorted(maps.Keys(cepProviderFactories))
+			return nil, fmt.Errorf("unknown CEP provider %q (available: %s)", e.Name, strings.Join(available, ", "))
+		}
+		if seen[e.Name] {
+			return nil, fmt.Errorf("duplicate CEP provider %s", e.Name)
+		}
+		seen[e.Name] = true
+		if e.Weight < 0 {
+			return nil, fmt.Errorf("CEP provider %s: negative weight", e.Name)
+		}
+		var timeout time.Duration
+		if e.Timeout != "" {
+			if timeout, err = time.ParseDuration(e.Timeout); err != nil {
+				return nil, fmt.Errorf("CEP provider %s: invalid timeout: %w", e.Name, err)
+			}
+		}
+		p, err := factory(cfg, up, masker)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize CEP provider %s: %w", e.Name, err)
+		}
+		health := tracker.Register("cep", e.Name, func(ctx context.Context) error {
+			_, err := p.City(ctx, cfg.SelftestCep)
+			return err
+		})
+		chain.entries = append(chain.entries, cepChainEntry{provider: p, weight: e.Weight, timeout: timeout, health: health})
+	}
+	return chain, nil
+}
+
+// Describe summarizes the chain for the startup log.
+func (c *cepChain) Describe() string {
+	parts := make([]string, len(c.entries))
+	for i, e := range c.entries {
+		parts[i] = fmt.Sprintf("%s (weight %d", e.provider.Name(), e.weight)
+		if e.timeout > 0 {
+			parts[i] += ", timeout " + e.timeout.String()
+		}
+		parts[i] += ")"
+	}
+	return strings.Join(parts, ", ") + ", routing " + string(c.policy)
+}
+
+func (c *cepChain) order() []cepChainEntry {
+	return orderProviders(c.entries, c.policy,
+		func(e cepChainEntry) int { return e.weight },
+		func(e cepChainEntry) *trackedProvider { return e.health })
+}
+
+// City falls through to the next provider on any failure. The CEP is
+// reported as not found only when every provider said so.
+func (c *cepChain) City(ctx context.Context, cep string) (string, error) {
+	span := trace.SpanFromContext(ctx)
+	var notFound, failed []error
+	for _, e := range c.order() {
+		start := time.Now()
+		city, err := e.call(ctx, cep)
+		if ctx.Err() == nil {
+			c.tracker.Observe(e.health, err, time.Since(start))
+		}
+		if err == nil {
+			span.SetAttributes(attribute.String("cep.provider", e.provider.Name()))
+			return city, nil
+		}
+		err = fmt.Errorf("%s: %w", e.provider.Name(), err)
+		if ctx.Err() != nil {
+			return "", err
+		}
+		if errors.Is(err, apperrors.ErrCepNotFound) {
+			notFound = append(notFound, err)
+		} else {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return "", errors.Join(failed...)
+	}
+	return "", errors.Join(notFound...)
+}
+
+func (e cepChainEntry) call(ctx context.Context, cep string) (string, error) {
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+	return e.provider.City(ctx, cep)
+}
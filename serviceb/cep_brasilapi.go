@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+)
+
+func init() {
+	registerCepProvider("brasilapi", func(cfg config, up *upstreamClient, _ *masking.Masker) (CepProvider, error) {
+		limiter, err := newProviderLimiter("brasilapi", cfg.BrasilAPIRateLimit, cfg.ProviderRateBurst, cfg.ProviderRateMaxWait, up.meter)
+		if err != nil {
+			return nil, err
+		}
+		endpoints, err := newEndpointSet(cfg, "brasilapi", "https://brasilapi.com.br")
+		if err != nil {
+			return nil, err
+		}
+		return &brasilAPIProvider{upstream: up, limiter: limiter, endpoints: endpoints}, nil
+	})
+}
+
+// brasilAPIProvider queries the BrasilAPI CEP endpoint, which aggregates
+// several public CEP sources.
+type brasilAPIProvider struct {
+	upstream  *upstreamClient
+	limiter   *providerLimiter
+	endpoints *endpointSet
+}
+
+func (p *brasilAPIProvider) Name() string                  { return "brasilapi" }
+func (p *brasilAPIProvider) ProbeURL() string              { return p.endpoints.URL() + "/" }
+func (p *brasilAPIProvider) RateLimiter() *providerLimiter { return p.limiter }
+
+func (p *brasilAPIProvider) City(ctx context.Context, cep string) (string, error) {
+	status, body, err := p.upstream.Get(ctx, "BrasilAPI", p.limiter, p.endpoints.URL()+"/api/cep/v1/"+cep)
+	if err != nil {
+		return "", err
+	}
+	if status == http.StatusNotFound || status == http.StatusBadRequest {
+		return "", apperrors.ErrCepNotFound
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code from BrasilAPI: %d", status)
+	}
+
+	var info struct {
+		City string `json:"city"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return "", fmt.Errorf("error unmarshaling BrasilAPI response: %w", err)
+	}
+	if info.City == "" {
+		return "", apperrors.ErrCepNotFound
+	}
+	return info.City, nil
+}
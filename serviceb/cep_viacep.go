@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+)
+
+func init() {
+	registerCepProvider("viacep", func(cfg config, up *upstreamClient, masker *masking.Masker) (CepProvider, error) {
+		limiter, err := newProviderLimiter("viacep", cfg.ViaCepRateLimit, cfg.ProviderRateBurst, cfg.ProviderRateMaxWait, up.meter)
+		if err != nil {
+			return nil, err
+		}
+		endpoints, err := newEndpointSet(cfg, "viacep", "https://viacep.com.br")
+		if err != nil {
+			return nil, err
+		}
+		return &viaCepProvider{upstream: up, masker: masker, limiter: limiter, endpoints: endpoints}, nil
+	})
+}
+
+type ViaCepResponse struct {
+	Cep         string `json:"cep"`
+	Logradouro  string `json:"logradouro"`
+	Complemento string `json:"complemento"`
+	Bairro      string `json:"bairro"`
+	Localidade  string `json:"localidade"`
+	Uf          string `json:"uf"`
+	Ibge        string `json:"ibge"`
+	Gia         string `json:"gia"`
+	Ddd         string `json:"ddd"`
+	Siafi       string `json:"siafi"`
+	Erro        string `json:"erro,omitempty"`
+}
+
+// viaCepProvider queries viacep.com.br.
+type viaCepProvider struct {
+	upstream  *upstreamClient
+	masker    *masking.Masker
+	limiter   *providerLimiter
+	endpoints *endpointSet
+}
+
+func (p *viaCepProvider) Name() string                  { return "viacep" }
+func (p *viaCepProvider) ProbeURL() string              { return p.endpoints.URL() + "/" }
+func (p *viaCepProvider) RateLimiter() *providerLimiter { return p.limiter }
+
+func (p *viaCepProvider) City(ctx context.Context, cep string) (string, error) {
+	url := fmt.Sprintf("%s/ws/%s/json/", p.endpoints.URL(), cep)
+	_, body, err := p.upstream.Get(ctx, "ViaCEP API", p.limiter, url)
+	if err != nil {
+		return "", err
+	}
+
+	if !p.masker.Lossy() {
+		log.Printf("ViaCEP response for %s: %s", cep, string(body))
+	} else {
+		log.Printf("ViaCEP response for %s: %d bytes", p.masker.Cep(cep), len(body))
+	}
+
+	if err := validateUpstream(ctx, "viacep", body); err != nil {
+		return "", err
+	}
+
+	var cepInfo ViaCepResponse
+	if err := json.Unmarshal(body, &cepInfo); err != nil {
+		return "", fmt.Errorf("error unmarshaling ViaCEP response: %w", err)
+	}
+
+	if cepInfo.Erro == "true" {
+		log.Printf("CEP %s not found", p.masker.Cep(cep))
+		return "", apperrors.ErrCepNotFound
+	}
+
+	return cepInfo.Localidade, nil
+}
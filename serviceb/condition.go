@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// weatherObservation is what a provider answers for a city. Providers map
+// their conditions onto weather.Condition, so that a response reads the
+// same whichever provider answered it; their own code is kept too, and
+// answered in extended mode.
+type weatherObservation struct {
+	TempC     float64
+	Condition weather.Condition
+	// ConditionCode is the provider's own code for the condition, empty
+	// when it has none.
+	ConditionCode string
+	// Provider is set by the chain to the provider that answered.
+	Provider string
+}
+
+// wmoCondition maps a WMO weather interpretation code, as Open-Meteo
+// reports it.
+func wmoCondition(code int) weather.Condition {
+	switch {
+	case code == 0:
+		return weather.ConditionClear
+	case code == 1 || code == 2:
+		return weather.ConditionPartlyCloudy
+	case code == 3:
+		return weather.ConditionCloudy
+	case code == 45 || code == 48:
+		return weather.ConditionFog
+	case code == 51 || code == 53 || code == 55:
+		return weather.ConditionDrizzle
+	case code == 56 || code == 57 || code == 66 || code == 67:
+		return weather.ConditionSleet
+	case code >= 61 && code <= 65, code >= 80 && code <= 82:
+		return weather.ConditionRain
+	case code >= 71 && code <= 77, code == 85 || code == 86:
+		return weather.ConditionSnow
+	case code >= 95 && code <= 99:
+		return weather.ConditionStorm
+	}
+	return weather.ConditionUnknown
+}
+
+// openWeatherMapCondition maps an OpenWeatherMap condition ID, whose
+// hundreds digit is the group.
+func openWeatherMapCondition(id int) weather.Condition {
+	switch {
+	case id >= 200 && id < 300:
+		return weather.ConditionStorm
+	case id >= 300 && id < 400:
+		return weather.ConditionDrizzle
+	case id == 511:
+		return weather.ConditionSleet
+	case id >= 500 && id < 600:
+		return weather.ConditionRain
+	case id == 611 || id == 612 || id == 613 || id == 615 || id == 616:
+		return weather.ConditionSleet
+	case id >= 600 && id < 700:
+		return weather.ConditionSnow
+	case id == 771 || id == 781:
+		// Squalls and tornadoes.
+		return weather.ConditionStorm
+	case id >= 700 && id < 800:
+		// Mist, smoke, haze, dust, fog, sand and ash.
+		return weather.ConditionFog
+	case id == 800:
+		return weather.ConditionClear
+	case id == 801 || id == 802:
+		return weather.ConditionPartlyCloudy
+	case id == 803 || id == 804:
+		return weather.ConditionCloudy
+	}
+	return weather.ConditionUnknown
+}
+
+// weatherAPIConditions maps the condition codes of WeatherAPI, which lists
+// them at https://www.weatherapi.com/docs/weather_conditions.json.
+var weatherAPIConditions = map[int]weather.Condition{
+	1000: weather.ConditionClear,
+	1003: weather.ConditionPartlyCloudy,
+	1006: weather.ConditionCloudy,
+	1009: weather.ConditionCloudy,
+	1030: weather.ConditionFog,
+	1063: weather.ConditionRain,
+	1066: weather.ConditionSnow,
+	1069: weather.ConditionSleet,
+	1072: weather.ConditionSleet,
+	1087: weather.ConditionStorm,
+	1114: weather.ConditionSnow,
+	1117: weather.ConditionSnow,
+	1135: weather.ConditionFog,
+	1147: weather.ConditionFog,
+	1150: weather.ConditionDrizzle,
+	1153: weather.ConditionDrizzle,
+	1168: weather.ConditionSleet,
+	1171: weather.ConditionSleet,
+	1180: weather.ConditionRain,
+	1183: weather.ConditionRain,
+	1186: weather.ConditionRain,
+	1189: weather.ConditionRain,
+	1192: weather.ConditionRain,
+	1195: weather.ConditionRain,
+	1198: weather.ConditionSleet,
+	1201: weather.ConditionSleet,
+	1204: weather.ConditionSleet,
+	1207: weather.ConditionSleet,
+	1210: weather.ConditionSnow,
+	1213: weather.ConditionSnow,
+	1216: weather.ConditionSnow,
+	1219: weather.ConditionSnow,
+	1222: weather.ConditionSnow,
+	1225: weather.ConditionSnow,
+	1237: weather.ConditionSleet,
+	1240: weather.ConditionRain,
+	1243: weather.ConditionRain,
+	1246: weather.ConditionRain,
+	1249: weather.ConditionSleet,
+	1252: weather.ConditionSleet,
+	1255: weather.ConditionSnow,
+	1258: weather.ConditionSnow,
+	1261: weather.ConditionSleet,
+	1264: weather.ConditionSleet,
+	1273: weather.ConditionStorm,
+	1276: weather.ConditionStorm,
+	1279: weather.ConditionStorm,
+	1282: weather.ConditionStorm,
+}
+
+func weatherAPICondition(code int) weather.Condition {
+	if c, ok := weatherAPIConditions[code]; ok {
+		return c
+	}
+	return weather.ConditionUnknown
+}
+
+// observed builds the observation of a provider reporting numeric codes;
+// code is nil when the response had none.
+func observed(tempC float64, code *int, mapping func(int) weather.Condition) weatherObservation {
+	if code == nil {
+		return weatherObservation{TempC: tempC, Condition: weather.ConditionUnknown}
+	}
+	return weatherObservation{TempC: tempC, Condition: mapping(*code), ConditionCode: strconv.Itoa(*code)}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/buildinfo"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/compression"
+	"github.com/joaolima7/otel-goexpert/pkg/debugcapture"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/metrics"
+	"github.com/joaolima7/otel-goexpert/pkg/outbound"
+	"github.com/joaolima7/otel-goexpert/pkg/profiling"
+	"github.com/joaolima7/otel-goexpert/pkg/server"
+	"github.com/joaolima7/otel-goexpert/pkg/watchdog"
+)
+
+// config is the resolved configuration of service B, read once at startup.
+// Fields tagged secret are masked by GET /admin/config.
+type config struct {
+	CollectorURL string
+	Metrics      metrics.Config
+	// TraceSampleRate is the share of traces sampled where no override of
+	// /admin/sampling applies; see sampling.Sampler.
+	TraceSampleRate float64
+	// Profiling uploads CPU and heap profiles to Pyroscope while its URL
+	// is set; see profiling.Profiler.
+	Profiling profiling.Config
+	// Watchdog warns, and optionally dumps the process, when goroutines,
+	// heap or scheduling lag go past their limits; see watchdog.Watchdog.
+	Watchdog watchdog.Config
+
+	// WeatherProviders are asked in order until one answers; see
+	// registerWeatherProvider for the available names. Entries may carry a
+	// weight for weighted routing, as "name:weight".
+	WeatherProviders        []string
+	WeatherAPIKey           string `secret:"true"`
+	OpenWeatherMapAPIKey    string `secret:"true"`
+	OpenWeatherMapRateLimit string
+	OpenMeteoRateLimit      string
+	StubWeatherTempC        float64
+	SyntheticWeather        syntheticWeatherConfig
+
+	CepMasking  string
+	CepHashSalt string `secret:"true"`
+	// CepValidation is how strictly CEPs are checked before a lookup:
+	// format, or range to also refuse CEPs outside every UF.
+	CepValidation string
+	// StrictJSON rejects request bodies with unknown fields, nulls or
+	// values of the wrong type, reporting each problem; see httpapi.DecodeRequest.
+	StrictJSON bool
+	// ErrorDocsURL is where the docs_url of error responses points, with
+	// {code} replaced by the error code.
+	ErrorDocsURL   string
+	SupportContact string
+	// Compression compresses responses with the encoding the client
+	// prefers; see compression.Middleware.
+	Compression compression.Config
+	// DebugCapture records redacted request and response bodies of the
+	// requests that ask for it; see debugcapture.Capturer.
+	DebugCapture debugcapture.Config
+
+	AuditLogPath         string
+	AccessLogSampling    string
+	SlowRequestThreshold time.Duration
+	RequestTimeout       time.Duration
+	ReadinessGrace       time.Duration
+	// StartupVerify checks the dependencies once at boot and logs a
+	// summary; with StartupStrict a failed hard check aborts the start.
+	StartupVerify        bool
+	StartupStrict        bool
+	StartupVerifyTimeout time.Duration
+	// MaxInFlight enables priority-aware load shedding; see shedding.Shedder.
+	MaxInFlight int
+
+	// ACLAllow and ACLDeny restrict who may call the service, and
+	// AdminACLAllow who may call the admin API, as CIDR lists.
+	// X-Forwarded-For is honored only from TrustedProxies.
+	ACLAllow       []string
+	ACLDeny        []string
+	AdminACLAllow  []string
+	TrustedProxies []string
+
+	// Failed upstream calls are retried up to RetryMaxAttempts in total,
+	// while retries stay within RetryBudgetPercent of the calls made in the
+	// last RetryBudgetWindow (plus RetryBudgetMin).
+	RetryMaxAttempts   int
+	RetryBackoff       time.Duration
+	RetryBudgetPercent int
+	RetryBudgetMin     int
+	RetryBudgetWindow  time.Duration
+
+	// IdempotencyTTL is how long responses are kept for replay under their
+	// Idempotency-Key; zero disables it.
+	IdempotencyTTL     time.Duration
+	IdempotencyMaxKeys int
+	// DedupWindow replays identical requests from the same client without
+	// an Idempotency-Key for this long; zero disables it.
+	DedupWindow time.Duration
+
+	// StorageDriver selects the repository backend: memory, postgres or
+	// sqlite. StorageDSN is passed to the database driver.
+	StorageDriver string
+	StorageDSN    string
+	// StorageMemoryMaxLookups bounds the history of the memory backend,
+	// which drops the oldest lookups past it; zero keeps them all.
+	StorageMemoryMaxLookups int
+	// StorageAutoMigrate applies pending schema migrations on startup.
+	StorageAutoMigrate bool
+
+	// AdminToken is the bearer token of the admin API, which is disabled
+	// while empty.
+	AdminToken string `secret:"true"`
+
+	CacheMaxEntries int
+	CacheCepTTL     time.Duration
+	// WeatherMaxAge is how long callers, service A among them, may keep a
+	// weather answer; 0 has them revalidate every time.
+	WeatherMaxAge time.Duration
+	// CachePrewarmInterval enables the prewarmer, which keeps the
+	// CachePrewarmTop most-queried CEPs cached.
+	CachePrewarmInterval time.Duration
+	CachePrewarmTop      int
+	StatsTopKCapacity    int
+	// HistoryRetention enables the history_prune cron task, which deletes
+	// older lookups.
+	HistoryRetention time.Duration
+	// CronSchedule overrides the schedules of the cron tasks, as
+	// "task=spec;task=spec"; see cron.Scheduler.
+	CronSchedule string
+	// RedisURL enables cross-replica cache invalidation over pub/sub, and
+	// the election of the leader, the replica that runs the cron tasks in
+	// LeaderTasks, through a lease of LeaderLeaseTTL on LeaderKey.
+	RedisURL                 string
+	CacheInvalidationChannel string
+	LeaderTasks              []string
+	LeaderKey                string
+	LeaderLeaseTTL           time.Duration
+
+	// CepProvidersFile lists the CEP providers with their weights and
+	// timeouts; see cepProviderConfig. Without it ViaCEP is used alone.
+	CepProvidersFile string
+
+	// ViaCepRateLimit and WeatherAPIRateLimit cap outbound calls to each
+	// provider, as "N/period"; see newProviderLimiter.
+	ViaCepRateLimit     string
+	BrasilAPIRateLimit  string
+	WeatherAPIRateLimit string
+	ProviderRateBurst   int
+	ProviderRateMaxWait time.Duration
+
+	WebhookTimeout time.Duration
+	// SMTP enables the email channel of subscriptions; see smtpNotifier.
+	SMTP smtpConfig
+	// SelftestCep is the known CEP looked up by POST /admin/selftest.
+	SelftestCep string
+
+	// WorkerPool runs the background work: jobs, notifications,
+	// MQTT publishes and cache refreshes.
+	WorkerPool workerPoolConfig
+	// Asynchronous jobs (POST /jobs) run on the worker pool, bounded by
+	// JobTimeout as a whole and by JobItemTimeout per CEP.
+	JobMaxCeps     int
+	JobTimeout     time.Duration
+	JobItemTimeout time.Duration
+
+	// ConsulAddr enables registration with the Consul agent when set.
+	ConsulAddr         string
+	ConsulRegistration consulRegistration
+
+	// ProviderRouting picks which healthy provider of each chain is asked
+	// first: ordered, weighted or latency; see routingPolicy.
+	ProviderRouting string
+	// ProviderEndpoints lists regional endpoints or mirrors of the upstream
+	// APIs; calls go to the fastest healthy one, as probed every
+	// EndpointProbeInterval. See endpointSet.
+	ProviderEndpoints     string
+	EndpointProbeInterval time.Duration
+	// MQTT publishes the weather of subscribed CEPs to weather/{cep}
+	// topics; see mqttPublisher.
+	MQTT mqttConfig
+	// NATS publishes the same updates to weather.{cep} subjects; see
+	// natsPublisher.
+	NATS natsConfig
+	// The weather updates go through the transactional outbox, which is
+	// relayed every OutboxRelayInterval, OutboxRelayBatch messages at a
+	// time, and right after each lookup; see outboxRelay.
+	OutboxRelayInterval time.Duration
+	OutboxRelayBatch    int
+
+	// Health decides when providers are demoted to the end of their
+	// chain; see healthTracker.
+	Health healthConfig
+
+	// Deterministic pins the clock and the random seeds for reproducible
+	// tests; see clock.DeterministicConfig.
+	Deterministic clock.DeterministicConfig
+
+	Outbound outbound.Config
+	Server   server.Config
+}
+
+func loadConfig() config {
+	forceHTTP1 := getEnvBool("FORCE_HTTP1", false)
+	port := getEnv("PORT", "8081")
+
+	return config{
+		CollectorURL:    getEnv("OTEL_COLLECTOR_URL", "otel-collector:4317"),
+		TraceSampleRate: getEnvFloat("TRACE_SAMPLE_RATE", 1),
+		Metrics: metrics.Config{
+			AttributeAllow: splitList(getEnv("METRICS_ATTRIBUTE_ALLOW", "")),
+			Temporality:    getEnv("METRICS_TEMPORALITY", metrics.TemporalityCumulative),
+			Interval:       getEnvDuration("METRICS_EXPORT_INTERVAL", 15*time.Second),
+			Prometheus:     getEnvBool("METRICS_PROMETHEUS", false),
+		},
+		Profiling: profiling.Config{
+			URL:       getEnv("PROFILING_URL", ""),
+			AuthToken: getEnv("PROFILING_AUTH_TOKEN", ""),
+			TenantID:  getEnv("PROFILING_TENANT_ID", ""),
+			Interval:  getEnvDuration("PROFILING_INTERVAL", 15*time.Second),
+			Types:     splitList(getEnv("PROFILING_TYPES", "cpu,heap")),
+		},
+		Watchdog: watchdog.Config{
+			Interval:      getEnvDuration("WATCHDOG_INTERVAL", 5*time.Second),
+			MaxGoroutines: getEnvInt("WATCHDOG_MAX_GOROUTINES", 10000),
+			MaxHeapBytes:  uint64(getEnvInt("WATCHDOG_MAX_HEAP_MB", 512)) << 20,
+			MaxLag:        getEnvDuration("WATCHDOG_MAX_LAG", 250*time.Millisecond),
+			DumpDir:       getEnv("WATCHDOG_DUMP_DIR", ""),
+			DumpCooldown:  getEnvDuration("WATCHDOG_DUMP_COOLDOWN", 10*time.Minute),
+		},
+
+		WeatherProviders:        splitList(getEnv("WEATHER_PROVIDERS", "weatherapi")),
+		WeatherAPIKey:           getEnv("WEATHER_API_KEY", "bfbdabb82902462aaf4190220252008"),
+		OpenWeatherMapAPIKey:    getEnv("OPENWEATHERMAP_API_KEY", ""),
+		OpenWeatherMapRateLimit: getEnv("OPENWEATHERMAP_RATE_LIMIT", ""),
+		OpenMeteoRateLimit:      getEnv("OPEN_METEO_RATE_LIMIT", ""),
+		StubWeatherTempC:        getEnvFloat("STUB_WEATHER_TEMP_C", 25),
+		SyntheticWeather: syntheticWeatherConfig{
+			Seed:     getEnvInt("SYNTHETIC_WEATHER_SEED", 1),
+			Variance: getEnvFloat("SYNTHETIC_WEATHER_VARIANCE", 0),
+			Latency:  getEnvDuration("SYNTHETIC_WEATHER_LATENCY", 0),
+			Jitter:   getEnvDuration("SYNTHETIC_WEATHER_JITTER", 0),
+		},
+
+		CepMasking:     getEnv("CEP_MASKING", string(masking.None)),
+		CepValidation:  getEnv("CEP_VALIDATION", "format"),
+		CepHashSalt:    getEnv("CEP_HASH_SALT", ""),
+		StrictJSON:     getEnvBool("STRICT_JSON", false),
+		ErrorDocsURL:   getEnv("ERROR_DOCS_URL", "/errors/{code}"),
+		SupportContact: getEnv("SUPPORT_CONTACT", ""),
+		Compression: compression.Config{
+			Encodings:   splitList(getEnv("COMPRESSION_ENCODINGS", "zstd,br,gzip")),
+			GzipLevel:   getEnvInt("COMPRESSION_GZIP_LEVEL", 6),
+			BrotliLevel: getEnvInt("COMPRESSION_BROTLI_LEVEL", compression.DefaultBrotliLevel),
+			ZstdLevel:   getEnvInt("COMPRESSION_ZSTD_LEVEL", 3),
+			MinBytes:    getEnvInt("COMPRESSION_MIN_BYTES", 1024),
+
+			RequestMaxBytes: int64(getEnvInt("REQUEST_MAX_DECOMPRESSED_BYTES", 10<<20)),
+		},
+		DebugCapture: debugcapture.Config{
+			Secret:   getEnv("DEBUG_CAPTURE_SECRET", ""),
+			MaxBytes: getEnvInt("DEBUG_CAPTURE_MAX_BYTES", 4096),
+			Keep:     getEnvInt("DEBUG_CAPTURE_KEEP", 100),
+		},
+
+		AuditLogPath:         getEnv("AUDIT_LOG_PATH", ""),
+		AccessLogSampling:    getEnv("ACCESS_LOG_SAMPLING", ""),
+		SlowRequestThreshold: getEnvDuration("SLOW_REQUEST_THRESHOLD", 2*time.Second),
+		RequestTimeout:       getEnvDuration("REQUEST_TIMEOUT", 4*time.Second),
+		ReadinessGrace:       getEnvDuration("READINESS_GRACE_TIMEOUT", 30*time.Second),
+		StartupVerify:        getEnvBool("STARTUP_VERIFY", true),
+		StartupStrict:        getEnvBool("STARTUP_STRICT", false),
+		StartupVerifyTimeout: getEnvDuration("STARTUP_VERIFY_TIMEOUT", 5*time.Second),
+		MaxInFlight:          getEnvInt("LOAD_SHED_MAX_INFLIGHT", 0),
+
+		ACLAllow:       splitList(getEnv("ACL_ALLOW", "")),
+		ACLDeny:        splitList(getEnv("ACL_DENY", "")),
+		AdminACLAllow:  splitList(getEnv("ADMIN_ACL_ALLOW", "")),
+		TrustedProxies: splitList(getEnv("TRUSTED_PROXIES", "")),
+
+		RetryMaxAttempts:   getEnvInt("RETRY_MAX_ATTEMPTS", 2),
+		RetryBackoff:       getEnvDuration("RETRY_BACKOFF", 100*time.Millisecond),
+		RetryBudgetPercent: getEnvInt("RETRY_BUDGET_PERCENT", 10),
+		RetryBudgetMin:     getEnvInt("RETRY_BUDGET_MIN", 10),
+		RetryBudgetWindow:  getEnvDuration("RETRY_BUDGET_WINDOW", 10*time.Second),
+
+		IdempotencyTTL:     getEnvDuration("IDEMPOTENCY_TTL", 10*time.Minute),
+		IdempotencyMaxKeys: getEnvInt("IDEMPOTENCY_MAX_KEYS", 10000),
+		DedupWindow:        getEnvDuration("DEDUP_WINDOW", 0),
+
+		StorageDriver: getEnv("STORAGE_DRIVER", "memory"),
+		StorageDSN:    getEnv("STORAGE_DSN", ""),
+
+		StorageMemoryMaxLookups: getEnvInt("STORAGE_MEMORY_MAX_LOOKUPS", 100000),
+
+		StorageAutoMigrate: getEnvBool("STORAGE_AUTO_MIGRATE", true),
+
+		AdminToken: getEnv("ADMIN_TOKEN", ""),
+
+		CacheMaxEntries:          getEnvInt("CACHE_MAX_ENTRIES", 10000),
+		CacheCepTTL:              getEnvDuration("CACHE_CEP_TTL", 24*time.Hour),
+		WeatherMaxAge:            getEnvDuration("WEATHER_MAX_AGE", time.Minute),
+		CachePrewarmInterval:     getEnvDuration("CACHE_PREWARM_INTERVAL", 0),
+		CachePrewarmTop:          getEnvInt("CACHE_PREWARM_TOP", 20),
+		StatsTopKCapacity:        getEnvInt("STATS_TOPK_CAPACITY", 100),
+		HistoryRetention:         getEnvDuration("HISTORY_RETENTION", 0),
+		CronSchedule:             getEnv("CRON_SCHEDULE", ""),
+		RedisURL:                 getEnv("REDIS_URL", ""),
+		CacheInvalidationChannel: getEnv("CACHE_INVALIDATION_CHANNEL", "otel-goexpert:cache-invalidation"),
+		LeaderTasks:              splitList(getEnv("LEADER_TASKS", "cache_prewarm,history_prune")),
+		LeaderKey:                getEnv("LEADER_KEY", "otel-goexpert:serviceb:leader"),
+		LeaderLeaseTTL:           getEnvDuration("LEADER_LEASE_TTL", 15*time.Second),
+
+		CepProvidersFile: getEnv("CEP_PROVIDERS_FILE", ""),
+
+		ViaCepRateLimit:     getEnv("VIACEP_RATE_LIMIT", ""),
+		BrasilAPIRateLimit:  getEnv("BRASILAPI_RATE_LIMIT", ""),
+		WeatherAPIRateLimit: getEnv("WEATHERAPI_RATE_LIMIT", ""),
+		ProviderRateBurst:   getEnvInt("PROVIDER_RATE_BURST", 10),
+		ProviderRateMaxWait: getEnvDuration("PROVIDER_RATE_MAX_WAIT", time.Second),
+
+		WebhookTimeout: getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		SMTP: smtpConfig{
+			Host:     getEnv("SMTP_HOST", ""),
+			Port:     getEnvInt("SMTP_PORT", 587),
+			Username: getEnv("SMTP_USERNAME", ""),
+			Password: getEnv("SMTP_PASSWORD", ""),
+			From:     getEnv("SMTP_FROM", "otel-goexpert@localhost"),
+			Timeout:  getEnvDuration("SMTP_TIMEOUT", 30*time.Second),
+		},
+		SelftestCep: getEnv("SELFTEST_CEP", "01001000"),
+
+		WorkerPool: workerPoolConfig{
+			Size:         getEnvInt("WORKER_POOL_SIZE", 8),
+			QueueDepth:   getEnvInt("WORKER_POOL_QUEUE_DEPTH", 1000),
+			TaskTimeout:  getEnvDuration("WORKER_POOL_TASK_TIMEOUT", 30*time.Second),
+			DrainTimeout: getEnvDuration("WORKER_POOL_DRAIN_TIMEOUT", 3*time.Second),
+		},
+		JobMaxCeps:     getEnvInt("JOB_MAX_CEPS", 10000),
+		JobTimeout:     getEnvDuration("JOB_TIMEOUT", time.Hour),
+		JobItemTimeout: getEnvDuration("JOB_ITEM_TIMEOUT", 4*time.Second),
+
+		ConsulAddr:         getEnv("CONSUL_ADDR", ""),
+		ConsulRegistration: consulRegistrationFromEnv(port),
+
+		ProviderRouting:       getEnv("PROVIDER_ROUTING", string(routeWeighted)),
+		ProviderEndpoints:     getEnv("PROVIDER_ENDPOINTS", ""),
+		EndpointProbeInterval: getEnvDuration("PROVIDER_ENDPOINT_PROBE_INTERVAL", 15*time.Second),
+		MQTT: mqttConfig{
+			BrokerURL:   getEnv("MQTT_BROKER_URL", ""),
+			ClientID:    getEnv("MQTT_CLIENT_ID", "service-b-"+buildinfo.InstanceID),
+			Username:    getEnv("MQTT_USERNAME", ""),
+			Password:    getEnv("MQTT_PASSWORD", ""),
+			TopicPrefix: getEnv("MQTT_TOPIC_PREFIX", ""),
+			QoS:         getEnvInt("MQTT_QOS", 1),
+			Retained:    getEnvBool("MQTT_RETAINED", true),
+		},
+		NATS: natsConfig{
+			URL:           getEnv("NATS_URL", ""),
+			SubjectPrefix: getEnv("NATS_SUBJECT_PREFIX", ""),
+		},
+		OutboxRelayInterval: getEnvDuration("OUTBOX_RELAY_INTERVAL", time.Second),
+		OutboxRelayBatch:    getEnvInt("OUTBOX_RELAY_BATCH", 100),
+		Health: healthConfig{
+			Window:         getEnvInt("PROVIDER_HEALTH_WINDOW", 20),
+			MinSamples:     getEnvInt("PROVIDER_HEALTH_MIN_SAMPLES", 10),
+			DemoteScore:    getEnvFloat("PROVIDER_HEALTH_DEMOTE_SCORE", 0.5),
+			SlowLatency:    getEnvDuration("PROVIDER_HEALTH_SLOW_LATENCY", 2*time.Second),
+			ProbeInterval:  getEnvDuration("PROVIDER_HEALTH_PROBE_INTERVAL", 30*time.Second),
+			RecoveryProbes: getEnvInt("PROVIDER_HEALTH_RECOVERY_PROBES", 3),
+			ProbeCity:      getEnv("PROVIDER_HEALTH_PROBE_CITY", "São Paulo"),
+		},
+		Deterministic: clock.DeterministicConfig{
+			Enabled: getEnvBool("DETERMINISTIC_MODE", false),
+			Seed:    uint64(getEnvInt("DETERMINISTIC_SEED", 1)),
+			Start:   getEnv("DETERMINISTIC_START", "2024-01-01T00:00:00Z"),
+		},
+		Outbound: outbound.Config{
+			ForceHTTP1:          forceHTTP1,
+			MaxIdleConns:        getEnvInt("OUTBOUND_MAX_IDLE_CONNS", 100),
+			MaxIdleConnsPerHost: getEnvInt("OUTBOUND_MAX_IDLE_CONNS_PER_HOST", 10),
+			MaxConnsPerHost:     getEnvInt("OUTBOUND_MAX_CONNS_PER_HOST", 0),
+			IdleConnTimeout:     getEnvDuration("OUTBOUND_IDLE_CONN_TIMEOUT", 90*time.Second),
+			TLSHandshakeTimeout: getEnvDuration("OUTBOUND_TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+			CABundlePath:        getEnv("OUTBOUND_CA_BUNDLE", ""),
+			InsecureSkipVerify:  getEnvBool("OUTBOUND_INSECURE_SKIP_VERIFY", false),
+			Telemetry: outbound.TelemetryConfig{
+				ClientExclude:  splitList(getEnv("OTEL_HTTP_CLIENT_EXCLUDE", "")),
+				ClientSpanName: getEnv("OTEL_HTTP_CLIENT_SPAN_NAME", ""),
+				PeerNames:      outbound.ParsePeerNames(splitList(getEnv("OTEL_HTTP_PEER_NAMES", ""))),
+			},
+		},
+		Server: server.Config{
+			Addr:            ":" + port,
+			TLSCertFile:     getEnv("TLS_CERT_FILE", ""),
+			TLSKeyFile:      getEnv("TLS_KEY_FILE", ""),
+			ForceHTTP1:      forceHTTP1,
+			H2C:             getEnvBool("H2C_ENABLED", true),
+			ReusePort:       getEnvBool("REUSE_PORT", false),
+			DrainTimeout:    getEnvDuration("SHUTDOWN_DRAIN_TIMEOUT", 10*time.Second),
+			ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 25*time.Second),
+		},
+	}
+}
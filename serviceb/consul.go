@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// consulRegistration describes this instance to the Consul agent.
+type consulRegistration struct {
+	ID      string             `json:"ID"`
+	Name    string             `json:"Name"`
+	Address string             `json:"Address,omitempty"`
+	Port    int                `json:"Port"`
+	Check   consulServiceCheck `json:"Check"`
+}
+
+type consulServiceCheck struct {
+	HTTP     string `json:"HTTP"`
+	Interval string `json:"Interval"`
+	Timeout  string `json:"Timeout"`
+	// DeregisterCriticalServiceAfter cleans up instances that went away
+	// without deregistering, e.g. after a crash.
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+// registerWithConsul registers this instance with the local Consul agent,
+// health-checked through /healthz.
+func registerWithConsul(ctx context.Context, consulAddr string, reg consulRegistration) error {
+	body, err := json.Marshal(reg)
+	if err != nil {
+		return fmt.Errorf("error marshaling registration: %w", err)
+	}
+	return consulAgentPut(ctx, consulAddr+"/v1/agent/service/register", body)
+}
+
+// consulRegistrar keeps track of this instance's registration.
+type consulRegistrar struct {
+	addr         string
+	registration consulRegistration
+	registered   bool
+}
+
+func (c *consulRegistrar) Register(ctx context.Context) error {
+	if err := registerWithConsul(ctx, c.addr, c.registration); err != nil {
+		return err
+	}
+	c.registered = true
+	return nil
+}
+
+// Deregister removes the registration if Register succeeded earlier.
+func (c *consulRegistrar) Deregister(ctx context.Context) error {
+	if !c.registered {
+		return nil
+	}
+	return deregisterFromConsul(ctx, c.addr, c.registration.ID)
+}
+
+func deregisterFromConsul(ctx context.Context, consulAddr, id string) error {
+	return consulAgentPut(ctx, consulAddr+"/v1/agent/service/deregister/"+id, nil)
+}
+
+func consulAgentPut(ctx context.Context, endpoint string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling Consul agent: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from Consul agent: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func consulRegistrationFromEnv(port string) consulRegistration {
+	hostname, _ := os.Hostname()
+	address := getEnv("CONSUL_SERVICE_ADDRESS", hostname)
+	name := getEnv("CONSUL_SERVICE_NAME", "serviceb")
+	portNum, _ := strconv.Atoi(port)
+
+	return consulRegistration{
+		ID:      getEnv("CONSUL_SERVICE_ID", fmt.Sprintf("%s-%s-%s", name, hostname, port)),
+		Name:    name,
+		Address: address,
+		Port:    portNum,
+		Check: consulServiceCheck{
+			HTTP:                           fmt.Sprintf("http://%s/healthz", net.JoinHostPort(address, port)),
+			Interval:                       "10s",
+			Timeout:                        "2s",
+			DeregisterCriticalServiceAfter: "1m",
+		},
+	}
+}
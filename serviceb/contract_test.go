@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/shedding"
+)
+
+// contractPath is the contract between service A and service B, shared
+// with service A's consumer tests. Service B is the provider: it must
+// answer every interaction the way the contract pins.
+const contractPath = "../contracts/servicea-serviceb.json"
+
+type contract struct {
+	Consumer     string        `json:"consumer"`
+	Provider     string        `json:"provider"`
+	Interactions []interaction `json:"interactions"`
+}
+
+// interaction is one request of the consumer and the response the provider
+// answers it with in the given state. Response bodies are examples: the
+// provider must answer with the same fields and JSON types, and with the
+// same values for the fields listed in Exact. ConsumerOutcome is what the
+// consumer makes of the response.
+type interaction struct {
+	Description   string `json:"description"`
+	ProviderState string `json:"provider_state"`
+	Request       struct {
+		Method  string            `json:"method"`
+		Path    string            `json:"path"`
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"`
+	} `json:"request"`
+	Response struct {
+		Status  int               `json:"status"`
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"`
+		Exact   []string          `json:"exact"`
+	} `json:"response"`
+	ConsumerOutcome string `json:"consumer_outcome"`
+}
+
+func loadContract(t *testing.T) contract {
+	t.Helper()
+	data, err := os.ReadFile(contractPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c contract
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatalf("parsing %s: %v", contractPath, err)
+	}
+	return c
+}
+
+// failingWeatherProvider fails every lookup with err.
+type failingWeatherProvider struct{ err error }
+
+func (failingWeatherProvider) Name() string { return "failing" }
+
+func (p failingWeatherProvider) CurrentWeather(context.Context, string) (weatherObservation, error) {
+	return weatherObservation{}, p.err
+}
+
+// providerStates set up the states the contract's interactions start from,
+// on top of newFakeWeatherHandler, which knows 01001000 and not 00000000.
+var providerStates = map[string]func(t *testing.T, h *weatherHandler, shedder *shedding.Shedder){
+	"":                                  func(*testing.T, *weatherHandler, *shedding.Shedder) {},
+	"the CEP and its weather are known": func(*testing.T, *weatherHandler, *shedding.Shedder) {},
+	"the CEP is unknown":                func(*testing.T, *weatherHandler, *shedding.Shedder) {},
+	"the city's weather is known":       func(*testing.T, *weatherHandler, *shedding.Shedder) {},
+	"the weather provider times out": func(_ *testing.T, h *weatherHandler, _ *shedding.Shedder) {
+		h.resolver.weather.entries[0].provider = failingWeatherProvider{context.DeadlineExceeded}
+	},
+	"the weather provider is rate limited for 30s": func(_ *testing.T, h *weatherHandler, _ *shedding.Shedder) {
+		h.resolver.weather.entries[0].provider = failingWeatherProvider{httpapi.WithRetryAfter(ErrProviderRateLimited, 30*time.Second)}
+	},
+	"the weather provider fails": func(_ *testing.T, h *weatherHandler, _ *shedding.Shedder) {
+		h.resolver.weather.entries[0].provider = failingWeatherProvider{errors.New("unexpected status code: 500")}
+	},
+	"service B is at capacity": func(t *testing.T, _ *weatherHandler, s *shedding.Shedder) {
+		// Hold every slot with critical requests that wait for the test to
+		// end.
+		release := make(chan struct{})
+		var held sync.WaitGroup
+		hold := s.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			held.Done()
+			<-release
+		}))
+		for range 10 {
+			held.Add(1)
+			req := httptest.NewRequest(http.MethodPost, "/weather", nil)
+			req.Header.Set(shedding.PriorityHeader, "critical")
+			go hold.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		held.Wait()
+		t.Cleanup(func() { close(release) })
+	},
+}
+
+// TestServiceBContract verifies service B against every interaction of
+// the contract, from the provider state it names.
+func TestServiceBContract(t *testing.T) {
+	c := loadContract(t)
+	for _, it := range c.Interactions {
+		t.Run(it.Description, func(t *testing.T) {
+			setup, ok := providerStates[it.ProviderState]
+			if !ok {
+				t.Fatalf("unknown provider state %q", it.ProviderState)
+			}
+			h := newFakeWeatherHandler(t, 0)
+			shedder := shedding.New(10, testMeter)
+			setup(t, h, shedder)
+
+			mux := http.NewServeMux()
+			mux.Handle("POST /weather", shedder.Middleware(h))
+			req := httptest.NewRequest(it.Request.Method, it.Request.Path, strings.NewReader(string(it.Request.Body)))
+			for k, v := range it.Request.Headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			withServiceMiddleware(mux).ServeHTTP(rec, req)
+
+			if rec.Code != it.Response.Status {
+				t.Errorf("status = %d, want %d", rec.Code, it.Response.Status)
+			}
+			for k, v := range it.Response.Headers {
+				if got := rec.Header().Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+			var want, got any
+			if err := json.Unmarshal(it.Response.Body, &want); err != nil {
+				t.Fatalf("contract body: %v", err)
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %s: %v", rec.Body, err)
+			}
+			for _, mismatch := range matchShape(want, got, "", it.Response.Exact) {
+				t.Error(mismatch)
+			}
+		})
+	}
+}
+
+// matchShape lists where got departs from the example want: a missing
+// field, a different JSON type, or a different value on a path listed in
+// exact. Fields the example doesn't have are allowed, so that the provider
+// can add to its responses.
+func matchShape(want, got any, path string, exact []string) []string {
+	name := path
+	if name == "" {
+		name = "body"
+	}
+	if slices.Contains(exact, path) {
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			return []string{fmt.Sprintf("%s = %v, want %v", name, got, want)}
+		}
+		return nil
+	}
+
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s is %T, want an object", name, got)}
+		}
+		var mismatches []string
+		for k, wv := range w {
+			child := k
+			if path != "" {
+				child = path + "." + k
+			}
+			gv, ok := g[k]
+			if !ok {
+				mismatches = append(mismatches, fmt.Sprintf("%s is missing", child))
+				continue
+			}
+			mismatches = append(mismatches, matchShape(wv, gv, child, exact)...)
+		}
+		return mismatches
+	case []any:
+		g, ok := got.([]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s is %T, want an array", name, got)}
+		}
+		var mismatches []string
+		if len(w) > 0 {
+			for i, gv := range g {
+				mismatches = append(mismatches, matchShape(w[0], gv, fmt.Sprintf("%s[%d]", path, i), exact)...)
+			}
+		}
+		return mismatches
+	default:
+		if fmt.Sprintf("%T", want) != fmt.Sprintf("%T", got) {
+			return []string{fmt.Sprintf("%s is %T, want %T", name, got, want)}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	deadLetterNotification = "notification"
+	deadLetterJobItem      = "job_item"
+)
+
+// notificationLetter is the payload of a notification that could not be
+// delivered. A replay delivers the same event, ID included, so receivers
+// can deduplicate.
+type notificationLetter struct {
+	SubscriptionID string         `json:"subscription_id"`
+	Event          thresholdEvent `json:"event"`
+}
+
+// jobItemLetter is the payload of a failed item of a job: the CEP at Index
+// of job JobID, of the given kind.
+type jobItemLetter struct {
+	JobID string `json:"job_id"`
+	Kind  string `json:"kind"`
+	Index int    `json:"index"`
+	Cep   string `json:"cep"`
+	City  string `json:"city,omitempty"`
+}
+
+// errJobUnfinished refuses to replay an item of a job that is still
+// running, whose results would overwrite the replay.
+var errJobUnfinished = errors.New("job is still running")
+
+// deadLetterQueue keeps the background work that failed for good, so it
+// can be listed and replayed once the cause is fixed.
+type deadLetterQueue struct {
+	repo     DeadLetterRepository
+	recorded metric.Int64Counter
+	tracer   trace.Tracer
+}
+
+func newDeadLetterQueue(repo DeadLetterRepository, meter metric.Meter, tracer trace.Tracer) *deadLetterQueue {
+	q := &deadLetterQueue{repo: repo, tracer: tracer}
+	var err error
+	q.recorded, err = meter.Int64Counter("dead_letters.recorded",
+		metric.WithDescription("Background work that failed for good and was dead-lettered, by kind"),
+		metric.WithUnit("{letter}"),
+	)
+	if err != nil {
+		log.Printf("Error creating dead letter counter: %v", err)
+	}
+	return q
+}
+
+// Add dead-letters work of kind that failed with reason. It writes with a
+// context of its own, since the work's may be past its deadline.
+func (q *deadLetterQueue) Add(ctx context.Context, kind, subject string, payload any, reason error) {
+	if q == nil {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		errlog.Printf("Error encoding dead letter for %s: %v", subject, err)
+		return
+	}
+	now := clock.Now()
+	d := DeadLetter{
+		ID:        randomHex(16),
+		Kind:      kind,
+		Subject:   subject,
+		Reason:    reason.Error(),
+		Payload:   body,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		d.TraceID = sc.TraceID().String()
+	}
+
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := q.repo.CreateDeadLetter(writeCtx, d); err != nil {
+		errlog.Printf("Error dead-lettering %s: %v", subject, err)
+		return
+	}
+	if q.recorded != nil {
+		q.recorded.Add(ctx, 1, metric.WithAttributes(attribute.String("dead_letter.kind", kind)))
+	}
+}
+
+// Replay runs the work of d again, through notifier or jr depending on
+// its kind. On success the letter is deleted; on failure its reason and
+// replay count are updated and the failure is returned.
+func (q *deadLetterQueue) Replay(ctx context.Context, d DeadLetter, notifier *subscriptionNotifier, jr *jobRunner) error {
+	ctx, span := q.tracer.Start(ctx, "replay_dead_letter", trace.WithAttributes(
+		attribute.String("dead_letter.id", d.ID),
+		attribute.String("dead_letter.kind", d.Kind),
+		attribute.String("dead_letter.trace_id", d.TraceID),
+	))
+	defer span.End()
+
+	var err error
+	switch d.Kind {
+	case deadLetterNotification:
+		err = notifier.replay(ctx, d.Payload)
+	case deadLetterJobItem:
+		err = jr.replayItem(ctx, d.Payload)
+	default:
+		err = fmt.Errorf("unknown dead letter kind %q", d.Kind)
+	}
+	if errors.Is(err, errJobUnfinished) {
+		return err
+	}
+	if err == nil {
+		return q.repo.DeleteDeadLetter(ctx, d.ID)
+	}
+
+	span.RecordError(err)
+	d.Replays++
+	d.Reason = err.Error()
+	d.UpdatedAt = clock.Now()
+	if updateErr := q.repo.UpdateDeadLetter(ctx, d); updateErr != nil {
+		errlog.Printf("Error updating dead letter %s: %v", d.ID, updateErr)
+	}
+	return err
+}
+
+func (sn *subscriptionNotifier) replay(ctx context.Context, payload json.RawMessage) error {
+	var l notificationLetter
+	if err := json.Unmarshal(payload, &l); err != nil {
+		return fmt.Errorf("error decoding notification: %w", err)
+	}
+	sub, err := sn.subs.GetSubscription(ctx, l.SubscriptionID)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("subscription %s no longer exists", l.SubscriptionID)
+	}
+	if err != nil {
+		return err
+	}
+	n, ok := sn.notifiers[sub.Channel]
+	if !ok {
+		return fmt.Errorf("no notifier for channel %q", sub.Channel)
+	}
+	return n.Notify(ctx, sub, l.Event)
+}
+
+// replayItem looks up the CEP of a failed job item again and, when it
+// succeeds, puts the result in place of the failure.
+func (jr *jobRunner) replayItem(ctx context.Context, payload json.RawMessage) error {
+	var l jobItemLetter
+	if err := json.Unmarshal(payload, &l); err != nil {
+		return fmt.Errorf("error decoding job item: %w", err)
+	}
+	j, err := jr.jobs.GetJob(ctx, l.JobID)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("job %s no longer exists", l.JobID)
+	}
+	if err != nil {
+		return err
+	}
+	if j.Status == jobQueued || j.Status == jobRunning {
+		return errJobUnfinished
+	}
+
+	var r JobResult
+	if l.Kind == jobCacheImport {
+		r = jr.warm(ctx, l.Cep, l.City)
+	} else {
+		r = jr.lookup(ctx, l.Cep)
+	}
+	if r.Error != "" {
+		return errors.New(string(r.Error))
+	}
+	if l.Index < len(j.Results) {
+		if j.Results[l.Index].Error != "" {
+			j.Failed--
+		}
+		j.Results[l.Index] = r
+		j.UpdatedAt = clock.Now()
+		if err := jr.jobs.UpdateJob(ctx, j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deadLetterReplay is the outcome of replaying one dead letter.
+type deadLetterReplay struct {
+	ID       string `json:"id"`
+	Replayed bool   `json:"replayed"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func (a *adminAPI) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	list, err := a.dead.repo.ListDeadLetters(r.Context(), r.URL.Query().Get("kind"), limit)
+	if err != nil {
+		errlog.Printf("Error listing dead letters: %v", err)
+		httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", r.Context())
+		return
+	}
+	if list == nil {
+		list = []DeadLetter{}
+	}
+	httpapi.Render(w, http.StatusOK, list, r.Context())
+}
+
+func (a *adminAPI) handleGetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	d, ok := a.loadDeadLetter(w, r)
+	if ok {
+		httpapi.Render(w, http.StatusOK, d, r.Context())
+	}
+}
+
+func (a *adminAPI) handleDeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := a.dead.repo.DeleteDeadLetter(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		httpapi.RespondWithError(w, weather.CodeNotFound, "dead letter not found", r.Context())
+		return
+	}
+	if err != nil {
+		errlog.Printf("Error deleting dead letter: %v", err)
+		httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", r.Context())
+		return
+	}
+	a.auditLog.Record(r.Context(), "admin", "dead_letter.delete", "success", map[string]string{"id": id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReplayDeadLetter replays one dead letter and reports the outcome.
+func (a *adminAPI) handleReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	d, ok := a.loadDeadLetter(w, r)
+	if !ok {
+		return
+	}
+	res := a.replayDeadLetter(r.Context(), d)
+	if res.Reason == errJobUnfinished.Error() {
+		httpapi.RespondWithError(w, weather.CodeInvalidRequest, res.Reason, r.Context())
+		return
+	}
+	httpapi.Render(w, http.StatusOK, res, r.Context())
+}
+
+// handleReplayDeadLetters replays the dead letters of ?kind=, or all of
+// them, oldest first, and reports the outcome of each.
+func (a *adminAPI) handleReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	list, err := a.dead.repo.ListDeadLetters(r.Context(), r.URL.Query().Get("kind"), limit)
+	if err != nil {
+		errlog.Printf("Error listing dead letters: %v", err)
+		httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", r.Context())
+		return
+	}
+	results := make([]deadLetterReplay, 0, len(list))
+	for _, d := range list {
+		results = append(results, a.replayDeadLetter(r.Context(), d))
+	}
+	httpapi.Render(w, http.StatusOK, results, r.Context())
+}
+
+func (a *adminAPI) replayDeadLetter(ctx context.Context, d DeadLetter) deadLetterReplay {
+	res := deadLetterReplay{ID: d.ID, Replayed: true}
+	outcome := "success"
+	if err := a.dead.Replay(ctx, d, a.notifier, a.jobs); err != nil {
+		res.Replayed, res.Reason = false, err.Error()
+		outcome = "failure"
+	}
+	a.auditLog.Record(ctx, "admin", "dead_letter.replay", outcome, map[string]string{"id": d.ID, "kind": d.Kind})
+	return res
+}
+
+func (a *adminAPI) loadDeadLetter(w http.ResponseWriter, r *http.Request) (DeadLetter, bool) {
+	d, err := a.dead.repo.GetDeadLetter(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, ErrNotFound) {
+		httpapi.RespondWithError(w, weather.CodeNotFound, "dead letter not found", r.Context())
+		return d, false
+	}
+	if err != nil {
+		errlog.Printf("Error loading dead letter: %v", err)
+		httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", r.Context())
+		return d, false
+	}
+	return d, true
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+// deadlineHeader carries the caller's remaining time budget as a relative
+// duration (e.g. "1500ms"), which avoids depending on synchronized clocks.
+const deadlineHeader = "X-Request-Deadline"
+
+// deadlineMiddleware bounds the request context by the budget forwarded by
+// the caller, so work is abandoned once the caller has given up.
+func deadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(deadlineHeader)
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		budget, err := time.ParseDuration(value)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if budget <= 0 {
+			httpapi.RespondWithError(w, weather.CodeUpstreamTimeout, "request timeout", r.Context())
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/fx"
+)
+
+// endpointSwitchMargin is how much faster another endpoint must be before
+// calls move to it, so that two endpoints about as fast don't take turns.
+const endpointSwitchMargin = 1.2
+
+// endpoint is one base URL an upstream API is served from.
+type endpoint struct {
+	region string
+	url    string
+	// latency is the moving average of the probes, valid once probed.
+	latency time.Duration
+	probed  bool
+	healthy bool
+}
+
+// endpointSet is where one upstream API is called: its public endpoint, or
+// the regional endpoints and mirrors PROVIDER_ENDPOINTS lists for it. The
+// endpoints are probed continuously and calls go to the fastest healthy
+// one, so a deployment near a regional mirror stops crossing the ocean for
+// every call; when it fails, calls move to the next fastest.
+type endpointSet struct {
+	api string
+
+	mu        sync.RWMutex
+	endpoints []*endpoint
+	current   int
+}
+
+// upstreamEndpoints holds the endpoint sets of the configured providers,
+// for the prober and /admin/endpoints.
+var upstreamEndpoints = &endpointRegistry{sets: make(map[string]*endpointSet)}
+
+type endpointRegistry struct {
+	mu   sync.Mutex
+	sets map[string]*endpointSet
+}
+
+// parseProviderEndpoints reads PROVIDER_ENDPOINTS, written as
+// "api=region@url,region@url;api=url". The region is a label for logs and
+// metrics; without one an endpoint is named after its host.
+func parseProviderEndpoints(s string) (map[string][]*endpoint, error) {
+	out := make(map[string][]*endpoint)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		api, list, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid PROVIDER_ENDPOINTS entry %q, want api=url,url", item)
+		}
+		api = strings.TrimSpace(api)
+		for _, spec := range splitList(list) {
+			e := &endpoint{url: spec, healthy: true}
+			if region, u, ok := strings.Cut(spec, "@"); ok && !strings.Contains(region, "://") {
+				e.region, e.url = region, u
+			}
+			if !strings.HasPrefix(e.url, "http://") && !strings.HasPrefix(e.url, "https://") {
+				return nil, fmt.Errorf("invalid endpoint %q for %s in PROVIDER_ENDPOINTS", spec, api)
+			}
+			e.url = strings.TrimSuffix(e.url, "/")
+			if e.region == "" {
+				e.region = hostOf(e.url)
+			}
+			out[api] = append(out[api], e)
+		}
+	}
+	return out, nil
+}
+
+func hostOf(rawURL string) string {
+	_, rest, _ := strings.Cut(rawURL, "://")
+	host, _, _ := strings.Cut(rest, "/")
+	return host
+}
+
+// newEndpointSet returns the endpoints of api, as PROVIDER_ENDPOINTS lists
+// them, or defaultURL, its public endpoint.
+func newEndpointSet(cfg config, api, defaultURL string) (*endpointSet, error) {
+	specs, err := parseProviderEndpoints(cfg.ProviderEndpoints)
+	if err != nil {
+		return nil, err
+	}
+	s := &endpointSet{api: api, endpoints: specs[api]}
+	if len(s.endpoints) == 0 {
+		s.endpoints = []*endpoint{{region: "default", url: defaultURL, healthy: true}}
+	}
+	upstreamEndpoints.mu.Lock()
+	upstreamEndpoints.sets[api] = s
+	upstreamEndpoints.mu.Unlock()
+	return s, nil
+}
+
+// URL returns the base URL, without a trailing slash, to call api at.
+func (s *endpointSet) URL() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.endpoints[s.current].url
+}
+
+// probe measures each endpoint and picks the one to call.
+func (s *endpointSet) probe(ctx context.Context, client *http.Client) {
+	s.mu.RLock()
+	endpoints := slices.Clone(s.endpoints)
+	s.mu.RUnlock()
+
+	type result struct {
+		latency time.Duration
+		err     error
+	}
+	results := make([]result, len(endpoints))
+	var wg sync.WaitGroup
+	for i, e := range endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].latency, results[i].err = probeEndpoint(ctx, client, e.url)
+		}()
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range endpoints {
+		r := results[i]
+		if r.err != nil {
+			if e.healthy {
+				errlog.Printf("Endpoint %s of %s failed its probe: %v", e.region, s.api, r.err)
+			}
+			e.healthy = false
+			continue
+		}
+		if !e.healthy {
+			log.Printf("Endpoint %s of %s is back", e.region, s.api)
+		}
+		e.healthy = true
+		if !e.probed {
+			e.latency, e.probed = r.latency, true
+		} else {
+			e.latency = (e.latency*7 + r.latency*3) / 10
+		}
+	}
+	s.selectLocked()
+}
+
+// selectLocked moves calls to the fastest healthy endpoint, if the current
+// one failed or the other is faster by endpointSwitchMargin.
+func (s *endpointSet) selectLocked() {
+	best := -1
+	for i, e := range s.endpoints {
+		if e.healthy && e.probed && (best < 0 || e.latency < s.endpoints[best].latency) {
+			best = i
+		}
+	}
+	if best < 0 || best == s.current {
+		return
+	}
+	cur, next := s.endpoints[s.current], s.endpoints[best]
+	if cur.healthy && cur.probed && float64(cur.latency) <= float64(next.latency)*endpointSwitchMargin {
+		return
+	}
+	log.Printf("Routing %s to %s (%s, %s) instead of %s (%s)", s.api, next.region, next.url,
+		next.latency.Round(time.Millisecond), cur.region, describeEndpoint(cur))
+	s.current = best
+}
+
+func describeEndpoint(e *endpoint) string {
+	switch {
+	case !e.healthy:
+		return "failing"
+	case !e.probed:
+		return "not probed yet"
+	}
+	return e.latency.Round(time.Millisecond).String()
+}
+
+// probeEndpoint times a request to the root of baseURL. Any answer short of
+// a server error means the endpoint is up.
+func probeEndpoint(ctx context.Context, client *http.Client, baseURL string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, baseURL+"/", nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return time.Since(start), nil
+}
+
+// probed returns the sets with a choice to make.
+func (r *endpointRegistry) probed() []*endpointSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sets []*endpointSet
+	for _, s := range r.sets {
+		if len(s.endpoints) > 1 {
+			sets = append(sets, s)
+		}
+	}
+	return sets
+}
+
+type endpointStatus struct {
+	Region    string   `json:"region"`
+	URL       string   `json:"url"`
+	Healthy   bool     `json:"healthy"`
+	LatencyMs *float64 `json:"latency_ms,omitempty"`
+	Selected  bool     `json:"selected"`
+}
+
+type endpointSetStatus struct {
+	API       string           `json:"api"`
+	Endpoints []endpointStatus `json:"endpoints"`
+}
+
+// Statuses reports every set, sorted by API.
+func (r *endpointRegistry) Statuses() []endpointSetStatus {
+	r.mu.Lock()
+	sets := make([]*endpointSet, 0, len(r.sets))
+	for _, s := range r.sets {
+		sets = append(sets, s)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(sets, func(a, b *endpointSet) int { return strings.Compare(a.api, b.api) })
+
+	out := make([]endpointSetStatus, 0, len(sets))
+	for _, s := range sets {
+		s.mu.RLock()
+		st := endpointSetStatus{API: s.api}
+		for i, e := range s.endpoints {
+			es := endpointStatus{Region: e.region, URL: e.url, Healthy: e.healthy, Selected: i == s.current}
+			if e.probed {
+				ms := float64(e.latency.Microseconds()) / 1000
+				es.LatencyMs = &ms
+			}
+			st.Endpoints = append(st.Endpoints, es)
+		}
+		s.mu.RUnlock()
+		out = append(out, st)
+	}
+	return out
+}
+
+// handleEndpoints serves GET /admin/endpoints.
+func handleEndpoints(w http.ResponseWriter, r *http.Request) {
+	httpapi.Render(w, http.StatusOK, upstreamEndpoints.Statuses(), r.Context())
+}
+
+// startEndpointProbes probes, every PROVIDER_ENDPOINT_PROBE_INTERVAL, the
+// APIs with more than one endpoint. It takes the provider chains so that
+// their endpoint sets exist by then.
+func startEndpointProbes(lc fx.Lifecycle, cfg config, _ *cepChain, _ *weatherChain, meter metric.Meter) error {
+	specs, err := parseProviderEndpoints(cfg.ProviderEndpoints)
+	if err != nil {
+		return err
+	}
+	upstreamEndpoints.mu.Lock()
+	for api := range specs {
+		if _, ok := upstreamEndpoints.sets[api]; !ok {
+			log.Printf("Ignoring PROVIDER_ENDPOINTS for %s: no provider in use calls it", api)
+		}
+	}
+	upstreamEndpoints.mu.Unlock()
+
+	sets := upstreamEndpoints.probed()
+	if len(sets) == 0 || cfg.EndpointProbeInterval <= 0 {
+		return nil
+	}
+	registerEndpointMetrics(meter)
+	// Probes are not traced: a span per endpoint every few seconds would
+	// only add noise. Connections are kept alive, so probes time the round
+	// trip rather than the TLS handshake.
+	client := &http.Client{Timeout: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lc.Append(fx.StartStopHook(
+		func() {
+			go func() {
+				defer close(done)
+				ticker := time.NewTicker(cfg.EndpointProbeInterval)
+				defer ticker.Stop()
+				for {
+					for _, s := range sets {
+						s.probe(ctx, client)
+					}
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+				}
+			}()
+		},
+		func() {
+			cancel()
+			<-done
+		},
+	))
+	return nil
+}
+
+func registerEndpointMetrics(meter metric.Meter) {
+	latency, err := meter.Float64ObservableGauge("provider.endpoint.latency",
+		metric.WithDescription("Moving average of the probe round trip to each endpoint of an upstream API"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		log.Printf("Error creating endpoint latency gauge: %v", err)
+		return
+	}
+	selected, err := meter.Int64ObservableGauge("provider.endpoint.selected",
+		metric.WithDescription("1 for the endpoint of each upstream API calls go to"),
+	)
+	if err != nil {
+		log.Printf("Error creating endpoint selection gauge: %v", err)
+		return
+	}
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		for _, s := range upstreamEndpoints.Statuses() {
+			for _, e := range s.Endpoints {
+				attrs := metric.WithAttributes(attribute.String("provider", s.API), attribute.String("region", e.Region))
+				if e.LatencyMs != nil {
+					o.ObserveFloat64(latency, *e.LatencyMs/1000, attrs)
+				}
+				var v int64
+				if e.Selected {
+					v = 1
+				}
+				o.ObserveInt64(selected, v, attrs)
+			}
+		}
+		return nil
+	}, latency, selected)
+	if err != nil {
+		log.Printf("Error registering endpoint metrics: %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// healthConfig tunes provider health scoring. A provider is demoted once
+// its score over the last Window calls drops below DemoteScore (with at
+// least MinSamples calls seen), and restored after RecoveryProbes probes
+// in a row succeed. Probes run every ProbeInterval, unless CRON_SCHEDULE
+// says otherwise. A zero DemoteScore or ProbeInterval disables demotion.
+type healthConfig struct {
+	Window         int
+	MinSamples     int
+	DemoteScore    float64
+	SlowLatency    time.Duration
+	ProbeInterval  time.Duration
+	RecoveryProbes int
+	// ProbeCity is the city recovery probes ask weather providers for.
+	ProbeCity string
+}
+
+type providerState string
+
+const (
+	providerHealthy providerState = "healthy"
+	providerDemoted providerState = "demoted"
+)
+
+// maxHealthTransitions bounds the transition history kept for /stats.
+const maxHealthTransitions = 50
+
+type healthSample struct {
+	failed  bool
+	latency time.Duration
+}
+
+// trackedProvider is the rolling health of one provider.
+type trackedProvider struct {
+	kind, name string
+	probe      func(ctx context.Context) error
+
+	mu        sync.Mutex
+	samples   []healthSample
+	next      int
+	count     int
+	state     providerState
+	since     time.Time
+	recovered int
+}
+
+// stats returns the score, error rate and mean latency of the window. The
+// score is the success rate, scaled down when the mean latency exceeds
+// slow. Callers hold p.mu.
+func (p *trackedProvider) stats(slow time.Duration) (score, errorRate float64, avgLatency time.Duration) {
+	if p.count == 0 {
+		return 1, 0, 0
+	}
+	var failures int
+	var total time.Duration
+	for _, s := range p.samples[:p.count] {
+		if s.failed {
+			failures++
+		}
+		total += s.latency
+	}
+	errorRate = float64(failures) / float64(p.count)
+	avgLatency = total / time.Duration(p.count)
+	score = 1 - errorRate
+	if slow > 0 && avgLatency > slow {
+		score *= float64(slow) / float64(avgLatency)
+	}
+	return score, errorRate, avgLatency
+}
+
+// P95 returns the 95th percentile latency of the successful calls in the
+// window, or zero when there are none.
+func (p *trackedProvider) P95() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.p95()
+}
+
+func (p *trackedProvider) p95() time.Duration {
+	return p.percentiles(95)[0]
+}
+
+// percentiles returns the given percentiles of the latency of the
+// successful calls in the window, zero when there are none. Callers hold
+// p.mu.
+func (p *trackedProvider) percentiles(ps ...int) []time.Duration {
+	var latencies []time.Duration
+	for _, s := range p.samples[:p.count] {
+		if !s.failed {
+			latencies = append(latencies, s.latency)
+		}
+	}
+	out := make([]time.Duration, len(ps))
+	if len(latencies) == 0 {
+		return out
+	}
+	slices.Sort(latencies)
+	for i, q := range ps {
+		out[i] = latencies[(len(latencies)*q+99)/100-1]
+	}
+	return out
+}
+
+// Healthy reports whether the provider should be asked before the demoted
+// ones.
+func (p *trackedProvider) Healthy() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state == providerHealthy
+}
+
+// healthTracker scores the providers of both chains from the calls they
+// serve, and probes the demoted ones until they recover.
+type healthTracker struct {
+	cfg healthConfig
+
+	mu          sync.Mutex
+	providers   []*trackedProvider
+	transitions []healthTransition
+
+	transitioned metric.Int64Counter
+}
+
+type healthTransition struct {
+	Time   time.Time     `json:"time"`
+	Kind   string        `json:"kind"`
+	Name   string        `json:"name"`
+	From   providerState `json:"from"`
+	To     providerState `json:"to"`
+	Reason string        `json:"reason"`
+}
+
+type providerHealthStatus struct {
+	Kind         string        `json:"kind"`
+	Name         string        `json:"name"`
+	State        providerState `json:"state"`
+	Since        time.Time     `json:"since"`
+	Score        float64       `json:"score"`
+	ErrorRate    float64       `json:"error_rate"`
+	AvgLatencyMs float64       `json:"avg_latency_ms"`
+	P95LatencyMs float64       `json:"p95_latency_ms"`
+	Samples      int           `json:"samples"`
+}
+
+type healthSnapshot struct {
+	Providers   []providerHealthStatus `json:"providers"`
+	Transitions []healthTransition     `json:"transitions"`
+}
+
+func newHealthTracker(cfg healthConfig, meter metric.Meter) *healthTracker {
+	if cfg.Window < 1 {
+		cfg.Window = 1
+	}
+	if cfg.ProbeInterval <= 0 {
+		cfg.DemoteScore = 0
+	}
+	t := &healthTracker{cfg: cfg}
+
+	var err error
+	t.transitioned, err = meter.Int64Counter("provider.health.transitions",
+		metric.WithDescription("Provider demotions and restorations, by provider and new state"),
+		metric.WithUnit("{transition}"),
+	)
+	if err != nil {
+		log.Printf("Failed to create provider health counter: %v", err)
+	}
+	_, err = meter.Float64ObservableGauge("provider.health.score",
+		metric.WithDescription("Rolling health score of each provider, from 0 to 1"),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			for _, s := range t.Snapshot().Providers {
+				o.Observe(s.Score, metric.WithAttributes(attribute.String("provider", s.Name)))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		log.Printf("Failed to create provider health gauge: %v", err)
+	}
+	return t
+}
+
+// Register starts tracking a provider. probe is called while the provider
+// is demoted to tell whether it has recovered.
+func (t *healthTracker) Register(kind, name string, probe func(ctx context.Context) error) *trackedProvider {
+	p := &trackedProvider{
+		kind:    kind,
+		name:    name,
+		probe:   probe,
+		samples: make([]healthSample, t.cfg.Window),
+		state:   providerHealthy,
+		since:   clock.Now(),
+	}
+	t.mu.Lock()
+	t.providers = append(t.providers, p)
+	t.mu.Unlock()
+	return p
+}
+
+// Observe records the outcome of one call to p and demotes it when its
+// score falls below the threshold. A not-found answer counts as a success:
+// the provider responded.
+func (t *healthTracker) Observe(p *trackedProvider, err error, latency time.Duration) {
+	failed := err != nil && !errors.Is(err, apperrors.ErrCepNotFound)
+
+	p.mu.Lock()
+	p.samples[p.next] = healthSample{failed: failed, latency: latency}
+	p.next = (p.next + 1) % len(p.samples)
+	if p.count < len(p.samples) {
+		p.count++
+	}
+	if p.state != providerHealthy || p.count < t.cfg.MinSamples {
+		p.mu.Unlock()
+		return
+	}
+	score, errorRate, avgLatency := p.stats(t.cfg.SlowLatency)
+	if score >= t.cfg.DemoteScore {
+		p.mu.Unlock()
+		return
+	}
+	p.state, p.since, p.recovered = providerDemoted, clock.Now(), 0
+	p.mu.Unlock()
+
+	t.transition(p, providerHealthy, providerDemoted, fmt.Sprintf("score %.2f below %.2f (error rate %.2f, avg latency %s)",
+		score, t.cfg.DemoteScore, errorRate, avgLatency.Round(time.Millisecond)))
+}
+
+func (t *healthTracker) transition(p *trackedProvider, from, to providerState, reason string) {
+	log.Printf("Provider %s/%s %s -> %s: %s", p.kind, p.name, from, to, reason)
+	if t.transitioned != nil {
+		t.transitioned.Add(context.Background(), 1, metric.WithAttributes(
+			attribute.String("provider", p.name),
+			attribute.String("state", string(to)),
+		))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.transitions = append(t.transitions, healthTransition{
+		Time: clock.Now(), Kind: p.kind, Name: p.name, From: from, To: to, Reason: reason,
+	})
+	if len(t.transitions) > maxHealthTransitions {
+		t.transitions = t.transitions[len(t.transitions)-maxHealthTransitions:]
+	}
+}
+
+// ProbeDemoted probes each demoted provider once. It runs as the
+// provider_health_probes cron task.
+func (t *healthTracker) ProbeDemoted(ctx context.Context) error {
+	t.mu.Lock()
+	providers := append([]*trackedProvider(nil), t.providers...)
+	t.mu.Unlock()
+	for _, p := range providers {
+		if !p.Healthy() {
+			t.probe(ctx, p)
+		}
+	}
+	return nil
+}
+
+func (t *healthTracker) probe(ctx context.Context, p *trackedProvider) {
+	probeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	err := p.probe(probeCtx)
+	cancel()
+	if err != nil && !errors.Is(err, apperrors.ErrCepNotFound) {
+		p.mu.Lock()
+		p.recovered = 0
+		p.mu.Unlock()
+		log.Printf("Recovery probe of %s/%s failed: %v", p.kind, p.name, err)
+		return
+	}
+
+	p.mu.Lock()
+	p.recovered++
+	if p.recovered < t.cfg.RecoveryProbes {
+		p.mu.Unlock()
+		return
+	}
+	p.state, p.since, p.recovered = providerHealthy, clock.Now(), 0
+	p.next, p.count = 0, 0
+	p.mu.Unlock()
+
+	t.transition(p, providerDemoted, providerHealthy, fmt.Sprintf("%d recovery probes succeeded", t.cfg.RecoveryProbes))
+}
+
+// Snapshot reports the current health of every provider and the latest
+// transitions, oldest first.
+func (t *healthTracker) Snapshot() healthSnapshot {
+	t.mu.Lock()
+	providers := append([]*trackedProvider(nil), t.providers...)
+	snap := healthSnapshot{Transitions: append([]healthTransition{}, t.transitions...)}
+	t.mu.Unlock()
+
+	snap.Providers = make([]providerHealthStatus, 0, len(providers))
+	for _, p := range providers {
+		p.mu.Lock()
+		score, errorRate, avgLatency := p.stats(t.cfg.SlowLatency)
+		snap.Providers = append(snap.Providers, providerHealthStatus{
+			Kind:         p.kind,
+			Name:         p.name,
+			State:        p.state,
+			Since:        p.since,
+			Score:        score,
+			ErrorRate:    errorRate,
+			AvgLatencyMs: float64(avgLatency.Microseconds()) / 1000,
+			P95LatencyMs: float64(p.p95().Microseconds()) / 1000,
+			Samples:      p.count,
+		})
+		p.mu.Unlock()
+	}
+	return snap
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type invalidationMessage struct {
+	Key    string `json:"key"`
+	Origin string `json:"origin"`
+}
+
+// redisInvalidator fans cache invalidations out to the other replicas over
+// a Redis pub/sub channel.
+type redisInvalidator struct {
+	client  *redis.Client
+	channel string
+	origin  string
+}
+
+func newRedisClient(redisURL string) (*redis.Client, error) {
+	if !strings.Contains(redisURL, "://") {
+		redisURL = "redis://" + redisURL
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return redis.NewClient(opts), nil
+}
+
+func newRedisInvalidator(redisURL, channel string) (*redisInvalidator, error) {
+	client, err := newRedisClient(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &redisInvalidator{
+		client:  client,
+		channel: channel,
+		origin:  hex.EncodeToString(id),
+	}, nil
+}
+
+func (r *redisInvalidator) Publish(ctx context.Context, key string) error {
+	payload, err := json.Marshal(invalidationMessage{Key: key, Origin: r.origin})
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, r.channel, payload).Err()
+}
+
+// Listen applies invalidations published by other replicas to c until ctx
+// is done. The subscription reconnects on its own after Redis failures.
+func (r *redisInvalidator) Listen(ctx context.Context, c *lookupCache) {
+	sub := r.client.Subscribe(ctx, r.channel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var m invalidationMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+				log.Printf("Ignoring malformed cache invalidation: %v", err)
+				continue
+			}
+			if m.Origin == r.origin {
+				continue
+			}
+			if m.Key == "" {
+				c.dropAll()
+			} else {
+				c.drop(m.Key)
+			}
+		}
+	}
+}
+
+func (r *redisInvalidator) Close() error {
+	return r.client.Close()
+}
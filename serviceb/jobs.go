@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/shedding"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	jobLookup      = "lookup"
+	jobCacheImport = "cache_import"
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// jobCheckpointEvery is how many CEPs a job processes between progress
+// writes; a restarted job resumes from its last checkpoint.
+const jobCheckpointEvery = 25
+
+// jobRunner processes asynchronous batches of CEPs on the worker pool. Jobs
+// are persisted before they are queued and checkpointed while they run, so
+// the ones interrupted by a restart are picked up again on start.
+type jobRunner struct {
+	jobs        JobRepository
+	dead        *deadLetterQueue
+	pool        *workerPool
+	resolver    *weatherResolver
+	strictness  cep.Strictness
+	masker      *masking.Masker
+	timeout     time.Duration
+	itemTimeout time.Duration
+	tracer      trace.Tracer
+
+	cancel context.CancelFunc
+}
+
+func newJobRunner(jobs JobRepository, dead *deadLetterQueue, pool *workerPool, resolver *weatherResolver, strictness cep.Strictness, masker *masking.Masker, timeout, itemTimeout time.Duration, tracer trace.Tracer) *jobRunner {
+	return &jobRunner{
+		jobs:        jobs,
+		dead:        dead,
+		pool:        pool,
+		resolver:    resolver,
+		strictness:  strictness,
+		masker:      masker,
+		timeout:     timeout,
+		itemTimeout: itemTimeout,
+		tracer:      tracer,
+	}
+}
+
+// Start requeues the unfinished jobs. They may outnumber the free queue
+// slots, so they are fed in the background as room frees up.
+func (jr *jobRunner) Start(ctx context.Context) error {
+	pending, err := jr.jobs.ListUnfinishedJobs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load unfinished jobs: %w", err)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	log.Printf("Resuming %d unfinished jobs", len(pending))
+	resumeCtx, cancel := context.WithCancel(context.Background())
+	jr.cancel = cancel
+	go func() {
+		for _, j := range pending {
+			id := j.ID
+			if err := jr.pool.SubmitWait(resumeCtx, "job", jr.timeout, func(ctx context.Context) { jr.run(ctx, id) }); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends the resumption of unfinished jobs; the pool drains the rest.
+func (jr *jobRunner) Stop() {
+	if jr.cancel != nil {
+		jr.cancel()
+	}
+}
+
+// Submit queues a stored job.
+func (jr *jobRunner) Submit(id string) error {
+	return jr.pool.Submit("job", jr.timeout, func(ctx context.Context) { jr.run(ctx, id) })
+}
+
+func (jr *jobRunner) run(ctx context.Context, id string) {
+	ctx, span := jr.tracer.Start(ctx, "run_job", trace.WithNewRoot(), trace.WithAttributes(attribute.String("job.id", id)))
+	defer span.End()
+
+	j, err := jr.jobs.GetJob(ctx, id)
+	if err != nil {
+		errlog.Printf("Error loading job %s: %v", id, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.SetAttributes(
+		attribute.String("job.kind", j.Kind),
+		attribute.Int("job.total", j.Total),
+		attribute.Int("job.resumed_at", len(j.Results)),
+		attribute.String("job.origin_trace_id", j.TraceID),
+	)
+
+	j.Status = jobRunning
+	j.UpdatedAt = clock.Now()
+	if err := jr.jobs.UpdateJob(ctx, j); err != nil {
+		errlog.Printf("Error updating job %s: %v", id, err)
+	}
+
+	for i := len(j.Results); i < len(j.Ceps); i++ {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			jr.fail(j, "job timed out")
+			span.SetStatus(codes.Error, "job timed out")
+			return
+		}
+		if ctx.Err() != nil {
+			// Shutting down: the job stays running and resumes on start,
+			// from the progress saved here.
+			jr.interrupted(j)
+			return
+		}
+		var r JobResult
+		if j.Kind == jobCacheImport {
+			var city string
+			if i < len(j.Cities) {
+				city = j.Cities[i]
+			}
+			r = jr.warm(ctx, j.Ceps[i], city)
+		} else {
+			r = jr.lookup(ctx, j.Ceps[i])
+		}
+		if r.Error != "" && ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// Cut short by a shutdown: the item is redone on resume.
+			jr.interrupted(j)
+			return
+		}
+		if r.Error != "" {
+			j.Failed++
+			// Items failed by a provider are dead-lettered for a replay.
+			if r.Error.Retryable() && ctx.Err() == nil {
+				jr.deadLetter(ctx, j, i, r.Error)
+			}
+		}
+		j.Results = append(j.Results, r)
+		j.Completed = len(j.Results)
+
+		if j.Completed%jobCheckpointEvery == 0 && j.Completed < j.Total {
+			j.UpdatedAt = clock.Now()
+			if err := jr.jobs.UpdateJob(ctx, j); err != nil {
+				errlog.Printf("Error checkpointing job %s: %v", id, err)
+			}
+		}
+	}
+
+	now := clock.Now()
+	j.Status = jobSucceeded
+	j.Ceps, j.Cities = nil, nil
+	j.UpdatedAt, j.FinishedAt = now, &now
+	if err := jr.jobs.UpdateJob(ctx, j); err != nil {
+		errlog.Printf("Error finishing job %s: %v", id, err)
+	}
+	span.SetAttributes(attribute.Int("job.failed", j.Failed))
+}
+
+func (jr *jobRunner) deadLetter(ctx context.Context, j Job, i int, code weather.ErrorCode) {
+	l := jobItemLetter{JobID: j.ID, Kind: j.Kind, Index: i, Cep: j.Ceps[i]}
+	if i < len(j.Cities) {
+		l.City = j.Cities[i]
+	}
+	subject := fmt.Sprintf("item %d of %s job %s (CEP %s)", i, j.Kind, j.ID, jr.masker.Cep(l.Cep))
+	jr.dead.Add(ctx, deadLetterJobItem, subject, l, errors.New(string(code)))
+}
+
+// interrupted checkpoints j when the shutdown cancels it, so that it
+// resumes where it stopped rather than at its last periodic checkpoint. It
+// writes with a fresh context, since the job's own is cancelled.
+func (jr *jobRunner) interrupted(j Job) {
+	log.Printf("Job %s interrupted by shutdown at %d/%d, resuming on start", j.ID, j.Completed, j.Total)
+	j.UpdatedAt = clock.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := jr.jobs.UpdateJob(ctx, j); err != nil {
+		errlog.Printf("Error checkpointing job %s: %v", j.ID, err)
+	}
+}
+
+// fail finishes j as failed. It writes with a fresh context, since the
+// job's own may be past its deadline.
+func (jr *jobRunner) fail(j Job, reason string) {
+	now := clock.Now()
+	j.Status, j.Error, j.Ceps, j.Cities = jobFailed, reason, nil, nil
+	j.UpdatedAt, j.FinishedAt = now, &now
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := jr.jobs.UpdateJob(ctx, j); err != nil {
+		errlog.Printf("Error updating job %s: %v", j.ID, err)
+	}
+}
+
+// lookup resolves one CEP of a job. Failures are recorded in the result
+// with the error code the synchronous API would have answered.
+func (jr *jobRunner) lookup(ctx context.Context, cep string) JobResult {
+	r := JobResult{Cep: cep}
+	if !isValidCep(cep, jr.strictness) {
+		r.Error = weather.CodeInvalidZipcode
+		return r
+	}
+	if jr.itemTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, jr.itemTimeout)
+		defer cancel()
+	}
+
+	city, err := jr.resolver.City(ctx, cep)
+	if err != nil {
+		r.Error = lookupErrorCode(err)
+		return r
+	}
+	r.City = city
+	obs, err := jr.resolver.Weather(ctx, city)
+	if err != nil {
+		r.Error = lookupErrorCode(err)
+		return r
+	}
+	temp := weather.Temperature{Value: obs.TempC, Unit: weather.Celsius}
+	tempC, tempF, tempK := temp.Celsius(), temp.Fahrenheit(), temp.Kelvin()
+	r.TempC, r.TempF, r.TempK = &tempC, &tempF, &tempK
+	r.Condition = obs.Condition
+	return r
+}
+
+// warm caches the city of one CEP of a cache import: the given one, or
+// else the one the CEP providers resolve.
+func (jr *jobRunner) warm(ctx context.Context, cep, city string) JobResult {
+	r := JobResult{Cep: cep}
+	if !isValidCep(cep, jr.strictness) {
+		r.Error = weather.CodeInvalidZipcode
+		return r
+	}
+	if city != "" {
+		jr.resolver.Remember(cep, city)
+		r.City = city
+		return r
+	}
+	if jr.itemTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, jr.itemTimeout)
+		defer cancel()
+	}
+
+	city, err := jr.resolver.City(ctx, cep)
+	if err != nil {
+		r.Error = lookupErrorCode(err)
+		return r
+	}
+	r.City = city
+	return r
+}
+
+// lookupErrorCode maps a lookup failure to its API error code.
+func lookupErrorCode(err error) weather.ErrorCode {
+	return apperrors.CodeOf(err)
+}
+
+type createJobRequest struct {
+	Ceps []string `json:"ceps"`
+}
+
+// handleCreateJob stores a batch lookup and queues it, answering 202 with
+// the job right away; GET /jobs/{id} follows its progress.
+func handleCreateJob(jr *jobRunner, maxCeps int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var req createJobRequest
+		if err := httpapi.DecodeRequest(r, &req); err != nil {
+			httpapi.RespondWithDecodeError(w, err, weather.CodeInvalidRequest, "invalid request body", ctx)
+			return
+		}
+		if len(req.Ceps) == 0 {
+			httpapi.RespondWithError(w, weather.CodeInvalidRequest, "ceps must not be empty", ctx)
+			return
+		}
+		if len(req.Ceps) > maxCeps {
+			httpapi.RespondWithError(w, weather.CodeInvalidRequest, fmt.Sprintf("at most %d ceps per job", maxCeps), ctx)
+			return
+		}
+
+		startJob(w, r, jr, jobLookup, req.Ceps, nil)
+	}
+}
+
+// startJob stores a job of kind over ceps and queues it, answering 202
+// with the job right away; GET /jobs/{id} follows its progress. It
+// reports whether the job was queued.
+func startJob(w http.ResponseWriter, r *http.Request, jr *jobRunner, kind string, ceps, cities []string) (Job, bool) {
+	ctx := r.Context()
+	now := clock.Now()
+	j := Job{
+		ID:        randomHex(16),
+		Kind:      kind,
+		Status:    jobQueued,
+		Ceps:      ceps,
+		Cities:    cities,
+		Total:     len(ceps),
+		Results:   []JobResult{},
+		TraceID:   trace.SpanFromContext(ctx).SpanContext().TraceID().String(),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := jr.jobs.CreateJob(ctx, j); err != nil {
+		errlog.Printf("Error creating job: %v", err)
+		httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", ctx)
+		return j, false
+	}
+	if err := jr.Submit(j.ID); err != nil {
+		jr.fail(j, err.Error())
+		httpapi.SetRetryAfter(w, shedding.RetryAfter)
+		httpapi.RespondWithError(w, weather.CodeOverloaded, "job queue is full", ctx)
+		return j, false
+	}
+
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	httpapi.Render(w, http.StatusAccepted, j, ctx)
+	return j, true
+}
+
+func handleGetJob(jobs JobRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		j, err := jobs.GetJob(r.Context(), chi.URLParam(r, "id"))
+		if errors.Is(err, ErrNotFound) {
+			httpapi.RespondWithError(w, weather.CodeNotFound, "job not found", r.Context())
+			return
+		}
+		if err != nil {
+			errlog.Printf("Error loading job: %v", err)
+			httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", r.Context())
+			return
+		}
+		j.Completed = len(j.Results)
+		if !httpapi.StreamsJSON(r.Context()) {
+			httpapi.Render(w, http.StatusOK, j, r.Context())
+			return
+		}
+		// A job holds up to JOB_MAX_CEPS results: stream them rather than
+		// encode the whole job in memory.
+		results := j.Results
+		j.Results = []JobResult{}
+		stream := httpapi.NewResponseStream(w, http.StatusOK, httpapi.JSONContentType)
+		if err := stream.EncodeWithArray(j, "results", len(results), func(i int) any { return results[i] }); err != nil {
+			errlog.Printf("Error streaming job: %v", err)
+		}
+	}
+}
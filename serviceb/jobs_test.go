@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+func TestJobResultKeepsRequestedCep(t *testing.T) {
+	// Masking hides CEPs from the logs, not from the caller who sent them.
+	masker, err := masking.New(string(masking.Truncate), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jr := &jobRunner{strictness: cep.Format, masker: masker}
+	for _, cep := range []string{"0100100a", "123"} {
+		for name, r := range map[string]JobResult{
+			"lookup": jr.lookup(context.Background(), cep),
+			"warm":   jr.warm(context.Background(), cep, ""),
+		} {
+			if r.Cep != cep {
+				t.Errorf("%s(%q): cep = %q, want the requested one", name, cep, r.Cep)
+			}
+			if r.Error != weather.CodeInvalidZipcode {
+				t.Errorf("%s(%q): error = %q, want %q", name, cep, r.Error, weather.CodeInvalidZipcode)
+			}
+		}
+	}
+}
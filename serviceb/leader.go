@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/buildinfo"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// renewLeaseScript extends the lease only while this replica still holds
+// it, so a leader that stalled past its TTL can't take back a lease another
+// replica acquired meanwhile.
+var renewLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLeaseScript deletes the lease only if this replica holds it.
+var releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// leaderElector elects, among the replicas sharing a Redis, the one that
+// runs the singleton cron tasks. The leader holds a lease, a key with a
+// TTL, and renews it every third of the TTL; when it dies, the lease
+// expires and the next replica to try takes over. A leader that can't
+// renew in time steps down before its lease runs out, so two replicas are
+// never leaders at once, clock drift aside.
+type leaderElector struct {
+	client *redis.Client
+	key    string
+	id     string
+	ttl    time.Duration
+
+	// leading and failing are only touched by the loop, and by Stop once
+	// it's done.
+	leading bool
+	failing bool
+	// expires is when the lease held runs out, in real Unix nanoseconds.
+	expires atomic.Int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newLeaderElector(redisURL, key string, ttl time.Duration, meter metric.Meter) (*leaderElector, error) {
+	client, err := newRedisClient(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	e := &leaderElector{
+		client: client,
+		key:    key,
+		id:     buildinfo.InstanceID,
+		ttl:    ttl,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	_, err = meter.Int64ObservableGauge("leader.is_leader",
+		metric.WithDescription("1 while this replica is the leader running the singleton cron tasks"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			var v int64
+			if e.IsLeader() {
+				v = 1
+			}
+			o.Observe(v)
+			return nil
+		}),
+	)
+	if err != nil {
+		log.Printf("Error creating leader gauge: %v", err)
+	}
+	return e, nil
+}
+
+// IsLeader reports whether this replica holds the lease. It turns false
+// as the lease runs out, even if the loop hasn't noticed yet.
+func (e *leaderElector) IsLeader() bool {
+	return time.Now().UnixNano() < e.expires.Load()
+}
+
+func (e *leaderElector) Start() {
+	go e.loop()
+}
+
+// Stop releases the lease, so another replica takes over right away rather
+// than once it expires.
+func (e *leaderElector) Stop(ctx context.Context) error {
+	close(e.stop)
+	<-e.done
+	if e.leading {
+		if err := releaseLeaseScript.Run(ctx, e.client, []string{e.key}, e.id).Err(); err != nil {
+			errlog.Printf("Error releasing leader lease: %v", err)
+		}
+		e.setLeader(false)
+	}
+	return e.client.Close()
+}
+
+// loop tries to acquire or renew the lease every third of its TTL. Real
+// time is used, not clock.Now: the lease expires in Redis, by its clock.
+func (e *leaderElector) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		e.campaign()
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *leaderElector) campaign() {
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+	defer cancel()
+	start := time.Now()
+
+	var held bool
+	var err error
+	if e.leading {
+		var n int64
+		n, err = renewLeaseScript.Run(ctx, e.client, []string{e.key}, e.id, e.ttl.Milliseconds()).Int64()
+		held = n == 1
+	} else {
+		held, err = e.client.SetNX(ctx, e.key, e.id, e.ttl).Result()
+	}
+	if err != nil && !e.failing {
+		errlog.Printf("Leader election failing, singleton cron tasks may not run: %v", err)
+	} else if err == nil && e.failing {
+		log.Printf("Leader election working again")
+	}
+	e.failing = err != nil
+
+	switch {
+	case err != nil && e.IsLeader():
+		// The lease is still ours until it expires; try again next tick.
+		errlog.Printf("Error renewing leader lease: %v", err)
+	case err != nil:
+		if e.leading {
+			errlog.Printf("Error renewing leader lease, stepping down: %v", err)
+		}
+		e.setLeader(false)
+	default:
+		if held {
+			// Counted from before the request, so we never outlive it.
+			e.expires.Store(start.Add(e.ttl).UnixNano())
+		}
+		e.setLeader(held)
+	}
+}
+
+func (e *leaderElector) setLeader(leader bool) {
+	if !leader {
+		e.expires.Store(0)
+	}
+	if e.leading == leader {
+		return
+	}
+	e.leading = leader
+	if leader {
+		log.Printf("Elected leader: running the singleton cron tasks")
+	} else {
+		log.Printf("No longer the leader: singleton cron tasks run elsewhere")
+	}
+}
@@ -2,301 +2,398 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
+	"embed"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/buildinfo"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/retry"
+	"github.com/joaolima7/otel-goexpert/pkg/sampling"
+	"github.com/joaolima7/otel-goexpert/pkg/server"
+	"github.com/joaolima7/otel-goexpert/pkg/slowrequest"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
-var (
-	weatherApiKey string
-	tracer        trace.Tracer
-)
-
-type CepRequest struct {
-	Cep string `json:"cep"`
-}
+// maxCityLength bounds the city of a request, in bytes; the longest city
+// name in Brazil is well under it.
+const maxCityLength = 100
 
-type ViaCepResponse struct {
-	Cep         string `json:"cep"`
-	Logradouro  string `json:"logradouro"`
-	Complemento string `json:"complemento"`
-	Bairro      string `json:"bairro"`
-	Localidade  string `json:"localidade"`
-	Uf          string `json:"uf"`
-	Ibge        string `json:"ibge"`
-	Gia         string `json:"gia"`
-	Ddd         string `json:"ddd"`
-	Siafi       string `json:"siafi"`
-	Erro        string `json:"erro,omitempty"`
-}
+func main() {
+	migrateOnly := flag.Bool("migrate", false, "apply pending storage migrations and exit")
+	flag.Parse()
 
-type WeatherResponse struct {
-	Location struct {
-		Name string `json:"name"`
-	} `json:"location"`
-	Current struct {
-		TempC float64 `json:"temp_c"`
-	} `json:"current"`
-}
+	cfg := loadConfig()
+	if err := clock.SetDeterministic(cfg.Deterministic); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	log.Printf("Service B %s (commit %s, built %s, %s)", buildinfo.Current.Version, buildinfo.Current.GitCommit, buildinfo.Current.BuildDate, buildinfo.Current.GoVersion)
 
-type WeatherResult struct {
-	City  string  `json:"city"`
-	TempC float64 `json:"temp_C"`
-	TempF float64 `json:"temp_F"`
-	TempK float64 `json:"temp_K"`
-}
+	if *migrateOnly {
+		if err := migrateStorage(cfg.StorageDriver, cfg.StorageDSN); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
 
-type ErrorResponse struct {
-	Message string `json:"message"`
-}
+	var (
+		srv    *http.Server
+		consul *consulRegistrar
+	)
+	app := fx.New(appOptions(cfg), fx.Populate(&srv, &consul))
 
-func main() {
-	weatherApiKey = getEnv("WEATHER_API_KEY", "bfbdabb82902462aaf4190220252008")
-	collectorURL := getEnv("OTEL_COLLECTOR_URL", "otel-collector:4317")
+	startCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := app.Start(startCtx); err != nil {
+		log.Fatalf("Failed to start: %v", err)
+	}
 
-	tp, err := initTracer(collectorURL)
+	fmt.Printf("Service B listening on %s...\n", cfg.Server.Addr)
+	deadline, err := server.Run(srv, cfg.Server, func(upgrading bool) {
+		// A successor re-registers under the same ID, so leave it alone.
+		if upgrading {
+			return
+		}
+		if err := consul.Deregister(context.Background()); err != nil {
+			log.Printf("Error deregistering from Consul: %v", err)
+		}
+	})
 	if err != nil {
-		log.Fatalf("Failed to initialize tracer: %v", err)
+		log.Printf("Server error: %v", err)
 	}
-	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := tp.Shutdown(ctx); err != nil {
-			log.Fatalf("Error shutting down tracer provider: %v", err)
-		}
-	}()
 
-	r := chi.NewRouter()
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
+	stopCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := app.Stop(stopCtx); err != nil {
+		log.Printf("Error during shutdown: %v", err)
+	}
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+}
 
-	r.Post("/weather", handleWeatherRequest)
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	httpapi.Render(w, http.StatusOK, healthResponse{Status: "ok"}, r.Context())
+}
 
-	port := getEnv("PORT", "8081")
-	fmt.Printf("Service B listening on port %s...\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+// weatherHandler looks up the weather of a CEP, or of a city. The lookups
+// of a CEP are counted in stats, stored in the history and checked against
+// the subscriptions of the CEP.
+type weatherHandler struct {
+	resolver *weatherResolver
+	stats    *queryStats
+	lookups  LookupRepository
+	subs     SubscriptionRepository
+	// outbox relays the weather updates of subscribed CEPs to MQTT and
+	// NATS; nil when both outputs are disabled.
+	outbox     *outboxRelay
+	notifier   *subscriptionNotifier
+	strictness cep.Strictness
+	masker     *masking.Masker
+	tracer     trace.Tracer
+	// cacheControl is the Cache-Control of the answers, from
+	// WEATHER_MAX_AGE.
+	cacheControl string
 }
 
-func handleWeatherRequest(w http.ResponseWriter, r *http.Request) {
-	ctx, span := tracer.Start(r.Context(), "handle_weather_request")
+func (h *weatherHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, span := h.tracer.Start(r.Context(), "handle_weather_request")
 	defer span.End()
 
-	var req CepRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusUnprocessableEntity, "invalid zipcode", ctx)
+	endValidate := slowrequest.StartPhase(ctx, "validate")
+	var req weather.Location
+	if err := httpapi.DecodeRequest(r, &req); err != nil {
+		httpapi.RespondWithDecodeError(w, err, weather.CodeInvalidZipcode, "invalid zipcode", ctx)
 		return
 	}
 
-	if !isValidCep(req.Cep) {
-		respondWithError(w, http.StatusUnprocessableEntity, "invalid zipcode", ctx)
-		return
+	byCity := req.Cep == "" && req.City != ""
+	if byCity {
+		req.City = strings.TrimSpace(req.City)
+		if req.City == "" || len(req.City) > maxCityLength {
+			httpapi.RespondWithError(w, weather.CodeInvalidZipcode, "invalid city", ctx)
+			return
+		}
+	} else {
+		c, err := cep.Normalize(req.Cep)
+		if err != nil || !isValidCep(c, h.strictness) {
+			httpapi.RespondWithError(w, weather.CodeInvalidZipcode, "invalid zipcode", ctx)
+			return
+		}
+		req.Cep = c
+		span.SetAttributes(attribute.String("cep", h.masker.Cep(req.Cep)))
+		if uf, ok := cep.UF(req.Cep); ok {
+			span.SetAttributes(attribute.String("cep.uf", uf))
+		}
 	}
-
-	location, err := getCepInfo(ctx, req.Cep)
-	if err != nil {
-		if errors.Is(err, ErrCepNotFound) {
-			log.Printf("CEP not found: %s", req.Cep)
-			respondWithError(w, http.StatusNotFound, "can not find zipcode", ctx)
+	endValidate()
+
+	location := req.City
+	if !byCity {
+		endCepLookup := slowrequest.StartPhase(ctx, "cep_lookup")
+		var err error
+		location, err = h.resolver.City(ctx, req.Cep)
+		endCepLookup()
+		if err != nil {
+			respondWithLookupError(w, err, "CEP "+h.masker.Cep(req.Cep), ctx)
 			return
 		}
-		log.Printf("Internal error processing CEP %s: %v", req.Cep, err)
-		respondWithError(w, http.StatusInternalServerError, "internal server error", ctx)
-		return
 	}
 
-	weather, err := getWeatherInfo(ctx, location)
+	endWeatherLookup := slowrequest.StartPhase(ctx, "weather_lookup")
+	obs, err := h.resolver.Weather(ctx, location)
+	endWeatherLookup()
 	if err != nil {
-		if errors.Is(err, ErrCepNotFound) {
-			log.Printf("Location not found in weather API: %s", location)
-			respondWithError(w, http.StatusNotFound, "can not find zipcode", ctx)
-			return
-		}
-		log.Printf("Internal error getting weather for %s: %v", location, err)
-		respondWithError(w, http.StatusInternalServerError, "internal server error", ctx)
+		respondWithLookupError(w, err, "weather for "+location, ctx)
 		return
 	}
 
-	tempC := weather.Current.TempC
-	tempF := celsiusToFahrenheit(tempC)
-	tempK := celsiusToKelvin(tempC)
+	h.stats.cities.Add(location)
 
-	result := WeatherResult{
-		City:  location,
-		TempC: tempC,
-		TempF: tempF,
-		TempK: tempK,
+	tempC := obs.TempC
+	result := weather.NewResult(location, weather.Temperature{Value: tempC, Unit: weather.Celsius})
+	result.Condition = obs.Condition
+	// The condition code is the answering provider's own, and means
+	// nothing without it.
+	if isExtended(r) {
+		result.ConditionCode, result.Provider = obs.ConditionCode, obs.Provider
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(result)
-}
-
-var (
-	ErrCepNotFound = errors.New("cep not found")
-)
-
-func getCepInfo(ctx context.Context, cep string) (string, error) {
-	ctx, span := tracer.Start(ctx, "get_cep_info")
-	defer span.End()
-
-	url := fmt.Sprintf("https://viacep.com.br/ws/%s/json/", cep)
-	client := http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	// Lookups and subscriptions are kept by CEP; a city has neither.
+	if !byCity {
+		h.stats.ceps.Add(req.Cep)
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return "", fmt.Errorf("error creating request: %w", err)
-	}
+		subs, err := h.subs.ListSubscriptionsByCep(ctx, req.Cep)
+		if err != nil {
+			errlog.Printf("Error loading subscriptions for CEP %s: %v", h.masker.Cep(req.Cep), err)
+		}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("error calling ViaCEP API: %w", err)
+		endStore := slowrequest.StartPhase(ctx, "store")
+		err = h.saveLookup(ctx, Lookup{
+			Cep:       h.masker.Cep(req.Cep),
+			City:      location,
+			TempC:     tempC,
+			TraceID:   span.SpanContext().TraceID().String(),
+			CreatedAt: clock.Now(),
+		}, len(subs) > 0)
+		endStore()
+		if err != nil {
+			errlog.Printf("Error storing lookup for CEP %s: %v", h.masker.Cep(req.Cep), err)
+		}
+		h.notifier.Notify(ctx, subs, location, tempC)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error reading response body: %w", err)
-	}
+	endEncode := slowrequest.StartPhase(ctx, "encode")
+	httpapi.RenderCacheable(w, r, result, h.cacheControl, ctx)
+	endEncode()
+}
 
-	log.Printf("ViaCEP response for %s: %s", cep, string(body))
+// cacheControlFor is the Cache-Control of answers that may be kept for
+// maxAge, or revalidated every time when it is 0.
+// lookupErrorMessages are the messages a failed lookup is answered with,
+// by its code; a code missing here is answered with the error itself.
+var lookupErrorMessages = map[weather.ErrorCode]string{
+	weather.CodeZipcodeNotFound:     "can not find zipcode",
+	weather.CodeUpstreamTimeout:     "request timeout",
+	weather.CodeUpstreamUnavailable: "upstream rate limit reached",
+	weather.CodeUpstreamSchemaError: "upstream response was malformed",
+	weather.CodeInternal:            "internal server error",
+}
 
-	if string(body) == `{"erro": "true"}` || string(body) == `{"erro":"true"}` {
-		log.Printf("CEP %s not found (error in response)", cep)
-		return "", ErrCepNotFound
+// respondWithLookupError answers a failed lookup of subject with the code
+// of err.
+func respondWithLookupError(w http.ResponseWriter, err error, subject string, ctx context.Context) {
+	code := apperrors.CodeOf(err)
+	switch code {
+	case weather.CodeZipcodeNotFound:
+		log.Printf("Not found: %s", subject)
+	case weather.CodeUpstreamUnavailable:
+		httpapi.SetRetryAfter(w, httpapi.RetryAfterOf(err))
+	case weather.CodeInternal:
+		errlog.Printf("Internal error looking up %s: %v", subject, err)
 	}
-
-	var cepInfo ViaCepResponse
-	if err := json.Unmarshal(body, &cepInfo); err != nil {
-		return "", fmt.Errorf("error unmarshaling ViaCEP response: %w", err)
+	msg, ok := lookupErrorMessages[code]
+	if !ok {
+		msg = err.Error()
 	}
+	httpapi.RespondWithError(w, code, msg, ctx)
+}
 
-	if cepInfo.Erro == "true" || cepInfo.Localidade == "" || cepInfo.Cep == "" {
-		log.Printf("CEP %s not found: %+v", cep, cepInfo)
-		return "", ErrCepNotFound
+func cacheControlFor(maxAge time.Duration) string {
+	if maxAge <= 0 {
+		return "no-cache"
 	}
+	return fmt.Sprintf("max-age=%d", int(maxAge.Seconds()))
+}
 
-	return cepInfo.Localidade, nil
+// weatherResolver resolves CEPs to their city, from cache when it can and
+// through the ceps chain otherwise, and cities to their weather through
+// the weather chain.
+type weatherResolver struct {
+	ceps     *cepChain
+	weather  *weatherChain
+	cache    *lookupCache
+	cacheTTL time.Duration
+	tracer   trace.Tracer
 }
 
-func getWeatherInfo(ctx context.Context, city string) (*WeatherResponse, error) {
-	ctx, span := tracer.Start(ctx, "get_weather_info")
+func (res *weatherResolver) City(ctx context.Context, cep string) (string, error) {
+	ctx, span := res.tracer.Start(ctx, "get_cep_info")
 	defer span.End()
 
-	encodedCity := url.QueryEscape(city)
-	url := fmt.Sprintf("https://api.weatherapi.com/v1/current.json?key=%s&q=%s&aqi=no", weatherApiKey, encodedCity)
-	client := http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		log.Printf("Error creating request to Weather API: %v", err)
-		return nil, fmt.Errorf("error creating request: %w", err)
+	if !isSynthetic(ctx) {
+		if city, ok := res.cache.Get(cepCacheKey(cep)); ok {
+			span.SetAttributes(attribute.Bool("cache.hit", true))
+			return city, nil
+		}
+		span.SetAttributes(attribute.Bool("cache.hit", false))
 	}
 
-	resp, err := client.Do(req)
+	city, err := res.ceps.City(ctx, cep)
 	if err != nil {
-		log.Printf("Error calling Weather API: %v", err)
-		return nil, fmt.Errorf("error calling Weather API: %w", err)
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Weather API could not find city '%s': status=%d, body=%s", city, resp.StatusCode, string(body))
-		return nil, ErrCepNotFound
-	}
+	res.Remember(cep, city)
+	return city, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Weather API error: status=%d, body=%s", resp.StatusCode, string(body))
-		return nil, fmt.Errorf("unexpected status code from Weather API: %d", resp.StatusCode)
-	}
+// Remember caches city as the city of cep.
+func (res *weatherResolver) Remember(cep, city string) {
+	res.cache.Set(cepCacheKey(cep), city, res.cacheTTL)
+}
 
-	var weather WeatherResponse
-	if err := json.NewDecoder(resp.Body).Decode(&weather); err != nil {
-		log.Printf("Error decoding Weather API response: %v", err)
-		return nil, fmt.Errorf("error decoding Weather API response: %w", err)
-	}
+func (res *weatherResolver) Weather(ctx context.Context, city string) (weatherObservation, error) {
+	ctx, span := res.tracer.Start(ctx, "get_weather_info")
+	defer span.End()
 
-	return &weather, nil
+	return res.weather.CurrentWeather(ctx, city)
 }
 
-func celsiusToFahrenheit(celsius float64) float64 {
-	return celsius*1.8 + 32
+// isExtended reports whether r asked, with ?extended=true, for the
+// provider details of the answer along with the answer itself.
+func isExtended(r *http.Request) bool {
+	extended, _ := strconv.ParseBool(r.URL.Query().Get("extended"))
+	return extended
 }
 
-func celsiusToKelvin(celsius float64) float64 {
-	return celsius + 273
+// upstreamClient makes the outbound calls to the providers and the
+// notification channels, under the shared retry policy. client is shared
+// by every outbound call so connections are pooled.
+type upstreamClient struct {
+	client *http.Client
+	retry  retry.Policy
+	// meter records the instruments of the providers calling through
+	// the client, such as their rate limiters.
+	meter metric.Meter
 }
 
-func isValidCep(cep string) bool {
-	re := regexp.MustCompile(`^\d{8}$`)
-	return re.MatchString(cep)
+// Get GETs rawURL from a provider, waiting on the provider's rate limiter
+// before every attempt. Transport errors and 5xx responses are retried;
+// other statuses are returned to the caller along with the body.
+func (u *upstreamClient) Get(ctx context.Context, provider string, limiter *providerLimiter, rawURL string) (int, []byte, error) {
+	var (
+		status int
+		body   []byte
+	)
+	err := u.retry.Do(ctx, limiter.name, func(ctx context.Context) (bool, error) {
+		if err := limiter.Wait(ctx); err != nil {
+			return false, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+		if err != nil {
+			return false, fmt.Errorf("error creating request: %w", err)
+		}
+
+		resp, err := u.client.Do(req)
+		if err != nil {
+			return true, fmt.Errorf("error calling %s: %w", provider, err)
+		}
+		defer resp.Body.Close()
+
+		body, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return true, fmt.Errorf("error reading response body: %w", err)
+		}
+		status = resp.StatusCode
+		if status >= http.StatusInternalServerError {
+			return true, fmt.Errorf("unexpected status code from %s: %d", provider, status)
+		}
+		return false, nil
+	})
+	return status, body, err
 }
 
-func respondWithError(w http.ResponseWriter, statusCode int, message string, ctx context.Context) {
-	span := trace.SpanFromContext(ctx)
-	span.AddEvent("error_response", trace.WithAttributes(
-		semconv.HTTPStatusCodeKey.Int(statusCode),
-	))
+// parseCepValidation reads CEP_VALIDATION, how much of a CEP isValidCep
+// checks.
+func parseCepValidation(strictness string) cep.Strictness {
+	st, err := cep.ParseStrictness(strictness)
+	if err != nil {
+		log.Printf("Unknown CEP_VALIDATION %q, falling back to %q", strictness, cep.Format)
+		st = cep.Format
+	}
+	return st
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(ErrorResponse{Message: message})
+// isValidCep reports whether s is a CEP worth looking up: 8 digits and,
+// with CEP_VALIDATION=range, in the range of a UF.
+func isValidCep(s string, strictness cep.Strictness) bool {
+	return cep.Validate(s, strictness) == nil
 }
 
-func initTracer(collectorURL string) (*sdktrace.TracerProvider, error) {
+// initTracer also returns its connection to the collector, which the
+// readiness and startup checks watch.
+func initTracer(collectorURL string) (*sdktrace.TracerProvider, *grpc.ClientConn, error) {
 	ctx := context.Background()
 
-	conn, err := grpc.DialContext(ctx, collectorURL, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	conn, err := grpc.NewClient(collectorURL, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gRPC connection to collector: %w", err)
+		return nil, nil, fmt.Errorf("failed to create gRPC connection to collector: %w", err)
 	}
 
 	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+		return nil, nil, fmt.Errorf("failed to create trace exporter: %w", err)
 	}
 
-	res, err := resource.New(ctx,
-		resource.WithAttributes(
-			semconv.ServiceNameKey.String("service-b"),
-		),
-	)
+	res, err := buildinfo.NewResource(ctx, "service-b")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create resource: %w", err)
+		return nil, nil, fmt.Errorf("failed to create resource: %w", err)
 	}
 
 	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSampler(traceSampler),
 		sdktrace.WithBatcher(exporter),
 		sdktrace.WithResource(res),
 	)
 	otel.SetTracerProvider(tp)
 	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
-	tracer = tp.Tracer("service-b")
 
-	return tp, nil
+	return tp, conn, nil
 }
 
 func getEnv(key, fallback string) string {
@@ -305,3 +402,79 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s=%q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean for %s=%q, using %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s=%q, using %d", key, value, fallback)
+		return fallback
+	}
+	return i
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid number for %s=%q, using %g", key, value, fallback)
+		return fallback
+	}
+	return f
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// templateFiles holds the HTML view of Result. The layout and the other
+// views come with httpapi.
+//
+//go:embed templates
+var templateFiles embed.FS
+
+func init() {
+	httpapi.ParseTemplates(templateFiles, "templates/*.html")
+}
+
+// traceSampler is the sampler of the tracer provider.
+var traceSampler = sampling.New(tenantBaggageKey)
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// migrationFiles holds one directory of numbered migrations per SQL
+// storage driver.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrateStorage brings the schema of the given backend up to date; the
+// memory backend has none. It opens its own connection, since the migration drivers close the handle
+// they are given.
+func migrateStorage(driver, dsn string) error {
+	if driver == "" || driver == "memory" {
+		return nil
+	}
+
+	db, err := openSQLDB(driver, dsn)
+	if err != nil {
+		return err
+	}
+
+	source, err := iofs.New(migrationFiles, "migrations/"+driver)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+
+	var target database.Driver
+	switch driver {
+	case "postgres":
+		target, err = postgres.WithInstance(db, &postgres.Config{})
+	case "sqlite":
+		target, err = sqliteMigrationTarget(db)
+	default:
+		err = fmt.Errorf("unknown storage driver %q", driver)
+	}
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to prepare migrations: %w", err)
+	}
+
+	m, err := migrate.NewWithInstance("iofs", source, driver, target)
+	if err != nil {
+		target.Close()
+		return fmt.Errorf("failed to prepare migrations: %w", err)
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to apply migrations: %w", err)
+	}
+
+	version, _, err := m.Version()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	log.Printf("Storage schema at version %d", version)
+	return nil
+}
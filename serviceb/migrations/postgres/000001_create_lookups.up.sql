@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS lookups (
+    id BIGSERIAL PRIMARY KEY,
+    cep TEXT NOT NULL,
+    city TEXT NOT NULL,
+    temp_c DOUBLE PRECISION NOT NULL,
+    trace_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS lookups_cep_created_at ON lookups (cep, created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE subscriptions ADD COLUMN channel TEXT NOT NULL DEFAULT 'webhook';
+ALTER TABLE subscriptions ADD COLUMN email TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE jobs DROP COLUMN cities;
+ALTER TABLE jobs DROP COLUMN kind;
@@ -0,0 +1,2 @@
+ALTER TABLE jobs ADD COLUMN kind TEXT NOT NULL DEFAULT 'lookup';
+ALTER TABLE jobs ADD COLUMN cities TEXT NOT NULL DEFAULT '[]';
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS lookups (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    cep TEXT NOT NULL,
+    city TEXT NOT NULL,
+    temp_c REAL NOT NULL,
+    trace_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS lookups_cep_created_at ON lookups (cep, created_at);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id TEXT PRIMARY KEY,
+    cep TEXT NOT NULL,
+    callback_url TEXT NOT NULL,
+    secret TEXT NOT NULL DEFAULT '',
+    min_temp_c REAL,
+    max_temp_c REAL,
+    created_at TIMESTAMP NOT NULL
+);
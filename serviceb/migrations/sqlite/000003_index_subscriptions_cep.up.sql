@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS subscriptions_cep ON subscriptions (cep);
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/joaolima7/otel-goexpert/pkg/redact"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// mqttConfig enables the MQTT output when BrokerURL is set.
+type mqttConfig struct {
+	BrokerURL   string
+	ClientID    string
+	Username    string
+	Password    string `secret:"true"`
+	TopicPrefix string
+	QoS         int
+	Retained    bool
+}
+
+// brokerPublishTimeout bounds how long a publish waits for the broker to
+// acknowledge it (MQTT QoS 1 and 2, NATS) or for the message to be
+// written (MQTT QoS 0).
+const brokerPublishTimeout = 5 * time.Second
+
+// weatherUpdate is the payload published to weather/{cep}. ID is unique
+// per lookup (see weatherUpdateID), for consumers to drop the duplicates
+// the outbox and history backfills may send.
+type weatherUpdate struct {
+	ID      string    `json:"id"`
+	Cep     string    `json:"cep"`
+	City    string    `json:"city"`
+	TempC   float64   `json:"temp_C"`
+	TempF   float64   `json:"temp_F"`
+	TempK   float64   `json:"temp_K"`
+	TraceID string    `json:"trace_id"`
+	Time    time.Time `json:"time"`
+}
+
+// mqttPublisher pushes the weather of subscribed CEPs to an MQTT broker,
+// so dashboards and devices can subscribe without polling the API.
+type mqttPublisher struct {
+	client   mqtt.Client
+	prefix   string
+	qos      byte
+	retained bool
+	tracer   trace.Tracer
+}
+
+func newMQTTPublisher(cfg mqttConfig, tracer trace.Tracer) (*mqttPublisher, error) {
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS %d", cfg.QoS)
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.BrokerURL).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			log.Printf("Connected to MQTT broker %s", redact.Credentials(cfg.BrokerURL))
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection lost: %v", err)
+		})
+
+	// With SetConnectRetry the connection is made in the background, so an
+	// unreachable broker does not hold up the start.
+	client := mqtt.NewClient(opts)
+	client.Connect()
+	return &mqttPublisher{client: client, prefix: cfg.TopicPrefix, qos: byte(cfg.QoS), retained: cfg.Retained, tracer: tracer}, nil
+}
+
+// Publish sends u to weather/{cep} under a producer span; see
+// weatherTopicKey for what {cep} is.
+func (p *mqttPublisher) Publish(ctx context.Context, u weatherUpdate) error {
+	return p.publish(ctx, u, p.retained)
+}
+
+// PublishBackfill sends u, an update replayed from the history, as
+// Publish does but never retained: the broker keeps the latest reading
+// of the topic, not a past one.
+func (p *mqttPublisher) PublishBackfill(ctx context.Context, u weatherUpdate) error {
+	return p.publish(ctx, u, false)
+}
+
+func (p *mqttPublisher) publish(ctx context.Context, u weatherUpdate, retained bool) error {
+	topic := p.prefix + "weather/" + weatherTopicKey(u.Cep)
+	ctx, span := p.tracer.Start(ctx, "publish "+topic, trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "mqtt"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.Int("mqtt.qos", int(p.qos)),
+			attribute.Bool("mqtt.retained", retained),
+		))
+	defer span.End()
+
+	payload, err := json.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("error encoding weather update: %w", err)
+	}
+	token := p.client.Publish(topic, p.qos, retained, payload)
+	if !token.WaitTimeout(brokerPublishTimeout) {
+		err = fmt.Errorf("timed out publishing to %s", topic)
+	} else {
+		err = token.Error()
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("error publishing to %s: %w", topic, err)
+	}
+	return nil
+}
+
+func (p *mqttPublisher) Close() {
+	p.client.Disconnect(250)
+}
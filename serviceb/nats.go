@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/joaolima7/otel-goexpert/pkg/redact"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// natsConfig enables the NATS output when URL is set.
+type natsConfig struct {
+	URL           string
+	SubjectPrefix string
+}
+
+// natsPublisher pushes the weather of subscribed CEPs to NATS subjects
+// weather.{cep}, the counterpart of the MQTT topics for consumers already
+// on the event bus of Service A.
+type natsPublisher struct {
+	conn   *nats.Conn
+	prefix string
+	tracer trace.Tracer
+}
+
+func newNATSPublisher(cfg natsConfig, tracer trace.Tracer) (*natsPublisher, error) {
+	// With RetryOnFailedConnect the connection is made in the background,
+	// so an unreachable server does not hold up the start; publishes fail
+	// until it connects, and the outbox keeps the updates meanwhile.
+	conn, err := nats.Connect(cfg.URL, nats.Name("service-b"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true),
+		nats.ConnectHandler(func(*nats.Conn) {
+			log.Printf("Connected to NATS server %s", redact.Credentials(cfg.URL))
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("NATS connection lost: %v", err)
+			}
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	return &natsPublisher{conn: conn, prefix: cfg.SubjectPrefix, tracer: tracer}, nil
+}
+
+// Publish sends u to weather.{cep} under a producer span, and carries the
+// trace context in the message headers. Core NATS keeps nothing, so the
+// latest reading is only there for the consumers connected at the time.
+func (p *natsPublisher) Publish(ctx context.Context, u weatherUpdate) error {
+	subject := p.prefix + "weather." + weatherTopicKey(u.Cep)
+	ctx, span := p.tracer.Start(ctx, "publish "+subject, trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", subject),
+			attribute.String("messaging.message.id", u.ID),
+		))
+	defer span.End()
+
+	payload, err := json.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("error encoding weather update: %w", err)
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = payload
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(http.Header(msg.Header)))
+
+	// PublishMsg only buffers the message; the flush makes a dead
+	// connection fail here, where the outbox can retry, rather than lose
+	// what was buffered.
+	err = p.conn.PublishMsg(msg)
+	if err == nil {
+		err = p.conn.FlushWithContext(ctx)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("error publishing to %s: %w", subject, err)
+	}
+	return nil
+}
+
+// PublishBackfill sends u, an update replayed from the history. NATS has
+// nothing like a retained message, so it goes out as Publish sends it.
+func (p *natsPublisher) PublishBackfill(ctx context.Context, u weatherUpdate) error {
+	return p.Publish(ctx, u)
+}
+
+func (p *natsPublisher) Close() {
+	if err := p.conn.Drain(); err != nil {
+		log.Printf("Error draining NATS connection: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+)
+
+// Notifier delivers threshold events over one channel. Each subscription
+// names its channel; Validate runs when the subscription is created and
+// checks that it carries the address the channel delivers to.
+type Notifier interface {
+	Validate(sub Subscription) error
+	Notify(ctx context.Context, sub Subscription, e thresholdEvent) error
+}
+
+const (
+	channelWebhook = "webhook"
+	channelSlack   = "slack"
+	channelEmail   = "email"
+)
+
+// newNotifiers builds the available channels, which send through up and
+// mask CEPs with masker. Webhooks and Slack need nothing beyond the
+// subscription; email needs an SMTP server.
+func newNotifiers(cfg config, up *upstreamClient, masker *masking.Masker) (map[string]Notifier, error) {
+	set := map[string]Notifier{
+		channelWebhook: webhookNotifier{upstream: up, timeout: cfg.WebhookTimeout},
+		channelSlack:   slackNotifier{upstream: up, masker: masker, timeout: cfg.WebhookTimeout},
+	}
+	if cfg.SMTP.Host != "" {
+		email, err := newSMTPNotifier(cfg.SMTP, up.retry, masker)
+		if err != nil {
+			return nil, err
+		}
+		set[channelEmail] = email
+	}
+	return set, nil
+}
+
+// notifierChannels lists the channels of set, sorted, for logs and errors.
+func notifierChannels(set map[string]Notifier) string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// describeThreshold is the human-readable summary of e used by the email
+// and Slack channels. The CEP is masked, as anywhere it leaves the process.
+func describeThreshold(e thresholdEvent, masker *masking.Masker) string {
+	var bound string
+	switch {
+	case e.MaxTempC != nil && e.TempC > *e.MaxTempC:
+		bound = fmt.Sprintf("above the maximum of %.1f°C", *e.MaxTempC)
+	case e.MinTempC != nil && e.TempC < *e.MinTempC:
+		bound = fmt.Sprintf("below the minimum of %.1f°C", *e.MinTempC)
+	default:
+		bound = "outside the subscribed range"
+	}
+	return fmt.Sprintf("Temperature in %s (CEP %s) is %.1f°C, %s", e.City, masker.Cep(e.Cep), e.TempC, bound)
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// formatEventTime renders the time of an event for human channels.
+func formatEventTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05 MST")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+)
+
+// slackNotifier posts threshold events to a Slack incoming webhook, given
+// as the subscription's callback_url.
+type slackNotifier struct {
+	upstream *upstreamClient
+	masker   *masking.Masker
+	timeout  time.Duration
+}
+
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+func (n slackNotifier) Validate(sub Subscription) error {
+	u, err := url.Parse(sub.CallbackURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("callback_url must be the https URL of a Slack incoming webhook")
+	}
+	return nil
+}
+
+func (n slackNotifier) Notify(ctx context.Context, sub Subscription, e thresholdEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+
+	body, err := json.Marshal(slackMessage{
+		Text: fmt.Sprintf(":thermometer: %s (%s)", describeThreshold(e, n.masker), formatEventTime(e.Time)),
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding Slack message: %w", err)
+	}
+	return n.upstream.Post(ctx, "slack", sub.CallbackURL, body, nil)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/retry"
+)
+
+// smtpConfig enables the email channel when Host is set. Port 465 uses
+// implicit TLS; on other ports STARTTLS is used when the server offers it.
+type smtpConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string `secret:"true"`
+	From     string
+	Timeout  time.Duration
+}
+
+// smtpNotifier emails threshold events to the subscription's address.
+type smtpNotifier struct {
+	cfg smtpConfig
+	// from is the bare address of cfg.From, for the envelope.
+	from   string
+	retry  retry.Policy
+	masker *masking.Masker
+}
+
+func newSMTPNotifier(cfg smtpConfig, policy retry.Policy, masker *masking.Masker) (*smtpNotifier, error) {
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM %q: %w", cfg.From, err)
+	}
+	return &smtpNotifier{cfg: cfg, from: from.Address, retry: policy, masker: masker}, nil
+}
+
+func (n *smtpNotifier) Validate(sub Subscription) error {
+	addr, err := mail.ParseAddress(sub.Email)
+	if err != nil || addr.Address != sub.Email {
+		return errors.New("invalid email")
+	}
+	return nil
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, sub Subscription, e thresholdEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.Timeout)
+	defer cancel()
+
+	msg := n.message(sub.Email, e)
+	return n.retry.Do(ctx, "smtp", func(ctx context.Context) (bool, error) {
+		err := n.send(ctx, sub.Email, msg)
+		// Permanent SMTP failures (5xx) are not worth retrying; transient
+		// ones (4xx) and connection errors are.
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			return protoErr.Code >= 400 && protoErr.Code < 500, err
+		}
+		return err != nil, err
+	})
+}
+
+func (n *smtpNotifier) message(to string, e thresholdEvent) []byte {
+	summary := describeThreshold(e, n.masker)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Weather alert: "+e.City))
+	fmt.Fprintf(&b, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", e.ID, n.cfg.Host)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	fmt.Fprintf(&b, "%s.\r\n\r\n", summary)
+	fmt.Fprintf(&b, "Time: %s\r\n", formatEventTime(e.Time))
+	fmt.Fprintf(&b, "Subscription: %s\r\n", e.SubscriptionID)
+	fmt.Fprintf(&b, "Event: %s\r\n", e.ID)
+	return b.Bytes()
+}
+
+// send delivers one message. net/smtp has no context support, so the
+// deadline of ctx is applied to the connection instead.
+func (n *smtpNotifier) send(ctx context.Context, to string, msg []byte) error {
+	addr := net.JoinHostPort(n.cfg.Host, strconv.Itoa(n.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: n.cfg.Host}
+	dialer := &net.Dialer{}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if n.cfg.Port == 465 {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to SMTP server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, n.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error starting SMTP session: %w", err)
+	}
+	defer c.Close()
+
+	if n.cfg.Port != 465 {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("error starting TLS: %w", err)
+			}
+		}
+	}
+	if n.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)); err != nil {
+			return fmt.Errorf("error authenticating to SMTP server: %w", err)
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return fmt.Errorf("error sending MAIL FROM: %w", err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return fmt.Errorf("error sending RCPT TO: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("error sending DATA: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("error writing message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error finishing message: %w", err)
+	}
+	return c.Quit()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// outboxWeatherUpdate is the topic of the weatherUpdate messages relayed
+// to the brokers, and outboxWeatherBackfill that of the ones replayed from
+// the history, which are relayed the same but never retained.
+const (
+	outboxWeatherUpdate   = "weather_update"
+	outboxWeatherBackfill = "weather_backfill"
+)
+
+// outboxRelay publishes the messages of the transactional outbox. They are
+// written in the same transaction as the lookup they come from (see
+// saveLookup), so a crash can neither lose an event of a stored lookup nor
+// publish one of a lookup that was rolled back. Messages are relayed in
+// order and deleted once every broker took them: after a crash in
+// between, or when one broker fails and the message is retried on all, a
+// message is published twice, and consumers deduplicate by its ID.
+type outboxRelay struct {
+	repo     OutboxRepository
+	brokers  []weatherBroker
+	interval time.Duration
+	batch    int
+
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	relayed  metric.Int64Counter
+	tracer   trace.Tracer
+	lastFail time.Time
+}
+
+// weatherBroker is an output the outbox relays weather updates to:
+// mqttPublisher or natsPublisher.
+type weatherBroker interface {
+	Publish(ctx context.Context, u weatherUpdate) error
+	PublishBackfill(ctx context.Context, u weatherUpdate) error
+}
+
+func newOutboxRelay(repo OutboxRepository, brokers []weatherBroker, interval time.Duration, batch int, meter metric.Meter, tracer trace.Tracer) *outboxRelay {
+	o := &outboxRelay{
+		repo:     repo,
+		brokers:  brokers,
+		interval: interval,
+		batch:    max(batch, 1),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		tracer:   tracer,
+	}
+	var err error
+	o.relayed, err = meter.Int64Counter("outbox.relayed",
+		metric.WithDescription("Outbox messages handed to the broker, by topic and outcome"),
+		metric.WithUnit("{message}"),
+	)
+	if err != nil {
+		log.Printf("Error creating outbox counter: %v", err)
+	}
+	return o
+}
+
+func (o *outboxRelay) Start() {
+	go o.loop()
+}
+
+// Stop ends the relay after the batch in flight; what is left is relayed
+// on the next start.
+func (o *outboxRelay) Stop() {
+	close(o.stop)
+	<-o.done
+}
+
+// Wake relays right away instead of on the next tick, after a commit.
+func (o *outboxRelay) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outboxRelay) loop() {
+	defer close(o.done)
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		o.drain()
+		select {
+		case <-o.stop:
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// drain relays the pending messages in batches until the outbox is empty
+// or a publish fails, which leaves the rest for the next tick so that
+// messages keep their order.
+func (o *outboxRelay) drain() {
+	for {
+		select {
+		case <-o.stop:
+			return
+		default:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), o.timeout())
+		msgs, err := o.repo.ListOutbox(ctx, o.batch)
+		cancel()
+		if err != nil {
+			errlog.Printf("Error reading the outbox: %v", err)
+			return
+		}
+		for _, m := range msgs {
+			if err := o.relay(m); err != nil {
+				return
+			}
+		}
+		if len(msgs) < o.batch {
+			return
+		}
+	}
+}
+
+// timeout bounds the relay of a message, published to each broker in
+// turn.
+func (o *outboxRelay) timeout() time.Duration {
+	return time.Duration(len(o.brokers))*brokerPublishTimeout + 5*time.Second
+}
+
+func (o *outboxRelay) relay(m OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout())
+	defer cancel()
+	ctx, span := o.tracer.Start(ctx, "relay_outbox", trace.WithNewRoot(), trace.WithAttributes(
+		attribute.Int64("outbox.id", m.ID),
+		attribute.String("outbox.topic", m.Topic),
+		attribute.Int("outbox.attempts", m.Attempts),
+	))
+	defer span.End()
+
+	err := o.publish(ctx, m)
+	outcome := "published"
+	switch {
+	case errors.Is(err, errMalformedOutbox):
+		// Retrying can't help, and it would hold up every later message.
+		errlog.Printf("Dropping outbox message %d: %v", m.ID, err)
+		span.RecordError(err)
+		outcome, err = "dropped", nil
+	case err != nil:
+		outcome = "failed"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		if clock.Now().Sub(o.lastFail) > time.Minute {
+			errlog.Printf("Error relaying outbox message %d: %v", m.ID, err)
+			o.lastFail = clock.Now()
+		}
+		if failErr := o.repo.FailOutbox(ctx, m.ID, err.Error()); failErr != nil {
+			errlog.Printf("Error updating outbox message %d: %v", m.ID, failErr)
+		}
+	}
+	if err == nil {
+		if err = o.repo.DeleteOutbox(ctx, m.ID); err != nil {
+			errlog.Printf("Error deleting outbox message %d: %v", m.ID, err)
+		}
+	}
+	if o.relayed != nil {
+		o.relayed.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("outbox.topic", m.Topic),
+			attribute.String("outcome", outcome),
+		))
+	}
+	return err
+}
+
+// errMalformedOutbox marks messages the relay can't make sense of.
+var errMalformedOutbox = errors.New("malformed outbox message")
+
+func (o *outboxRelay) publish(ctx context.Context, m OutboxMessage) error {
+	switch m.Topic {
+	case outboxWeatherUpdate, outboxWeatherBackfill:
+		var u weatherUpdate
+		if err := json.Unmarshal(m.Payload, &u); err != nil {
+			return fmt.Errorf("%w: %v", errMalformedOutbox, err)
+		}
+		for _, b := range o.brokers {
+			var err error
+			if m.Topic == outboxWeatherBackfill {
+				err = b.PublishBackfill(ctx, u)
+			} else {
+				err = b.Publish(ctx, u)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown topic %q", errMalformedOutbox, m.Topic)
+	}
+}
+
+// saveLookup stores l. When the CEP has subscriptions and the MQTT or NATS
+// output is enabled, the weather update for them is written to the outbox in the
+// same transaction, and the relay is woken to publish it.
+func (h *weatherHandler) saveLookup(ctx context.Context, l Lookup, subscribed bool) error {
+	if h.outbox == nil || !subscribed {
+		return h.lookups.SaveLookup(ctx, l)
+	}
+	err := h.outbox.repo.SaveLookupWithOutbox(ctx, l, func(l Lookup) ([]OutboxMessage, error) {
+		msg, err := weatherUpdateMessage(outboxWeatherUpdate, l)
+		return []OutboxMessage{msg}, err
+	})
+	if err != nil {
+		return err
+	}
+	h.outbox.Wake()
+	return nil
+}
+
+// weatherTopicKey is the last level of the MQTT topic, and the last token
+// of the NATS subject, the update of a CEP goes to: the CEP as masked in
+// the history (see CEP_MASKING), so a raw CEP only appears with masking off.
+// CEP_MASKING=truncate leaves the five-digit prefix, whose topic carries
+// every CEP sharing it; the asterisks are dropped, as NATS takes them for
+// wildcards. With hash, the key is the hmac: value GET /trend/{cep}
+// answers with as cep.
+func weatherTopicKey(masked string) string {
+	return strings.TrimRight(masked, "*")
+}
+
+// weatherUpdateMessage is the outbox message of topic carrying the
+// weather update of l, a stored lookup.
+func weatherUpdateMessage(topic string, l Lookup) (OutboxMessage, error) {
+	temp := weather.Temperature{Value: l.TempC, Unit: weather.Celsius}
+	payload, err := json.Marshal(weatherUpdate{
+		ID:      weatherUpdateID(l),
+		Cep:     l.Cep,
+		City:    l.City,
+		TempC:   l.TempC,
+		TempF:   temp.Fahrenheit(),
+		TempK:   temp.Kelvin(),
+		TraceID: l.TraceID,
+		Time:    l.CreatedAt.UTC(),
+	})
+	if err != nil {
+		return OutboxMessage{}, fmt.Errorf("error encoding weather update: %w", err)
+	}
+	return OutboxMessage{Topic: topic, Payload: payload, CreatedAt: l.CreatedAt}, nil
+}
+
+// weatherUpdateID derives the ID of the update of l from its ID in the
+// history, so the update published live and any replayed by a backfill
+// share it, and consumers that deduplicate by ID count the lookup once.
+func weatherUpdateID(l Lookup) string {
+	sum := sha256.Sum256([]byte("lookup:" + strconv.FormatInt(l.ID, 10)))
+	return hex.EncodeToString(sum[:16])
+}
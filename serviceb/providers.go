@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"golang.org/x/time/rate"
+)
+
+// Circuit states of a provider, as GET /providers reports them. There is
+// no separate breaker: a demoted provider is only asked once the healthy
+// ones failed, and probed until it recovers, which is what an open
+// circuit amounts to here.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// providerLatency is in milliseconds, over the successful calls of the
+// health window.
+type providerLatency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// providerQuota is the state of the local rate limiter of a provider.
+// CooldownMs is how long the next call would wait for a token; past
+// MaxWaitMs, calls fail fast with UPSTREAM_UNAVAILABLE.
+type providerQuota struct {
+	Limit      string  `json:"limit"`
+	Burst      int     `json:"burst"`
+	Available  float64 `json:"available"`
+	CooldownMs float64 `json:"cooldown_ms"`
+	MaxWaitMs  float64 `json:"max_wait_ms"`
+	Exhausted  bool    `json:"exhausted"`
+}
+
+type providerReport struct {
+	Kind    string        `json:"kind"`
+	Name    string        `json:"name"`
+	Weight  int           `json:"weight"`
+	State   providerState `json:"state"`
+	Since   time.Time     `json:"since"`
+	Circuit string        `json:"circuit"`
+	// RecoveryProbes counts the probes in a row a demoted provider has
+	// passed, out of RecoveryProbesNeeded.
+	RecoveryProbes       int             `json:"recovery_probes,omitempty"`
+	RecoveryProbesNeeded int             `json:"recovery_probes_needed,omitempty"`
+	Score                float64         `json:"score"`
+	ErrorRate            float64         `json:"error_rate"`
+	Samples              int             `json:"samples"`
+	LatencyMs            providerLatency `json:"latency_ms"`
+	// Quota is nil for providers without a rate limit.
+	Quota *providerQuota `json:"quota,omitempty"`
+}
+
+type providersReport struct {
+	CepRouting     routingPolicy    `json:"cep_routing"`
+	WeatherRouting routingPolicy    `json:"weather_routing"`
+	Providers      []providerReport `json:"providers"`
+}
+
+// handleProviders serves GET /providers: every configured provider, CEP
+// ones first, in the order of their chain.
+func handleProviders(ceps *cepChain, weather *weatherChain) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := providersReport{
+			CepRouting:     ceps.policy,
+			WeatherRouting: weather.policy,
+		}
+		for _, e := range ceps.entries {
+			report.Providers = append(report.Providers, reportProvider(ceps.tracker.cfg, e.provider, e.weight, e.health))
+		}
+		for _, e := range weather.entries {
+			report.Providers = append(report.Providers, reportProvider(weather.tracker.cfg, e.provider, e.weight, e.health))
+		}
+		httpapi.Render(w, http.StatusOK, report, r.Context())
+	}
+}
+
+func reportProvider(cfg healthConfig, provider any, weight int, p *trackedProvider) providerReport {
+	p.mu.Lock()
+	score, errorRate, _ := p.stats(cfg.SlowLatency)
+	latency := p.percentiles(50, 95, 99)
+	rep := providerReport{
+		Kind:      p.kind,
+		Name:      p.name,
+		Weight:    weight,
+		State:     p.state,
+		Since:     p.since,
+		Circuit:   circuitClosed,
+		Score:     score,
+		ErrorRate: errorRate,
+		Samples:   p.count,
+		LatencyMs: providerLatency{P50: millis(latency[0]), P95: millis(latency[1]), P99: millis(latency[2])},
+	}
+	if p.state == providerDemoted {
+		rep.Circuit = circuitOpen
+		if p.recovered > 0 {
+			rep.Circuit = circuitHalfOpen
+		}
+		rep.RecoveryProbes, rep.RecoveryProbesNeeded = p.recovered, cfg.RecoveryProbes
+	}
+	p.mu.Unlock()
+
+	if rl, ok := provider.(providerRateLimited); ok {
+		rep.Quota = rl.RateLimiter().Quota()
+	}
+	return rep
+}
+
+// Quota reports the limiter, or nil when it is unlimited.
+func (l *providerLimiter) Quota() *providerQuota {
+	if l.limiter.Limit() == rate.Inf {
+		return nil
+	}
+	tokens := l.limiter.TokensAt(clock.Now())
+	q := &providerQuota{
+		Limit:     l.spec,
+		Burst:     l.limiter.Burst(),
+		Available: math.Round(max(tokens, 0)*100) / 100,
+		MaxWaitMs: millis(l.maxWait),
+	}
+	if tokens < 1 {
+		cooldown := time.Duration((1 - tokens) / float64(l.limiter.Limit()) * float64(time.Second))
+		q.CooldownMs = millis(cooldown)
+		q.Exhausted = cooldown > l.maxWait
+	}
+	return q
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// ErrProviderRateLimited means a call would have waited past the maximum
+// for a token of its provider's rate limiter.
+var ErrProviderRateLimited = apperrors.New(weather.CodeUpstreamUnavailable, "provider rate limit reached")
+
+// providerLimiter smooths calls to one upstream provider with a token
+// bucket sized from its quota. Callers queue for a token for at most
+// maxWait and fail fast beyond that, well before the provider itself
+// starts answering with quota errors.
+type providerLimiter struct {
+	name    string
+	spec    string
+	limiter *rate.Limiter
+	maxWait time.Duration
+	limited metric.Int64Counter
+}
+
+// newProviderLimiter builds a limiter for spec, written as "N/period" (for
+// example "23/m" or "1000000/720h"). An empty spec means unlimited.
+func newProviderLimiter(name, spec string, burst int, maxWait time.Duration, meter metric.Meter) (*providerLimiter, error) {
+	l := &providerLimiter{name: name, spec: spec, limiter: rate.NewLimiter(rate.Inf, 0), maxWait: maxWait}
+	if spec != "" {
+		limit, err := parseRate(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit for %s: %w", name, err)
+		}
+		l.limiter = rate.NewLimiter(limit, max(burst, 1))
+	}
+
+	var err error
+	l.limited, err = meter.Int64Counter("provider.rate_limited",
+		metric.WithDescription("Upstream calls rejected by the local provider rate limiter"),
+		metric.WithUnit("{call}"),
+	)
+	if err != nil {
+		log.Printf("Error creating rate limit counter: %v", err)
+	}
+	return l, nil
+}
+
+// Wait blocks until a call to the provider is allowed.
+func (l *providerLimiter) Wait(ctx context.Context) error {
+	now := clock.Now()
+	r := l.limiter.ReserveN(now, 1)
+	delay := r.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+
+	span := trace.SpanFromContext(ctx)
+	deadline, hasDeadline := ctx.Deadline()
+	if delay > l.maxWait || (hasDeadline && time.Until(deadline) < delay) {
+		r.CancelAt(now)
+		if l.limited != nil {
+			l.limited.Add(ctx, 1, metric.WithAttributes(attribute.String("provider", l.name)))
+		}
+		span.SetAttributes(attribute.Bool("provider.rate_limited", true))
+		return httpapi.WithRetryAfter(fmt.Errorf("%s: %w", l.name, ErrProviderRateLimited), delay)
+	}
+
+	span.SetAttributes(attribute.Int64("provider.rate_limit_wait_ms", delay.Milliseconds()))
+	timer := clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		r.CancelAt(clock.Now())
+		return ctx.Err()
+	}
+}
+
+func parseRate(spec string) (rate.Limit, error) {
+	count, period, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, fmt.Errorf("expected N/period, got %q", spec)
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(count), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid count %q", count)
+	}
+	period = strings.TrimSpace(period)
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid period %q", period)
+	}
+	return rate.Limit(n / d.Seconds()), nil
+}
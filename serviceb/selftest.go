@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// syntheticKey marks a context as belonging to a synthetic check, which
+// must reach the real providers instead of being answered from the cache.
+type syntheticKey struct{}
+
+func isSynthetic(ctx context.Context) bool {
+	v, _ := ctx.Value(syntheticKey{}).(bool)
+	return v
+}
+
+type selftestStage struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	Result     string  `json:"result,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type selftestReport struct {
+	Status     string          `json:"status"`
+	Cep        string          `json:"cep"`
+	TraceID    string          `json:"trace_id"`
+	DurationMs float64         `json:"duration_ms"`
+	Stages     []selftestStage `json:"stages"`
+}
+
+// runSelftest looks cep up through the provider chains of resolver,
+// bypassing the cache and without storing the lookup, notifying
+// subscribers or counting it in the query stats.
+func runSelftest(ctx context.Context, tracer trace.Tracer, resolver *weatherResolver, masker *masking.Masker, cep string) selftestReport {
+	ctx = context.WithValue(ctx, syntheticKey{}, true)
+	ctx, span := tracer.Start(ctx, "synthetic_check", trace.WithAttributes(
+		attribute.Bool("synthetic", true),
+		attribute.String("synthetic.check", "selftest"),
+		attribute.String("cep", masker.Cep(cep)),
+	))
+	defer span.End()
+
+	report := selftestReport{Status: "pass", Cep: masker.Cep(cep), TraceID: span.SpanContext().TraceID().String()}
+	start := time.Now()
+	stage := func(name string, run func() (string, error)) bool {
+		stageStart := time.Now()
+		result, err := run()
+		s := selftestStage{
+			Name:       name,
+			Status:     "pass",
+			DurationMs: float64(time.Since(stageStart).Microseconds()) / 1000,
+			Result:     result,
+		}
+		if err != nil {
+			s.Status, s.Error = "fail", err.Error()
+			report.Status = "fail"
+		}
+		report.Stages = append(report.Stages, s)
+		return err == nil
+	}
+
+	var city string
+	if stage("cep_lookup", func() (string, error) {
+		var err error
+		city, err = resolver.City(ctx, cep)
+		return city, err
+	}) {
+		stage("weather_lookup", func() (string, error) {
+			obs, err := resolver.Weather(ctx, city)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%.1f°C, %s", obs.TempC, obs.Condition), nil
+		})
+	}
+
+	report.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	span.SetAttributes(attribute.String("synthetic.status", report.Status))
+	return report
+}
+
+// handleSelftest runs the canary lookup of SELFTEST_CEP and answers 503
+// when a stage failed, so uptime monitors can alert on the status code
+// alone.
+func (a *adminAPI) handleSelftest(w http.ResponseWriter, r *http.Request) {
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.Bool("synthetic", true))
+	report := runSelftest(r.Context(), a.tracer, a.resolver, a.masker, a.cfg.SelftestCep)
+
+	statusCode := http.StatusOK
+	if report.Status != "pass" {
+		statusCode = http.StatusServiceUnavailable
+	}
+	a.auditLog.Record(r.Context(), "admin", "selftest.run", report.Status, nil)
+	httpapi.Render(w, statusCode, report, r.Context())
+}
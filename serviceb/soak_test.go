@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/soak"
+)
+
+// soakRequests is the traffic each soak client cycles through: cached and
+// expiring lookups, failures, every response format and the stats.
+var soakRequests = []struct {
+	method, path, body string
+	status             int
+}{
+	{http.MethodPost, "/weather", `{"cep":"01001000"}`, http.StatusOK},
+	{http.MethodPost, "/weather", `{"cep":"20040002"}`, http.StatusOK},
+	{http.MethodPost, "/weather", `{"cep":"00000000"}`, http.StatusNotFound},
+	{http.MethodPost, "/weather", `{"cep":"123"}`, http.StatusUnprocessableEntity},
+	{http.MethodPost, "/weather?format=xml", `{"cep":"01001000"}`, http.StatusOK},
+	{http.MethodPost, "/weather?format=html", `{"cep":"01001000"}`, http.StatusOK},
+	{http.MethodPost, "/weather?format=csv", `{"cep":"01001000"}`, http.StatusOK},
+	{http.MethodGet, "/stats", "", http.StatusOK},
+}
+
+func TestSoak(t *testing.T) {
+	duration := soak.Duration(t)
+	h := newFakeWeatherHandler(t, 100)
+	h.resolver.cacheTTL = time.Second
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /weather", h)
+	mux.Handle("GET /stats", &statsHandler{stats: h.stats, cache: h.resolver.cache, tracker: h.resolver.ceps.tracker})
+	srv := httptest.NewServer(withServiceMiddleware(mux))
+	defer srv.Close()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+
+	next := make([]int, soak.Concurrency())
+	drive := func(ctx context.Context, c int) error {
+		r := soakRequests[next[c]%len(soakRequests)]
+		next[c]++
+		req, err := http.NewRequestWithContext(ctx, r.method, srv.URL+r.path, strings.NewReader(r.body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != r.status {
+			return fmt.Errorf("%s %s: status %d, want %d", r.method, r.path, resp.StatusCode, r.status)
+		}
+		return nil
+	}
+	settle := func() {
+		pruneHistory(context.Background(), h.lookups, time.Second)
+		transport.CloseIdleConnections()
+	}
+	soak.Run(t, duration, drive, settle)
+}
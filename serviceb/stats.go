@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// queryStats keeps the approximate most-queried CEPs and cities.
+type queryStats struct {
+	ceps   *topK
+	cities *topK
+}
+
+func newQueryStats(capacity int) *queryStats {
+	return &queryStats{ceps: newTopK(capacity), cities: newTopK(capacity)}
+}
+
+// statsHandler answers GET /stats: the most-queried CEPs and cities, and
+// the state of the cache and of the providers. CEPs are masked like
+// everywhere else they leave the process.
+type statsHandler struct {
+	stats   *queryStats
+	cache   *lookupCache
+	tracker *healthTracker
+	masker  *masking.Masker
+}
+
+func (h *statsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ceps := h.stats.ceps.Top(10)
+	for i := range ceps {
+		ceps[i].Key = h.masker.Cep(ceps[i].Key)
+	}
+
+	httpapi.Render(w, http.StatusOK, map[string]any{
+		"top_ceps":   ceps,
+		"top_cities": h.stats.cities.Top(10),
+		"cache":      h.cache.Stats(0),
+		"providers":  h.tracker.Snapshot(),
+	}, r.Context())
+}
+
+// prewarmCache queues a refresh of the n most-queried CEPs that are
+// missing from the cache, so popular lookups don't pay for a ViaCEP round
+// trip after their entry expires. It runs as the cache_prewarm cron task.
+func prewarmCache(stats *queryStats, resolver *weatherResolver, pool *workerPool, masker *masking.Masker, tracer trace.Tracer, n int) error {
+	queued := 0
+	for _, top := range stats.ceps.Top(n) {
+		if _, ok := resolver.cache.Peek(cepCacheKey(top.Key)); ok {
+			continue
+		}
+		cep := top.Key
+		err := pool.Submit("cache_refresh", 0, func(ctx context.Context) {
+			ctx, span := tracer.Start(ctx, "prewarm_cep", trace.WithNewRoot())
+			defer span.End()
+			if _, err := resolver.City(ctx, cep); err != nil {
+				errlog.Printf("Error prewarming CEP %s: %v", masker.Cep(cep), err)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("queued %d CEPs for prewarming: %w", queued, err)
+		}
+		queued++
+	}
+	if queued > 0 {
+		log.Printf("Queued %d CEPs for prewarming", queued)
+	}
+	return nil
+}
+
+// pruneHistory deletes the lookups older than retention. It runs as the
+// history_prune cron task.
+func pruneHistory(ctx context.Context, lookups LookupRepository, retention time.Duration) error {
+	if retention <= 0 {
+		return errors.New("HISTORY_RETENTION is not set")
+	}
+	n, err := lookups.PruneLookups(ctx, clock.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("lookups.pruned", n))
+	if n > 0 {
+		log.Printf("Pruned %d lookups older than %s", n, retention)
+	}
+	return nil
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Lookup is a persisted weather lookup. Cep holds the masked
+// representation (see CEP_MASKING), never the raw value unless masking is off.
+type Lookup struct {
+	ID        int64     `json:"id"`
+	Cep       string    `json:"cep"`
+	City      string    `json:"city"`
+	TempC     float64   `json:"temp_C"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Subscription asks to be notified about the weather of a CEP. Channel
+// picks the Notifier: webhook and slack deliver to CallbackURL, email to
+// Email.
+type Subscription struct {
+	ID          string    `json:"id"`
+	Cep         string    `json:"cep"`
+	Channel     string    `json:"channel"`
+	CallbackURL string    `json:"callback_url,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Secret      string    `json:"-"`
+	MinTempC    *float64  `json:"min_temp_C,omitempty"`
+	MaxTempC    *float64  `json:"max_temp_C,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Job is an asynchronous batch of CEPs: a lookup, or a cache import that
+// only resolves and caches their cities. Ceps holds the raw input only
+// until the job finishes; Results carry masked CEPs like Lookup. Cities,
+// for imports, holds the city already known for each CEP, if any.
+type Job struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	Status     string      `json:"status"`
+	Ceps       []string    `json:"-"`
+	Cities     []string    `json:"-"`
+	Total      int         `json:"total"`
+	Completed  int         `json:"completed"`
+	Failed     int         `json:"failed"`
+	Error      string      `json:"error,omitempty"`
+	Results    []JobResult `json:"results"`
+	TraceID    string      `json:"trace_id,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+}
+
+// OutboxMessage is an event waiting in the outbox, encoded as JSON.
+type OutboxMessage struct {
+	ID        int64
+	Topic     string
+	Payload   json.RawMessage
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+}
+
+// JobResult is the outcome of one CEP of a job, in input order, with the
+// CEP as requested: it belongs to whoever created the job, and CEP_MASKING
+// only applies to logs and spans.
+type JobResult struct {
+	Cep   string   `json:"cep"`
+	City  string   `json:"city,omitempty"`
+	TempC *float64 `json:"temp_C,omitempty"`
+	TempF *float64 `json:"temp_F,omitempty"`
+	TempK *float64 `json:"temp_K,omitempty"`
+	// Condition is empty for results stored before conditions were.
+	Condition weather.Condition `json:"condition,omitempty"`
+	Error     weather.ErrorCode `json:"error,omitempty"`
+}
+
+// DeadLetter is background work that failed for good: a notification that
+// could not be delivered, or a job item a provider failed. It is kept with
+// the reason until it is replayed or deleted. Payload holds what a replay
+// needs, raw CEPs included, and is never rendered; Subject describes the
+// work with the CEP masked.
+type DeadLetter struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"`
+	Subject   string          `json:"subject"`
+	Reason    string          `json:"reason"`
+	Payload   json.RawMessage `json:"-"`
+	Replays   int             `json:"replays"`
+	TraceID   string          `json:"trace_id,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// LookupRepository stores the lookup history.
+type LookupRepository interface {
+	SaveLookup(ctx context.Context, l Lookup) error
+	// ListLookups returns the lookups for cep created at or after since,
+	// newest first.
+	ListLookups(ctx context.Context, cep string, since time.Time, limit int) ([]Lookup, error)
+	// ScanLookups returns up to limit lookups of any CEP created at or
+	// after since and before until, with an ID above afterID, in ID order,
+	// to page through the history.
+	ScanLookups(ctx context.Context, since, until time.Time, afterID int64, limit int) ([]Lookup, error)
+	// PruneLookups deletes the lookups created before before and returns
+	// how many were removed.
+	PruneLookups(ctx context.Context, before time.Time) (int64, error)
+}
+
+// SubscriptionRepository stores subscriptions.
+type SubscriptionRepository interface {
+	CreateSubscription(ctx context.Context, s Subscription) error
+	GetSubscription(ctx context.Context, id string) (Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]Subscription, error)
+	ListSubscriptionsByCep(ctx context.Context, cep string) ([]Subscription, error)
+	DeleteSubscription(ctx context.Context, id string) error
+}
+
+// JobRepository stores asynchronous jobs and their progress.
+type JobRepository interface {
+	CreateJob(ctx context.Context, j Job) error
+	GetJob(ctx context.Context, id string) (Job, error)
+	UpdateJob(ctx context.Context, j Job) error
+	// ListUnfinishedJobs returns the queued and running jobs, oldest
+	// first, so they can be resumed after a restart.
+	ListUnfinishedJobs(ctx context.Context) ([]Job, error)
+}
+
+// OutboxRepository stores the transactional outbox: events written with
+// the lookup they come from, until the relay publishes them.
+type OutboxRepository interface {
+	// SaveLookupWithOutbox stores l and the messages msgs builds for it in
+	// one transaction. msgs gets l with its ID assigned.
+	SaveLookupWithOutbox(ctx context.Context, l Lookup, msgs func(Lookup) ([]OutboxMessage, error)) error
+	// AppendOutbox stores msgs on their own, for events of lookups already
+	// stored, such as a history backfill.
+	AppendOutbox(ctx context.Context, msgs []OutboxMessage) error
+	// ListOutbox returns up to limit pending messages, oldest first.
+	ListOutbox(ctx context.Context, limit int) ([]OutboxMessage, error)
+	DeleteOutbox(ctx context.Context, id int64) error
+	// FailOutbox records a failed attempt at publishing a message.
+	FailOutbox(ctx context.Context, id int64, reason string) error
+}
+
+// DeadLetterRepository stores the dead-letter queue.
+type DeadLetterRepository interface {
+	CreateDeadLetter(ctx context.Context, d DeadLetter) error
+	GetDeadLetter(ctx context.Context, id string) (DeadLetter, error)
+	UpdateDeadLetter(ctx context.Context, d DeadLetter) error
+	// ListDeadLetters returns up to limit dead letters of kind, or of any
+	// kind when empty, oldest first.
+	ListDeadLetters(ctx context.Context, kind string, limit int) ([]DeadLetter, error)
+	DeleteDeadLetter(ctx context.Context, id string) error
+}
+
+// storage bundles the repositories of one backend.
+type storage interface {
+	LookupRepository
+	SubscriptionRepository
+	JobRepository
+	DeadLetterRepository
+	OutboxRepository
+	Close() error
+}
+
+// openStorage opens the backend named by driver: "memory", "postgres" or
+// "sqlite". The memory backend keeps at most memoryMaxLookups lookups.
+func openStorage(driver, dsn string, memoryMaxLookups int) (storage, error) {
+	switch driver {
+	case "", "memory":
+		return newMemoryStorage(memoryMaxLookups), nil
+	case "postgres", "sqlite":
+		return openSQLStorage(driver, dsn)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", driver)
+	}
+}
+
+// memoryStorage keeps everything in process memory. It is the default and
+// is also handy in tests. Lookups past maxLookups push out the oldest, so
+// that the history stays bounded even when nothing prunes it.
+type memoryStorage struct {
+	mu            sync.RWMutex
+	nextID        int64
+	lookups       []Lookup
+	maxLookups    int
+	subscriptions map[string]Subscription
+	jobs          map[string]Job
+	deadLetters   map[string]DeadLetter
+	outbox        []OutboxMessage
+	nextOutboxID  int64
+}
+
+// newMemoryStorage returns a memory backend keeping up to maxLookups
+// lookups; zero keeps them all.
+func newMemoryStorage(maxLookups int) *memoryStorage {
+	return &memoryStorage{
+		maxLookups:    maxLookups,
+		subscriptions: make(map[string]Subscription),
+		jobs:          make(map[string]Job),
+		deadLetters:   make(map[string]DeadLetter),
+	}
+}
+
+func (m *memoryStorage) SaveLookup(ctx context.Context, l Lookup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	l.ID = m.nextID
+	m.lookups = append(m.lookups, l)
+	if m.maxLookups > 0 && len(m.lookups) > m.maxLookups {
+		// append moves the rest to a new array once this one is full, so
+		// the dropped head is freed then.
+		m.lookups[0] = Lookup{}
+		m.lookups = m.lookups[1:]
+	}
+	return nil
+}
+
+func (m *memoryStorage) ListLookups(ctx context.Context, cep string, since time.Time, limit int) ([]Lookup, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []Lookup
+	for i := len(m.lookups) - 1; i >= 0; i-- {
+		l := m.lookups[i]
+		if l.Cep != cep || l.CreatedAt.Before(since) {
+			continue
+		}
+		out = append(out, l)
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryStorage) ScanLookups(ctx context.Context, since, until time.Time, afterID int64, limit int) ([]Lookup, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []Lookup
+	for _, l := range m.lookups {
+		if l.ID <= afterID || l.CreatedAt.Before(since) || !l.CreatedAt.Before(until) {
+			continue
+		}
+		out = append(out, l)
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryStorage) PruneLookups(ctx context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.lookups)
+	m.lookups = slices.DeleteFunc(m.lookups, func(l Lookup) bool { return l.CreatedAt.Before(before) })
+	return int64(n - len(m.lookups)), nil
+}
+
+func (m *memoryStorage) CreateSubscription(ctx context.Context, s Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.subscriptions[s.ID]; exists {
+		return fmt.Errorf("subscription %s already exists", s.ID)
+	}
+	m.subscriptions[s.ID] = s
+	return nil
+}
+
+func (m *memoryStorage) GetSubscription(ctx context.Context, id string) (Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.subscriptions[id]
+	if !ok {
+		return Subscription{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (m *memoryStorage) ListSubscriptions(ctx context.Context) ([]Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]Subscription, 0, len(m.subscriptions))
+	for _, s := range m.subscriptions {
+		out = append(out, s)
+	}
+	slices.SortFunc(out, func(a, b Subscription) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryStorage) ListSubscriptionsByCep(ctx context.Context, cep string) ([]Subscription, error) {
+	all, _ := m.ListSubscriptions(ctx)
+	out := all[:0]
+	for _, s := range all {
+		if s.Cep == cep {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryStorage) DeleteSubscription(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subscriptions[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.subscriptions, id)
+	return nil
+}
+
+// cloneJob copies the slices of j, so callers can't modify stored jobs.
+func cloneJob(j Job) Job {
+	j.Ceps = slices.Clone(j.Ceps)
+	j.Cities = slices.Clone(j.Cities)
+	j.Results = slices.Clone(j.Results)
+	return j
+}
+
+func (m *memoryStorage) CreateJob(ctx context.Context, j Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.jobs[j.ID]; exists {
+		return fmt.Errorf("job %s already exists", j.ID)
+	}
+	m.jobs[j.ID] = cloneJob(j)
+	return nil
+}
+
+func (m *memoryStorage) GetJob(ctx context.Context, id string) (Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return cloneJob(j), nil
+}
+
+func (m *memoryStorage) UpdateJob(ctx context.Context, j Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.jobs[j.ID]; !ok {
+		return ErrNotFound
+	}
+	m.jobs[j.ID] = cloneJob(j)
+	return nil
+}
+
+func (m *memoryStorage) ListUnfinishedJobs(ctx context.Context) ([]Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []Job
+	for _, j := range m.jobs {
+		if j.Status == jobQueued || j.Status == jobRunning {
+			out = append(out, cloneJob(j))
+		}
+	}
+	slices.SortFunc(out, func(a, b Job) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryStorage) CreateDeadLetter(ctx context.Context, d DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.deadLetters[d.ID]; exists {
+		return fmt.Errorf("dead letter %s already exists", d.ID)
+	}
+	m.deadLetters[d.ID] = d
+	return nil
+}
+
+func (m *memoryStorage) GetDeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.deadLetters[id]
+	if !ok {
+		return DeadLetter{}, ErrNotFound
+	}
+	return d, nil
+}
+
+func (m *memoryStorage) UpdateDeadLetter(ctx context.Context, d DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.deadLetters[d.ID]; !ok {
+		return ErrNotFound
+	}
+	m.deadLetters[d.ID] = d
+	return nil
+}
+
+func (m *memoryStorage) ListDeadLetters(ctx context.Context, kind string, limit int) ([]DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var out []DeadLetter
+	for _, d := range m.deadLetters {
+		if kind == "" || d.Kind == kind {
+			out = append(out, d)
+		}
+	}
+	slices.SortFunc(out, func(a, b DeadLetter) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (m *memoryStorage) DeleteDeadLetter(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.deadLetters[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.deadLetters, id)
+	return nil
+}
+
+// SaveLookupWithOutbox holds the lock across both writes, which is all the
+// atomicity process memory needs.
+func (m *memoryStorage) SaveLookupWithOutbox(ctx context.Context, l Lookup, msgs func(Lookup) ([]OutboxMessage, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l.ID = m.nextID + 1
+	built, err := msgs(l)
+	if err != nil {
+		return err
+	}
+	m.nextID++
+	m.lookups = append(m.lookups, l)
+	for _, msg := range built {
+		m.nextOutboxID++
+		msg.ID = m.nextOutboxID
+		m.outbox = append(m.outbox, msg)
+	}
+	return nil
+}
+
+func (m *memoryStorage) AppendOutbox(ctx context.Context, msgs []OutboxMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, msg := range msgs {
+		m.nextOutboxID++
+		msg.ID = m.nextOutboxID
+		m.outbox = append(m.outbox, msg)
+	}
+	return nil
+}
+
+func (m *memoryStorage) ListOutbox(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.outbox[:min(limit, len(m.outbox))]), nil
+}
+
+func (m *memoryStorage) DeleteOutbox(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outbox = slices.DeleteFunc(m.outbox, func(msg OutboxMessage) bool { return msg.ID == id })
+	return nil
+}
+
+func (m *memoryStorage) FailOutbox(ctx context.Context, id int64, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.outbox {
+		if m.outbox[i].ID == id {
+			m.outbox[i].Attempts++
+			m.outbox[i].LastError = reason
+		}
+	}
+	return nil
+}
+
+func (m *memoryStorage) Close() error { return nil }
@@ -0,0 +1,16 @@
+//go:build !cgo
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/golang-migrate/migrate/v4/database"
+)
+
+const sqliteAvailable = false
+
+func sqliteMigrationTarget(db *sql.DB) (database.Driver, error) {
+	return nil, errors.New("sqlite storage requires a cgo-enabled build")
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// sqlStorage implements the repositories on database/sql. The queries use
+// $N placeholders, which both PostgreSQL and SQLite accept.
+type sqlStorage struct {
+	db *sql.DB
+}
+
+// openSQLStorage connects to the database. The schema is expected to be
+// current; see migrateStorage.
+func openSQLStorage(driver, dsn string) (*sqlStorage, error) {
+	db, err := openSQLDB(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStorage{db: db}, nil
+}
+
+func openSQLDB(driver, dsn string) (*sql.DB, error) {
+	driverName := driver
+	if driver == "sqlite" {
+		if !sqliteAvailable {
+			return nil, errors.New("sqlite storage requires a cgo-enabled build")
+		}
+		driverName = "sqlite3"
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s storage: %w", driver, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s storage: %w", driver, err)
+	}
+	return db, nil
+}
+
+func (s *sqlStorage) SaveLookup(ctx context.Context, l Lookup) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO lookups (cep, city, temp_c, trace_id, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		l.Cep, l.City, l.TempC, l.TraceID, l.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error saving lookup: %w", err)
+	}
+	return nil
+}
+
+// SaveLookupWithOutbox inserts the lookup and its outbox messages in one
+// transaction.
+func (s *sqlStorage) SaveLookupWithOutbox(ctx context.Context, l Lookup, msgs func(Lookup) ([]OutboxMessage, error)) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error saving lookup: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO lookups (cep, city, temp_c, trace_id, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		l.Cep, l.City, l.TempC, l.TraceID, l.CreatedAt.UTC()).Scan(&l.ID)
+	if err != nil {
+		return fmt.Errorf("error saving lookup: %w", err)
+	}
+	built, err := msgs(l)
+	if err != nil {
+		return err
+	}
+	for _, m := range built {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO outbox (topic, payload, created_at) VALUES ($1, $2, $3)`,
+			m.Topic, string(m.Payload), m.CreatedAt.UTC())
+		if err != nil {
+			return fmt.Errorf("error saving outbox message: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error saving lookup: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) ListLookups(ctx context.Context, cep string, since time.Time, limit int) ([]Lookup, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, cep, city, temp_c, trace_id, created_at FROM lookups
+		 WHERE cep = $1 AND created_at >= $2 ORDER BY created_at DESC LIMIT $3`,
+		cep, since.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing lookups: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Lookup
+	for rows.Next() {
+		var l Lookup
+		if err := rows.Scan(&l.ID, &l.Cep, &l.City, &l.TempC, &l.TraceID, &l.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error reading lookup: %w", err)
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStorage) ScanLookups(ctx context.Context, since, until time.Time, afterID int64, limit int) ([]Lookup, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, cep, city, temp_c, trace_id, created_at FROM lookups
+		 WHERE id > $1 AND created_at >= $2 AND created_at < $3 ORDER BY id LIMIT $4`,
+		afterID, since.UTC(), until.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning lookups: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Lookup
+	for rows.Next() {
+		var l Lookup
+		if err := rows.Scan(&l.ID, &l.Cep, &l.City, &l.TempC, &l.TraceID, &l.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error reading lookup: %w", err)
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStorage) PruneLookups(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM lookups WHERE created_at < $1`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("error pruning lookups: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStorage) CreateSubscription(ctx context.Context, sub Subscription) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO subscriptions (id, cep, channel, callback_url, email, secret, min_temp_c, max_temp_c, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		sub.ID, sub.Cep, sub.Channel, sub.CallbackURL, sub.Email, sub.Secret, sub.MinTempC, sub.MaxTempC, sub.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error creating subscription: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) GetSubscription(ctx context.Context, id string) (Subscription, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, cep, channel, callback_url, email, secret, min_temp_c, max_temp_c, created_at FROM subscriptions WHERE id = $1`, id)
+	sub, err := scanSubscription(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Subscription{}, ErrNotFound
+	}
+	return sub, err
+}
+
+func (s *sqlStorage) ListSubscriptions(ctx context.Context) ([]Subscription, error) {
+	return s.querySubscriptions(ctx,
+		`SELECT id, cep, channel, callback_url, email, secret, min_temp_c, max_temp_c, created_at FROM subscriptions ORDER BY created_at`)
+}
+
+func (s *sqlStorage) ListSubscriptionsByCep(ctx context.Context, cep string) ([]Subscription, error) {
+	return s.querySubscriptions(ctx,
+		`SELECT id, cep, channel, callback_url, email, secret, min_temp_c, max_temp_c, created_at FROM subscriptions WHERE cep = $1 ORDER BY created_at`, cep)
+}
+
+func (s *sqlStorage) querySubscriptions(ctx context.Context, query string, args ...any) ([]Subscription, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Subscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sub)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStorage) DeleteSubscription(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error deleting subscription: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStorage) CreateJob(ctx context.Context, j Job) error {
+	ceps, cities, results, err := encodeJob(j)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO jobs (id, kind, status, ceps, cities, results, total, failed, error, trace_id, created_at, updated_at, finished_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		j.ID, j.Kind, j.Status, ceps, cities, results, j.Total, j.Failed, j.Error, j.TraceID, j.CreatedAt.UTC(), j.UpdatedAt.UTC(), utcOrNil(j.FinishedAt))
+	if err != nil {
+		return fmt.Errorf("error creating job: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) GetJob(ctx context.Context, id string) (Job, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, kind, status, ceps, cities, results, total, failed, error, trace_id, created_at, updated_at, finished_at FROM jobs WHERE id = $1`, id)
+	j, err := scanJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, ErrNotFound
+	}
+	return j, err
+}
+
+func (s *sqlStorage) UpdateJob(ctx context.Context, j Job) error {
+	ceps, cities, results, err := encodeJob(j)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE jobs SET status = $1, ceps = $2, cities = $3, results = $4, failed = $5, error = $6, updated_at = $7, finished_at = $8 WHERE id = $9`,
+		j.Status, ceps, cities, results, j.Failed, j.Error, j.UpdatedAt.UTC(), utcOrNil(j.FinishedAt), j.ID)
+	if err != nil {
+		return fmt.Errorf("error updating job: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStorage) ListUnfinishedJobs(ctx context.Context) ([]Job, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, kind, status, ceps, cities, results, total, failed, error, trace_id, created_at, updated_at, finished_at FROM jobs
+		 WHERE status IN ($1, $2) ORDER BY created_at`, jobQueued, jobRunning)
+	if err != nil {
+		return nil, fmt.Errorf("error listing jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, j)
+	}
+	return out, rows.Err()
+}
+
+// AppendOutbox inserts msgs in one transaction.
+func (s *sqlStorage) AppendOutbox(ctx context.Context, msgs []OutboxMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error saving outbox messages: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, m := range msgs {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO outbox (topic, payload, created_at) VALUES ($1, $2, $3)`,
+			m.Topic, string(m.Payload), m.CreatedAt.UTC())
+		if err != nil {
+			return fmt.Errorf("error saving outbox message: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error saving outbox messages: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) ListOutbox(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, topic, payload, attempts, last_error, created_at FROM outbox ORDER BY id LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var out []OutboxMessage
+	for rows.Next() {
+		var (
+			m       OutboxMessage
+			payload string
+		)
+		if err := rows.Scan(&m.ID, &m.Topic, &payload, &m.Attempts, &m.LastError, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error reading outbox message: %w", err)
+		}
+		m.Payload = json.RawMessage(payload)
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStorage) DeleteOutbox(ctx context.Context, id int64) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM outbox WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("error deleting outbox message: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) FailOutbox(ctx context.Context, id int64, reason string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE outbox SET attempts = attempts + 1, last_error = $1 WHERE id = $2`, reason, id)
+	if err != nil {
+		return fmt.Errorf("error updating outbox message: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) CreateDeadLetter(ctx context.Context, d DeadLetter) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO dead_letters (id, kind, subject, reason, payload, replays, trace_id, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		d.ID, d.Kind, d.Subject, d.Reason, string(d.Payload), d.Replays, d.TraceID, d.CreatedAt.UTC(), d.UpdatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("error creating dead letter: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) GetDeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, kind, subject, reason, payload, replays, trace_id, created_at, updated_at FROM dead_letters WHERE id = $1`, id)
+	d, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DeadLetter{}, ErrNotFound
+	}
+	return d, err
+}
+
+func (s *sqlStorage) UpdateDeadLetter(ctx context.Context, d DeadLetter) error {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE dead_letters SET reason = $1, replays = $2, updated_at = $3 WHERE id = $4`,
+		d.Reason, d.Replays, d.UpdatedAt.UTC(), d.ID)
+	if err != nil {
+		return fmt.Errorf("error updating dead letter: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStorage) ListDeadLetters(ctx context.Context, kind string, limit int) ([]DeadLetter, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, kind, subject, reason, payload, replays, trace_id, created_at, updated_at FROM dead_letters
+		 WHERE $1 = '' OR kind = $1 ORDER BY created_at LIMIT $2`, kind, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var out []DeadLetter
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStorage) DeleteDeadLetter(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM dead_letters WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("error deleting dead letter: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
+
+func scanSubscription(row interface{ Scan(...any) error }) (Subscription, error) {
+	var (
+		sub      Subscription
+		min, max sql.NullFloat64
+	)
+	if err := row.Scan(&sub.ID, &sub.Cep, &sub.Channel, &sub.CallbackURL, &sub.Email, &sub.Secret, &min, &max, &sub.CreatedAt); err != nil {
+		return Subscription{}, err
+	}
+	if min.Valid {
+		sub.MinTempC = &min.Float64
+	}
+	if max.Valid {
+		sub.MaxTempC = &max.Float64
+	}
+	return sub, nil
+}
+
+// encodeJob serializes the CEPs, cities and results of j, which are stored
+// as JSON text to keep the schema portable across drivers.
+func encodeJob(j Job) (string, string, string, error) {
+	ceps, err := json.Marshal(j.Ceps)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error encoding job CEPs: %w", err)
+	}
+	cities, err := json.Marshal(j.Cities)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error encoding job cities: %w", err)
+	}
+	results, err := json.Marshal(j.Results)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error encoding job results: %w", err)
+	}
+	return string(ceps), string(cities), string(results), nil
+}
+
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var (
+		j                     Job
+		ceps, cities, results string
+		finishedAt            sql.NullTime
+	)
+	if err := row.Scan(&j.ID, &j.Kind, &j.Status, &ceps, &cities, &results, &j.Total, &j.Failed, &j.Error, &j.TraceID, &j.CreatedAt, &j.UpdatedAt, &finishedAt); err != nil {
+		return Job{}, err
+	}
+	if err := json.Unmarshal([]byte(ceps), &j.Ceps); err != nil {
+		return Job{}, fmt.Errorf("error decoding job CEPs: %w", err)
+	}
+	if err := json.Unmarshal([]byte(cities), &j.Cities); err != nil {
+		return Job{}, fmt.Errorf("error decoding job cities: %w", err)
+	}
+	if err := json.Unmarshal([]byte(results), &j.Results); err != nil {
+		return Job{}, fmt.Errorf("error decoding job results: %w", err)
+	}
+	j.Completed = len(j.Results)
+	if finishedAt.Valid {
+		j.FinishedAt = &finishedAt.Time
+	}
+	return j, nil
+}
+
+func scanDeadLetter(row interface{ Scan(...any) error }) (DeadLetter, error) {
+	var (
+		d       DeadLetter
+		payload string
+	)
+	if err := row.Scan(&d.ID, &d.Kind, &d.Subject, &d.Reason, &payload, &d.Replays, &d.TraceID, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		return DeadLetter{}, err
+	}
+	d.Payload = json.RawMessage(payload)
+	return d, nil
+}
+
+func utcOrNil(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
@@ -0,0 +1,19 @@
+//go:build cgo
+
+package main
+
+import (
+	"database/sql"
+
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteAvailable reports whether the SQLite driver is compiled in; it
+// needs cgo.
+const sqliteAvailable = true
+
+func sqliteMigrationTarget(db *sql.DB) (database.Driver, error) {
+	return sqlite3.WithInstance(db, &sqlite3.Config{})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/joaolima7/otel-goexpert/pkg/accesslog"
+	"github.com/joaolima7/otel-goexpert/pkg/debugcapture"
+	"github.com/joaolima7/otel-goexpert/pkg/netacl"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tenantBaggageKey carries the tenant ID authenticated by service A.
+const tenantBaggageKey = "tenant.id"
+
+// tenantMiddleware tags the span and access log with the tenant that
+// service A authenticated, taken from the propagated baggage.
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := baggage.FromContext(r.Context()).Member(tenantBaggageKey).Value(); id != "" {
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("tenant.id", id))
+			accesslog.Annotate(r.Context(), slog.String("tenant_id", id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// debugCaptureEnabledFor reports whether service A captures the request r
+// is made for, in which case service B captures its part too.
+func debugCaptureEnabledFor(r *http.Request) bool {
+	return baggage.FromContext(r.Context()).Member(debugcapture.BaggageKey).Value() == "true"
+}
+
+// requestCaller names who sent r, to keep the idempotency keys of
+// different callers apart: its address as acl tells it and, on the
+// requests service A makes, the tenant it authenticated. The baggage only
+// narrows the scope of an address, so a caller setting it can't reach the
+// responses of another.
+func requestCaller(acl *netacl.ACL) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		caller := "client " + r.RemoteAddr
+		if addr, ok := acl.ClientAddr(r); ok {
+			caller = "client " + addr.String()
+		}
+		if tenant := baggage.FromContext(r.Context()).Member(tenantBaggageKey).Value(); tenant != "" {
+			caller += " tenant " + tenant
+		}
+		return caller
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// topK tracks the most frequent keys in bounded memory with the
+// space-saving algorithm: once capacity is reached, a new key takes over
+// the slot of the least frequent one and inherits its count as the error
+// bound. Counts are overestimates by at most Error.
+type topK struct {
+	mu       sync.Mutex
+	capacity int
+	counters map[string]*topKCounter
+}
+
+type topKCounter struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+	Error int64  `json:"error"`
+}
+
+func newTopK(capacity int) *topK {
+	return &topK{capacity: capacity, counters: make(map[string]*topKCounter, capacity)}
+}
+
+func (t *topK) Add(key string) {
+	if t.capacity <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c, ok := t.counters[key]; ok {
+		c.Count++
+		return
+	}
+	if len(t.counters) < t.capacity {
+		t.counters[key] = &topKCounter{Key: key, Count: 1}
+		return
+	}
+
+	var min *topKCounter
+	for _, c := range t.counters {
+		if min == nil || c.Count < min.Count {
+			min = c
+		}
+	}
+	delete(t.counters, min.Key)
+	t.counters[key] = &topKCounter{Key: key, Count: min.Count + 1, Error: min.Count}
+}
+
+// Top returns up to n counters, most frequent first.
+func (t *topK) Top(n int) []topKCounter {
+	t.mu.Lock()
+	out := make([]topKCounter, 0, len(t.counters))
+	for _, c := range t.counters {
+		out = append(out, *c)
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b topKCounter) int {
+		if a.Count != b.Count {
+			return cmp.Compare(b.Count, a.Count)
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultTrendHours = 24
+	maxTrendHours     = 7 * 24
+	// maxTrendLookups caps the lookups a trend reads from the history;
+	// past it, the oldest are left out and the trend is marked truncated.
+	maxTrendLookups = 10000
+)
+
+// trendStats summarizes the temperatures of a set of lookups.
+type trendStats struct {
+	Lookups  int     `json:"lookups"`
+	MinTempC float64 `json:"min_temp_C"`
+	MaxTempC float64 `json:"max_temp_C"`
+	AvgTempC float64 `json:"avg_temp_C"`
+}
+
+func (s *trendStats) add(tempC float64) {
+	if s.Lookups == 0 || tempC < s.MinTempC {
+		s.MinTempC = tempC
+	}
+	if s.Lookups == 0 || tempC > s.MaxTempC {
+		s.MaxTempC = tempC
+	}
+	// AvgTempC holds the sum until round.
+	s.AvgTempC += tempC
+	s.Lookups++
+}
+
+func (s *trendStats) round() {
+	if s.Lookups > 0 {
+		s.AvgTempC = math.Round(s.AvgTempC/float64(s.Lookups)*10) / 10
+	}
+}
+
+type trendHour struct {
+	Hour time.Time `json:"hour"`
+	trendStats
+}
+
+// trendScopeCep and trendScopeMasked tell which lookups a trend covers:
+// those of the CEP alone, or those of every CEP that masks to the same
+// value, since the history keeps CEPs as CEP_MASKING leaves them.
+const (
+	trendScopeCep    = "cep"
+	trendScopeMasked = "masked"
+)
+
+// trendResponse is the answer of GET /trend/{cep}. Stats is nil when the
+// history has no lookup of the CEP in the window. Under a masking mode,
+// Scope is trendScopeMasked and MaskedCep is the value the lookups were
+// gathered by.
+type trendResponse struct {
+	Cep       string      `json:"cep"`
+	Scope     string      `json:"scope"`
+	MaskedCep string      `json:"masked_cep,omitempty"`
+	Hours     int         `json:"hours"`
+	From      time.Time   `json:"from"`
+	To        time.Time   `json:"to"`
+	Stats     *trendStats `json:"stats"`
+	Series    []trendHour `json:"series"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// handleTrend answers GET /trend/{cep}?hours=24 from the lookup history:
+// the minimum, maximum and average temperature looked up for the CEP in
+// the last hours, and the same per UTC hour, oldest first, for the hours
+// that had lookups. The history keeps CEPs masked, so under CEP_MASKING
+// the trend is of the masked CEP, and says so in its scope: with truncate,
+// it covers every CEP sharing the first five digits.
+func handleTrend(lookups LookupRepository, strictness cep.Strictness, masker *masking.Masker, tracer trace.Tracer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Start(r.Context(), "handle_trend_request")
+		defer span.End()
+
+		c, err := cep.Normalize(chi.URLParam(r, "cep"))
+		if err != nil || !isValidCep(c, strictness) {
+			httpapi.RespondWithError(w, weather.CodeInvalidZipcode, "invalid zipcode", ctx)
+			return
+		}
+		hours := defaultTrendHours
+		if v := r.URL.Query().Get("hours"); v != "" {
+			hours, err = strconv.Atoi(v)
+			if err != nil || hours < 1 || hours > maxTrendHours {
+				httpapi.RespondWithError(w, weather.CodeInvalidRequest, "hours must be between 1 and "+strconv.Itoa(maxTrendHours), ctx)
+				return
+			}
+		}
+		span.SetAttributes(attribute.String("cep", masker.Cep(c)), attribute.Int("trend.hours", hours))
+
+		to := clock.Now().UTC()
+		from := to.Add(-time.Duration(hours) * time.Hour)
+		masked := masker.Cep(c)
+		history, err := lookups.ListLookups(ctx, masked, from, maxTrendLookups)
+		if err != nil {
+			errlog.Printf("Error loading lookups of CEP %s: %v", masked, err)
+			httpapi.RespondWithError(w, weather.CodeInternal, "internal server error", ctx)
+			return
+		}
+		span.SetAttributes(attribute.Int("trend.lookups", len(history)))
+
+		resp := trendResponse{
+			Cep:       c,
+			Scope:     trendScopeCep,
+			Hours:     hours,
+			From:      from,
+			To:        to,
+			Series:    []trendHour{},
+			Truncated: len(history) == maxTrendLookups,
+		}
+		if masker.Lossy() {
+			resp.Scope, resp.MaskedCep = trendScopeMasked, masked
+		}
+		if len(history) > 0 {
+			resp.Stats = &trendStats{}
+		}
+		// The history comes newest first.
+		for _, l := range slices.Backward(history) {
+			resp.Stats.add(l.TempC)
+			hour := l.CreatedAt.UTC().Truncate(time.Hour)
+			if n := len(resp.Series); n == 0 || !resp.Series[n-1].Hour.Equal(hour) {
+				resp.Series = append(resp.Series, trendHour{Hour: hour})
+			}
+			resp.Series[len(resp.Series)-1].add(l.TempC)
+		}
+		if resp.Stats != nil {
+			resp.Stats.round()
+		}
+		for i := range resp.Series {
+			resp.Series[i].round()
+		}
+		httpapi.Render(w, http.StatusOK, resp, ctx)
+	}
+}
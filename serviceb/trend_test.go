@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+)
+
+func TestTrendScope(t *testing.T) {
+	tests := []struct {
+		mode      masking.Mode
+		scope     string
+		maskedCep string
+		lookups   int
+	}{
+		{masking.None, trendScopeCep, "", 1},
+		// Truncated, 01001000 and 01001999 share a history.
+		{masking.Truncate, trendScopeMasked, "01001***", 2},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			masker, err := masking.New(string(tt.mode), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := newMemoryStorage(0)
+			for i, cep := range []string{"01001000", "01001999"} {
+				l := Lookup{Cep: masker.Cep(cep), City: "São Paulo", TempC: 20 + float64(i), CreatedAt: clock.Now()}
+				if err := store.SaveLookup(context.Background(), l); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := chi.NewRouter()
+			r.Get("/trend/{cep}", handleTrend(store, cep.Format, masker, testTracer))
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/trend/01001000", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+
+			var resp trendResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding response: %v\n%s", err, rec.Body)
+			}
+			if resp.Cep != "01001000" {
+				t.Errorf("cep = %q, want the requested one", resp.Cep)
+			}
+			if resp.Scope != tt.scope || resp.MaskedCep != tt.maskedCep {
+				t.Errorf("scope = %q, masked_cep = %q; want %q, %q", resp.Scope, resp.MaskedCep, tt.scope, tt.maskedCep)
+			}
+			if resp.Stats == nil || resp.Stats.Lookups != tt.lookups {
+				t.Errorf("stats = %+v, want %d lookups", resp.Stats, tt.lookups)
+			}
+		})
+	}
+}
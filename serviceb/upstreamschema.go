@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// schemaFiles holds a JSON Schema per upstream API, named after the
+// provider, describing the responses the provider relies on.
+//
+//go:embed schemas
+var schemaFiles embed.FS
+
+var upstreamSchemas = compileUpstreamSchemas()
+
+func compileUpstreamSchemas() map[string]*jsonschema.Schema {
+	files, err := fs.ReadDir(schemaFiles, "schemas")
+	if err != nil {
+		panic(err)
+	}
+	c := jsonschema.NewCompiler()
+	schemas := make(map[string]*jsonschema.Schema, len(files))
+	for _, f := range files {
+		data, err := schemaFiles.ReadFile("schemas/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+		if err != nil {
+			panic(fmt.Sprintf("schemas/%s: %v", f.Name(), err))
+		}
+		if err := c.AddResource(f.Name(), doc); err != nil {
+			panic(err)
+		}
+		schemas[strings.TrimSuffix(f.Name(), ".json")] = c.MustCompile(f.Name())
+	}
+	return schemas
+}
+
+// upstreamSchemaError tells which field of a provider's response broke its
+// schema, and how.
+type upstreamSchemaError struct {
+	provider string
+	// field is the dotted path of the offending value; "response" for the
+	// body as a whole.
+	field  string
+	reason string
+}
+
+func (e *upstreamSchemaError) Error() string {
+	return fmt.Sprintf("%s response does not match its schema at %s: %s", e.provider, e.field, e.reason)
+}
+
+func (e *upstreamSchemaError) Unwrap() error { return apperrors.ErrUpstreamSchema }
+
+var schemaMessages = message.NewPrinter(language.English)
+
+// validateUpstream checks body against the schema of provider before any
+// of it is used. On a mismatch it records the offending field on the span
+// and returns an error wrapping apperrors.ErrUpstreamSchema.
+func validateUpstream(ctx context.Context, provider string, body []byte) error {
+	schema, ok := upstreamSchemas[provider]
+	if !ok {
+		return nil
+	}
+
+	var schemaErr *upstreamSchemaError
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		schemaErr = &upstreamSchemaError{provider: provider, field: "response", reason: "not valid JSON"}
+	} else if err := schema.Validate(doc); err != nil {
+		var ve *jsonschema.ValidationError
+		if !errors.As(err, &ve) {
+			return err
+		}
+		schemaErr = schemaViolation(provider, ve)
+	}
+	if schemaErr == nil {
+		return nil
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("upstream.schema.provider", provider),
+		attribute.String("upstream.schema.field", schemaErr.field),
+	)
+	span.RecordError(schemaErr)
+	return schemaErr
+}
+
+// schemaViolation reports the first innermost cause of a validation error,
+// which points at the offending value rather than at the object holding it.
+func schemaViolation(provider string, ve *jsonschema.ValidationError) *upstreamSchemaError {
+	for len(ve.Causes) > 0 {
+		ve = ve.Causes[0]
+	}
+	path := slices.Clone(ve.InstanceLocation)
+	if req, ok := ve.ErrorKind.(*kind.Required); ok && len(req.Missing) > 0 {
+		path = append(path, req.Missing[0])
+	}
+	field := strings.Join(path, ".")
+	if field == "" {
+		field = "response"
+	}
+	return &upstreamSchemaError{provider: provider, field: field, reason: ve.ErrorKind.LocalizedString(schemaMessages)}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WeatherProvider looks up the current weather of a Brazilian city.
+// Each implementation lives in its own file and registers itself from an
+// init function; WEATHER_PROVIDERS picks which ones serve requests.
+type WeatherProvider interface {
+	Name() string
+	// CurrentWeather returns the temperature in Celsius and the condition,
+	// or apperrors.ErrCepNotFound when the provider does not know the city.
+	CurrentWeather(ctx context.Context, city string) (weatherObservation, error)
+}
+
+// providerProbe is implemented by providers, of either kind, whose API
+// reachability gates readiness.
+type providerProbe interface {
+	Name() string
+	ProbeURL() string
+}
+
+// providerVerifier is implemented by providers that can check their
+// credentials at startup, beyond plain reachability.
+type providerVerifier interface {
+	Verify(ctx context.Context) error
+}
+
+// providerRateLimited is implemented by providers whose calls go through a
+// local rate limiter, for GET /providers to report their quota.
+type providerRateLimited interface {
+	RateLimiter() *providerLimiter
+}
+
+// weatherProviderFactory builds a provider from the service configuration.
+// The provider calls its API through up.
+type weatherProviderFactory func(cfg config, up *upstreamClient) (WeatherProvider, error)
+
+var weatherProviderFactories = make(map[string]weatherProviderFactory)
+
+func registerWeatherProvider(name string, factory weatherProviderFactory) {
+	if _, dup := weatherProviderFactories[name]; dup {
+		panic("weather provider registered twice: " + name)
+	}
+	weatherProviderFactories[name] = factory
+}
+
+type weatherChainEntry struct {
+	provider WeatherProvider
+	weight   int
+	health   *trackedProvider
+}
+
+// weatherChain asks a healthy provider picked by its routing policy first,
+// then the others in order until one answers, the demoted ones last.
+type weatherChain struct {
+	entries []weatherChainEntry
+	policy  routingPolicy
+	tracker *healthTracker
+}
+
+func newWeatherChain(cfg config, tracker *healthTracker, up *upstreamClient) (*weatherChain, error) {
+	if len(cfg.WeatherProviders) == 0 {
+		return nil, errors.New("no weather providers configured")
+	}
+	policy, err := parseRoutingPolicy(cfg.ProviderRouting)
+	if err != nil {
+		return nil, err
+	}
+	chain := &weatherChain{policy: policy, tracker: tracker}
+	for _, spec := range cfg.WeatherProviders {
+		name, weight, err := parseWeatherProviderSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		factory, ok := weatherProviderFactories[name]
+		if !ok {
+			available := slices.Sorted(maps.Keys(weatherProviderFactories))
+			return nil, fmt.Errorf("unknown weather provider %q (available: %s)", name, strings.Join(available, ", "))
+		}
+		p, err := factory(cfg, up)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize weather provider %s: %w", name, err)
+		}
+		health := tracker.Register("weather", name, func(ctx context.Context) error {
+			_, err := p.CurrentWeather(ctx, cfg.Health.ProbeCity)
+			return err
+		})
+		chain.entries = append(chain.entries, weatherChainEntry{provider: p, weight: weight, health: health})
+	}
+	return chain, nil
+}
+
+// parseWeatherProviderSpec splits a WEATHER_PROVIDERS entry written as
+// "name" or "name:weight".
+func parseWeatherProviderSpec(spec string) (string, int, error) {
+	name, w, ok := strings.Cut(spec, ":")
+	if !ok {
+		return name, 0, nil
+	}
+	weight, err := strconv.Atoi(w)
+	if err != nil || weight < 0 {
+		return "", 0, fmt.Errorf("invalid weight in weather provider %q", spec)
+	}
+	return name, weight, nil
+}
+
+// Names lists the providers in the order they are asked.
+func (c *weatherChain) Names() []string {
+	names := make([]string, len(c.entries))
+	for i, e := range c.entries {
+		names[i] = e.provider.Name()
+	}
+	return names
+}
+
+func (c *weatherChain) order() []weatherChainEntry {
+	return orderProviders(c.entries, c.policy,
+		func(e weatherChainEntry) int { return e.weight },
+		func(e weatherChainEntry) *trackedProvider { return e.health })
+}
+
+// CurrentWeather falls through to the next provider on any failure. The
+// city is reported as not found only when every provider said so;
+// otherwise the other failures are returned.
+func (c *weatherChain) CurrentWeather(ctx context.Context, city string) (weatherObservation, error) {
+	span := trace.SpanFromContext(ctx)
+	var notFound, failed []error
+	for _, e := range c.order() {
+		start := time.Now()
+		obs, err := e.provider.CurrentWeather(ctx, city)
+		if ctx.Err() == nil {
+			c.tracker.Observe(e.health, err, time.Since(start))
+		}
+		if err == nil {
+			span.SetAttributes(attribute.String("weather.provider", e.provider.Name()),
+				attribute.String("weather.condition", string(obs.Condition)))
+			obs.Provider = e.provider.Name()
+			return obs, nil
+		}
+		err = fmt.Errorf("%s: %w", e.provider.Name(), err)
+		if ctx.Err() != nil {
+			return weatherObservation{}, err
+		}
+		if errors.Is(err, apperrors.ErrCepNotFound) {
+			notFound = append(notFound, err)
+		} else {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return weatherObservation{}, errors.Join(failed...)
+	}
+	return weatherObservation{}, errors.Join(notFound...)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+)
+
+func init() {
+	registerWeatherProvider("openmeteo", func(cfg config, up *upstreamClient) (WeatherProvider, error) {
+		limiter, err := newProviderLimiter("openmeteo", cfg.OpenMeteoRateLimit, cfg.ProviderRateBurst, cfg.ProviderRateMaxWait, up.meter)
+		if err != nil {
+			return nil, err
+		}
+		forecast, err := newEndpointSet(cfg, "openmeteo", "https://api.open-meteo.com")
+		if err != nil {
+			return nil, err
+		}
+		geocoding, err := newEndpointSet(cfg, "openmeteo_geocoding", "https://geocoding-api.open-meteo.com")
+		if err != nil {
+			return nil, err
+		}
+		return &openMeteoProvider{upstream: up, limiter: limiter, forecast: forecast, geocoding: geocoding}, nil
+	})
+}
+
+// openMeteoProvider queries Open-Meteo, which needs no API key. Cities are
+// resolved to coordinates with its geocoding API first.
+type openMeteoProvider struct {
+	upstream  *upstreamClient
+	limiter   *providerLimiter
+	forecast  *endpointSet
+	geocoding *endpointSet
+}
+
+func (p *openMeteoProvider) Name() string                  { return "openmeteo" }
+func (p *openMeteoProvider) ProbeURL() string              { return p.forecast.URL() + "/" }
+func (p *openMeteoProvider) RateLimiter() *providerLimiter { return p.limiter }
+
+func (p *openMeteoProvider) CurrentWeather(ctx context.Context, city string) (weatherObservation, error) {
+	var geo struct {
+		Results []struct {
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+		} `json:"results"`
+	}
+	geoURL := p.geocoding.URL() + "/v1/search?count=1&language=pt&countryCode=BR&name=" + url.QueryEscape(city)
+	if err := p.get(ctx, geoURL, &geo); err != nil {
+		return weatherObservation{}, err
+	}
+	if len(geo.Results) == 0 {
+		return weatherObservation{}, apperrors.ErrCepNotFound
+	}
+
+	var forecast struct {
+		Current struct {
+			Temperature float64 `json:"temperature_2m"`
+			WeatherCode *int    `json:"weather_code"`
+		} `json:"current"`
+	}
+	forecastURL := fmt.Sprintf("%s/v1/forecast?latitude=%f&longitude=%f&current=temperature_2m,weather_code",
+		p.forecast.URL(), geo.Results[0].Latitude, geo.Results[0].Longitude)
+	if err := p.get(ctx, forecastURL, &forecast); err != nil {
+		return weatherObservation{}, err
+	}
+	return observed(forecast.Current.Temperature, forecast.Current.WeatherCode, wmoCondition), nil
+}
+
+func (p *openMeteoProvider) get(ctx context.Context, rawURL string, v any) error {
+	status, body, err := p.upstream.Get(ctx, "Open-Meteo API", p.limiter, rawURL)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status code from Open-Meteo API: %d", status)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("error decoding Open-Meteo API response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+)
+
+func init() {
+	registerWeatherProvider("openweathermap", func(cfg config, up *upstreamClient) (WeatherProvider, error) {
+		if cfg.OpenWeatherMapAPIKey == "" {
+			return nil, errors.New("OPENWEATHERMAP_API_KEY is required")
+		}
+		limiter, err := newProviderLimiter("openweathermap", cfg.OpenWeatherMapRateLimit, cfg.ProviderRateBurst, cfg.ProviderRateMaxWait, up.meter)
+		if err != nil {
+			return nil, err
+		}
+		endpoints, err := newEndpointSet(cfg, "openweathermap", "https://api.openweathermap.org")
+		if err != nil {
+			return nil, err
+		}
+		return &openWeatherMapProvider{upstream: up, key: cfg.OpenWeatherMapAPIKey, limiter: limiter, endpoints: endpoints}, nil
+	})
+}
+
+// openWeatherMapProvider queries the OpenWeatherMap current weather API.
+type openWeatherMapProvider struct {
+	upstream  *upstreamClient
+	key       string
+	limiter   *providerLimiter
+	endpoints *endpointSet
+}
+
+func (p *openWeatherMapProvider) Name() string                  { return "openweathermap" }
+func (p *openWeatherMapProvider) ProbeURL() string              { return p.endpoints.URL() + "/" }
+func (p *openWeatherMapProvider) RateLimiter() *providerLimiter { return p.limiter }
+
+func (p *openWeatherMapProvider) CurrentWeather(ctx context.Context, city string) (weatherObservation, error) {
+	rawURL := fmt.Sprintf("%s/data/2.5/weather?units=metric&q=%s,BR&appid=%s",
+		p.endpoints.URL(), url.QueryEscape(city), url.QueryEscape(p.key))
+	status, body, err := p.upstream.Get(ctx, "OpenWeatherMap API", p.limiter, rawURL)
+	if err != nil {
+		return weatherObservation{}, err
+	}
+	if status == http.StatusNotFound {
+		return weatherObservation{}, apperrors.ErrCepNotFound
+	}
+	if status != http.StatusOK {
+		return weatherObservation{}, fmt.Errorf("unexpected status code from OpenWeatherMap API: %d", status)
+	}
+
+	var weather struct {
+		Main struct {
+			Temp float64 `json:"temp"`
+		} `json:"main"`
+		// Weather lists the conditions, the primary one first.
+		Weather []struct {
+			ID int `json:"id"`
+		} `json:"weather"`
+	}
+	if err := json.Unmarshal(body, &weather); err != nil {
+		return weatherObservation{}, fmt.Errorf("error decoding OpenWeatherMap API response: %w", err)
+	}
+	var id *int
+	if len(weather.Weather) > 0 {
+		id = &weather.Weather[0].ID
+	}
+	return observed(weather.Main.Temp, id, openWeatherMapCondition), nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+func init() {
+	registerWeatherProvider("stub", func(cfg config, _ *upstreamClient) (WeatherProvider, error) {
+		return stubWeatherProvider{tempC: cfg.StubWeatherTempC}, nil
+	})
+}
+
+// stubWeatherProvider answers every city with a fixed temperature under a
+// clear sky, for local development and tests without provider credentials.
+type stubWeatherProvider struct {
+	tempC float64
+}
+
+func (stubWeatherProvider) Name() string { return "stub" }
+
+func (p stubWeatherProvider) CurrentWeather(context.Context, string) (weatherObservation, error) {
+	return weatherObservation{TempC: p.tempC, Condition: weather.ConditionClear}, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/weather"
+)
+
+func init() {
+	registerWeatherProvider("synthetic", func(cfg config, _ *upstreamClient) (WeatherProvider, error) {
+		return syntheticWeatherProvider{cfg: cfg.SyntheticWeather}, nil
+	})
+}
+
+// syntheticWeatherConfig tunes the synthetic weather provider. Every city
+// gets a base temperature derived from Seed, so runs with the same seed
+// see the same weather; Variance adds up to that many degrees of noise
+// per call, and every call takes Latency plus up to Jitter.
+type syntheticWeatherConfig struct {
+	Seed     int
+	Variance float64
+	Latency  time.Duration
+	Jitter   time.Duration
+}
+
+// syntheticWeatherProvider makes up plausible weather without calling
+// anything, for demos, workshops and load tests. Cities range from 10 to
+// 30°C on average and swing 4°C over the day, warmest mid-afternoon in
+// Brasília time. The sky of each city changes every syntheticSkyPeriod,
+// clear or cloudy more often than not.
+type syntheticWeatherProvider struct {
+	cfg syntheticWeatherConfig
+}
+
+// syntheticDailySwing is the amplitude of the day/night cycle, in °C.
+const syntheticDailySwing = 4.0
+
+// syntheticSkyPeriod is how long the synthetic sky over a city lasts.
+const syntheticSkyPeriod = 3 * time.Hour
+
+// syntheticSkies are drawn from uniformly, so repeats make a sky likelier.
+var syntheticSkies = []weather.Condition{
+	weather.ConditionClear, weather.ConditionClear, weather.ConditionClear,
+	weather.ConditionPartlyCloudy, weather.ConditionPartlyCloudy,
+	weather.ConditionCloudy, weather.ConditionCloudy,
+	weather.ConditionFog, weather.ConditionDrizzle, weather.ConditionRain, weather.ConditionRain, weather.ConditionStorm,
+}
+
+var brasiliaTime = time.FixedZone("BRT", -3*60*60)
+
+func (syntheticWeatherProvider) Name() string { return "synthetic" }
+
+func (p syntheticWeatherProvider) CurrentWeather(ctx context.Context, city string) (weatherObservation, error) {
+	if err := p.wait(ctx); err != nil {
+		return weatherObservation{}, err
+	}
+
+	key := strconv.Itoa(p.cfg.Seed) + ":" + strings.ToLower(strings.TrimSpace(city))
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	base := 10 + float64(h.Sum64()%2000)/100
+
+	now := clock.Now().In(brasiliaTime)
+	h.Reset()
+	h.Write([]byte(key + ":" + strconv.FormatInt(now.Unix()/int64(syntheticSkyPeriod/time.Second), 10)))
+	sky := syntheticSkies[h.Sum64()%uint64(len(syntheticSkies))]
+
+	hour := float64(now.Hour()) + float64(now.Minute())/60
+	temp := base + syntheticDailySwing*math.Sin(2*math.Pi*(hour-9)/24)
+	if p.cfg.Variance > 0 {
+		temp += (clock.Random().Float64()*2 - 1) * p.cfg.Variance
+	}
+	return weatherObservation{TempC: math.Round(temp*10) / 10, Condition: sky}, nil
+}
+
+// wait simulates the provider's latency, on the wall clock so that it
+// also holds under DETERMINISTIC_MODE.
+func (p syntheticWeatherProvider) wait(ctx context.Context) error {
+	d := p.cfg.Latency
+	if p.cfg.Jitter > 0 {
+		d += time.Duration(clock.Random().Int64N(int64(p.cfg.Jitter)))
+	}
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
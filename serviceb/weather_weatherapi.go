@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/joaolima7/otel-goexpert/pkg/apperrors"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+)
+
+func init() {
+	registerWeatherProvider("weatherapi", func(cfg config, up *upstreamClient) (WeatherProvider, error) {
+		limiter, err := newProviderLimiter("weatherapi", cfg.WeatherAPIRateLimit, cfg.ProviderRateBurst, cfg.ProviderRateMaxWait, up.meter)
+		if err != nil {
+			return nil, err
+		}
+		endpoints, err := newEndpointSet(cfg, "weatherapi", "https://api.weatherapi.com")
+		if err != nil {
+			return nil, err
+		}
+		return &weatherAPIProvider{upstream: up, key: cfg.WeatherAPIKey, limiter: limiter, endpoints: endpoints}, nil
+	})
+}
+
+type WeatherResponse struct {
+	Location struct {
+		Name string `json:"name"`
+	} `json:"location"`
+	Current struct {
+		TempC     float64 `json:"temp_c"`
+		Condition struct {
+			Code *int `json:"code"`
+		} `json:"condition"`
+	} `json:"current"`
+}
+
+// weatherAPIProvider queries weatherapi.com.
+type weatherAPIProvider struct {
+	upstream  *upstreamClient
+	key       string
+	limiter   *providerLimiter
+	endpoints *endpointSet
+}
+
+func (p *weatherAPIProvider) Name() string                  { return "weatherapi" }
+func (p *weatherAPIProvider) ProbeURL() string              { return p.endpoints.URL() + "/" }
+func (p *weatherAPIProvider) RateLimiter() *providerLimiter { return p.limiter }
+
+// Verify checks the API key at startup.
+func (p *weatherAPIProvider) Verify(ctx context.Context) error {
+	return weatherAPIKeyCheck(p.upstream.client, p.endpoints.URL(), p.key)(ctx)
+}
+
+func (p *weatherAPIProvider) CurrentWeather(ctx context.Context, city string) (weatherObservation, error) {
+	encodedCity := url.QueryEscape(city)
+	url := fmt.Sprintf("%s/v1/current.json?key=%s&q=%s&aqi=no", p.endpoints.URL(), p.key, encodedCity)
+
+	status, body, err := p.upstream.Get(ctx, "Weather API", p.limiter, url)
+	if err != nil {
+		errlog.Printf("Error calling Weather API: %v", err)
+		return weatherObservation{}, err
+	}
+
+	if status == http.StatusNotFound || status == http.StatusBadRequest {
+		log.Printf("Weather API could not find city '%s': status=%d, body=%s", city, status, string(body))
+		return weatherObservation{}, apperrors.ErrCepNotFound
+	}
+
+	if status != http.StatusOK {
+		errlog.Printf("Weather API error: status=%d, body=%s", status, string(body))
+		return weatherObservation{}, fmt.Errorf("unexpected status code from Weather API: %d", status)
+	}
+
+	if err := validateUpstream(ctx, "weatherapi", body); err != nil {
+		errlog.Printf("Unexpected Weather API response: %v", err)
+		return weatherObservation{}, err
+	}
+
+	var weather WeatherResponse
+	if err := json.Unmarshal(body, &weather); err != nil {
+		errlog.Printf("Error decoding Weather API response: %v", err)
+		return weatherObservation{}, fmt.Errorf("error decoding Weather API response: %w", err)
+	}
+
+	return observed(weather.Current.TempC, weather.Current.Condition.Code, weatherAPICondition), nil
+}
+
+// weatherAPIKeyCheck makes one WeatherAPI call to tell a rejected key
+// apart from an unreachable API. It bypasses the provider limiter and the
+// retry policy, so that a boot check neither waits on the quota nor spends
+// the retry budget.
+func weatherAPIKeyCheck(client *http.Client, baseURL, key string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if key == "" {
+			return errors.New("WEATHER_API_KEY is empty")
+		}
+		u := baseURL + "/v1/current.json?aqi=no&q=London&key=" + url.QueryEscape(key)
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			// Drop the *url.Error wrapper: its message includes the key.
+			return fmt.Errorf("error calling Weather API: %w", errors.Unwrap(err))
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			return fmt.Errorf("Weather API rejected the key (status %d)", resp.StatusCode)
+		case resp.StatusCode != http.StatusOK:
+			return fmt.Errorf("unexpected status code from Weather API: %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/client"
+	"github.com/joaolima7/otel-goexpert/pkg/clock"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// thresholdEvent is the payload delivered when a lookup finds the
+// temperature of a subscribed CEP outside the subscription's range.
+type thresholdEvent struct {
+	ID             string    `json:"id"`
+	Type           string    `json:"type"`
+	SubscriptionID string    `json:"subscription_id"`
+	Cep            string    `json:"cep"`
+	City           string    `json:"city"`
+	TempC          float64   `json:"temp_C"`
+	MinTempC       *float64  `json:"min_temp_C,omitempty"`
+	MaxTempC       *float64  `json:"max_temp_C,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+// crossesThreshold reports whether tempC is outside the range of sub.
+func crossesThreshold(sub Subscription, tempC float64) bool {
+	return (sub.MinTempC != nil && tempC < *sub.MinTempC) || (sub.MaxTempC != nil && tempC > *sub.MaxTempC)
+}
+
+// subscriptionNotifier delivers the threshold events of subscriptions over
+// their channel on the worker pool, and dead-letters those it could not
+// deliver.
+type subscriptionNotifier struct {
+	notifiers map[string]Notifier
+	subs      SubscriptionRepository
+	pool      *workerPool
+	dead      *deadLetterQueue
+	masker    *masking.Masker
+	tracer    trace.Tracer
+}
+
+// Notify delivers threshold events for subs, the subscriptions of a CEP,
+// in the background, each over its subscription's channel, so the lookup
+// response isn't held up.
+func (sn *subscriptionNotifier) Notify(ctx context.Context, subs []Subscription, city string, tempC float64) {
+	link := trace.LinkFromContext(ctx)
+	for _, sub := range subs {
+		if !crossesThreshold(sub, tempC) {
+			continue
+		}
+		n, ok := sn.notifiers[sub.Channel]
+		if !ok {
+			errlog.Printf("No notifier for channel %q of subscription %s", sub.Channel, sub.ID)
+			continue
+		}
+		e := thresholdEvent{
+			ID:             randomHex(16),
+			Type:           "weather.threshold_crossed",
+			SubscriptionID: sub.ID,
+			Cep:            sub.Cep,
+			City:           city,
+			TempC:          tempC,
+			MinTempC:       sub.MinTempC,
+			MaxTempC:       sub.MaxTempC,
+			Time:           clock.Now().UTC(),
+		}
+		// Notifiers bound themselves with their own timeout.
+		err := sn.pool.Submit(sub.Channel, -1, func(ctx context.Context) {
+			ctx, span := sn.tracer.Start(ctx, "deliver_notification", trace.WithNewRoot(), trace.WithLinks(link),
+				trace.WithAttributes(
+					attribute.String("subscription.id", sub.ID),
+					attribute.String("notification.channel", sub.Channel),
+					attribute.String("notification.event_id", e.ID),
+				))
+			defer span.End()
+			if err := n.Notify(ctx, sub, e); err != nil {
+				errlog.Printf("Error delivering %s notification for subscription %s: %v", sub.Channel, sub.ID, err)
+				sn.dead.Add(ctx, deadLetterNotification, sn.subject(sub), notificationLetter{SubscriptionID: sub.ID, Event: e}, err)
+			}
+		})
+		if err != nil {
+			errlog.Printf("Dropped %s notification for subscription %s: %v", sub.Channel, sub.ID, err)
+			sn.dead.Add(ctx, deadLetterNotification, sn.subject(sub), notificationLetter{SubscriptionID: sub.ID, Event: e}, err)
+		}
+	}
+}
+
+func (sn *subscriptionNotifier) subject(sub Subscription) string {
+	return fmt.Sprintf("%s notification of subscription %s (CEP %s)", sub.Channel, sub.ID, sn.masker.Cep(sub.Cep))
+}
+
+// webhookNotifier POSTs the event as JSON to the subscription's callback,
+// signed with its secret (see client.Sign).
+type webhookNotifier struct {
+	upstream *upstreamClient
+	timeout  time.Duration
+}
+
+func (n webhookNotifier) Validate(sub Subscription) error {
+	if !isHTTPURL(sub.CallbackURL) {
+		return errors.New("invalid callback_url")
+	}
+	return nil
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, sub Subscription, e thresholdEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding webhook payload: %w", err)
+	}
+	return n.upstream.Post(ctx, "webhook", sub.CallbackURL, body, func(req *http.Request) {
+		req.Header.Set(client.SignatureHeader, client.Sign(sub.Secret, time.Now(), body))
+	})
+}
+
+// Post POSTs a JSON body to url, retrying on transport errors, 5xx and
+// 429. prepare runs on every attempt, before the request is sent.
+func (u *upstreamClient) Post(ctx context.Context, gateway, url string, body []byte, prepare func(req *http.Request)) error {
+	span := trace.SpanFromContext(ctx)
+	return u.retry.Do(ctx, gateway, func(ctx context.Context) (bool, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return false, fmt.Errorf("error creating request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if prepare != nil {
+			prepare(req)
+		}
+
+		resp, err := u.client.Do(req)
+		if err != nil {
+			return true, fmt.Errorf("error calling %s: %w", gateway, err)
+		}
+		resp.Body.Close()
+		span.SetAttributes(attribute.Int(gateway+".status_code", resp.StatusCode))
+		if resp.StatusCode >= 300 {
+			return resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests,
+				fmt.Errorf("%s answered with status %d", gateway, resp.StatusCode)
+		}
+		return false, nil
+	})
+}
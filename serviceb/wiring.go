@@ -0,0 +1,629 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/joaolima7/otel-goexpert/pkg/accesslog"
+	"github.com/joaolima7/otel-goexpert/pkg/audit"
+	"github.com/joaolima7/otel-goexpert/pkg/buildinfo"
+	"github.com/joaolima7/otel-goexpert/pkg/cep"
+	"github.com/joaolima7/otel-goexpert/pkg/compression"
+	"github.com/joaolima7/otel-goexpert/pkg/cron"
+	"github.com/joaolima7/otel-goexpert/pkg/debugcapture"
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"github.com/joaolima7/otel-goexpert/pkg/health"
+	"github.com/joaolima7/otel-goexpert/pkg/httpapi"
+	"github.com/joaolima7/otel-goexpert/pkg/idempotency"
+	"github.com/joaolima7/otel-goexpert/pkg/masking"
+	"github.com/joaolima7/otel-goexpert/pkg/metrics"
+	"github.com/joaolima7/otel-goexpert/pkg/netacl"
+	"github.com/joaolima7/otel-goexpert/pkg/outbound"
+	"github.com/joaolima7/otel-goexpert/pkg/profiling"
+	"github.com/joaolima7/otel-goexpert/pkg/redact"
+	"github.com/joaolima7/otel-goexpert/pkg/retry"
+	"github.com/joaolima7/otel-goexpert/pkg/sampling"
+	"github.com/joaolima7/otel-goexpert/pkg/server"
+	"github.com/joaolima7/otel-goexpert/pkg/shedding"
+	"github.com/joaolima7/otel-goexpert/pkg/slowrequest"
+	"github.com/joaolima7/otel-goexpert/pkg/synthetic"
+	"github.com/joaolima7/otel-goexpert/pkg/watchdog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+	"google.golang.org/grpc"
+)
+
+// appOptions describes how the components of service B are built and
+// started. Alternate wirings (tests, an all-in-one binary) can reuse it and
+// override individual providers with fx.Decorate or fx.Replace.
+func appOptions(cfg config) fx.Option {
+	return fx.Options(
+		fx.Supply(cfg),
+		fx.Provide(
+			provideTracerProvider,
+			provideTracer,
+			provideMeterProvider,
+			provideMeter,
+			provideAuditLogger,
+			provideCepMasker,
+			provideDebugCapturer,
+			provideHTTPClient,
+			provideUpstreamClient,
+			provideCepStrictness,
+			provideHealthTracker,
+			provideMQTTPublisher,
+			provideNATSPublisher,
+			provideNotifiers,
+			provideCepChain,
+			provideWeatherChain,
+			provideStorage,
+			newDeadLetterQueue,
+			provideOutboxRelay,
+			provideLookupCache,
+			provideWeatherResolver,
+			provideSubscriptionNotifier,
+			provideQueryStats,
+			provideLeaderElector,
+			provideScheduler,
+			provideWorkerPool,
+			provideJobRunner,
+			provideReadiness,
+			provideWeatherHandler,
+			provideAdminAPI,
+			provideRouter,
+			provideServer,
+			provideConsulRegistrar,
+		),
+		fx.Invoke(flushTelemetryLast, stopErrorLog, startProfiler, startWatchdog, startEndpointProbes, verifyDependencies),
+		fx.NopLogger,
+	)
+}
+
+// provideTracerProvider also returns the connection to the collector.
+func provideTracerProvider(lc fx.Lifecycle, cfg config) (*sdktrace.TracerProvider, *grpc.ClientConn, error) {
+	traceSampler.SetRate(cfg.TraceSampleRate)
+	tp, conn, err := initTracer(cfg.CollectorURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize tracer: %w", err)
+	}
+	lc.Append(fx.StopHook(tp.Shutdown))
+	return tp, conn, nil
+}
+
+func provideTracer(tp *sdktrace.TracerProvider) trace.Tracer {
+	return tp.Tracer("service-b")
+}
+
+// provideMeterProvider also returns the Prometheus endpoint, nil unless
+// METRICS_PROMETHEUS is set.
+func provideMeterProvider(lc fx.Lifecycle, cfg config) (*sdkmetric.MeterProvider, *metrics.PrometheusEndpoint, error) {
+	prom, err := metrics.NewPrometheusEndpoint(cfg.Metrics)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize meter: %w", err)
+	}
+	mp, err := metrics.NewMeterProvider("service-b", cfg.CollectorURL, cfg.Metrics, prom)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize meter: %w", err)
+	}
+	lc.Append(fx.StopHook(mp.Shutdown))
+	return mp, prom, nil
+}
+
+func provideMeter(mp *sdkmetric.MeterProvider) metric.Meter {
+	return mp.Meter("service-b")
+}
+
+// flushTelemetryLast builds the tracer and meter providers before any
+// other component. fx runs stop hooks in the reverse order, so they are
+// shut down, flushing what they hold, only once everything else has
+// drained and stopped, and the spans and metrics of the shutdown itself
+// are exported too.
+func flushTelemetryLast(*sdktrace.TracerProvider, *sdkmetric.MeterProvider) {}
+
+// stopErrorLog flushes the errors errlog held back once the rest has
+// stopped.
+func stopErrorLog(lc fx.Lifecycle) {
+	lc.Append(fx.StopHook(errlog.Stop))
+}
+
+// startProfiler uploads continuous profiles while PROFILING_URL is set.
+func startProfiler(lc fx.Lifecycle, cfg config) {
+	if cfg.Profiling.URL == "" || cfg.Profiling.Interval <= 0 {
+		return
+	}
+	p := profiling.New("service-b", cfg.Profiling)
+	lc.Append(fx.StartStopHook(p.Start, p.Stop))
+}
+
+// startWatchdog samples the process unless WATCHDOG_INTERVAL is zero.
+func startWatchdog(lc fx.Lifecycle, cfg config, meter metric.Meter) {
+	if cfg.Watchdog.Interval <= 0 {
+		return
+	}
+	w := watchdog.New("service-b", cfg.Watchdog, meter)
+	lc.Append(fx.StartStopHook(w.Start, w.Stop))
+}
+
+// provideCepMasker masks CEPs as CEP_MASKING says.
+func provideCepMasker(cfg config) (*masking.Masker, error) {
+	return masking.New(cfg.CepMasking, cfg.CepHashSalt)
+}
+
+func provideDebugCapturer(cfg config, masker *masking.Masker, auditLog *audit.Logger) *debugcapture.Capturer {
+	return debugcapture.New(cfg.DebugCapture, debugCaptureEnabledFor, masker, auditLog)
+}
+
+func provideHTTPClient(cfg config, capturer *debugcapture.Capturer, meter metric.Meter) (*http.Client, error) {
+	client, err := outbound.NewClient(cfg.Outbound, meter, capturer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize outbound transport: %w", err)
+	}
+	return client, nil
+}
+
+// provideUpstreamClient calls the providers and the notification channels
+// through client, retrying within the RETRY_* budget.
+func provideUpstreamClient(cfg config, client *http.Client, meter metric.Meter) *upstreamClient {
+	return &upstreamClient{
+		client: client,
+		retry: retry.Policy{
+			Budget:      retry.NewBudget(float64(cfg.RetryBudgetPercent)/100, cfg.RetryBudgetMin, cfg.RetryBudgetWindow, meter),
+			MaxAttempts: cfg.RetryMaxAttempts,
+			Backoff:     cfg.RetryBackoff,
+		},
+		meter: meter,
+	}
+}
+
+// provideCepStrictness reads CEP_VALIDATION.
+func provideCepStrictness(cfg config) cep.Strictness {
+	return parseCepValidation(cfg.CepValidation)
+}
+
+func provideAuditLogger(lc fx.Lifecycle, cfg config) (*audit.Logger, error) {
+	auditLog, err := audit.New(cfg.AuditLogPath, "service-b")
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize audit log: %w", err)
+	}
+	lc.Append(fx.StopHook(auditLog.Close))
+	auditLog.Record(context.Background(), "system", "config.load", "success", map[string]string{
+		"collector_url": cfg.CollectorURL,
+	})
+	return auditLog, nil
+}
+
+// provideHealthTracker scores the providers; the provider_health_probes
+// cron task probes the demoted ones for recovery.
+func provideHealthTracker(cfg config, meter metric.Meter) *healthTracker {
+	return newHealthTracker(cfg.Health, meter)
+}
+
+// provideMQTTPublisher connects to the broker when the MQTT output is
+// enabled; otherwise it returns nil and nothing is published.
+func provideMQTTPublisher(lc fx.Lifecycle, cfg config, tracer trace.Tracer) (*mqttPublisher, error) {
+	if cfg.MQTT.BrokerURL == "" {
+		return nil, nil
+	}
+	publisher, err := newMQTTPublisher(cfg.MQTT, tracer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize MQTT output: %w", err)
+	}
+	lc.Append(fx.StopHook(publisher.Close))
+	log.Printf("Publishing weather of subscribed CEPs to MQTT broker %s", redact.Credentials(cfg.MQTT.BrokerURL))
+	return publisher, nil
+}
+
+// provideNATSPublisher connects to NATS when the NATS output is enabled;
+// otherwise it returns nil and nothing is published there.
+func provideNATSPublisher(lc fx.Lifecycle, cfg config, tracer trace.Tracer) (*natsPublisher, error) {
+	if cfg.NATS.URL == "" {
+		return nil, nil
+	}
+	publisher, err := newNATSPublisher(cfg.NATS, tracer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize NATS output: %w", err)
+	}
+	lc.Append(fx.StopHook(publisher.Close))
+	log.Printf("Publishing weather of subscribed CEPs to NATS server %s", redact.Credentials(cfg.NATS.URL))
+	return publisher, nil
+}
+
+// provideOutboxRelay relays the outbox to the MQTT broker and NATS, those
+// of the two outputs that are enabled, or returns nil with neither. It
+// stops before the brokers and storage close.
+func provideOutboxRelay(lc fx.Lifecycle, cfg config, mqttOut *mqttPublisher, natsOut *natsPublisher, repo OutboxRepository, meter metric.Meter, tracer trace.Tracer) *outboxRelay {
+	var brokers []weatherBroker
+	if mqttOut != nil {
+		brokers = append(brokers, mqttOut)
+	}
+	if natsOut != nil {
+		brokers = append(brokers, natsOut)
+	}
+	if len(brokers) == 0 {
+		return nil
+	}
+	relay := newOutboxRelay(repo, brokers, cfg.OutboxRelayInterval, cfg.OutboxRelayBatch, meter, tracer)
+	lc.Append(fx.StartStopHook(relay.Start, relay.Stop))
+	return relay
+}
+
+// provideNotifiers builds the channels subscriptions can be notified on.
+func provideNotifiers(cfg config, up *upstreamClient, masker *masking.Masker) (map[string]Notifier, error) {
+	set, err := newNotifiers(cfg, up, masker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize notifications: %w", err)
+	}
+	log.Printf("Notification channels: %s", notifierChannels(set))
+	return set, nil
+}
+
+func provideCepChain(cfg config, tracker *healthTracker, up *upstreamClient, masker *masking.Masker) (*cepChain, error) {
+	chain, err := newCepChain(cfg, tracker, up, masker)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("CEP providers: %s", chain.Describe())
+	return chain, nil
+}
+
+func provideWeatherChain(cfg config, tracker *healthTracker, up *upstreamClient) (*weatherChain, error) {
+	chain, err := newWeatherChain(cfg, tracker, up)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Weather providers: %s", strings.Join(chain.Names(), ", "))
+	return chain, nil
+}
+
+// provideStorage opens the configured backend and exposes it through the
+// repository interfaces, so consumers never depend on a concrete database.
+func provideStorage(lc fx.Lifecycle, cfg config) (LookupRepository, SubscriptionRepository, JobRepository, DeadLetterRepository, OutboxRepository, error) {
+	if cfg.StorageAutoMigrate {
+		if err := migrateStorage(cfg.StorageDriver, cfg.StorageDSN); err != nil {
+			return nil, nil, nil, nil, nil, fmt.Errorf("failed to migrate storage: %w", err)
+		}
+	}
+	store, err := openStorage(cfg.StorageDriver, cfg.StorageDSN, cfg.StorageMemoryMaxLookups)
+	if err != nil {
+		return nil, nil, nil, nil, nil, fmt.Errorf("failed to initialize storage: %w", err)
+	}
+	lc.Append(fx.StopHook(store.Close))
+	return store, store, store, store, store, nil
+}
+
+// provideWorkerPool starts the shared pool for background work. It depends
+// on storage so that it drains before storage is closed.
+func provideWorkerPool(lc fx.Lifecycle, cfg config, _ LookupRepository, meter metric.Meter) *workerPool {
+	pool := newWorkerPool(cfg.WorkerPool.Size, cfg.WorkerPool.QueueDepth, cfg.WorkerPool.TaskTimeout, meter)
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			pool.Start()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			drainCtx, cancel := context.WithTimeout(ctx, cfg.WorkerPool.DrainTimeout)
+			defer cancel()
+			pool.Drain(drainCtx)
+			return nil
+		},
+	})
+	return pool
+}
+
+// provideJobRunner resumes the unfinished jobs once the pool is running.
+func provideJobRunner(lc fx.Lifecycle, cfg config, jobs JobRepository, dead *deadLetterQueue, pool *workerPool, resolver *weatherResolver, strictness cep.Strictness, masker *masking.Masker, tracer trace.Tracer) *jobRunner {
+	jr := newJobRunner(jobs, dead, pool, resolver, strictness, masker, cfg.JobTimeout, cfg.JobItemTimeout, tracer)
+	lc.Append(fx.Hook{
+		OnStart: jr.Start,
+		OnStop: func(context.Context) error {
+			jr.Stop()
+			return nil
+		},
+	})
+	return jr
+}
+
+// provideLookupCache builds the L1 cache and, when Redis is configured,
+// connects it to the invalidation channel shared by all replicas.
+func provideLookupCache(lc fx.Lifecycle, cfg config) (*lookupCache, error) {
+	c := newLookupCache(cfg.CacheMaxEntries)
+	if cfg.RedisURL == "" {
+		return c, nil
+	}
+
+	inv, err := newRedisInvalidator(cfg.RedisURL, cfg.CacheInvalidationChannel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize cache invalidation: %w", err)
+	}
+	c.invalidator = inv
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.Append(fx.StartStopHook(
+		func() { go inv.Listen(ctx, c) },
+		func() error {
+			cancel()
+			return inv.Close()
+		},
+	))
+	return c, nil
+}
+
+// provideWeatherResolver keeps the city of a CEP cached for CACHE_CEP_TTL.
+func provideWeatherResolver(cfg config, ceps *cepChain, weather *weatherChain, cache *lookupCache, tracer trace.Tracer) *weatherResolver {
+	return &weatherResolver{ceps: ceps, weather: weather, cache: cache, cacheTTL: cfg.CacheCepTTL, tracer: tracer}
+}
+
+// provideSubscriptionNotifier delivers on the shared pool and dead-letters
+// what it could not deliver.
+func provideSubscriptionNotifier(notifiers map[string]Notifier, subs SubscriptionRepository, pool *workerPool, dead *deadLetterQueue, masker *masking.Masker, tracer trace.Tracer) *subscriptionNotifier {
+	return &subscriptionNotifier{notifiers: notifiers, subs: subs, pool: pool, dead: dead, masker: masker, tracer: tracer}
+}
+
+// provideQueryStats tracks the most-queried keys and, when configured,
+// feeds the top CEPs to the cache prewarmer.
+func provideQueryStats(cfg config) *queryStats {
+	return newQueryStats(cfg.StatsTopKCapacity)
+}
+
+// provideLeaderElector elects the replica that runs the singleton cron
+// tasks. Without Redis there is no election: the replica is taken to be
+// the only one and runs them all.
+func provideLeaderElector(lc fx.Lifecycle, cfg config, meter metric.Meter) (*leaderElector, error) {
+	if cfg.RedisURL == "" || len(cfg.LeaderTasks) == 0 {
+		return nil, nil
+	}
+	if cfg.LeaderLeaseTTL < time.Second {
+		return nil, fmt.Errorf("LEADER_LEASE_TTL must be at least 1s, got %s", cfg.LeaderLeaseTTL)
+	}
+	e, err := newLeaderElector(cfg.RedisURL, cfg.LeaderKey, cfg.LeaderLeaseTTL, meter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize leader election: %w", err)
+	}
+	lc.Append(fx.StartStopHook(e.Start, e.Stop))
+	return e, nil
+}
+
+// provideScheduler registers the recurring tasks. Their default schedules
+// follow the older interval settings; CRON_SCHEDULE overrides them. The
+// tasks in LEADER_TASKS run on the elected leader only.
+func provideScheduler(lc fx.Lifecycle, cfg config, tracer trace.Tracer, stats *queryStats, resolver *weatherResolver, masker *masking.Masker, pool *workerPool, tracker *healthTracker, lookups LookupRepository, leader *leaderElector) (*cron.Scheduler, error) {
+	every := func(d time.Duration) string {
+		if d <= 0 {
+			return ""
+		}
+		return "@every " + d.String()
+	}
+	probeSpec := ""
+	if cfg.Health.DemoteScore > 0 {
+		probeSpec = every(cfg.Health.ProbeInterval)
+	}
+	pruneSpec := ""
+	if cfg.HistoryRetention > 0 {
+		pruneSpec = "@hourly"
+	}
+
+	tasks := []cron.Task{
+		{
+			Name: "cache_prewarm",
+			Spec: every(cfg.CachePrewarmInterval),
+			Run: func(context.Context) error {
+				return prewarmCache(stats, resolver, pool, masker, tracer, cfg.CachePrewarmTop)
+			},
+		},
+		{
+			Name: "history_prune",
+			Spec: pruneSpec,
+			Run: func(ctx context.Context) error {
+				return pruneHistory(ctx, lookups, cfg.HistoryRetention)
+			},
+		},
+		{
+			Name: "provider_health_probes",
+			Spec: probeSpec,
+			Run:  tracker.ProbeDemoted,
+		},
+	}
+	for _, name := range cfg.LeaderTasks {
+		i := slices.IndexFunc(tasks, func(t cron.Task) bool { return t.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown cron task %q in LEADER_TASKS", name)
+		}
+		tasks[i].Singleton = true
+	}
+	sched, err := cron.New(cfg.CronSchedule, tasks, tracer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize cron: %w", err)
+	}
+	if leader != nil {
+		sched.SetLeaderCheck(leader.IsLeader)
+	}
+	log.Printf("Cron tasks: %s", sched.Describe())
+	lc.Append(fx.StartStopHook(sched.Start, sched.Stop))
+	return sched, nil
+}
+
+// probedProviders lists the configured providers, CEP first, that can
+// probe their API.
+func probedProviders(ceps *cepChain, weather *weatherChain) []providerProbe {
+	var probes []providerProbe
+	for _, e := range ceps.entries {
+		if p, ok := e.provider.(providerProbe); ok {
+			probes = append(probes, p)
+		}
+	}
+	for _, e := range weather.entries {
+		if p, ok := e.provider.(providerProbe); ok {
+			probes = append(probes, p)
+		}
+	}
+	return probes
+}
+
+func provideReadiness(lc fx.Lifecycle, cfg config, collector *grpc.ClientConn, client *http.Client, ceps *cepChain, weather *weatherChain) *health.Readiness {
+	ready := health.NewReadiness()
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.Append(fx.StartStopHook(
+		func() {
+			checks := []health.ReadinessCheck{
+				{Name: "collector", Check: health.GRPCConnCheck(collector)},
+			}
+			for _, p := range probedProviders(ceps, weather) {
+				checks = append(checks, health.ReadinessCheck{Name: p.Name(), Check: health.HTTPReachableCheck(client, p.ProbeURL())})
+			}
+			go ready.Run(ctx, cfg.ReadinessGrace, checks)
+		},
+		cancel,
+	))
+	return ready
+}
+
+// verifyDependencies checks the collector and the configured providers,
+// including their credentials when they can verify them, before the server
+// starts accepting requests.
+func verifyDependencies(lc fx.Lifecycle, cfg config, collector *grpc.ClientConn, client *http.Client, ceps *cepChain, weather *weatherChain) {
+	if !cfg.StartupVerify {
+		return
+	}
+	checks := []health.StartupCheck{
+		{
+			Name:  "collector",
+			Hint:  "check OTEL_COLLECTOR_URL and that the collector accepts OTLP/gRPC; telemetry is dropped meanwhile",
+			Check: health.GRPCConnCheck(collector),
+		},
+	}
+	for _, p := range probedProviders(ceps, weather) {
+		check := health.StartupCheck{
+			Name:  p.Name(),
+			Hint:  fmt.Sprintf("check outbound HTTPS access to %s; lookups through %s fail until it is reachable", p.ProbeURL(), p.Name()),
+			Hard:  true,
+			Check: health.HTTPReachableCheck(client, p.ProbeURL()),
+		}
+		if v, ok := p.(providerVerifier); ok {
+			check.Hint = fmt.Sprintf("check the %s credentials and outbound HTTPS access to %s", p.Name(), p.ProbeURL())
+			check.Check = v.Verify
+		}
+		checks = append(checks, check)
+	}
+	lc.Append(fx.StartHook(func(ctx context.Context) error {
+		return health.VerifyStartup(ctx, cfg.StartupVerifyTimeout, cfg.StartupStrict, checks)
+	}))
+}
+
+func provideWeatherHandler(cfg config, resolver *weatherResolver, stats *queryStats, lookups LookupRepository, subs SubscriptionRepository, relay *outboxRelay, notifier *subscriptionNotifier, strictness cep.Strictness, masker *masking.Masker, tracer trace.Tracer) *weatherHandler {
+	return &weatherHandler{
+		resolver:     resolver,
+		stats:        stats,
+		lookups:      lookups,
+		subs:         subs,
+		outbox:       relay,
+		notifier:     notifier,
+		strictness:   strictness,
+		masker:       masker,
+		tracer:       tracer,
+		cacheControl: cacheControlFor(cfg.WeatherMaxAge),
+	}
+}
+
+func provideAdminAPI(cfg config, auditLog *audit.Logger, masker *masking.Masker, capturer *debugcapture.Capturer, sched *cron.Scheduler, resolver *weatherResolver, lookups LookupRepository, subs SubscriptionRepository, notifier *subscriptionNotifier, jobs *jobRunner, dead *deadLetterQueue, relay *outboxRelay, strictness cep.Strictness, tracer trace.Tracer) *adminAPI {
+	return &adminAPI{
+		cfg:        cfg,
+		auditLog:   auditLog,
+		masker:     masker,
+		capturer:   capturer,
+		sched:      sched,
+		resolver:   resolver,
+		lookups:    lookups,
+		subs:       subs,
+		notifier:   notifier,
+		jobs:       jobs,
+		dead:       dead,
+		outbox:     relay,
+		strictness: strictness,
+		tracer:     tracer,
+	}
+}
+
+func provideRouter(cfg config, auditLog *audit.Logger, masker *masking.Masker, capturer *debugcapture.Capturer, ready *health.Readiness, tracker *healthTracker, ceps *cepChain, weather *weatherChain, cache *lookupCache, stats *queryStats, lookups LookupRepository, jobs *jobRunner, strictness cep.Strictness, lookup *weatherHandler, admin *adminAPI, prom *metrics.PrometheusEndpoint, meter metric.Meter, tracer trace.Tracer) (http.Handler, error) {
+	acl, err := netacl.New(cfg.ACLAllow, cfg.ACLDeny, cfg.TrustedProxies, auditLog)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network ACL: %w", err)
+	}
+	adminACL, err := netacl.New(cfg.AdminACLAllow, cfg.ACLDeny, cfg.TrustedProxies, auditLog)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin network ACL: %w", err)
+	}
+	idempotent := idempotency.New(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys, requestCaller(acl))
+	dedup := idempotency.New(cfg.DedupWindow, cfg.IdempotencyMaxKeys, requestCaller(acl))
+
+	r := chi.NewRouter()
+	r.Use(httpapi.Options{
+		StrictJSON:     cfg.StrictJSON,
+		ErrorDocsURL:   cfg.ErrorDocsURL,
+		SupportContact: cfg.SupportContact,
+	}.Middleware)
+	r.Use(middleware.RequestID)
+	r.Use(httpapi.RenderMiddleware)
+	r.Use(synthetic.Middleware)
+	r.Use(accesslog.New(os.Stdout, cfg.AccessLogSampling).Middleware)
+	r.Use(compression.Middleware(cfg.Compression))
+	r.Use(compression.DecompressRequests(cfg.Compression.RequestMaxBytes))
+	r.Use(tenantMiddleware)
+	r.Use(middleware.Recoverer)
+	r.Use(deadlineMiddleware)
+	r.Use(slowrequest.Middleware(cfg.SlowRequestThreshold))
+	r.Use(middleware.GetHead)
+	r.Use(httpapi.OptionsMiddleware(r))
+	r.NotFound(httpapi.HandleNotFound)
+	r.MethodNotAllowed(httpapi.MethodNotAllowedHandler(r))
+
+	r.Get("/healthz", handleHealthz)
+	r.Method("GET", "/readyz", ready)
+	r.Get("/errors", httpapi.HandleErrorCatalog)
+	r.Get("/errors/{code}", httpapi.HandleErrorDefinition)
+	r.Get("/version", buildinfo.HandleVersion)
+	if prom != nil {
+		r.With(adminACL.Middleware).Method("GET", "/metrics", prom)
+	}
+	r.Method("GET", "/stats", &statsHandler{stats: stats, cache: cache, tracker: tracker, masker: masker})
+	r.Get("/providers", handleProviders(ceps, weather))
+	r.With(acl.Middleware, capturer.Middleware, shedding.New(cfg.MaxInFlight, meter).Middleware, httpapi.Timeout(cfg.RequestTimeout), idempotent.Middleware, dedup.DedupMiddleware).Method("POST", "/weather", lookup)
+	r.With(acl.Middleware, capturer.Middleware, shedding.New(cfg.MaxInFlight, meter).Middleware).Post("/jobs", handleCreateJob(jobs, cfg.JobMaxCeps))
+	r.With(acl.Middleware).Get("/jobs/{id}", handleGetJob(jobs.jobs))
+	r.With(acl.Middleware).Get("/trend/{cep}", handleTrend(lookups, strictness, masker, tracer))
+	r.With(adminACL.Middleware).Mount("/admin", admin.Routes())
+
+	return sampling.HintsMiddleware(nil)(otelhttp.NewHandler(r, "service-b")), nil
+}
+
+func provideServer(cfg config, handler http.Handler) *http.Server {
+	return server.New(cfg.Server, handler)
+}
+
+// provideConsulRegistrar registers the instance on start. Deregistration
+// is left to the shutdown path, which knows whether a successor process
+// has taken over the registration.
+func provideConsulRegistrar(lc fx.Lifecycle, cfg config) *consulRegistrar {
+	reg := &consulRegistrar{addr: cfg.ConsulAddr, registration: cfg.ConsulRegistration}
+	if cfg.ConsulAddr != "" {
+		lc.Append(fx.StartHook(func(ctx context.Context) error {
+			if err := reg.Register(ctx); err != nil {
+				return fmt.Errorf("failed to register with Consul: %w", err)
+			}
+			log.Printf("Registered with Consul as %s", cfg.ConsulRegistration.ID)
+			return nil
+		}))
+	}
+	return reg
+}
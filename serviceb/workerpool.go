@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joaolima7/otel-goexpert/pkg/errlog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	errPoolFull     = errors.New("worker pool queue is full")
+	errPoolDraining = errors.New("worker pool is draining")
+)
+
+// workerPoolConfig sizes the shared worker pool. TaskTimeout is the default
+// bound of a task; DrainTimeout is how long shutdown waits for the queue.
+type workerPoolConfig struct {
+	Size         int
+	QueueDepth   int
+	TaskTimeout  time.Duration
+	DrainTimeout time.Duration
+}
+
+// poolTask is one unit of background work. Kind labels the metrics.
+type poolTask struct {
+	kind     string
+	timeout  time.Duration
+	run      func(ctx context.Context)
+	enqueued time.Time
+}
+
+// workerPool runs background work (async jobs, notifications, cache
+// refreshes) on a fixed number of workers behind a bounded queue, so bursts
+// queue up or are rejected instead of spawning unbounded goroutines.
+type workerPool struct {
+	queue   chan poolTask
+	size    int
+	timeout time.Duration
+
+	mu       sync.RWMutex
+	draining bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	busy   atomic.Int64
+
+	waitTime metric.Float64Histogram
+	duration metric.Float64Histogram
+	rejected metric.Int64Counter
+}
+
+func newWorkerPool(size, depth int, timeout time.Duration, meter metric.Meter) *workerPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &workerPool{
+		queue:   make(chan poolTask, max(depth, 0)),
+		size:    max(size, 1),
+		timeout: timeout,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	var err error
+	_, err = meter.Int64ObservableGauge("worker_pool.queue_depth",
+		metric.WithDescription("Tasks waiting in the worker pool queue"),
+		metric.WithUnit("{task}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(len(p.queue)))
+			return nil
+		}),
+	)
+	if err != nil {
+		log.Printf("Failed to create worker pool queue gauge: %v", err)
+	}
+	_, err = meter.Int64ObservableGauge("worker_pool.busy",
+		metric.WithDescription("Workers currently running a task"),
+		metric.WithUnit("{worker}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(p.busy.Load())
+			return nil
+		}),
+	)
+	if err != nil {
+		log.Printf("Failed to create worker pool busy gauge: %v", err)
+	}
+	p.waitTime, err = meter.Float64Histogram("worker_pool.task.wait",
+		metric.WithDescription("Time tasks spent queued before a worker picked them up"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		log.Printf("Failed to create worker pool wait histogram: %v", err)
+	}
+	p.duration, err = meter.Float64Histogram("worker_pool.task.duration",
+		metric.WithDescription("Processing time of worker pool tasks, by kind"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		log.Printf("Failed to create worker pool duration histogram: %v", err)
+	}
+	p.rejected, err = meter.Int64Counter("worker_pool.task.rejected",
+		metric.WithDescription("Tasks rejected because the queue was full or the pool draining, by kind"),
+		metric.WithUnit("{task}"),
+	)
+	if err != nil {
+		log.Printf("Failed to create worker pool rejection counter: %v", err)
+	}
+	return p
+}
+
+// Start launches the workers.
+func (p *workerPool) Start() {
+	for range p.size {
+		p.wg.Add(1)
+		go p.work()
+	}
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for t := range p.queue {
+		if p.ctx.Err() != nil {
+			// Drain gave up on the remaining work.
+			continue
+		}
+		p.execute(t)
+	}
+}
+
+func (p *workerPool) execute(t poolTask) {
+	attrs := metric.WithAttributes(attribute.String("task.kind", t.kind))
+	if p.waitTime != nil {
+		p.waitTime.Record(p.ctx, time.Since(t.enqueued).Seconds(), attrs)
+	}
+
+	ctx := p.ctx
+	timeout := t.timeout
+	if timeout == 0 {
+		timeout = p.timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	p.busy.Add(1)
+	defer p.busy.Add(-1)
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			errlog.Printf("Worker pool %s task panicked: %v", t.kind, r)
+		}
+		if p.duration != nil {
+			p.duration.Record(context.Background(), time.Since(start).Seconds(), attrs)
+		}
+	}()
+	t.run(ctx)
+}
+
+// Submit queues fn without blocking. timeout bounds the task; zero uses
+// the pool default and a negative value means no limit.
+func (p *workerPool) Submit(kind string, timeout time.Duration, fn func(ctx context.Context)) error {
+	err := p.enqueue(poolTask{kind: kind, timeout: timeout, run: fn, enqueued: time.Now()})
+	if err != nil {
+		p.reject(kind)
+	}
+	return err
+}
+
+// SubmitWait is Submit, but waits for room in the queue until ctx is done.
+func (p *workerPool) SubmitWait(ctx context.Context, kind string, timeout time.Duration, fn func(ctx context.Context)) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		err := p.enqueue(poolTask{kind: kind, timeout: timeout, run: fn, enqueued: time.Now()})
+		if !errors.Is(err, errPoolFull) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *workerPool) enqueue(t poolTask) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.draining {
+		return errPoolDraining
+	}
+	select {
+	case p.queue <- t:
+		return nil
+	default:
+		return errPoolFull
+	}
+}
+
+func (p *workerPool) reject(kind string) {
+	if p.rejected != nil {
+		p.rejected.Add(context.Background(), 1, metric.WithAttributes(attribute.String("task.kind", kind)))
+	}
+}
+
+// Drain stops accepting tasks and lets the queued and running ones finish
+// until ctx is done. Then the running tasks are cancelled and whatever is
+// still queued is dropped.
+func (p *workerPool) Drain(ctx context.Context) {
+	p.mu.Lock()
+	if p.draining {
+		p.mu.Unlock()
+		return
+	}
+	p.draining = true
+	close(p.queue)
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.cancel()
+		return
+	case <-ctx.Done():
+	}
+	running, dropped := p.busy.Load(), len(p.queue)
+	p.cancel()
+	<-done
+	log.Printf("Worker pool drain timed out: cancelled %d running tasks, dropped %d queued", running, dropped)
+}